@@ -19,7 +19,9 @@ package backends
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -27,15 +29,46 @@ import (
 	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
 )
 
+const (
+	// kernelSpecsAPIPath is the URL path to the kernelspecs collection in the Jupyter REST API.
+	kernelSpecsAPIPath = "/api/kernelspecs"
+	// kernelsAPIPath is the URL path to the kernels collection in the Jupyter REST API.
+	kernelsAPIPath = "/api/kernels"
+	// sessionsAPIPath is the URL path to the sessions collection in the Jupyter REST API.
+	sessionsAPIPath = "/api/sessions"
+)
+
 // Backend is a wrapper around a Jupyter API server.
 type Backend struct {
 	name               string
 	resourceNameSuffix string
 	host               string
 	handler            http.Handler
+	// unqualified is set if the backend's resource IDs and names are used as is in the global view.
+	unqualified bool
+}
+
+// Pool is a set of backends that may change over time, e.g. as backends are discovered.
+type Pool interface {
+	// Backends returns the backends currently in the pool. The first one is the local backend.
+	Backends() []*Backend
+}
+
+// fixedPool is a Pool whose backends never change.
+type fixedPool []*Backend
+
+// Backends implements the Pool interface.
+func (p fixedPool) Backends() []*Backend {
+	return p
+}
+
+// Fixed returns a Pool of the given backends, where the first one is the local backend.
+func Fixed(bs ...*Backend) Pool {
+	return fixedPool(bs)
 }
 
 // New returns a new instance of Backend.
@@ -48,6 +81,16 @@ func New(backendName string, resourceNameSuffix string, host string, proxy http.
 	}
 }
 
+// Unqualified returns a copy of the backend whose resource IDs and names are used as is in the global view, rather than being qualified by the backend.
+//
+// This is only suitable when the backend is the only one, as its IDs could otherwise collide with those of other backends.
+func (b *Backend) Unqualified() *Backend {
+	unqualified := *b
+	unqualified.resourceNameSuffix = ""
+	unqualified.unqualified = true
+	return &unqualified
+}
+
 // Name returns the name of the backend.
 func (b *Backend) Name() string {
 	return b.name
@@ -71,7 +114,12 @@ func (b *Backend) generateXSRFToken(r *http.Request) {
 
 // Get returns the contents (as a slice of bytes) of the resource at the given URL path.
 func (b *Backend) Get(path string) ([]byte, error) {
-	r, err := http.NewRequest(http.MethodGet, path, strings.NewReader(""))
+	return b.GetContext(context.Background(), path)
+}
+
+// GetContext returns the contents (as a slice of bytes) of the resource at the given URL path, using the given context for the backend request.
+func (b *Backend) GetContext(ctx context.Context, path string) ([]byte, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, path, strings.NewReader(""))
 	if err != nil {
 		return nil, fmt.Errorf("failure creating a backend request: %w", err)
 	}
@@ -84,6 +132,9 @@ func (b *Backend) Get(path string) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failure reading the backend response from %q: %w", b.name, err)
 	}
+	if err := b.checkJSONResponse(backendResp, backendRespBytes); err != nil {
+		return nil, err
+	}
 	if backendResp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("%w: %s", util.HTTPError(backendResp.StatusCode), string(backendRespBytes))
 	}
@@ -105,6 +156,9 @@ func (b *Backend) Create(path string, body []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failure reading the backend create response: %w", err)
 	}
+	if err := b.checkJSONResponse(resp, respBytes); err != nil {
+		return nil, err
+	}
 	if resp.StatusCode != http.StatusCreated {
 		return nil, fmt.Errorf("%w: %s", util.HTTPError(resp.StatusCode), string(respBytes))
 	}
@@ -126,6 +180,9 @@ func (b *Backend) Patch(path string, body []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failure reading the backend create response: %w", err)
 	}
+	if err := b.checkJSONResponse(resp, respBytes); err != nil {
+		return nil, err
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("%w: %s", util.HTTPError(resp.StatusCode), string(respBytes))
 	}
@@ -150,11 +207,161 @@ func (b *Backend) Delete(path string) error {
 	if err != nil {
 		return fmt.Errorf("failure reading the body for a backend delete response with status %v: %w", resp.StatusCode, err)
 	}
+	if err := b.checkJSONResponse(resp, respBytes); err != nil {
+		return err
+	}
 	return fmt.Errorf("%w: %s", util.HTTPError(resp.StatusCode), string(respBytes))
 }
 
+// checkJSONResponse returns an error unless the body of the given backend response is empty or holds JSON.
+//
+// Other responses are not from the Jupyter API, e.g. they are HTML error pages from a proxy in
+// front of the backend, so they are reported with their status rather than failing to parse. A
+// response that claims success is reported with a 502 status instead.
+func (b *Backend) checkJSONResponse(resp *http.Response, body []byte) error {
+	if len(body) == 0 || util.IsJSONResponse(resp.Header, body) {
+		return nil
+	}
+	statusCode := resp.StatusCode
+	if statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices {
+		statusCode = http.StatusBadGateway
+	}
+	return fmt.Errorf("unexpected non-JSON response with status %d from %q: %w", resp.StatusCode, b.name, util.HTTPError(statusCode))
+}
+
+// roundTrip sends a request with the given method, path, and body to the backend, and returns the response and its body.
+func (b *Backend) roundTrip(ctx context.Context, method, path string, body []byte) (*http.Response, []byte, error) {
+	r, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failure creating a backend request: %w", err)
+	}
+	r.Host = b.host
+	if method != http.MethodGet {
+		b.generateXSRFToken(r)
+	}
+	rr := httptest.NewRecorder()
+	b.handler.ServeHTTP(rr, r)
+	resp := rr.Result()
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failure reading the backend response from %q: %w", b.name, err)
+	}
+	return resp, respBytes, nil
+}
+
+// send sends a request with the given method, path, and body to the backend, and returns the response status and body.
+//
+// Responses whose body is not JSON are reported as errors.
+func (b *Backend) send(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+	resp, respBytes, err := b.roundTrip(ctx, method, path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := b.checkJSONResponse(resp, respBytes); err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, respBytes, nil
+}
+
+// GetRaw returns the status and body of the backend's response to a GET request for the given URL path, as is.
+//
+// Unlike GetContext, responses with an error status or a body that is not JSON are returned rather than reported as errors.
+func (b *Backend) GetRaw(ctx context.Context, path string) (int, []byte, error) {
+	resp, respBytes, err := b.roundTrip(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, respBytes, nil
+}
+
+// ListKernelSpecs returns the kernelspecs reported by the backend.
+func (b *Backend) ListKernelSpecs(ctx context.Context) (*resources.KernelSpecs, error) {
+	status, respBytes, err := b.send(ctx, http.MethodGet, kernelSpecsAPIPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("failure reading the kernelspecs from %q: %w: %s", b.name, util.HTTPError(status), string(respBytes))
+	}
+	var ks resources.KernelSpecs
+	if err := json.Unmarshal(respBytes, &ks); err != nil {
+		return nil, fmt.Errorf("failure parsing the kernelspecs response from %q: %w", b.name, err)
+	}
+	return &ks, nil
+}
+
+// ListKernels returns the kernels running in the backend.
+func (b *Backend) ListKernels(ctx context.Context) ([]*resources.Kernel, error) {
+	status, respBytes, err := b.send(ctx, http.MethodGet, kernelsAPIPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("failure reading the kernels from %q: %w: %s", b.name, util.HTTPError(status), string(respBytes))
+	}
+	var ks []*resources.Kernel
+	if err := json.Unmarshal(respBytes, &ks); err != nil {
+		return nil, fmt.Errorf("failure parsing the kernels response from %q: %w", b.name, err)
+	}
+	return ks, nil
+}
+
+// ListSessions returns the sessions in the backend.
+func (b *Backend) ListSessions(ctx context.Context) ([]*resources.Session, error) {
+	status, respBytes, err := b.send(ctx, http.MethodGet, sessionsAPIPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("failure reading the sessions from %q: %w: %s", b.name, util.HTTPError(status), string(respBytes))
+	}
+	var sessions []*resources.Session
+	if err := json.Unmarshal(respBytes, &sessions); err != nil {
+		return nil, fmt.Errorf("failure parsing the sessions response from %q: %w", b.name, err)
+	}
+	return sessions, nil
+}
+
+// StartKernel starts a new kernel in the backend.
+//
+// The given kernel must be in the backend's view, i.e. its spec ID must be specific to the backend.
+func (b *Backend) StartKernel(ctx context.Context, k *resources.Kernel) (*resources.Kernel, error) {
+	reqBytes, err := json.Marshal(k)
+	if err != nil {
+		return nil, fmt.Errorf("failure marshalling the kernel start request: %w", err)
+	}
+	status, respBytes, err := b.send(ctx, http.MethodPost, kernelsAPIPath, reqBytes)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusCreated {
+		return nil, fmt.Errorf("%w: %s", util.HTTPError(status), string(respBytes))
+	}
+	var started resources.Kernel
+	if err := json.Unmarshal(respBytes, &started); err != nil {
+		return nil, fmt.Errorf("failure parsing the kernel start response from %q: %w", b.name, err)
+	}
+	return &started, nil
+}
+
+// DeleteKernel shuts down the kernel with the given backend-specific ID.
+func (b *Backend) DeleteKernel(ctx context.Context, kernelID string) error {
+	status, respBytes, err := b.send(ctx, http.MethodDelete, kernelsAPIPath+"/"+kernelID, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusNoContent && status != http.StatusOK {
+		return fmt.Errorf("%w: %s", util.HTTPError(status), string(respBytes))
+	}
+	return nil
+}
+
 // UnifiedID takes a resource ID that is specific to the backend and returns an ID that is globally unique.
 func (b *Backend) UnifiedID(localID string) string {
+	if b.unqualified {
+		return localID
+	}
 	return b.name + "-" + localID
 }
 
@@ -166,6 +373,9 @@ func (b *Backend) UnifiedName(localName string) string {
 // ParseUnifiedID takes a resource ID that is globally unique and returns one that is specific to either the remote or local backend.
 func ParseUnifiedID(id string, backends []*Backend) (b *Backend, localID string, err error) {
 	for _, b := range backends {
+		if b.unqualified {
+			return b, id, nil
+		}
 		if strings.HasPrefix(id, b.name+"-") {
 			localID := strings.TrimPrefix(id, b.name+"-")
 			return b, localID, nil
@@ -16,16 +16,19 @@ limitations under the License.
 package backends
 
 import (
+	"context"
 	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
 )
 
 const (
 	testBackendName        = "backendname"
 	testResourceNameSuffix = " (Test Backend)"
-	testResponseContents   = "OK"
+	testResponseContents   = `{"status":"OK"}`
 )
 
 var testHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -83,6 +86,24 @@ func TestParseUnifiedID(t *testing.T) {
 	}
 }
 
+func TestUnqualified(t *testing.T) {
+	unqualified := testBackend.Unqualified()
+	if got, want := unqualified.UnifiedID("resource-id"), "resource-id"; got != want {
+		t.Errorf("Unqualified().UnifiedID: got %q, want %q", got, want)
+	}
+	if got, want := unqualified.UnifiedName("Resource"), "Resource"; got != want {
+		t.Errorf("Unqualified().UnifiedName: got %q, want %q", got, want)
+	}
+	if backend, localID, err := ParseUnifiedID("resource-id", []*Backend{unqualified}); err != nil {
+		t.Errorf("ParseUnifiedID, unexpected error for an unqualified backend: %v", err)
+	} else if backend != unqualified || localID != "resource-id" {
+		t.Errorf("ParseUnifiedID, unexpected result for an unqualified backend: got %v, %q", backend, localID)
+	}
+	if got, want := testBackend.UnifiedID("resource-id"), testBackendName+"-resource-id"; got != want {
+		t.Errorf("testBackend.UnifiedID after Unqualified: got %q, want %q", got, want)
+	}
+}
+
 func TestBackendGet(t *testing.T) {
 	if bs, err := testBackend.Get("/"); err != nil {
 		t.Errorf("Unexpected error in Backend.Get: %v", err)
@@ -112,3 +133,105 @@ func TestBackendDelete(t *testing.T) {
 		t.Errorf("Unexpected error in Backend.Delete: %v", err)
 	}
 }
+
+func TestBackendKernelMethods(t *testing.T) {
+	var requests []string
+	b := New(testBackendName, testResourceNameSuffix, "[::1]", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := util.CheckXSRF(r); err != nil {
+			http.Error(w, err.Error(), util.HTTPStatusCode(err))
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/kernelspecs":
+			w.Write([]byte(`{"default":"python3","kernelspecs":{"python3":{"name":"python3","spec":{"language":"python","display_name":"Python 3"}}}}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/kernels":
+			w.Write([]byte(`[{"id":"kernel1","name":"python3"}]`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/sessions":
+			w.Write([]byte(`[{"id":"session1","path":"notebook.ipynb","kernel":{"id":"kernel1","name":"python3"}}]`))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/kernels":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"kernel2","name":"python3"}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/kernels/kernel2":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ctx := context.Background()
+	if ks, err := b.ListKernelSpecs(ctx); err != nil {
+		t.Errorf("Unexpected error in Backend.ListKernelSpecs: %v", err)
+	} else if got, want := ks.Default, "python3"; got != want {
+		t.Errorf("Unexpected default kernelspec from Backend.ListKernelSpecs: got %q, want %q", got, want)
+	}
+	if ks, err := b.ListKernels(ctx); err != nil {
+		t.Errorf("Unexpected error in Backend.ListKernels: %v", err)
+	} else if len(ks) != 1 || ks[0].ID != "kernel1" {
+		t.Errorf("Unexpected kernels from Backend.ListKernels: got %+v", ks)
+	}
+	if sessions, err := b.ListSessions(ctx); err != nil {
+		t.Errorf("Unexpected error in Backend.ListSessions: %v", err)
+	} else if len(sessions) != 1 || sessions[0].Kernel == nil || sessions[0].Kernel.ID != "kernel1" {
+		t.Errorf("Unexpected sessions from Backend.ListSessions: got %+v", sessions)
+	}
+	if k, err := b.StartKernel(ctx, &resources.Kernel{SpecID: "python3"}); err != nil {
+		t.Errorf("Unexpected error in Backend.StartKernel: %v", err)
+	} else if got, want := k.ID, "kernel2"; got != want {
+		t.Errorf("Unexpected kernel from Backend.StartKernel: got %q, want %q", got, want)
+	}
+	if err := b.DeleteKernel(ctx, "kernel2"); err != nil {
+		t.Errorf("Unexpected error in Backend.DeleteKernel: %v", err)
+	}
+	if err := b.DeleteKernel(ctx, "kernel3"); err == nil {
+		t.Errorf("Unexpected success deleting an unknown kernel")
+	}
+	wantRequests := []string{
+		"GET /api/kernelspecs",
+		"GET /api/kernels",
+		"GET /api/sessions",
+		"POST /api/kernels",
+		"DELETE /api/kernels/kernel2",
+		"DELETE /api/kernels/kernel3",
+	}
+	if got, want := strings.Join(requests, ", "), strings.Join(wantRequests, ", "); got != want {
+		t.Errorf("Unexpected backend requests: got %q, want %q", got, want)
+	}
+}
+
+func TestBackendNonJSONResponse(t *testing.T) {
+	status := http.StatusOK
+	b := New(testBackendName, testResourceNameSuffix, "[::1]", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(status)
+		w.Write([]byte("<html><body><h1>Bad Gateway</h1></body></html>"))
+	}))
+	ctx := context.Background()
+	for _, status = range []int{http.StatusOK, http.StatusCreated, http.StatusBadGateway} {
+		calls := map[string]func() error{
+			"Get": func() error {
+				_, err := b.GetContext(ctx, "/api/sessions")
+				return err
+			},
+			"Create": func() error {
+				_, err := b.Create("/api/sessions", []byte("{}"))
+				return err
+			},
+			"Patch": func() error {
+				_, err := b.Patch("/api/sessions/session1", []byte("{}"))
+				return err
+			},
+			"ListKernelSpecs": func() error {
+				_, err := b.ListKernelSpecs(ctx)
+				return err
+			},
+		}
+		for name, call := range calls {
+			if got, want := util.HTTPStatusCode(call()), http.StatusBadGateway; got != want {
+				t.Errorf("Unexpected error status from Backend.%s for a non-JSON response with status %d: got %d, want %d", name, status, got, want)
+			}
+		}
+	}
+	if _, _, err := b.GetRaw(ctx, "/api/kernelspecs"); err != nil {
+		t.Errorf("Unexpected error in Backend.GetRaw for a non-JSON response: %v", err)
+	}
+}
@@ -19,14 +19,18 @@ package kernels
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
@@ -38,20 +42,24 @@ import (
 const APIPath = "/api/kernels"
 
 // UnifiedView takes the backend view of the kernel and returns the global view.
+//
+// The global view keeps the kernel's metadata and any fields that are not part of the Jupyter
+// API. The metadata is copied, so that annotating the global view leaves the backend view intact.
 func UnifiedView(k *resources.Kernel, b *backends.Backend) *resources.Kernel {
 	if k == nil {
 		return nil
 	}
 	localSpecID := k.SpecID
 	unifiedSpecID := b.UnifiedID(localSpecID)
-	return &resources.Kernel{
-		ID:             k.ID,
-		SpecID:         unifiedSpecID,
-		Env:            k.Env,
-		LastActivity:   k.LastActivity,
-		Connections:    k.Connections,
-		ExecutionState: k.ExecutionState,
+	executionState := resources.NormalizeExecutionState(k.ExecutionState)
+	if executionState == resources.UnknownExecutionState && !strings.EqualFold(strings.TrimSpace(k.ExecutionState), resources.UnknownExecutionState) {
+		log.Printf("Unrecognized execution state %q for the kernel %q from %q; reporting it as %q", k.ExecutionState, k.ID, b.Name(), executionState)
 	}
+	unified := *k
+	unified.SpecID = unifiedSpecID
+	unified.ExecutionState = executionState
+	unified.Metadata = maps.Clone(k.Metadata)
+	return &unified
 }
 
 // BackendView takes the global view of the kernel and returns the backend view.
@@ -68,12 +76,36 @@ func BackendView(k *resources.Kernel, bs []*backends.Backend) (*backends.Backend
 		LastActivity:   k.LastActivity,
 		Connections:    k.Connections,
 		ExecutionState: k.ExecutionState,
+		Ready:          k.Ready,
 	}, nil
 }
 
+// withUnifiedFields returns the given JSON kernel with its spec ID and execution state replaced by those of the given unified view.
+//
+// Every other field, including those that are not part of the Jupyter API, is left unchanged.
+func withUnifiedFields(kernelBytes []byte, unified *resources.Kernel) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(kernelBytes, &fields); err != nil {
+		return nil, fmt.Errorf("failure parsing the kernel %q: %w", string(kernelBytes), err)
+	}
+	specIDBytes, err := json.Marshal(unified.SpecID)
+	if err != nil {
+		return nil, fmt.Errorf("failure marshalling the kernelspec ID %q: %w", unified.SpecID, err)
+	}
+	fields["name"] = specIDBytes
+	if unified.ExecutionState != "" {
+		executionStateBytes, err := json.Marshal(unified.ExecutionState)
+		if err != nil {
+			return nil, fmt.Errorf("failure marshalling the execution state %q: %w", unified.ExecutionState, err)
+		}
+		fields["execution_state"] = executionStateBytes
+	}
+	return json.Marshal(fields)
+}
+
 // Fetch returns the list of kernels for the given backend.
-func Fetch(b *backends.Backend) ([]*resources.Kernel, error) {
-	backendRespBytes, err := b.Get(APIPath)
+func Fetch(ctx context.Context, b *backends.Backend) ([]*resources.Kernel, error) {
+	backendRespBytes, err := b.GetContext(ctx, APIPath)
 	if err != nil {
 		return nil, fmt.Errorf("failure reading the kernels from %q: %w", b.Name(), err)
 	}
@@ -84,25 +116,53 @@ func Fetch(b *backends.Backend) ([]*resources.Kernel, error) {
 	return kernels, nil
 }
 
+// minLookupRefreshInterval is the minimum time between fetching the kernels of every backend to look up an unknown kernel.
+//
+// This bounds the load on the backends from clients that keep requesting kernels that do not exist.
+const minLookupRefreshInterval = 5 * time.Second
+
 type kernelsRecords struct {
+	pool                 backends.Pool
 	kernelsToBackendsMap map[string]*backends.Backend
+	// recorded is when each kernel in the kernelsToBackendsMap was last listed or recorded.
+	recorded map[string]time.Time
+	// refreshed is when the kernels of every backend were last fetched to look up an unknown kernel.
+	refreshed time.Time
+	// refreshErr is the error from the last such fetch, if any backend could not be listed.
+	refreshErr error
+	// refreshing is closed once the in-flight fetch to look up an unknown kernel, if there is one, completes.
+	refreshing chan struct{}
 	sync.Mutex
 }
 
-func (k *kernelsRecords) updateKernels(kernels []*resources.Kernel, backend *backends.Backend) {
+// updateKernels records the kernels that the given backend listed as of the given time.
+//
+// The backend's other kernels are forgotten, as they no longer exist, unless they were recorded
+// after the listing started, e.g. because they were just started.
+func (k *kernelsRecords) updateKernels(kernels []*resources.Kernel, backend *backends.Backend, listedAt time.Time) {
 	k.Lock()
 	defer k.Unlock()
+	listed := make(map[string]bool)
 	for _, kernel := range kernels {
+		listed[kernel.ID] = true
 		k.kernelsToBackendsMap[kernel.ID] = backend
+		k.recorded[kernel.ID] = listedAt
+	}
+	for kernelID, b := range k.kernelsToBackendsMap {
+		if b == backend && !listed[kernelID] && k.recorded[kernelID].Before(listedAt) {
+			delete(k.kernelsToBackendsMap, kernelID)
+			delete(k.recorded, kernelID)
+		}
 	}
 }
 
-func (k *kernelsRecords) fetchKernels(backend *backends.Backend) ([]*resources.Kernel, error) {
-	kernels, err := Fetch(backend)
+func (k *kernelsRecords) fetchKernels(ctx context.Context, backend *backends.Backend) ([]*resources.Kernel, error) {
+	listedAt := time.Now()
+	kernels, err := Fetch(ctx, backend)
 	if err != nil {
 		return nil, err
 	}
-	k.updateKernels(kernels, backend)
+	k.updateKernels(kernels, backend, listedAt)
 	return kernels, err
 }
 
@@ -116,57 +176,205 @@ func (k *kernelsRecords) findBackend(kernelID string) (*backends.Backend, error)
 	return b, nil
 }
 
+// lookupBackend returns the backend hosting the kernel with the given ID.
+//
+// If the kernel is not yet known, e.g. because it was started outside of the mixer since the
+// kernels were last listed, then the kernels of each backend are fetched before trying again.
+// If the kernel is still unknown but some backend could not be listed, then the kernel might
+// be running there, so a 502 error is returned rather than a 404.
+func (k *kernelsRecords) lookupBackend(ctx context.Context, kernelID string, bs []*backends.Backend) (*backends.Backend, error) {
+	if b, err := k.findBackend(kernelID); err == nil {
+		return b, nil
+	}
+	refreshErr := k.refresh(ctx, bs)
+	b, err := k.findBackend(kernelID)
+	if err != nil && refreshErr != nil {
+		return nil, fmt.Errorf("unknown kernel %q, and not every backend could be listed: %v: %w", kernelID, refreshErr, util.HTTPError(http.StatusBadGateway))
+	}
+	return b, err
+}
+
+// refresh fetches the kernels of each of the given backends to look up an unknown kernel, and returns an error if any of them could not be listed.
+//
+// Concurrent callers share a single fetch, and nothing is fetched if the last one completed
+// within the minLookupRefreshInterval, in which case the error from that one is returned.
+func (k *kernelsRecords) refresh(ctx context.Context, bs []*backends.Backend) error {
+	k.Lock()
+	if done := k.refreshing; done != nil {
+		k.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		k.Lock()
+		defer k.Unlock()
+		return k.refreshErr
+	}
+	if time.Since(k.refreshed) < minLookupRefreshInterval {
+		defer k.Unlock()
+		return k.refreshErr
+	}
+	done := make(chan struct{})
+	k.refreshing = done
+	k.Unlock()
+	defer close(done)
+	var errs []error
+	for _, backend := range bs {
+		if _, err := k.fetchKernels(ctx, backend); err != nil {
+			log.Printf("failure fetching the kernels from %q: %v\n", backend.Name(), err)
+			errs = append(errs, err)
+		}
+	}
+	k.Lock()
+	defer k.Unlock()
+	k.refreshing = nil
+	if err := ctx.Err(); err != nil {
+		// Only a complete fetch counts, so that a canceled request does not hide new kernels from others.
+		return err
+	}
+	k.refreshed = time.Now()
+	k.refreshErr = errors.Join(errs...)
+	return k.refreshErr
+}
+
 func (k *kernelsRecords) recordKernel(kernelID string, backend *backends.Backend) {
 	k.Lock()
 	defer k.Unlock()
 	k.kernelsToBackendsMap[kernelID] = backend
+	k.recorded[kernelID] = time.Now()
 }
 
-// combined takes the backend views of the kernels for both local and remote backends, and returns the global view of all kernels.
-func (k *kernelsRecords) combined(localBackend *backends.Backend, remoteBackend *backends.Backend) ([]*resources.Kernel, error) {
-	unified := []*resources.Kernel{}
-	localKernels, err := k.fetchKernels(localBackend)
-	if err != nil {
-		return nil, fmt.Errorf("failure fetching the local kernels: %w", err)
-	}
-	for _, kernel := range localKernels {
-		unified = append(unified, UnifiedView(kernel, localBackend))
+func (k *kernelsRecords) forgetKernel(kernelID string) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.kernelsToBackendsMap, kernelID)
+	delete(k.recorded, kernelID)
+}
+
+// Lookup implements the RoutingTable interface.
+func (k *kernelsRecords) Lookup(ctx context.Context, kernelID string) (*backends.Backend, error) {
+	return k.lookupBackend(ctx, kernelID, k.pool.Backends())
+}
+
+// Record implements the RoutingTable interface.
+func (k *kernelsRecords) Record(kernelID string, backend *backends.Backend) {
+	k.recordKernel(kernelID, backend)
+}
+
+// Snapshot implements the RoutingTable interface.
+func (k *kernelsRecords) Snapshot() map[string]string {
+	k.Lock()
+	defer k.Unlock()
+	snapshot := make(map[string]string, len(k.kernelsToBackendsMap))
+	for kernelID, backend := range k.kernelsToBackendsMap {
+		snapshot[kernelID] = backend.Name()
 	}
-	remoteKernels, err := k.fetchKernels(remoteBackend)
-	if err != nil {
-		log.Printf("failure fetching the remote kernels %v\n", err)
-		if localKernels != nil {
-			return unified, nil
+	return snapshot
+}
+
+// combined takes the backend views of the kernels for each of the given backends, and returns the global view of all kernels.
+//
+// Each backend's response is fetched and decoded independently, so a backend that fails or returns
+// a malformed response contributes no kernels while the others are still listed. An error is only
+// returned if none of the backends could be listed.
+//
+// The backend requests are made with the given context, so that canceling it, e.g. when the client
+// disconnects, cancels the in-flight request and skips the backends that have not been listed yet.
+func (k *kernelsRecords) combined(ctx context.Context, bs []*backends.Backend) ([]*resources.Kernel, error) {
+	unified := []*resources.Kernel{}
+	var errs []error
+	for _, backend := range bs {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("listing the kernels was canceled: %w", err)
+		}
+		backendKernels, err := k.fetchKernels(ctx, backend)
+		if err != nil {
+			log.Printf("failure fetching the kernels from %q: %v\n", backend.Name(), err)
+			errs = append(errs, err)
+			continue
+		}
+		for _, kernel := range backendKernels {
+			unified = append(unified, UnifiedView(kernel, backend))
 		}
-		return nil, fmt.Errorf("failure fetching the local+remote kernels: %w", err)
 	}
-	for _, kernel := range remoteKernels {
-		unified = append(unified, UnifiedView(kernel, remoteBackend))
+	if len(errs) > 0 && len(errs) == len(bs) {
+		return nil, fmt.Errorf("failure fetching the kernels from every backend: %w", errors.Join(errs...))
 	}
 	return unified, nil
 }
 
+// RoutingTable records which backend hosts each kernel known to a kernels handler.
+type RoutingTable interface {
+	// Lookup returns the backend hosting the kernel with the given ID.
+	//
+	// If the kernel is not yet known, then the kernels of each backend are fetched before trying
+	// again, at most once per minLookupRefreshInterval. An error with a 404 status is returned if
+	// no backend hosts the kernel.
+	Lookup(ctx context.Context, kernelID string) (*backends.Backend, error)
+	// Record records that the kernel with the given ID is hosted by the given backend, e.g. because it was just started there.
+	Record(kernelID string, backend *backends.Backend)
+	// Snapshot returns a copy of the table, mapping each kernel ID to the name of the backend hosting it.
+	Snapshot() map[string]string
+}
+
+// NewRoutingTable returns an empty routing table for the kernels of the backends currently in the given pool.
+func NewRoutingTable(pool backends.Pool) RoutingTable {
+	return newKernelsRecords(pool)
+}
+
+func newKernelsRecords(pool backends.Pool) *kernelsRecords {
+	return &kernelsRecords{
+		pool:                 pool,
+		kernelsToBackendsMap: make(map[string]*backends.Backend),
+		recorded:             make(map[string]time.Time),
+	}
+}
+
+// ListHook adjusts the global view of the kernels listed by a kernels handler before they are returned.
+//
+// The hook may modify the given kernels and returns those to list. If it returns an error, then
+// the listing fails with that error's HTTP status.
+type ListHook func(r *http.Request, ks []*resources.Kernel) ([]*resources.Kernel, error)
+
 // Handler returns an HTTP handler that implements the global, combined kernels collection.
 func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) http.Handler {
-	bs := []*backends.Backend{localBackend, remoteBackend}
-	kernelsRecords := &kernelsRecords{kernelsToBackendsMap: make(map[string]*backends.Backend)}
+	h, _ := HandlerWithRoutingTable(backends.Fixed(localBackend, remoteBackend))
+	return h
+}
+
+// HandlerWithRoutingTable returns an HTTP handler that implements the global, combined kernels collection for the backends currently in the given pool.
+//
+// It also returns the table the handler uses to route requests for each kernel. The given hooks
+// are applied, in order, to the listed kernels.
+func HandlerWithRoutingTable(pool backends.Pool, hooks ...ListHook) (http.Handler, RoutingTable) {
+	kernelsRecords := newKernelsRecords(pool)
 	go func() {
-		kernelsRecords.fetchKernels(localBackend)
-		kernelsRecords.fetchKernels(remoteBackend)
+		for _, backend := range pool.Backends() {
+			kernelsRecords.fetchKernels(context.Background(), backend)
+		}
 	}()
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		relativePath := strings.TrimPrefix(r.URL.Path, APIPath)
 		relativePath = strings.TrimPrefix(relativePath, "/")
 		if relativePath == "" && r.Method == http.MethodGet {
 			// List the kernels
-			unifiedKernels, err := kernelsRecords.combined(localBackend, remoteBackend)
+			unifiedKernels, err := kernelsRecords.combined(r.Context(), pool.Backends())
 			if err != nil {
 				errorMsg := fmt.Sprintf("failure fetching the kernels: %v", err)
 				http.Error(w, errorMsg, util.HTTPStatusCode(err))
 				util.Log(r, fmt.Sprintf("Failed kernels API call: %q", errorMsg))
 				return
 			}
+			for _, hook := range hooks {
+				if unifiedKernels, err = hook(r, unifiedKernels); err != nil {
+					errorMsg := fmt.Sprintf("failure listing the kernels: %v", err)
+					http.Error(w, errorMsg, util.HTTPStatusCode(err))
+					util.Log(r, fmt.Sprintf("Failed kernels API call: %q", errorMsg))
+					return
+				}
+			}
 			respBytes, err := json.Marshal(unifiedKernels)
 			if err != nil {
 				errorMsg := fmt.Sprintf("failure marshalling the kernels collection: %v", err)
@@ -174,6 +382,7 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 				util.Log(r, fmt.Sprintf("Failed kernels API call: %q", errorMsg))
 				return
 			}
+			w.Header().Set("Content-Type", "application/json")
 			w.Write(respBytes)
 			return
 		}
@@ -188,7 +397,7 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 		if relativePath != "" {
 			// Forward the request directly to the backend
 			kernelID := strings.Split(relativePath, "/")[0]
-			backend, err = kernelsRecords.findBackend(kernelID)
+			backend, err = kernelsRecords.lookupBackend(r.Context(), kernelID, pool.Backends())
 			if err != nil {
 				util.Log(r, err.Error())
 				http.Error(w, err.Error(), util.HTTPStatusCode(err))
@@ -205,7 +414,7 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 				http.Error(w, errorMsg, http.StatusBadRequest)
 				return
 			}
-			backendFromBody, backendKernel, err = BackendView(&unifiedKernel, bs)
+			backendFromBody, backendKernel, err = BackendView(&unifiedKernel, pool.Backends())
 			if err != nil {
 				errorMsg := fmt.Sprintf("failure processing a kernel request: %v", err)
 				util.Log(r, errorMsg)
@@ -259,6 +468,36 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 			http.Error(w, errorMsg, util.HTTPStatusCode(err))
 			return
 		}
+		if r.Method == http.MethodDelete && !strings.Contains(relativePath, "/") {
+			switch backendResp.StatusCode {
+			case http.StatusNotFound:
+				// The kernel is already gone, so the delete is treated as having succeeded.
+				util.Log(r, fmt.Sprintf("Kernel %q was not found in %q; treating the delete as successful", relativePath, backend.Name()))
+				kernelsRecords.forgetKernel(relativePath)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			case http.StatusBadGateway:
+				// The backend could not be reached, so report a distinct, retryable error.
+				errorMsg := fmt.Sprintf("failure deleting the kernel %q: the backend %q is unreachable", relativePath, backend.Name())
+				util.Log(r, errorMsg)
+				http.Error(w, errorMsg, http.StatusBadGateway)
+				return
+			case http.StatusNoContent, http.StatusOK:
+				kernelsRecords.forgetKernel(relativePath)
+			}
+		}
+		if len(backendRespBytes) > 0 && !util.IsJSONResponse(backendResp.Header, backendRespBytes) {
+			// This is not a response from the Jupyter API, e.g. it is an HTML error page from a proxy in
+			// front of the backend, so report it in the API's error format rather than trying to parse it.
+			statusCode := backendResp.StatusCode
+			if statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices {
+				statusCode = http.StatusBadGateway
+			}
+			errorMsg := fmt.Sprintf("unexpected non-JSON response with status %d from %q", backendResp.StatusCode, backend.Name())
+			util.Log(r, errorMsg)
+			util.WriteJSONError(w, statusCode, errorMsg)
+			return
+		}
 		if backendResp.StatusCode < http.StatusOK || backendResp.StatusCode >= http.StatusMultipleChoices {
 			// For anything other than a 2XX response to one of the Swagger URLs, we don't modify the response
 			w.WriteHeader(backendResp.StatusCode)
@@ -280,7 +519,12 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 			unifiedKernel := UnifiedView(&kernel, backend)
 			kernelsRecords.recordKernel(unifiedKernel.ID, backend)
 			var err error
-			respBytes, err = json.Marshal(unifiedKernel)
+			if r.Method == http.MethodGet && relativePath == unifiedKernel.ID {
+				// The frontend polls a single kernel for its state, so report it as the backend did, apart from the unified fields.
+				respBytes, err = withUnifiedFields(backendRespBytes, unifiedKernel)
+			} else {
+				respBytes, err = json.Marshal(unifiedKernel)
+			}
 			if err != nil {
 				errorMsg := fmt.Sprintf("failure marshalling the response: %v", err)
 				util.Log(r, errorMsg)
@@ -291,4 +535,5 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 		w.WriteHeader(backendResp.StatusCode)
 		w.Write(respBytes)
 	})
+	return h, kernelsRecords
 }
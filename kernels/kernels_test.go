@@ -1,14 +1,22 @@
 package kernels
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
 )
 
 func TestCombinedKernels(t *testing.T) {
@@ -16,17 +24,75 @@ func TestCombinedKernels(t *testing.T) {
 		desc                      string
 		localBackendResponseCode  int
 		localBackendResponse      []*resources.Kernel
+		localBackendRawResponse   string
 		remoteBackendResponseCode int
 		remoteBackendResponse     []*resources.Kernel
+		remoteBackendRawResponse  string
 		want                      []*resources.Kernel
 		wantErr                   error
 	}{
 		{
-			desc:                     "Bad local backend",
-			localBackendResponseCode: 502,
-			localBackendResponse:     []*resources.Kernel{},
-			want:                     []*resources.Kernel{},
-			wantErr:                  cmpopts.AnyError,
+			desc:                      "Bad local+remote backends",
+			localBackendResponseCode:  502,
+			localBackendResponse:      []*resources.Kernel{},
+			remoteBackendResponseCode: 502,
+			remoteBackendResponse:     []*resources.Kernel{},
+			want:                      []*resources.Kernel{},
+			wantErr:                   cmpopts.AnyError,
+		},
+		{
+			desc:                      "Bad local backend, Healthy remote backend",
+			localBackendResponseCode:  502,
+			localBackendResponse:      []*resources.Kernel{},
+			remoteBackendResponseCode: 200,
+			remoteBackendResponse: []*resources.Kernel{
+				&resources.Kernel{
+					ID:     "remote-deadbeef",
+					SpecID: "id",
+				},
+			},
+			want: []*resources.Kernel{
+				&resources.Kernel{
+					ID:     "remote-deadbeef",
+					SpecID: "remote-id",
+				},
+			},
+		},
+		{
+			desc:                      "Truncated local response, Healthy remote backend",
+			localBackendResponseCode:  200,
+			localBackendRawResponse:   `{"bad json`,
+			remoteBackendResponseCode: 200,
+			remoteBackendResponse: []*resources.Kernel{
+				&resources.Kernel{
+					ID:     "remote-deadbeef",
+					SpecID: "id",
+				},
+			},
+			want: []*resources.Kernel{
+				&resources.Kernel{
+					ID:     "remote-deadbeef",
+					SpecID: "remote-id",
+				},
+			},
+		},
+		{
+			desc:                     "Healthy local backend, Truncated remote response",
+			localBackendResponseCode: 200,
+			localBackendResponse: []*resources.Kernel{
+				&resources.Kernel{
+					ID:     "local-deadbeef",
+					SpecID: "id",
+				},
+			},
+			remoteBackendResponseCode: 200,
+			remoteBackendRawResponse:  `{"bad json`,
+			want: []*resources.Kernel{
+				&resources.Kernel{
+					ID:     "local-deadbeef",
+					SpecID: "local-id",
+				},
+			},
 		},
 		{
 			desc:                      "Healthy local backend, Bad Remote backend basic",
@@ -118,6 +184,12 @@ func TestCombinedKernels(t *testing.T) {
 			if err != nil {
 				t.Fatalf("json.Marshal(%v) got error %v want nil", tc.remoteBackendResponse, err)
 			}
+			if tc.localBackendRawResponse != "" {
+				localRespBytes = []byte(tc.localBackendRawResponse)
+			}
+			if tc.remoteBackendRawResponse != "" {
+				remoteRespBytes = []byte(tc.remoteBackendRawResponse)
+			}
 
 			localBackend := backends.New("local", " (Local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(tc.localBackendResponseCode)
@@ -127,19 +199,206 @@ func TestCombinedKernels(t *testing.T) {
 				w.WriteHeader(tc.remoteBackendResponseCode)
 				w.Write(remoteRespBytes)
 			}))
-			kR := &kernelsRecords{kernelsToBackendsMap: map[string]*backends.Backend{
-				"local": localBackend, "remote": remoteBackend}}
-			got, err := kR.combined(localBackend, remoteBackend)
+			kR := newKernelsRecords(backends.Fixed(localBackend, remoteBackend))
+			got, err := kR.combined(context.Background(), []*backends.Backend{localBackend, remoteBackend})
 			if !cmp.Equal(err, tc.wantErr, cmpopts.EquateErrors()) {
 				t.Errorf("combined(%v, %v) got error %v want %v", localBackend, remoteBackend, err, tc.wantErr)
 			}
 			if err != nil {
 				return
 			}
-			if diff := cmp.Diff(got, tc.want, cmp.AllowUnexported(resources.Kernel{})); diff != "" {
+			if diff := cmp.Diff(got, tc.want, cmpopts.IgnoreUnexported(resources.Kernel{})); diff != "" {
 				t.Errorf("combined() returned unexpected diff (-want +got):\n%s", diff)
 			}
 		})
 
 	}
 }
+
+func TestDeleteKernel(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL, err := url.Parse(closed.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q) got error %v want nil", closed.URL, err)
+	}
+	closed.Close()
+	testCases := []struct {
+		desc       string
+		backend    http.Handler
+		wantStatus int
+	}{
+		{
+			desc: "Backend deletes the kernel",
+			backend: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}),
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			desc:       "Kernel already deleted",
+			backend:    http.NotFoundHandler(),
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			desc:       "Backend refuses connections",
+			backend:    httputil.NewSingleHostReverseProxy(closedURL),
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			newBackend := func(name string, kernelList string) *backends.Backend {
+				return backends.New(name, " ("+name+")", name+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Method == http.MethodGet && r.URL.Path == APIPath {
+						w.Write([]byte(kernelList))
+						return
+					}
+					tc.backend.ServeHTTP(w, r)
+				}))
+			}
+			h := Handler(newBackend("local", `[{"id":"kernel1","name":"python3"}]`), newBackend("remote", `[]`))
+			// List the kernels so that the handler knows which backend hosts the kernel.
+			listRR := httptest.NewRecorder()
+			h.ServeHTTP(listRR, httptest.NewRequest(http.MethodGet, APIPath, nil))
+			if got, want := listRR.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected status listing the kernels: got %d, want %d", got, want)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, APIPath+"/kernel1", nil))
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Errorf("unexpected status deleting the kernel: got %d, want %d: %q", got, want, rr.Body.String())
+			}
+			if tc.wantStatus == http.StatusBadGateway && !strings.Contains(rr.Body.String(), "unreachable") {
+				t.Errorf("unexpected error message for an unreachable backend: %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetKernel(t *testing.T) {
+	// Only the remote backend serves the kernel, along with a field that is not part of the Jupyter API
+	// and an execution state that has to be normalized.
+	remoteKernel := `{"id":"kernel2","name":"pyspark","execution_state":" Busy","last_activity":"2023-02-14T02:50:02.922555Z","connections":1,"custom_field":{"nested":true}}`
+	local := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == APIPath {
+			w.Write([]byte(`[{"id":"kernel1","name":"python3"}]`))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	remote := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == APIPath:
+			w.Write([]byte("[" + remoteKernel + "]"))
+		case r.Method == http.MethodGet && r.URL.Path == APIPath+"/kernel2":
+			w.Write([]byte(remoteKernel))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	h := Handler(local, remote)
+
+	// The kernel is not listed first, so the handler has to look up which backend hosts it.
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, APIPath+"/kernel2", nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status getting the kernel: got %d, want %d: %q", got, want, rr.Body.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failure parsing the kernel %q: %v", rr.Body.String(), err)
+	}
+	want := map[string]any{
+		"id":              "kernel2",
+		"name":            "remote-pyspark",
+		"execution_state": "busy",
+		"last_activity":   "2023-02-14T02:50:02.922555Z",
+		"connections":     float64(1),
+		"custom_field":    map[string]any{"nested": true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected kernel: diff (-want +got):\n%s", diff)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, APIPath+"/unknown", nil))
+	if got, want := rr.Code, http.StatusNotFound; got != want {
+		t.Errorf("unexpected status getting an unknown kernel: got %d, want %d", got, want)
+	}
+}
+
+func TestLookupUnknownKernel(t *testing.T) {
+	var mu sync.Mutex
+	listed := 0
+	newBackend := func(name string) *backends.Backend {
+		return backends.New(name, " ("+name+")", name+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && r.URL.Path == APIPath {
+				mu.Lock()
+				listed++
+				mu.Unlock()
+				w.Write([]byte(`[]`))
+				return
+			}
+			http.NotFound(w, r)
+		}))
+	}
+	kR := newKernelsRecords(nil)
+	bs := []*backends.Backend{newBackend("local"), newBackend("remote")}
+	for i := 0; i < 3; i++ {
+		if _, err := kR.lookupBackend(context.Background(), "unknown", bs); util.HTTPStatusCode(err) != http.StatusNotFound {
+			t.Errorf("lookupBackend() got error %v want a not found error", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := listed, len(bs); got != want {
+		t.Errorf("Unexpected number of kernel listings for repeated lookups of an unknown kernel: got %d, want %d", got, want)
+	}
+}
+
+func TestUpdateKernels(t *testing.T) {
+	local := backends.New("local", " (local)", "local host", http.NotFoundHandler())
+	remote := backends.New("remote", " (remote)", "remote host", http.NotFoundHandler())
+	kR := newKernelsRecords(nil)
+	listedAt := time.Now()
+	kR.updateKernels([]*resources.Kernel{{ID: "gone"}, {ID: "kept"}}, local, listedAt.Add(-time.Minute))
+	kR.updateKernels([]*resources.Kernel{{ID: "remote"}}, remote, listedAt.Add(-time.Minute))
+	kR.recordKernel("started", local)
+	kR.updateKernels([]*resources.Kernel{{ID: "kept"}}, local, listedAt)
+	want := map[string]string{"kept": "local", "remote": "remote", "started": "local"}
+	if diff := cmp.Diff(want, kR.Snapshot()); diff != "" {
+		t.Errorf("Unexpected routing table after listing the kernels: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestBackendHTMLError(t *testing.T) {
+	local := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == APIPath {
+			w.Write([]byte(`[{"id":"kernel1","name":"python3"}]`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html><body><h1>502 Bad Gateway</h1></body></html>"))
+	}))
+	remote := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	h := Handler(local, remote)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, APIPath+"/kernel1", nil))
+	if got, want := rr.Code, http.StatusBadGateway; got != want {
+		t.Errorf("unexpected status for an HTML error page: got %d, want %d: %q", got, want, rr.Body.String())
+	}
+	if got, want := rr.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("unexpected content type for an HTML error page: got %q, want %q", got, want)
+	}
+	var got util.JSONError
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failure parsing the error response %q: %v", rr.Body.String(), err)
+	}
+	if got.Status != http.StatusBadGateway || got.Message == "" {
+		t.Errorf("unexpected error response for an HTML error page: got %+v", got)
+	}
+}
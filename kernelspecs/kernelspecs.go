@@ -18,6 +18,8 @@ limitations under the License.
 package kernelspecs
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -57,8 +59,8 @@ func UnifiedView(ks *resources.KernelSpec, b *backends.Backend) *resources.Kerne
 	return unifiedView
 }
 
-// fetchKernelSpecs takes a backend and returns the list of kernelspecs reported by that backend.
-func fetchKernelSpecs(b *backends.Backend) (*resources.KernelSpecs, error) {
+// Fetch takes a backend and returns the list of kernelspecs reported by that backend.
+func Fetch(b *backends.Backend) (*resources.KernelSpecs, error) {
 	backendRespBytes, err := b.Get(APIPath)
 	if err != nil {
 		return nil, fmt.Errorf("failure reading the kernelspecs from %q: %w", b.Name(), err)
@@ -70,51 +72,153 @@ func fetchKernelSpecs(b *backends.Backend) (*resources.KernelSpecs, error) {
 	return &kernelSpecs, nil
 }
 
+// TimedOutBackendsHeader is the response header listing the backends whose kernelspecs were omitted because they did not respond in time.
+const TimedOutBackendsHeader = "X-Mixer-Timed-Out-Backends"
+
+// fetchResult is the outcome of fetching the kernelspecs from a single backend.
+type fetchResult struct {
+	specs    *resources.KernelSpecs
+	err      error
+	timedOut bool
+}
+
+// fetchAll concurrently fetches the kernelspecs from each of the given backends.
+//
+// Once the given context is done, the backends that have not responded yet are no longer waited on,
+// so the whole fan-out is bounded by the context's deadline. They are marked as timed out only if
+// the deadline passed; if the context was canceled instead, then they fail with its error.
+func fetchAll(ctx context.Context, bs []*backends.Backend) []fetchResult {
+	pending := make([]chan fetchResult, len(bs))
+	for i, b := range bs {
+		pending[i] = make(chan fetchResult, 1)
+		go func(b *backends.Backend, ch chan<- fetchResult) {
+			ks, err := b.ListKernelSpecs(ctx)
+			ch <- fetchResult{specs: ks, err: err}
+		}(b, pending[i])
+	}
+	results := make([]fetchResult, len(bs))
+	for i := range bs {
+		select {
+		case results[i] = <-pending[i]:
+		case <-ctx.Done():
+			select {
+			case results[i] = <-pending[i]:
+			default:
+				results[i] = fetchResult{err: ctx.Err()}
+			}
+		}
+		if results[i].err != nil && ctx.Err() == context.DeadlineExceeded {
+			// The backend failed because the deadline passed, rather than on its own.
+			results[i] = fetchResult{timedOut: true}
+		}
+	}
+	return results
+}
+
 // CombinedKernelSpecs takes a backend view of the kernelspecs for both local and remote backends, and returns the combined global view of all kernelspecs.
-// In case there is failure parsing remote kernelspecs return locals if any. Always set a local kernel as default.
+// In case there is failure fetching the kernelspecs of either backend, return those of the other if any. Always set a local kernel as default.
 func CombinedKernelSpecs(localBackend *backends.Backend, remoteBackend *backends.Backend) (*resources.KernelSpecs, error) {
-	var defaultKernelSpecs string
+	unifiedView, _, err := CombinedKernelSpecsContext(context.Background(), localBackend, remoteBackend)
+	return unifiedView, err
+}
+
+// CombinedKernelSpecsContext is like CombinedKernelSpecs, but combines the kernelspecs of any number of backends and bounds the whole fetch by the deadline of the given context.
+//
+// The first backend is the local one, and the rest are remote. The backends are fetched
+// concurrently. Backends that have not responded once the context is done are omitted, and their
+// names are returned as timed out, along with the kernelspecs of the backends that did respond.
+// Backends that fail are likewise omitted, and an error is returned only if no backend that
+// responded contributed any kernelspecs. The default kernelspec is that of the first remote
+// backend reporting one, or the local backend's if none does.
+func CombinedKernelSpecsContext(ctx context.Context, bs ...*backends.Backend) (*resources.KernelSpecs, []string, error) {
+	unifiedView, _, timedOut, err := combine(ctx, bs)
+	return unifiedView, timedOut, err
+}
+
+// CombinedKernelSpecsWithDefaults is like CombinedKernelSpecsContext, but also returns the default kernelspec of each backend whose kernelspecs were combined.
+//
+// The defaults are the IDs of the kernelspecs within each backend, keyed by the backend's name.
+func CombinedKernelSpecsWithDefaults(ctx context.Context, bs ...*backends.Backend) (*resources.KernelSpecs, map[string]string, error) {
+	unifiedView, backendDefaults, _, err := combine(ctx, bs)
+	return unifiedView, backendDefaults, err
+}
+
+// combine implements CombinedKernelSpecsContext and CombinedKernelSpecsWithDefaults.
+func combine(ctx context.Context, bs []*backends.Backend) (*resources.KernelSpecs, map[string]string, []string, error) {
 	unifiedView := &resources.KernelSpecs{
 		KernelSpecs: make(map[string]*resources.KernelSpec),
 	}
-	localKernelSpecs, err := fetchKernelSpecs(localBackend)
-	if err != nil {
-		return unifiedView, fmt.Errorf("failure fetching the local kernelspecs: %w", err)
+	backendDefaults := make(map[string]string)
+	if len(bs) == 0 {
+		return unifiedView, nil, nil, fmt.Errorf("no backends to fetch the kernelspecs from: %w", util.HTTPError(http.StatusServiceUnavailable))
+	}
+	results := fetchAll(ctx, bs)
+	var timedOut []string
+	for i, b := range bs {
+		if results[i].timedOut {
+			log.Printf("timed out fetching the kernelspecs from %q\n", b.Name())
+			timedOut = append(timedOut, b.Name())
+		}
+	}
+	if len(timedOut) == len(results) {
+		return unifiedView, nil, timedOut, fmt.Errorf("timed out fetching the local+remote kernelspecs: %w", util.HTTPError(http.StatusGatewayTimeout))
 	}
-	if localKernelSpecs != nil {
-		if localKernelSpecs.Default != "" {
-			defaultKernelSpecs = localBackend.UnifiedID(localKernelSpecs.Default)
-			unifiedView.Default = defaultKernelSpecs
+	var fetchErr error
+	localBackend, local := bs[0], results[0]
+	if local.err != nil {
+		log.Printf("failure fetching the local kernelspecs from %q: %v\n", localBackend.Name(), local.err)
+		fetchErr = local.err
+	} else if !local.timedOut {
+		if local.specs.Default != "" {
+			unifiedView.Default = localBackend.UnifiedID(local.specs.Default)
+			backendDefaults[localBackend.Name()] = local.specs.Default
 		}
-		for id, spec := range localKernelSpecs.KernelSpecs {
+		for id, spec := range local.specs.KernelSpecs {
 			unifiedID := localBackend.UnifiedID(id)
 			unifiedView.KernelSpecs[unifiedID] = UnifiedView(spec, localBackend)
 		}
 	}
-	remoteKernelSpecs, err := fetchKernelSpecs(remoteBackend)
-	if err != nil {
-		log.Printf("failure fetching the remote kernelspecs %v\n", err)
-		// Local Kernels are populated. Return local kernelspecs.
-		if len(unifiedView.KernelSpecs) > 0 {
-			return unifiedView, nil
+	remoteDefault := ""
+	for i, remoteBackend := range bs[1:] {
+		remote := results[i+1]
+		if remote.timedOut {
+			continue
 		}
-		return unifiedView, fmt.Errorf("failure fetching the local+remote kernelspecs: %w", err)
-	}
-	if remoteKernelSpecs != nil && remoteKernelSpecs.Default != "" {
-		defaultKernelSpecs = remoteBackend.UnifiedID(remoteKernelSpecs.Default)
-		unifiedView.Default = defaultKernelSpecs
-		for id, spec := range remoteKernelSpecs.KernelSpecs {
-			unifiedID := remoteBackend.UnifiedID(id)
-			unifiedView.KernelSpecs[unifiedID] = UnifiedView(spec, remoteBackend)
+		if remote.err != nil {
+			log.Printf("failure fetching the remote kernelspecs from %q: %v\n", remoteBackend.Name(), remote.err)
+			fetchErr = remote.err
+			continue
 		}
+		if remote.specs.Default != "" {
+			if remoteDefault == "" {
+				remoteDefault = remoteBackend.UnifiedID(remote.specs.Default)
+			}
+			backendDefaults[remoteBackend.Name()] = remote.specs.Default
+			for id, spec := range remote.specs.KernelSpecs {
+				unifiedID := remoteBackend.UnifiedID(id)
+				unifiedView.KernelSpecs[unifiedID] = UnifiedView(spec, remoteBackend)
+			}
+		}
+	}
+	if fetchErr != nil && unifiedView.IsEmpty() {
+		return unifiedView, nil, timedOut, fmt.Errorf("failure fetching the local+remote kernelspecs: %w", fetchErr)
+	}
+	if remoteDefault != "" {
+		unifiedView.Default = remoteDefault
 	}
-	return unifiedView, nil
+	unifiedView.DisambiguateDisplayNames()
+	return unifiedView, backendDefaults, timedOut, nil
 }
 
 // Handler returns an HTTP handler that implements the global, combined kernelspecs collection.
 func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) http.Handler {
-	bs := []*backends.Backend{localBackend, remoteBackend}
-	resourcePath := "/kernelspecs/"
+	return PoolHandler(backends.Fixed(localBackend, remoteBackend))
+}
+
+// PoolHandler is like Handler, but combines the kernelspecs of the backends currently in the given pool.
+//
+// Only the collection itself is served; the kernelspec resources, e.g. their logos, are served separately.
+func PoolHandler(pool backends.Pool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			errorMsg := fmt.Sprintf("unsupported method %v", r.Method)
@@ -122,34 +226,23 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 			util.Log(r, errorMsg)
 			return
 		}
-		if strings.HasPrefix(r.URL.Path, resourcePath) {
-			subpath := strings.TrimPrefix(r.URL.Path, resourcePath)
-			unifiedID := strings.Split(subpath, "/")[0]
-			backend, localID, err := backends.ParseUnifiedID(unifiedID, bs)
-			if err != nil {
-				errorMsg := fmt.Sprintf("invalid kernelspec ID: %q", unifiedID)
-				http.Error(w, errorMsg, http.StatusBadRequest)
-				util.Log(r, fmt.Sprintf("Failure parsing a kernelspecs resource path: %q", errorMsg))
-				return
-			}
-			localPath := strings.Replace(r.URL.Path, unifiedID, localID, 1)
-			util.Log(r, fmt.Sprintf("Translated unified path %q into local path %q", r.URL.Path, localPath))
-			r.URL.Path = localPath
-			backend.ServeHTTP(w, r)
-			return
-		}
 		if r.URL.Path != APIPath {
 			errorMsg := fmt.Sprintf("unsupported kernelspecs API endpoint: %q", r.URL.Path)
 			http.Error(w, errorMsg, http.StatusBadRequest)
 			util.Log(r, fmt.Sprintf("Failed kernelspecs API call: %q\n", errorMsg))
 			return
 		}
-		unifiedKernelSpecs, err := CombinedKernelSpecs(localBackend, remoteBackend)
-		if err != nil {
-			errorMsg := fmt.Sprintf("failure fetching the kernelspecs: %v", err)
-			http.Error(w, errorMsg, util.HTTPStatusCode(err))
-			util.Log(r, fmt.Sprintf("Failed kernelspecs API call: %q", errorMsg))
-			return
+		unifiedKernelSpecs, timedOut, err := CombinedKernelSpecsContext(r.Context(), pool.Backends()...)
+		if len(timedOut) > 0 {
+			util.Log(r, fmt.Sprintf("Omitting the kernelspecs of backends that timed out: %v", timedOut))
+			w.Header().Set(TimedOutBackendsHeader, strings.Join(timedOut, ","))
+		}
+		degraded := err != nil
+		if degraded {
+			// Report that no kernelspecs are available rather than failing, so that the launcher
+			// shows no kernels instead of an error while the backends are unreachable.
+			util.Log(r, fmt.Sprintf("Serving empty kernelspecs after failing to fetch them: %v", err))
+			unifiedKernelSpecs = &resources.KernelSpecs{KernelSpecs: make(map[string]*resources.KernelSpec)}
 		}
 		respBytes, err := unifiedKernelSpecs.MarshalJSON()
 		if err != nil {
@@ -158,6 +251,37 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 			util.Log(r, fmt.Sprintf("Failed kernelspecs API call: %q", errorMsg))
 			return
 		}
+		if degraded {
+			// The empty collection stands in for the backends' until they recover, so it is not given
+			// an ETag that clients could revalidate against instead of fetching the real kernelspecs.
+			w.Write(respBytes)
+			return
+		}
+		tag := etag(respBytes)
+		w.Header().Set("ETag", tag)
+		if etagMatches(r.Header.Get("If-None-Match"), tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 		w.Write(respBytes)
 	})
 }
+
+// etag returns the entity tag for the given kernelspecs response body.
+//
+// The body is marshalled in a deterministic order, so the tag only changes when the kernelspecs do.
+// The tag is weak because the body may be served with different content encodings.
+func etag(body []byte) string {
+	return fmt.Sprintf("W/\"%x\"", sha256.Sum256(body))
+}
+
+// etagMatches reports whether or not the given `If-None-Match` header value matches the given entity tag.
+func etagMatches(ifNoneMatch, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
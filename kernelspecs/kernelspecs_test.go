@@ -1,9 +1,12 @@
 package kernelspecs
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -28,6 +31,30 @@ func TestCombinedKernelSpecs(t *testing.T) {
 			want:                     &resources.KernelSpecs{},
 			wantErr:                  cmpopts.AnyError,
 		},
+		{
+			desc:                     "Bad local backend, Healthy remote backend",
+			localBackendResponseCode: 500,
+			localBackendResponse:     &resources.KernelSpecs{},
+			remoteBackendResponse: &resources.KernelSpecs{
+				Default: "pyspark",
+				KernelSpecs: map[string]*resources.KernelSpec{
+					"pyspark": &resources.KernelSpec{
+						ID:   "pyspark",
+						Spec: &resources.Spec{Language: "python", DisplayName: "PySpark"},
+					},
+				},
+			},
+			want: &resources.KernelSpecs{
+				Default: "remote-pyspark",
+				KernelSpecs: map[string]*resources.KernelSpec{
+					"remote-pyspark": &resources.KernelSpec{
+						ID:        "remote-pyspark",
+						Spec:      &resources.Spec{Language: "python", DisplayName: "PySpark (Remote)"},
+						Resources: map[string]string{},
+					},
+				},
+			},
+		},
 		{
 			desc:                     "Healthy local backend, Bad remote backend",
 			localBackendResponseCode: 200,
@@ -157,11 +184,15 @@ func TestCombinedKernelSpecs(t *testing.T) {
 			}
 
 			localBackend := backends.New("local", " (Local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(tc.localBackendResponseCode)
+				if tc.localBackendResponseCode != 0 {
+					w.WriteHeader(tc.localBackendResponseCode)
+				}
 				w.Write(localRespBytes)
 			}))
 			remoteBackend := backends.New("remote", " (Remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(tc.remoteBackendResponseCode)
+				if tc.remoteBackendResponseCode != 0 {
+					w.WriteHeader(tc.remoteBackendResponseCode)
+				}
 				w.Write(remoteRespBytes)
 			}))
 
@@ -172,9 +203,167 @@ func TestCombinedKernelSpecs(t *testing.T) {
 			if err != nil {
 				return
 			}
-			if diff := cmp.Diff(got, tc.want, cmp.AllowUnexported(resources.KernelSpecs{}, resources.KernelSpec{})); diff != "" {
+			if diff := cmp.Diff(got, tc.want, cmp.AllowUnexported(resources.KernelSpecs{}, resources.KernelSpec{}), cmpopts.IgnoreUnexported(resources.Spec{})); diff != "" {
 				t.Errorf("CombinedKernelSpecs() returned unexpected diff (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
+
+func TestCombinedKernelSpecsDeadline(t *testing.T) {
+	localSpecs := &resources.KernelSpecs{
+		Default: "base",
+		KernelSpecs: map[string]*resources.KernelSpec{
+			"base": &resources.KernelSpec{
+				ID:   "base",
+				Spec: &resources.Spec{Language: "python", DisplayName: "Python 3"},
+			},
+		},
+	}
+	localRespBytes, err := json.Marshal(localSpecs)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v) got error %v want nil", localSpecs, err)
+	}
+	localBackend := backends.New("local", " (Local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(localRespBytes)
+	}))
+	remoteBackend := backends.New("remote", " (Remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+			w.Write([]byte(`{"default":"pyspark","kernelspecs":{}}`))
+		case <-r.Context().Done():
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	got, timedOut, err := CombinedKernelSpecsContext(ctx, localBackend, remoteBackend)
+	if err != nil {
+		t.Fatalf("CombinedKernelSpecsContext() got error %v want nil", err)
+	}
+	if diff := cmp.Diff([]string{"remote"}, timedOut); diff != "" {
+		t.Errorf("CombinedKernelSpecsContext() returned unexpected timed out backends (-want +got):\n%s", diff)
+	}
+	if got.Default != "local-base" {
+		t.Errorf("CombinedKernelSpecsContext() returned unexpected default: got %q want %q", got.Default, "local-base")
+	}
+	if _, ok := got.KernelSpecs["local-base"]; !ok || len(got.KernelSpecs) != 1 {
+		t.Errorf("CombinedKernelSpecsContext() returned unexpected kernelspecs: %v", got.KernelSpecs)
+	}
+
+	canceledCtx, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	blockedLocalBackend := backends.New("local", " (Local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	if _, timedOut, err := CombinedKernelSpecsContext(canceledCtx, blockedLocalBackend, remoteBackend); err == nil {
+		t.Errorf("CombinedKernelSpecsContext() with a canceled context got error nil want non-nil")
+	} else if len(timedOut) != 0 {
+		t.Errorf("CombinedKernelSpecsContext() with a canceled context returned unexpected timed out backends: %v", timedOut)
+	}
+
+	handlerCtx, handlerCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer handlerCancel()
+	rr := httptest.NewRecorder()
+	Handler(localBackend, remoteBackend).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, APIPath, nil).WithContext(handlerCtx))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler() got status %d want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if got, want := rr.Header().Get(TimedOutBackendsHeader), "remote"; got != want {
+		t.Errorf("Handler() got timed out backends header %q want %q", got, want)
+	}
+}
+
+func TestHandlerETag(t *testing.T) {
+	specs := &resources.KernelSpecs{
+		Default: "base",
+		KernelSpecs: map[string]*resources.KernelSpec{
+			"base":  &resources.KernelSpec{ID: "base", Spec: &resources.Spec{Language: "python", DisplayName: "Python 3"}},
+			"other": &resources.KernelSpec{ID: "other", Spec: &resources.Spec{Language: "python", DisplayName: "Python 3"}},
+		},
+	}
+	respBytes, err := json.Marshal(specs)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v) got error %v want nil", specs, err)
+	}
+	backendHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(respBytes)
+	})
+	h := Handler(backends.New("local", " (Local)", "local host", backendHandler), backends.New("remote", " (Remote)", "remote host", backendHandler))
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, APIPath, nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		return rr
+	}
+
+	first := get("")
+	tag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || tag == "" {
+		t.Fatalf("Handler() got status %d and ETag %q, want %d and a non-empty ETag", first.Code, tag, http.StatusOK)
+	}
+	for i := 0; i < 5; i++ {
+		if got := get("").Header().Get("ETag"); got != tag {
+			t.Errorf("Handler() got unstable ETag %q want %q", got, tag)
+		}
+	}
+	testCases := []struct {
+		desc        string
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{
+			desc:        "Matching ETag",
+			ifNoneMatch: tag,
+			wantStatus:  http.StatusNotModified,
+		},
+		{
+			desc:        "Matching ETag in a list",
+			ifNoneMatch: `"stale", ` + tag,
+			wantStatus:  http.StatusNotModified,
+		},
+		{
+			desc:        "Stale ETag",
+			ifNoneMatch: `"stale"`,
+			wantStatus:  http.StatusOK,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr := get(tc.ifNoneMatch)
+			if rr.Code != tc.wantStatus {
+				t.Errorf("Handler() got status %d want %d", rr.Code, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusNotModified && rr.Body.Len() > 0 {
+				t.Errorf("Handler() got unexpected body for a 304 response: %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandlerAllBackendsFail(t *testing.T) {
+	failingHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unreachable", http.StatusBadGateway)
+	})
+	h := Handler(backends.New("local", " (Local)", "local host", failingHandler), backends.New("remote", " (Remote)", "remote host", failingHandler))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, APIPath, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler() got status %d want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var got resources.KernelSpecs
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q) got error %v want nil", rr.Body.String(), err)
+	}
+	if !got.IsEmpty() || got.KernelSpecs == nil {
+		t.Errorf("Handler() got kernelspecs %q want an empty collection", rr.Body.String())
+	}
+	if tag := rr.Header().Get("ETag"); tag != "" {
+		t.Errorf("Handler() got ETag %q for the degraded response, want none", tag)
+	}
+}
@@ -40,18 +40,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"golang.org/x/oauth2"
-	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
-	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
-	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
-	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/sessions"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/mixer"
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
 )
 
@@ -61,15 +58,59 @@ var (
 	mixerHost    = flag.String("mixer-host", "kernels.googleusercontent.com", "The parent hostname for the kernels mixer.")
 	remoteURL    = flag.String("remote-url", "", "The full URL for the remote backend. If unset, this is constructed based on the --mixer-host")
 
-	jupyterPort  = flag.Int("jupyter-port", 8082, "The port on which the locally running Jupyter server is listening.")
-	jupyterToken = flag.String("jupyter-token", "", "The token used to authenticate calls to the locally running Jupyter instance.")
-	port         = flag.Int("port", 8081, "Port on which to start the server.")
+	remoteBasePath = flag.String("remote-base-path", "", "The path prefix under which the remote backend serves its API, e.g. \"/jupyter\".")
+
+	jupyterPort     = flag.Int("jupyter-port", 8082, "The port on which the locally running Jupyter server is listening.")
+	jupyterToken    = flag.String("jupyter-token", "", "The token used to authenticate calls to the locally running Jupyter instance.")
+	jupyterBasePath = flag.String("jupyter-base-path", "", "The path prefix under which the locally running Jupyter server serves its API, e.g. \"/jupyter\".")
+	localOnly       = flag.Bool("local-only", false, "Whether or not to disable the remote backend and forward every request to the locally running Jupyter server unmodified.")
+	port            = flag.Int("port", 8081, "Port on which to start the server.")
 
 	externalHostname = flag.String("external-hostname", "", "The hostname users will actually connect to to use this client.")
 
 	gceMetadataOverrideIP = flag.String("gce-metadata-override-ip", "", "Override GCE metadata IP when querying credentials.")
 
-	contextRequestTimeout = flag.Duration("context_request_timeout", 10*time.Second, "How long to give HTTP requests to complete. For outgoing client request, the context controls the entire lifetime of a request and its response: obtaining a connection, sending the request, and reading the response headers and body.")
+	gzipMinSize = flag.Int("gzip-min-size", util.DefaultGzipMinSize, "The minimum size, in bytes, of an aggregated response body before it is gzip-compressed for clients that accept that.")
+
+	deadSessionPolicy = flag.String("dead-session-policy", string(mixer.DropDeadSessions), "How to list sessions whose kernel no longer exists; either \"drop\" to omit them, or \"clear-kernel\" to list them without a kernel.")
+	fallbackBackend   = flag.String("fallback-backend", "", "The name of the backend, e.g. \"local\", whose default kernelspec is used to start kernels whose kernelspec cannot be resolved. If empty, then those requests are rejected.")
+
+	debugBackendHeaders = flag.Bool("debug-backend-headers", false, "Whether or not to add headers to proxied responses naming the backend that served them and how long it took. This exposes backend identifiers to clients, so it should only be used for debugging.")
+
+	startRateLimit = flag.Float64("start-rate-limit", 0, "The number of kernel starts per second allowed on average for each user. If zero, then kernel starts are not limited.")
+	startRateBurst = flag.Int("start-rate-burst", 1, "The number of kernel starts allowed at once for each user. Does nothing unless --start-rate-limit is set.")
+
+	corsAllowedOrigins   = flag.String("cors-allowed-origins", "", "Comma-separated list of the origins allowed to call the API from a different origin, or \"*\" to allow every origin. If empty, then CORS is disabled.")
+	corsAllowedMethods   = flag.String("cors-allowed-methods", "", "Comma-separated list of the methods allowed for cross-origin requests. If empty, then GET, POST, PATCH, and DELETE are allowed.")
+	corsAllowedHeaders   = flag.String("cors-allowed-headers", "", "Comma-separated list of the request headers allowed for cross-origin requests. If empty, then Authorization, Content-Type, and X-XSRFToken are allowed.")
+	corsAllowCredentials = flag.Bool("cors-allow-credentials", false, "Whether or not cross-origin requests may include cookies and other credentials.")
+
+	adminIdentities = flag.String("admin-identities", "", "Comma-separated list of the user identities allowed to call the mixer's admin endpoints.")
+	trustedProxies  = flag.String("trusted-proxies", "", "Comma-separated list of the IP addresses or CIDR ranges of the authenticating proxies whose X-Goog-Authenticated-User-Email header identifies the user. If empty, then no user identities are trusted.")
+
+	maxRequestBodySize = flag.Int64("max-request-body-size", mixer.DefaultMaxRequestBodySize, "The maximum size, in bytes, of the body of a request to create a kernel, session, or terminal.")
+
+	kernelSpecResourcesMaxAge = flag.Duration("kernelspec-resources-max-age", mixer.DefaultKernelSpecResourcesMaxAge, "How long clients may cache the kernelspec resource files, e.g. icons. If negative, then they are not marked as cacheable.")
+
+	maxConcurrentBackendRequests = flag.Int("max-concurrent-backend-requests", 0, "The maximum number of requests in flight to each backend at once. Requests over the limit wait for an earlier one to complete. If zero, then requests are not limited.")
+
+	circuitBreakerFailures = flag.Int("circuit-breaker-failures", 0, "The number of consecutive failed requests to a remote backend after which requests to it fail fast until the cooldown elapses. If zero, then requests are always forwarded.")
+	circuitBreakerCooldown = flag.Duration("circuit-breaker-cooldown", mixer.DefaultCircuitBreakerCooldown, "How long requests to a failing backend fail fast before one is forwarded to probe whether the backend has recovered.")
+
+	webSocketPingInterval = flag.Duration("websocket-ping-interval", 0, "How often to send a ping on each websocket connection proxied to a backend. If zero, then no pings are sent.")
+
+	userAgent = flag.String("user-agent", "", "The product token appended to the User-Agent of every request forwarded to a backend. If empty, then \"notebook-kernels-mixer/<version>\" is used.")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait on shutdown for in-flight requests to complete and for proxied websockets to close cleanly.")
+
+	contextRequestTimeout = flag.Duration("context_request_timeout", 10*time.Second, "How long to give HTTP requests to complete. For outgoing client request, the context controls the entire lifetime of a request and its response: obtaining a connection, sending the request, and reading the response headers and body. Requests to start a kernel or a session are instead given the longest backend start timeout, if that is longer.")
+
+	backendTimeout            = flag.Duration("backend-timeout", 0, "How long to wait on each request forwarded to a backend, besides those to start kernels and sessions. If zero, then those requests are bounded only by --context_request_timeout.")
+	backendStartTimeout       = flag.Duration("backend-start-timeout", 0, "How long to wait on each request forwarded to a backend to start a kernel or a session. If zero, then --backend-timeout is used.")
+	localBackendTimeout       = flag.Duration("local-backend-timeout", 0, "How long to wait on each request forwarded to the local backend, besides those to start kernels and sessions. If zero, then --backend-timeout is used.")
+	localBackendStartTimeout  = flag.Duration("local-backend-start-timeout", 0, "How long to wait on each request forwarded to the local backend to start a kernel or a session. If zero, then --backend-start-timeout is used.")
+	remoteBackendTimeout      = flag.Duration("remote-backend-timeout", 0, "How long to wait on each request forwarded to the remote backend, besides those to start kernels and sessions. If zero, then --backend-timeout is used.")
+	remoteBackendStartTimeout = flag.Duration("remote-backend-start-timeout", 0, "How long to wait on each request forwarded to the remote backend to start a kernel or a session. If zero, then --backend-start-timeout is used.")
 
 	logRequestHeaders      = flag.Bool("log-all-request-headers", false, "Whether or not to log the headers for every request.")
 	logAllRequestResponses = flag.Bool("log-all-request-responses", false, "Whether or not to log the response code for every request.")
@@ -118,130 +159,63 @@ func (tsf tokenSourceFunc) Token() (*oauth2.Token, error) {
 	return tsf()
 }
 
-func clearExternalOriginForWebsocketRequests(r *http.Request) {
-	if !websocket.IsWebSocketUpgrade(r) {
-		return
-	}
-
-	// The mixer does not allow cross origin websocket requests, so we clear out the
-	// origin header if it is set to something we allow.
-	origin := r.Header.Get("Origin")
-	if origin == "" {
-		return
-	}
-	originURL, err := url.Parse(origin)
-	if err != nil {
-		util.Log(r, fmt.Sprintf("Malformed URL in origin header: %q", origin))
-		return
-	}
-	if originURL.Host == *externalHostname {
-		r.Header.Del("Origin")
+// splitList splits the given comma-separated list, dropping empty entries.
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
 	}
+	return entries
 }
 
-const (
-	localBackendName        = "local"
-	localResourceNameSuffix = " (Local)"
-
-	remoteBackendName        = "remote"
-	remoteResourceNameSuffix = " (Remote)"
-)
-
 func main() {
 	flag.Parse()
-	var mixerURL *url.URL
-	var err error
-	if *remoteURL == "" {
-		if *mixerProject == "" || *mixerRegion == "" {
-			log.Fatal("You must specify the project and region of the kernels mixer")
-		}
-		mixerURL, err = url.Parse(fmt.Sprintf("https://%s-dot-%s.%s", *mixerProject, *mixerRegion, *mixerHost))
-	} else {
-		mixerURL, err = url.Parse(*remoteURL)
-	}
-	if err != nil {
-		log.Fatalf("Failure parsing the URL for the kernel mixer: %v", err)
-	}
-
-	mixerProxy := httputil.NewSingleHostReverseProxy(mixerURL)
-	baseDirector := mixerProxy.Director
-	mixerProxy.Director = func(r *http.Request) {
-		baseDirector(r)
-		if errs := util.ModifyProxiedRequestForHost(r, mixerURL.Host); len(errs) > 0 {
-			util.Log(r, fmt.Sprintf("Unexpected errors modifying proxied request headers: %v\n", errs))
-		}
-		clearExternalOriginForWebsocketRequests(r)
-	}
-	mixerProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		util.Log(r, fmt.Sprintf("Error forwarding a request to the kernels mixer: %v", err))
-		if websocket.IsWebSocketUpgrade(r) {
-			// Do not report the error via the response status code, as if we do then JupyterLab will
-			// not retry the websocket connection and will unnecessarily report the kernel as disconnected.
-			return
-		}
-		// Report the proxy error using the same status as the default error handler.
-		w.WriteHeader(http.StatusBadGateway)
-	}
-
 	tokenSource := oauth2.ReuseTokenSource(nil, tokenSourceFunc(gcloudToken))
 	// Do the initial token fetch at startup.
 	tokenSource.Token()
-	wrappedSessionsProxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, err := tokenSource.Token()
-		if err != nil {
-			msg := fmt.Sprintf("failure generating the authorization header: %v", err)
-			util.Log(r, msg)
-			http.Error(w, msg, util.HTTPStatusCode(err))
-			return
-		}
-		r.Header.Del("Authorization")
-		r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
-		mixerProxy.ServeHTTP(w, r)
+	localAddress := fmt.Sprintf("[::1]:%d", *port)
+	m, err := mixer.NewMixer(mixer.MixerOptions{
+		LocalBackendURL:              fmt.Sprintf("http://localhost:%d", *jupyterPort),
+		LocalBackendToken:            *jupyterToken,
+		LocalBackendBasePath:         *jupyterBasePath,
+		LocalOnly:                    *localOnly,
+		RemoteBackendURL:             *remoteURL,
+		RemoteBackendBasePath:        *remoteBasePath,
+		Project:                      *mixerProject,
+		Region:                       *mixerRegion,
+		Host:                         *mixerHost,
+		TokenSource:                  tokenSource,
+		ExternalHostname:             *externalHostname,
+		ListenAddress:                localAddress,
+		GzipMinSize:                  *gzipMinSize,
+		DeadSessionPolicy:            mixer.DeadSessionPolicy(*deadSessionPolicy),
+		FallbackBackend:              *fallbackBackend,
+		DebugBackendHeaders:          *debugBackendHeaders,
+		MaxRequestBodySize:           *maxRequestBodySize,
+		KernelSpecResourcesMaxAge:    *kernelSpecResourcesMaxAge,
+		MaxConcurrentBackendRequests: *maxConcurrentBackendRequests,
+		WebSocketPingInterval:        *webSocketPingInterval,
+		UserAgent:                    *userAgent,
+		CircuitBreaker:               mixer.CircuitBreakerPolicy{FailureThreshold: *circuitBreakerFailures, Cooldown: *circuitBreakerCooldown},
+		StartRateLimit:               mixer.RateLimit{Rate: *startRateLimit, Burst: *startRateBurst},
+		AdminIdentities:              splitList(*adminIdentities),
+		TrustedProxies:               splitList(*trustedProxies),
+		BackendTimeouts:              mixer.BackendTimeouts{Default: *backendTimeout, Start: *backendStartTimeout},
+		LocalBackendTimeouts:         mixer.BackendTimeouts{Default: *localBackendTimeout, Start: *localBackendStartTimeout},
+		RemoteBackendTimeouts:        mixer.BackendTimeouts{Default: *remoteBackendTimeout, Start: *remoteBackendStartTimeout},
+		CORS: mixer.CORSPolicy{
+			AllowedOrigins:   splitList(*corsAllowedOrigins),
+			AllowedMethods:   splitList(*corsAllowedMethods),
+			AllowedHeaders:   splitList(*corsAllowedHeaders),
+			AllowCredentials: *corsAllowCredentials,
+		},
 	})
-	remoteBackend := backends.New(remoteBackendName, remoteResourceNameSuffix, mixerURL.Host, wrappedSessionsProxy)
-
-	localBackendHost := fmt.Sprintf("localhost:%d", *jupyterPort)
-	localURL, err := url.Parse("http://" + localBackendHost)
 	if err != nil {
-		log.Fatalf("Failure parsing the URL for the locally-running Jupyter Lab instance: %v", err)
-	}
-	localProxy := httputil.NewSingleHostReverseProxy(localURL)
-	localProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		util.Log(r, fmt.Sprintf("Error forwarding a request to the local Jupyter server. Verify %s is active. %v", localURL.String(), err))
-		if websocket.IsWebSocketUpgrade(r) {
-			// Do not report the error via the response status code, as if we do then JupyterLab will
-			// not retry the websocket connection and will unnecessarily report the kernel as disconnected.
-			return
-		}
-		// Report the proxy error using the same status as the default error handler.
-		w.WriteHeader(http.StatusBadGateway)
+		log.Fatalf("Failure configuring the kernels mixer: %v", err)
 	}
-	if len(*jupyterToken) > 0 {
-		localProxyBaseDirector := localProxy.Director
-		localProxy.Director = func(r *http.Request) {
-			localProxyBaseDirector(r)
-			q := r.URL.Query()
-			q.Set("token", *jupyterToken)
-			r.URL.RawQuery = q.Encode()
-		}
-	}
-	localBackend := backends.New(localBackendName, localResourceNameSuffix, localBackendHost, localProxy)
-
-	kernelSpecsHandler := kernelspecs.Handler(localBackend, remoteBackend)
-	kernelsHandler := kernels.Handler(localBackend, remoteBackend)
-	sessionsHandler := sessions.Handler(localBackend, remoteBackend)
-
-	mux := http.NewServeMux()
-	mux.Handle("/api/kernelspecs", kernelSpecsHandler)
-	mux.Handle("/api/kernelspecs/", kernelSpecsHandler)
-	mux.Handle("/kernelspecs/", kernelSpecsHandler)
-
-	mux.Handle("/api/kernels", kernelsHandler)
-	mux.Handle("/api/kernels/", kernelsHandler)
-
-	mux.Handle("/api/sessions", sessionsHandler)
-	mux.Handle("/api/sessions/", sessionsHandler)
-	mux.Handle("/", localProxy)
+	handler := m.RequestTimeoutHandler(*contextRequestTimeout, m)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if *logRequestHeaders {
 			util.Log(r, fmt.Sprintf("Request headers: %+v", r.Header))
@@ -259,6 +233,11 @@ func main() {
 			}
 			w = util.NewLoggingResponseWriter(w, r, buff)
 		}
+		if m.IsCORSPreflight(r) {
+			// Preflight requests carry no credentials, so they are answered without checking for any.
+			m.ServeHTTP(w, r)
+			return
+		}
 		if len(*jupyterToken) > 0 {
 			if token := r.Header.Get("token"); token != *jupyterToken {
 				util.Log(r, fmt.Sprintf("Token mismatch: %q", token))
@@ -271,14 +250,31 @@ func main() {
 			http.Error(w, err.Error(), util.HTTPStatusCode(err))
 			return
 		}
-		if !websocket.IsWebSocketUpgrade(r) {
-			ctx, cancel := context.WithTimeout(r.Context(), *contextRequestTimeout)
-			defer cancel()
-			r = r.WithContext(ctx)
-		}
-		mux.ServeHTTP(w, r)
+		handler.ServeHTTP(w, r)
 	})
-	localAddress := fmt.Sprintf("[::1]:%d", *port)
+	discoveryCtx, stopDiscovery := context.WithCancel(context.Background())
+	go m.RunDiscovery(discoveryCtx)
+	srv := &http.Server{Addr: localAddress}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		<-signals
+		log.Printf("Shutting down...")
+		stopDiscovery()
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Failure shutting down the server: %v", err)
+		}
+		if err := m.Shutdown(ctx); err != nil {
+			log.Printf("Failure closing the proxied websockets: %v", err)
+		}
+	}()
 	log.Printf("Listening on %q...\n", localAddress)
-	log.Fatal(http.ListenAndServe(localAddress, nil))
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
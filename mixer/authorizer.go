@@ -0,0 +1,199 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/sessions"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// Authorizer decides which backends each user may use.
+type Authorizer interface {
+	// CanUseBackend reports whether or not the user with the given identity may start kernels on the given backend.
+	//
+	// The backend is identified by the endpointParentResource of its kernelspecs, e.g. a Dataproc
+	// cluster, and the empty string identifies the local backend.
+	CanUseBackend(ctx context.Context, identity, backend string) (bool, error)
+}
+
+// AllowAll is an Authorizer that allows every user to use every backend.
+type AllowAll struct{}
+
+// CanUseBackend implements the Authorizer interface.
+func (AllowAll) CanUseBackend(ctx context.Context, identity, backend string) (bool, error) {
+	return true, nil
+}
+
+// canUseSpec reports whether or not the user that sent the given request may start kernels from the given kernelspec.
+func (m *Mixer) canUseSpec(r *http.Request, spec *resources.KernelSpec) (bool, error) {
+	if m.opts.Authorizer == nil {
+		return true, nil
+	}
+	identity, err := m.userIdentity(r)
+	if err != nil {
+		return false, err
+	}
+	return m.opts.Authorizer.CanUseBackend(r.Context(), identity, spec.Resources[endpointParentResourceKey])
+}
+
+// authorizeKernelSpecsHandler wraps the given kernelspecs handler so that the kernelspecs of backends the user may not use are not listed.
+//
+// The filtered list depends on the user, so conditional requests are not supported when an Authorizer is configured.
+func (m *Mixer) authorizeKernelSpecsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.opts.Authorizer == nil || r.Method != http.MethodGet || r.URL.Path != kernelspecs.APIPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if _, err := m.userIdentity(r); err != nil {
+			errorMsg := fmt.Sprintf("failure identifying the user to authorize the kernelspecs: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		r.Header.Del("If-None-Match")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		resp := rr.Result()
+		for key, val := range resp.Header {
+			if key != "Content-Length" && key != "Etag" {
+				w.Header()[key] = val
+			}
+		}
+		respBytes := rr.Body.Bytes()
+		if resp.StatusCode == http.StatusOK {
+			var ks resources.KernelSpecs
+			if err := json.Unmarshal(respBytes, &ks); err != nil {
+				errorMsg := fmt.Sprintf("failure parsing the kernelspecs: %v", err)
+				util.Log(r, errorMsg)
+				http.Error(w, errorMsg, http.StatusInternalServerError)
+				return
+			}
+			for id, spec := range ks.KernelSpecs {
+				if spec == nil {
+					continue
+				}
+				if ok, err := m.canUseSpec(r, spec); err != nil || !ok {
+					if err != nil {
+						util.Log(r, fmt.Sprintf("Failure authorizing the kernelspec %q; omitting it: %v", id, err))
+					}
+					delete(ks.KernelSpecs, id)
+				}
+			}
+			if _, ok := ks.KernelSpecs[ks.Default]; !ok {
+				ks.Default = ""
+				if spec, ok := ks.DefaultSpec(); ok {
+					ks.Default = spec.ID
+				}
+			}
+			filtered, err := ks.MarshalJSON()
+			if err != nil {
+				errorMsg := fmt.Sprintf("failure marshalling the kernelspecs: %v", err)
+				util.Log(r, errorMsg)
+				http.Error(w, errorMsg, util.HTTPStatusCode(err))
+				return
+			}
+			respBytes = filtered
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	})
+}
+
+// startSpecID returns the unified ID of the kernelspec that the given request to start a kernel or a session uses.
+//
+// The request body is restored so that it can be read again. If the request does not start a
+// kernel from a kernelspec, then the empty string is returned.
+func startSpecID(r *http.Request) (string, error) {
+	if r.Method != http.MethodPost || (r.URL.Path != kernels.APIPath && r.URL.Path != sessions.APIPath) {
+		return "", nil
+	}
+	reqBytes, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("failure reading the request body: %w", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(reqBytes))
+	if r.URL.Path == sessions.APIPath {
+		var sess resources.Session
+		if err := json.Unmarshal(reqBytes, &sess); err != nil || sess.Kernel == nil {
+			// Leave malformed requests for the sessions handler to report.
+			return "", nil
+		}
+		return sess.Kernel.SpecID, nil
+	}
+	var k resources.Kernel
+	if err := json.Unmarshal(reqBytes, &k); err != nil {
+		return "", nil
+	}
+	return k.SpecID, nil
+}
+
+// authorizeStartHandler wraps the given kernels or sessions handler so that users cannot start kernels on backends they may not use.
+//
+// Such requests are rejected with a 403 status without being forwarded to any backend. Requests
+// for unknown kernelspecs are passed through, so that they are reported by the wrapped handler.
+func (m *Mixer) authorizeStartHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.opts.Authorizer == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		specID, err := startSpecID(r)
+		if err != nil {
+			errorMsg := err.Error()
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		if specID == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		spec, ok := m.lookupSpec(r.Context(), specID)
+		if !ok || spec == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		allowed, err := m.canUseSpec(r, spec)
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure authorizing the kernelspec %q: %v", specID, err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		if !allowed {
+			identity, _ := m.userIdentity(r)
+			errorMsg := fmt.Sprintf("%q is not allowed to start kernels from the kernelspec %q", identity, specID)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/google/go-cmp/cmp"
+)
+
+// denyBackends is an Authorizer that denies every user the given backends.
+type denyBackends map[string]bool
+
+func (d denyBackends) CanUseBackend(ctx context.Context, identity, backend string) (bool, error) {
+	return !d[backend], nil
+}
+
+func TestAuthorizer(t *testing.T) {
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{
+		Authorizer: denyBackends{testClusterResource: true},
+		Identity: func(*http.Request) (string, error) {
+			return "user@example.com", nil
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernelspecs", nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("Unexpected response status listing the kernelspecs: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	var ks resources.KernelSpecs
+	if err := json.Unmarshal(rr.Body.Bytes(), &ks); err != nil {
+		t.Fatalf("Failure parsing the kernelspecs %q: %v", rr.Body.String(), err)
+	}
+	var listed []string
+	for id := range ks.KernelSpecs {
+		listed = append(listed, id)
+	}
+	if diff := cmp.Diff([]string{"local-python3"}, listed); diff != "" {
+		t.Errorf("Unexpected kernelspecs listed: diff (-want +got):\n%s", diff)
+	}
+
+	testCases := []struct {
+		desc       string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{
+			desc:       "start on an allowed backend",
+			path:       "/api/kernels",
+			body:       `{"name":"local-python3"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			desc:       "start on a denied backend",
+			path:       "/api/kernels",
+			body:       `{"name":"remote-pyspark"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			desc:       "session on a denied backend",
+			path:       "/api/sessions",
+			body:       `{"path":"notebook.ipynb","type":"notebook","kernel":{"name":"remote-pyspark"}}`,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Errorf("Unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+		})
+	}
+}
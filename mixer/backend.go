@@ -0,0 +1,88 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+)
+
+// router resolves unified resource IDs to the backends that own them.
+//
+// The set of backends can be replaced while requests are being routed.
+type router struct {
+	// mu protects the fields below it.
+	mu       sync.RWMutex
+	backends []*backends.Backend
+}
+
+// newRouter returns a router for the given backends.
+func newRouter(bs ...*backends.Backend) *router {
+	return &router{backends: bs}
+}
+
+// Backends implements the backends.Pool interface, returning the backends that the router currently routes to.
+func (rt *router) Backends() []*backends.Backend {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.backends
+}
+
+// set replaces the backends that the router routes to.
+func (rt *router) set(bs []*backends.Backend) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.backends = bs
+}
+
+// resolve returns the backend owning the resource with the given unified ID, along with the resource's ID within that backend.
+func (rt *router) resolve(unifiedID string) (*backends.Backend, string, error) {
+	return backends.ParseUnifiedID(unifiedID, rt.Backends())
+}
+
+// lookup returns the backend with the given name, if the router routes to one.
+func (rt *router) lookup(name string) (*backends.Backend, bool) {
+	for _, b := range rt.Backends() {
+		if b.Name() == name {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// RoutingError reports that the kernelspec of a kernel to start could not be resolved to a backend.
+//
+// This is the case when the kernelspec's backend is unknown or no longer reports it, e.g. for a
+// stale kernelspec ID, and no fallback backend can be used instead.
+type RoutingError struct {
+	// SpecID is the unified ID of the kernelspec that could not be resolved.
+	SpecID string
+	// Err describes why the kernelspec could not be resolved, and carries the HTTP status to report.
+	Err error
+}
+
+// Error implements the error interface
+func (e *RoutingError) Error() string {
+	return fmt.Sprintf("failure routing the kernelspec %q: %v", e.SpecID, e.Err)
+}
+
+// Unwrap returns the reason the kernelspec could not be resolved.
+func (e *RoutingError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/sessions"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// fakeBackend is an in-memory Jupyter server that the mixer can route to.
+type fakeBackend struct {
+	name string
+
+	// mu protects the fields below it, which may be changed while the backend is in use.
+	mu       sync.Mutex
+	specs    *resources.KernelSpecs
+	kernels  []*resources.Kernel
+	sessions []*resources.Session
+	err      error
+}
+
+// setErr makes every later request to the backend fail with the given error, or succeed again if it is nil.
+func (b *fakeBackend) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+// ServeHTTP implements the http.Handler interface
+func (b *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		http.Error(w, b.err.Error(), http.StatusBadGateway)
+		return
+	}
+	var resp any
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == kernelspecs.APIPath:
+		resp = b.specs
+	case r.Method == http.MethodGet && r.URL.Path == kernels.APIPath:
+		resp = b.kernels
+	case r.Method == http.MethodGet && r.URL.Path == sessions.APIPath:
+		resp = b.sessions
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if v := reflect.ValueOf(resp); v.Kind() == reflect.Slice && v.IsNil() {
+		resp = []any{}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// backend returns the backend that the mixer uses to reach the fake server.
+func (b *fakeBackend) backend() *backends.Backend {
+	return backends.New(b.name, " ("+b.name+")", b.name+" host", b)
+}
+
+func TestRouterResolve(t *testing.T) {
+	local := (&fakeBackend{name: "local"}).backend()
+	remote := (&fakeBackend{name: "remote"}).backend()
+	rt := newRouter(local, remote)
+	testCases := []struct {
+		desc        string
+		unifiedID   string
+		wantBackend *backends.Backend
+		wantLocalID string
+		wantStatus  int
+	}{
+		{
+			desc:        "local",
+			unifiedID:   "local-python3",
+			wantBackend: local,
+			wantLocalID: "python3",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			desc:        "remote with a dash in the ID",
+			unifiedID:   "remote-pyspark-1",
+			wantBackend: remote,
+			wantLocalID: "pyspark-1",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			desc:       "unknown backend",
+			unifiedID:  "other-python3",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b, localID, err := rt.resolve(tc.unifiedID)
+			if got, want := util.HTTPStatusCode(err), tc.wantStatus; got != want {
+				t.Fatalf("unexpected status: got %d, want %d: %v", got, want, err)
+			}
+			if b != tc.wantBackend || localID != tc.wantLocalID {
+				t.Errorf("unexpected resolution: got (%v, %q), want (%v, %q)", b, localID, tc.wantBackend, tc.wantLocalID)
+			}
+		})
+	}
+}
+
+func TestMixerWithFakeBackends(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	local := &fakeBackend{
+		name:  "local",
+		specs: localKernelSpecs,
+		kernels: []*resources.Kernel{
+			{ID: "idle", SpecID: "python3", LastActivity: now.Add(-2 * time.Hour).Format(time.RFC3339Nano)},
+			{ID: "busy", SpecID: "python3", LastActivity: now.Format(time.RFC3339Nano)},
+		},
+	}
+	remote := &fakeBackend{name: "remote", err: errors.New("unreachable")}
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+	m.router = newRouter(local.backend(), remote.backend())
+	m.now = func() time.Time { return now }
+
+	resolution, err := m.ResolveStart(context.Background(), &resources.Kernel{SpecID: "local-python3"})
+	if err != nil {
+		t.Fatalf("failure resolving a start on the local backend: %v", err)
+	}
+	if got, want := resolution, (&StartResolution{SpecID: "local-python3", Backend: "local", BackendSpecID: "python3"}); !cmp.Equal(got, want) {
+		t.Errorf("unexpected resolution: diff %v", cmp.Diff(got, want))
+	}
+	if _, err := m.ResolveStart(context.Background(), &resources.Kernel{SpecID: "remote-pyspark"}); util.HTTPStatusCode(err) != http.StatusBadGateway {
+		t.Errorf("unexpected error resolving a start on an unreachable backend: %v", err)
+	}
+
+	idle, failed := m.IdleKernels(context.Background(), time.Hour)
+	if _, ok := failed["remote"]; !ok || len(failed) != 1 {
+		t.Errorf("unexpected backends skipped listing the idle kernels: got %v, want only %q", failed, "remote")
+	}
+	want := []*resources.Kernel{
+		{ID: "idle", SpecID: "local-python3", LastActivity: now.Add(-2 * time.Hour).Format(time.RFC3339Nano)},
+	}
+	if diff := cmp.Diff(idle, want, cmpopts.IgnoreUnexported(resources.Kernel{})); diff != "" {
+		t.Errorf("unexpected idle kernels: diff %v", diff)
+	}
+}
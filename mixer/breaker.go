@@ -0,0 +1,173 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultCircuitBreakerCooldown is the default time that a backend's circuit breaker stays open before probing the backend again.
+const DefaultCircuitBreakerCooldown = 30 * time.Second
+
+// CircuitBreakerPolicy controls when the mixer stops forwarding requests to a backend that keeps failing.
+type CircuitBreakerPolicy struct {
+	// FailureThreshold is the number of consecutive failed requests to a backend after which its breaker opens.
+	//
+	// A request fails if the backend cannot be reached, times out, or reports that it is unavailable.
+	// If unset, then requests are always forwarded.
+	FailureThreshold int
+
+	// Cooldown is how long the breaker stays open before a single request is let through to probe the backend.
+	//
+	// If unset, then DefaultCircuitBreakerCooldown is used.
+	Cooldown time.Duration
+}
+
+// circuitBreaker tracks the consecutive failures of the requests to a backend.
+//
+// Once the failures reach the policy's threshold, the breaker opens and rejects requests until
+// its cooldown elapses. It then half-opens, letting one probe request through: the breaker closes
+// again if the probe succeeds, and reopens for another cooldown if it fails.
+type circuitBreaker struct {
+	policy CircuitBreakerPolicy
+	// now returns the current time, and is overridden in tests.
+	now func() time.Time
+
+	// mu protects the fields below it.
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// newCircuitBreaker returns a new, closed circuit breaker for the given policy, or nil if the policy does not enable one.
+func newCircuitBreaker(policy CircuitBreakerPolicy) *circuitBreaker {
+	if policy.FailureThreshold <= 0 {
+		return nil
+	}
+	if policy.Cooldown <= 0 {
+		policy.Cooldown = DefaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{policy: policy, now: time.Now}
+}
+
+// allow reports whether or not a request may be forwarded to the backend.
+//
+// If so, then it also reports whether or not the request is the breaker's probe. If not, then it
+// returns when the breaker next lets a probe through.
+func (b *circuitBreaker) allow() (ok, probe bool, retryAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.policy.FailureThreshold {
+		return true, false, time.Time{}
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false, false, b.openUntil
+	}
+	b.probing = true
+	return true, true, time.Time{}
+}
+
+// abandon releases a request that the breaker allowed without recording its outcome.
+//
+// That is the case for requests whose outcome says nothing about the backend, e.g. because the
+// client hung up. An abandoned probe lets the next request probe the backend instead.
+func (b *circuitBreaker) abandon(probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+}
+
+// record records the outcome of a request that the breaker allowed.
+//
+// Once the breaker is open, only the outcome of its probe is recorded; other requests may have
+// been allowed before the breaker opened, and finish while it is open or the probe is in flight.
+func (b *circuitBreaker) record(probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	} else if b.failures >= b.policy.FailureThreshold {
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.policy.FailureThreshold {
+		b.openUntil = b.now().Add(b.policy.Cooldown)
+	}
+}
+
+// isBackendFailure reports whether or not the given response status means that the backend itself failed, rather than the request.
+func isBackendFailure(statusCode int) bool {
+	switch statusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backendCircuitBreakerHandler wraps the given backend proxy so that requests are not forwarded to the backend while the given breaker is open.
+//
+// Those requests fail immediately with a 503 status, so that aggregated responses omit the
+// backend without waiting on it. Websocket upgrade requests are passed through and not counted,
+// as their outcome is not reported in the response status, and neither are requests that the
+// client canceled. A nil breaker forwards every request.
+//
+// The breaker should wrap the proxy inside the backend's concurrency and timeout limits, so that
+// requests rejected by those limits are not counted as backend failures.
+func backendCircuitBreakerHandler(backendName string, b *circuitBreaker, h http.Handler) http.Handler {
+	if b == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ok, probe, retryAt := b.allow()
+		if !ok {
+			errorMsg := fmt.Sprintf("the backend %q is unavailable after repeated failures; it will be retried at %s", backendName, retryAt.Format(time.RFC3339))
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusServiceUnavailable)
+			return
+		}
+		sw := &statusRecordingResponseWriter{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if !completed || errors.Is(r.Context().Err(), context.Canceled) {
+				b.abandon(probe)
+				return
+			}
+			b.record(probe, isBackendFailure(sw.statusCode))
+		}()
+		h.ServeHTTP(sw, r)
+		completed = true
+	})
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackendCircuitBreaker(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker := newCircuitBreaker(CircuitBreakerPolicy{FailureThreshold: 3, Cooldown: time.Minute})
+	breaker.now = func() time.Time { return now }
+	backendStatus := http.StatusBadGateway
+	backendRequests := 0
+	h := backendCircuitBreakerHandler("remote", breaker, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests++
+		w.WriteHeader(backendStatus)
+	}))
+
+	testCases := []struct {
+		desc             string
+		advance          time.Duration
+		backendStatus    int
+		wantStatus       int
+		wantBackendCalls int
+	}{
+		{
+			desc:             "first failure",
+			backendStatus:    http.StatusBadGateway,
+			wantStatus:       http.StatusBadGateway,
+			wantBackendCalls: 1,
+		},
+		{
+			desc:             "request error resets the failures",
+			backendStatus:    http.StatusNotFound,
+			wantStatus:       http.StatusNotFound,
+			wantBackendCalls: 2,
+		},
+		{
+			desc:             "first consecutive failure",
+			backendStatus:    http.StatusGatewayTimeout,
+			wantStatus:       http.StatusGatewayTimeout,
+			wantBackendCalls: 3,
+		},
+		{
+			desc:             "second consecutive failure",
+			backendStatus:    http.StatusBadGateway,
+			wantStatus:       http.StatusBadGateway,
+			wantBackendCalls: 4,
+		},
+		{
+			desc:             "third consecutive failure opens the breaker",
+			backendStatus:    http.StatusBadGateway,
+			wantStatus:       http.StatusBadGateway,
+			wantBackendCalls: 5,
+		},
+		{
+			desc:             "open breaker",
+			backendStatus:    http.StatusOK,
+			wantStatus:       http.StatusServiceUnavailable,
+			wantBackendCalls: 5,
+		},
+		{
+			desc:             "open breaker before the cooldown elapses",
+			advance:          59 * time.Second,
+			backendStatus:    http.StatusOK,
+			wantStatus:       http.StatusServiceUnavailable,
+			wantBackendCalls: 5,
+		},
+		{
+			desc:             "failed probe after the cooldown reopens the breaker",
+			advance:          time.Second,
+			backendStatus:    http.StatusBadGateway,
+			wantStatus:       http.StatusBadGateway,
+			wantBackendCalls: 6,
+		},
+		{
+			desc:             "reopened breaker",
+			advance:          time.Second,
+			backendStatus:    http.StatusOK,
+			wantStatus:       http.StatusServiceUnavailable,
+			wantBackendCalls: 6,
+		},
+		{
+			desc:             "successful probe closes the breaker",
+			advance:          time.Minute,
+			backendStatus:    http.StatusOK,
+			wantStatus:       http.StatusOK,
+			wantBackendCalls: 7,
+		},
+		{
+			desc:             "closed breaker",
+			backendStatus:    http.StatusBadGateway,
+			wantStatus:       http.StatusBadGateway,
+			wantBackendCalls: 8,
+		},
+	}
+	for _, tc := range testCases {
+		now = now.Add(tc.advance)
+		backendStatus = tc.backendStatus
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernels", nil))
+		if got, want := rr.Code, tc.wantStatus; got != want {
+			t.Errorf("Unexpected response status for %q: got %d, want %d", tc.desc, got, want)
+		}
+		if got, want := backendRequests, tc.wantBackendCalls; got != want {
+			t.Errorf("Unexpected number of backend requests after %q: got %d, want %d", tc.desc, got, want)
+		}
+	}
+}
+
+func TestBackendCircuitBreakerCanceledRequests(t *testing.T) {
+	breaker := newCircuitBreaker(CircuitBreakerPolicy{FailureThreshold: 1, Cooldown: time.Minute})
+	h := backendCircuitBreakerHandler("remote", breaker, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The client hung up, so the proxy reports a bad gateway.
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernels", nil).WithContext(ctx))
+		if got, want := rr.Code, http.StatusBadGateway; got != want {
+			t.Errorf("Unexpected response status for canceled request %d: got %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker := newCircuitBreaker(CircuitBreakerPolicy{FailureThreshold: 1, Cooldown: time.Minute})
+	breaker.now = func() time.Time { return now }
+
+	// A request is allowed while the breaker is closed, and finishes after the breaker reopens and starts probing.
+	if ok, probe, _ := breaker.allow(); !ok || probe {
+		t.Fatalf("Unexpected result from a closed breaker: got (%t, %t), want (true, false)", ok, probe)
+	}
+	if ok, _, _ := breaker.allow(); !ok {
+		t.Fatalf("Unexpected rejection by a closed breaker")
+	}
+	breaker.record(false, true)
+	now = now.Add(time.Minute)
+	if ok, probe, _ := breaker.allow(); !ok || !probe {
+		t.Fatalf("Unexpected result once the cooldown elapsed: got (%t, %t), want (true, true)", ok, probe)
+	}
+	breaker.record(false, true)
+	if ok, _, _ := breaker.allow(); ok {
+		t.Errorf("Unexpected second probe while the first is in flight")
+	}
+	breaker.abandon(true)
+	if ok, probe, _ := breaker.allow(); !ok || !probe {
+		t.Errorf("Unexpected result once the probe was abandoned: got (%t, %t), want (true, true)", ok, probe)
+	}
+}
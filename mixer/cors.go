@@ -0,0 +1,202 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// corsPathPrefixes are the URL path prefixes of the API handlers that the CORS policy applies to.
+var corsPathPrefixes = []string{"/api/", "/mixer/"}
+
+var (
+	// defaultCORSMethods are the methods allowed for cross-origin requests when the CORS policy does not list any.
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete}
+	// defaultCORSHeaders are the request headers allowed for cross-origin requests when the CORS policy does not list any.
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "X-XSRFToken"}
+)
+
+// CORSPolicy controls which cross-origin frontends may call the mixer's API.
+//
+// The policy does not apply to websocket upgrade requests, whose origin is checked separately.
+type CORSPolicy struct {
+	// AllowedOrigins lists the origins, e.g. "https://app.example.com", that may call the API.
+	//
+	// The entry "*" allows every origin. If empty, then CORS is disabled and requests are
+	// served without any CORS headers.
+	AllowedOrigins []string
+	// AllowedMethods lists the methods that cross-origin requests may use.
+	//
+	// If empty, then GET, POST, PATCH, and DELETE are allowed.
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers that cross-origin requests may set.
+	//
+	// If empty, then "Authorization", "Content-Type", and "X-XSRFToken" are allowed.
+	AllowedHeaders []string
+	// AllowCredentials allows cross-origin requests to include cookies and other credentials.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the result of a preflight request.
+	//
+	// If zero, then the browser's default is used.
+	MaxAge time.Duration
+}
+
+// enabled reports whether or not the policy allows any cross-origin requests.
+func (p CORSPolicy) enabled() bool {
+	return len(p.AllowedOrigins) > 0
+}
+
+// allowsOrigin reports whether or not the given origin may call the API.
+func (p CORSPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// methods returns the methods that cross-origin requests may use.
+func (p CORSPolicy) methods() []string {
+	if len(p.AllowedMethods) == 0 {
+		return defaultCORSMethods
+	}
+	return p.AllowedMethods
+}
+
+// headers returns the request headers that cross-origin requests may set.
+func (p CORSPolicy) headers() []string {
+	if len(p.AllowedHeaders) == 0 {
+		return defaultCORSHeaders
+	}
+	return p.AllowedHeaders
+}
+
+// allowsMethod reports whether or not cross-origin requests may use the given method.
+func (p CORSPolicy) allowsMethod(method string) bool {
+	for _, allowed := range p.methods() {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether or not cross-origin requests may set every one of the given comma-separated request headers.
+func (p CORSPolicy) allowsHeaders(requested string) bool {
+	allowed := make(map[string]bool)
+	for _, name := range p.headers() {
+		allowed[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range strings.Split(requested, ",") {
+		if name = strings.TrimSpace(name); name != "" && !allowed[http.CanonicalHeaderKey(name)] {
+			return false
+		}
+	}
+	return true
+}
+
+// isCORSPreflight reports whether or not the given request is a CORS preflight request.
+func isCORSPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// corsApplies reports whether or not the mixer's CORS policy applies to the given request.
+func (m *Mixer) corsApplies(r *http.Request) bool {
+	if !m.opts.CORS.enabled() || websocket.IsWebSocketUpgrade(r) {
+		return false
+	}
+	for _, prefix := range corsPathPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCORSPreflight reports whether or not the given request is a CORS preflight request that the mixer answers itself.
+//
+// Browsers do not send credentials or custom headers with preflight requests, so these
+// should be passed to the mixer without checking for a token or an XSRF header.
+func (m *Mixer) IsCORSPreflight(r *http.Request) bool {
+	return isCORSPreflight(r) && m.corsApplies(r)
+}
+
+// isSameOrigin reports whether or not the given origin is the host that the request was sent to.
+//
+// Browsers also send the `Origin` header with some same-origin requests, and those are not subject to the CORS policy.
+func (m *Mixer) isSameOrigin(r *http.Request, origin string) bool {
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return originURL.Host == r.Host || (m.opts.ExternalHostname != "" && originURL.Host == m.opts.ExternalHostname)
+}
+
+// corsHandler wraps the given handler so that the API can be called by the cross-origin frontends allowed by the mixer's CORS policy.
+//
+// Preflight requests are answered directly, and requests from origins that are not allowed are
+// rejected with a 403 status without being forwarded to any backend. Same-origin requests and
+// websocket upgrade requests are passed through unmodified.
+func (m *Mixer) corsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !m.corsApplies(r) || m.isSameOrigin(r, origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		policy := m.opts.CORS
+		w.Header().Add("Vary", "Origin")
+		if !policy.allowsOrigin(origin) {
+			errorMsg := fmt.Sprintf("cross-origin requests from %q are not allowed", origin)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if policy.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !isCORSPreflight(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		requestedMethod := r.Header.Get("Access-Control-Request-Method")
+		requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+		if !policy.allowsMethod(requestedMethod) || !policy.allowsHeaders(requestedHeaders) {
+			errorMsg := fmt.Sprintf("cross-origin %s requests with the headers %q are not allowed", requestedMethod, requestedHeaders)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.methods(), ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.headers(), ", "))
+		if policy.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
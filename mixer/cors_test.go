@@ -0,0 +1,145 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{
+		CORS: CORSPolicy{
+			AllowedOrigins:   []string{"https://app.example.com"},
+			AllowedMethods:   []string{http.MethodGet, http.MethodPost},
+			AllowedHeaders:   []string{"Content-Type", "X-XSRFToken"},
+			AllowCredentials: true,
+			MaxAge:           time.Hour,
+		},
+	})
+	testCases := []struct {
+		desc        string
+		method      string
+		path        string
+		header      map[string]string
+		wantStatus  int
+		wantHeaders map[string]string
+	}{
+		{
+			desc:   "preflight from an allowed origin",
+			method: http.MethodOptions,
+			path:   "/api/kernels",
+			header: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  http.MethodPost,
+				"Access-Control-Request-Headers": "content-type",
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Methods":     "GET, POST",
+				"Access-Control-Allow-Headers":     "Content-Type, X-XSRFToken",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "3600",
+			},
+		},
+		{
+			desc:   "preflight from a disallowed origin",
+			method: http.MethodOptions,
+			path:   "/api/kernels",
+			header: map[string]string{
+				"Origin":                        "https://evil.example.com",
+				"Access-Control-Request-Method": http.MethodPost,
+			},
+			wantStatus: http.StatusForbidden,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+		{
+			desc:   "preflight for a disallowed method",
+			method: http.MethodOptions,
+			path:   "/api/kernels",
+			header: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": http.MethodDelete,
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			desc:       "request from an allowed origin",
+			method:     http.MethodGet,
+			path:       "/api/kernels",
+			header:     map[string]string{"Origin": "https://app.example.com"},
+			wantStatus: http.StatusOK,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		{
+			desc:       "request from a disallowed origin",
+			method:     http.MethodGet,
+			path:       "/api/kernels",
+			header:     map[string]string{"Origin": "https://evil.example.com"},
+			wantStatus: http.StatusForbidden,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+		{
+			desc:       "same-origin request",
+			method:     http.MethodGet,
+			path:       "/api/kernels",
+			header:     map[string]string{"Origin": "http://example.com"},
+			wantStatus: http.StatusOK,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+		{
+			desc:   "websocket upgrade is not subject to CORS",
+			method: http.MethodGet,
+			path:   "/api/kernels/kernel1/channels",
+			header: map[string]string{
+				"Origin":     "https://evil.example.com",
+				"Connection": "Upgrade",
+				"Upgrade":    "websocket",
+			},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			for key, val := range tc.header {
+				req.Header.Set(key, val)
+			}
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, req)
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Errorf("unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+			for key, want := range tc.wantHeaders {
+				if got := rr.Header().Get(key); got != want {
+					t.Errorf("unexpected %q header: got %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+)
+
+const (
+	// DefaultDiscoveryInterval is the default time between runs of backend discovery.
+	DefaultDiscoveryInterval = time.Minute
+	// DefaultDiscoveryJitter is the default fraction of the discovery interval that is randomly added to each wait.
+	DefaultDiscoveryJitter = 0.1
+)
+
+// Discovery finds the backends that the mixer routes to, e.g. the Dataproc clusters and sessions available to the user.
+type Discovery interface {
+	// DiscoverBackends returns the complete set of backends, including the local one.
+	DiscoverBackends(ctx context.Context) ([]*backends.Backend, error)
+}
+
+// DiscoveryFunc adapts a function to the Discovery interface.
+type DiscoveryFunc func(ctx context.Context) ([]*backends.Backend, error)
+
+// DiscoverBackends implements the Discovery interface.
+func (f DiscoveryFunc) DiscoverBackends(ctx context.Context) ([]*backends.Backend, error) {
+	return f(ctx)
+}
+
+// discoveryWait returns how long to wait before the next run of backend discovery.
+//
+// Each wait is chosen uniformly between the interval and the interval plus its jitter
+// fraction, so that many mixers started together do not poll in lockstep.
+func (opts MixerOptions) discoveryWait() time.Duration {
+	interval := opts.DiscoveryInterval
+	if interval <= 0 {
+		interval = DefaultDiscoveryInterval
+	}
+	jitter := opts.DiscoveryJitter
+	if jitter <= 0 {
+		jitter = DefaultDiscoveryJitter
+	}
+	return interval + time.Duration(rand.Float64()*jitter*float64(interval))
+}
+
+// discoverBackends runs backend discovery once, and swaps in the discovered backends if it succeeds.
+//
+// The mixer's own local backend is always kept first, replacing any discovered backend with the
+// same name, as the handlers treat the first backend as the local one. If discovery fails or
+// finds no backends, then the current backends are kept.
+func (m *Mixer) discoverBackends(ctx context.Context) {
+	bs, err := m.opts.Discovery.DiscoverBackends(ctx)
+	if err != nil {
+		log.Printf("Failure discovering the backends; keeping the current ones: %v", err)
+		return
+	}
+	if len(bs) == 0 {
+		log.Printf("Backend discovery found no backends; keeping the current ones")
+		return
+	}
+	discovered := []*backends.Backend{m.localBackend}
+	for _, b := range bs {
+		if b.Name() != m.localBackend.Name() {
+			discovered = append(discovered, b)
+		}
+	}
+	m.router.set(discovered)
+}
+
+// RunDiscovery periodically re-runs the mixer's backend discovery until the given context is done.
+//
+// The discovered backends replace the ones the mixer routes to, so that new backends become
+// routable without restarting the mixer. This does nothing if the mixer has no Discovery or is LocalOnly.
+func (m *Mixer) RunDiscovery(ctx context.Context) {
+	if m.opts.Discovery == nil || m.opts.LocalOnly {
+		return
+	}
+	for {
+		timer := time.NewTimer(m.opts.discoveryWait())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		m.discoverBackends(ctx)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+)
+
+func TestRunDiscovery(t *testing.T) {
+	local := (&fakeBackend{name: "local", specs: localKernelSpecs}).backend()
+	cluster := (&fakeBackend{name: "cluster", specs: remoteKernelSpecs}).backend()
+	var mu sync.Mutex
+	polls := 0
+	discovery := DiscoveryFunc(func(ctx context.Context) ([]*backends.Backend, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		polls++
+		if polls < 2 {
+			return []*backends.Backend{local}, nil
+		}
+		return []*backends.Backend{local, cluster}, nil
+	})
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{
+		Discovery:         discovery,
+		DiscoveryInterval: time.Millisecond,
+	})
+	m.router = newRouter(local)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.RunDiscovery(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// Route concurrently with discovery, as requests would.
+		resolution, err := m.ResolveStart(context.Background(), &resources.Kernel{SpecID: "cluster-pyspark"})
+		if err == nil {
+			if got, want := resolution.Backend, "cluster"; got != want {
+				t.Errorf("Unexpected backend for a discovered kernelspec: got %q, want %q", got, want)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The discovered backend did not become routable: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RunDiscovery did not stop after its context was cancelled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if polls < 2 {
+		t.Errorf("Unexpected number of discovery polls: got %d, want at least 2", polls)
+	}
+}
+
+func TestDiscoveredKernelSpecs(t *testing.T) {
+	local := (&fakeBackend{name: "local", specs: localKernelSpecs}).backend()
+	remote := (&fakeBackend{name: "remote", specs: remoteKernelSpecs}).backend()
+	cluster := (&fakeBackend{name: "cluster", specs: remoteKernelSpecs}).backend()
+	discovery := DiscoveryFunc(func(ctx context.Context) ([]*backends.Backend, error) {
+		return []*backends.Backend{local, cluster}, nil
+	})
+	m := newMixer(local, remote, MixerOptions{
+		Discovery:         discovery,
+		DiscoveryInterval: time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.RunDiscovery(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernelspecs", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Unexpected status listing the kernelspecs: got %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+		var ks resources.KernelSpecs
+		if err := json.Unmarshal(rr.Body.Bytes(), &ks); err != nil {
+			t.Fatalf("Failure parsing the kernelspecs %q: %v", rr.Body.String(), err)
+		}
+		if _, ok := ks.KernelSpecs["cluster-pyspark"]; ok {
+			if _, ok := ks.KernelSpecs["remote-pyspark"]; ok {
+				t.Errorf("Unexpected kernelspec from a backend that is no longer discovered: %v", ks.KernelSpecs)
+			}
+			if _, ok := ks.KernelSpecs["local-python3"]; !ok {
+				t.Errorf("Missing the local kernelspec after discovery: %v", ks.KernelSpecs)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The discovered backend's kernelspecs were not listed: %v", ks.KernelSpecs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
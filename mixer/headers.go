@@ -0,0 +1,217 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// xsrfCookieName is the name of the cookie in which Jupyter servers issue their XSRF token.
+	xsrfCookieName = "_xsrf"
+	// xsrfHeader is the request header in which Jupyter servers expect the XSRF token for mutating requests.
+	xsrfHeader = "X-XSRFToken"
+)
+
+// upgradeHeaders are the headers that are always forwarded, as they are needed to proxy websocket upgrade requests.
+//
+// These include the `Sec-Websocket-Extensions` header, so that extensions such as
+// `permessage-deflate` are negotiated end-to-end between the frontend and the backend.
+var upgradeHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+}
+
+// HeaderPolicy controls which request headers are forwarded to a backend.
+//
+// The policy is applied to every request forwarded to the backend, including websocket upgrade requests.
+type HeaderPolicy struct {
+	// Allow lists the request headers that are forwarded to the backend.
+	//
+	// If empty, then all request headers are forwarded. The headers needed to proxy
+	// websocket upgrade requests, and the request's XSRF cookie and header, are always
+	// forwarded. The remote backend's authorization
+	// from the mixer's TokenSource is added after the policy is applied, so it is always sent.
+	Allow []string
+	// Strip lists the request headers that are removed before forwarding to the backend.
+	//
+	// The headers needed to proxy websocket upgrade requests cannot be listed. If the
+	// "Cookie" header is removed, then its XSRF cookie is still forwarded along with the
+	// request's XSRF header, so that the backend can check one against the other.
+	Strip []string
+	// Inject holds the headers that are set on every request forwarded to the backend.
+	//
+	// These replace any values of the same headers in the incoming request.
+	Inject map[string]string
+}
+
+// DefaultRemoteHeaderPolicy returns the header policy for the remote backend when none is configured.
+//
+// It strips the user's credentials for the mixer, i.e. its cookies and authorization, so that
+// they are not sent to the remote backend, which is authorized by the mixer's TokenSource instead.
+func DefaultRemoteHeaderPolicy() HeaderPolicy {
+	return HeaderPolicy{Strip: []string{"Cookie", "Authorization"}}
+}
+
+// isEmpty reports whether or not the policy forwards every request header unmodified.
+func (p HeaderPolicy) isEmpty() bool {
+	return len(p.Allow) == 0 && len(p.Strip) == 0 && len(p.Inject) == 0
+}
+
+// validate reports an error if the policy would remove a header that is needed to proxy websocket upgrade requests.
+func (p HeaderPolicy) validate() error {
+	for _, name := range p.Strip {
+		for _, required := range upgradeHeaders {
+			if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(required) {
+				return fmt.Errorf("the header %q is needed to proxy websocket upgrade requests and cannot be stripped", name)
+			}
+		}
+	}
+	return nil
+}
+
+// apply modifies the given request headers according to the policy.
+func (p HeaderPolicy) apply(h http.Header) {
+	xsrfCookie, xsrfErr := (&http.Request{Header: h}).Cookie(xsrfCookieName)
+	xsrfToken := h.Get(xsrfHeader)
+	required := make(map[string]bool)
+	for _, name := range upgradeHeaders {
+		required[name] = true
+	}
+	if len(p.Allow) > 0 {
+		allowed := make(map[string]bool)
+		for _, name := range p.Allow {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+		for name := range h {
+			if key := http.CanonicalHeaderKey(name); !allowed[key] && !required[key] {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range p.Strip {
+		if !required[http.CanonicalHeaderKey(name)] {
+			h.Del(name)
+		}
+	}
+	if xsrfErr == nil && h.Get("Cookie") == "" {
+		h.Set("Cookie", xsrfCookie.String())
+	}
+	if xsrfErr == nil && xsrfToken != "" && h.Get(xsrfHeader) == "" {
+		h.Set(xsrfHeader, xsrfToken)
+	}
+	for name, val := range p.Inject {
+		h.Set(name, val)
+	}
+}
+
+// userAgentProduct is the product name that identifies the mixer in the User-Agent of the requests it forwards.
+const userAgentProduct = "notebook-kernels-mixer"
+
+// DefaultUserAgent returns the User-Agent product token that the mixer adds to forwarded requests by default, e.g. "notebook-kernels-mixer/v1.2.3".
+//
+// The version is that of the mixer's module in the running binary, or "devel" if it was not built from a released version.
+func DefaultUserAgent() string {
+	version := "devel"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		modules := append([]*debug.Module{&info.Main}, info.Deps...)
+		for _, m := range modules {
+			if m != nil && m.Path == "github.com/GoogleCloudPlatform/notebook-kernels-mixer" && m.Version != "" && m.Version != "(devel)" {
+				version = m.Version
+			}
+		}
+	}
+	return userAgentProduct + "/" + version
+}
+
+// addUserAgent adds the given product token to the User-Agent of the given request headers.
+//
+// The token is appended to any agent sent by the client, so that backends can tell both who
+// made the request and that it was forwarded by the mixer.
+func addUserAgent(h http.Header, agent string) {
+	existing := strings.TrimSpace(h.Get("User-Agent"))
+	switch {
+	case existing == "":
+		h.Set("User-Agent", agent)
+	case !strings.Contains(existing, agent):
+		h.Set("User-Agent", existing+" "+agent)
+	}
+}
+
+const (
+	// backendHeader is the debug response header naming the backend that served a proxied request.
+	backendHeader = "X-Mixer-Backend"
+	// backendLatencyHeader is the debug response header reporting how long the backend took to respond to a proxied request.
+	backendLatencyHeader = "X-Mixer-Backend-Latency"
+)
+
+// backendDebugResponseWriter adds the backend debug headers to a response when its header is written.
+type backendDebugResponseWriter struct {
+	http.ResponseWriter
+	backendName string
+	start       time.Time
+	wroteHeader bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface
+func (w *backendDebugResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(backendHeader, w.backendName)
+		w.Header().Set(backendLatencyHeader, time.Since(w.start).String())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface
+func (w *backendDebugResponseWriter) Write(bs []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(bs)
+}
+
+// Flush implements the http.Flusher interface
+func (w *backendDebugResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// backendDebugHandler wraps the given backend proxy so that its responses report the backend's name and latency.
+//
+// The latency is measured until the backend's response headers are received. Websocket
+// upgrade requests are passed through unmodified.
+func backendDebugHandler(backendName string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&backendDebugResponseWriter{ResponseWriter: w, backendName: backendName, start: time.Now()}, r)
+	})
+}
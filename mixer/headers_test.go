@@ -0,0 +1,389 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Failure parsing the test server URL %q: %v", server.URL, err)
+	}
+	opts := MixerOptions{
+		RemoteHeaderPolicy: HeaderPolicy{
+			Strip:  []string{"Cookie"},
+			Inject: map[string]string{"Authorization": "Bearer remote-token"},
+		},
+	}
+	local := newLocalBackend(serverURL, opts)
+	remote := newRemoteBackend(serverURL, opts)
+	testCases := []struct {
+		desc    string
+		handler http.Handler
+		upgrade bool
+		want    map[string]string
+	}{
+		{
+			desc:    "Local HTTP request",
+			handler: local,
+			want:    map[string]string{"Cookie": "session=secret; _xsrf=token", "Authorization": "Bearer user-token", "X-Custom": "custom"},
+		},
+		{
+			desc:    "Local websocket request",
+			handler: local,
+			upgrade: true,
+			want:    map[string]string{"Cookie": "session=secret; _xsrf=token", "Authorization": "Bearer user-token", "X-Custom": "custom"},
+		},
+		{
+			desc:    "Remote HTTP request",
+			handler: remote,
+			want:    map[string]string{"Cookie": "_xsrf=token", "Authorization": "Bearer remote-token", "X-Custom": "custom"},
+		},
+		{
+			desc:    "Remote websocket request",
+			handler: remote,
+			upgrade: true,
+			want:    map[string]string{"Cookie": "_xsrf=token", "Authorization": "Bearer remote-token", "X-Custom": "custom", "Upgrade": "websocket"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/kernels", nil)
+			r.Header.Set("Cookie", "session=secret; _xsrf=token")
+			r.Header.Set("Authorization", "Bearer user-token")
+			r.Header.Set("X-Custom", "custom")
+			if tc.upgrade {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			}
+			tc.handler.ServeHTTP(httptest.NewRecorder(), r)
+			got := <-received
+			for name, want := range tc.want {
+				if got := got.Get(name); got != want {
+					t.Errorf("Unexpected value for the forwarded header %q: got %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultRemoteHeaderPolicy(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Failure parsing the test server URL %q: %v", server.URL, err)
+	}
+	testCases := []struct {
+		desc string
+		opts MixerOptions
+		want map[string]string
+	}{
+		{
+			desc: "Without a token source",
+			want: map[string]string{"Cookie": "_xsrf=token", "Authorization": "", "X-Custom": "custom"},
+		},
+		{
+			desc: "With a token source",
+			opts: MixerOptions{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "mixer-token"})},
+			want: map[string]string{"Cookie": "_xsrf=token", "Authorization": "Bearer mixer-token", "X-Custom": "custom"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/kernels", nil)
+			r.Header.Set("Cookie", "session=secret; _xsrf=token")
+			r.Header.Set("Authorization", "Bearer user-token")
+			r.Header.Set("X-Custom", "custom")
+			newRemoteBackend(serverURL, tc.opts).ServeHTTP(httptest.NewRecorder(), r)
+			got := <-received
+			for name, want := range tc.want {
+				if got := got.Get(name); got != want {
+					t.Errorf("Unexpected value for the forwarded header %q: got %q, want %q", name, got, want)
+				}
+			}
+			if got := r.Header.Get("Authorization"); got != "Bearer user-token" {
+				t.Errorf("Unexpected modification of the incoming request's authorization: got %q", got)
+			}
+		})
+	}
+}
+
+func TestHeaderPolicyAllow(t *testing.T) {
+	p := HeaderPolicy{
+		Allow:  []string{"authorization"},
+		Inject: map[string]string{"X-Injected": "injected"},
+	}
+	h := http.Header{}
+	h.Set("Authorization", "Bearer token")
+	h.Set("Cookie", "session=secret; _xsrf=token")
+	h.Set("X-XSRFToken", "token")
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "websocket")
+	p.apply(h)
+	want := http.Header{
+		"Authorization": []string{"Bearer token"},
+		"Connection":    []string{"Upgrade"},
+		"Cookie":        []string{"_xsrf=token"},
+		"Upgrade":       []string{"websocket"},
+		"X-Injected":    []string{"injected"},
+		"X-Xsrftoken":   []string{"token"},
+	}
+	if len(h) != len(want) {
+		t.Errorf("Unexpected headers after applying the policy: got %v, want %v", h, want)
+	}
+	for name := range want {
+		if got, want := h.Get(name), want.Get(name); got != want {
+			t.Errorf("Unexpected value for the header %q: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestForwardedXSRFToken(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case kernelspecs.APIPath:
+			w.Write([]byte(`{"default":"python3","kernelspecs":{}}`))
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer local.Close()
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == kernelspecs.APIPath:
+			w.Write([]byte(`{"default":"pyspark","kernelspecs":{"pyspark":{"name":"pyspark","spec":{"language":"python","display_name":"PySpark"},"resources":{}}}}`))
+		case r.Method == http.MethodPost && r.URL.Path == kernels.APIPath:
+			if err := util.CheckXSRF(r); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"kernel1","name":"pyspark"}`))
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer remote.Close()
+	testCases := []struct {
+		desc   string
+		policy HeaderPolicy
+	}{
+		{
+			desc: "Default remote policy",
+		},
+		{
+			desc:   "Allowed headers that omit the XSRF header",
+			policy: HeaderPolicy{Allow: []string{"Content-Type"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m, err := NewMixer(MixerOptions{LocalBackendURL: local.URL, RemoteBackendURL: remote.URL, RemoteHeaderPolicy: tc.policy})
+			if err != nil {
+				t.Fatalf("Failure creating the mixer: %v", err)
+			}
+			req := httptest.NewRequest(http.MethodPost, kernels.APIPath, strings.NewReader(`{"name":"remote-pyspark"}`))
+			req.Header.Set("Cookie", "session=secret; _xsrf=token")
+			req.Header.Set("X-XSRFToken", "token")
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, req)
+			if got, want := rr.Code, http.StatusCreated; got != want {
+				t.Errorf("Unexpected response status starting a remote kernel: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHeaderPolicyValidate(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		opts    MixerOptions
+		wantErr bool
+	}{
+		{
+			desc: "Strip credentials",
+			opts: MixerOptions{RemoteHeaderPolicy: HeaderPolicy{Strip: []string{"Cookie", "Authorization"}}},
+		},
+		{
+			desc:    "Strip an upgrade header from the local backend",
+			opts:    MixerOptions{LocalHeaderPolicy: HeaderPolicy{Strip: []string{"upgrade"}}},
+			wantErr: true,
+		},
+		{
+			desc:    "Strip a websocket header from the remote backend",
+			opts:    MixerOptions{RemoteHeaderPolicy: HeaderPolicy{Strip: []string{"Sec-WebSocket-Protocol"}}},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tc.opts.LocalBackendURL = "http://localhost:8082"
+			tc.opts.LocalOnly = true
+			err := tc.opts.Validate()
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("Unexpected error from Validate(): got %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDebugBackendHeaders(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer local.Close()
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer remote.Close()
+	testCases := []struct {
+		desc        string
+		debug       bool
+		wantBackend string
+	}{
+		{
+			desc: "debug headers disabled",
+		},
+		{
+			desc:        "debug headers enabled",
+			debug:       true,
+			wantBackend: "local",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m, err := NewMixer(MixerOptions{
+				LocalBackendURL:     local.URL,
+				RemoteBackendURL:    remote.URL,
+				DebugBackendHeaders: tc.debug,
+			})
+			if err != nil {
+				t.Fatalf("failure creating the mixer: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/lab", nil))
+			if got, want := rr.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response status: got %d, want %d", got, want)
+			}
+			if got, want := rr.Header().Get(backendHeader), tc.wantBackend; got != want {
+				t.Errorf("unexpected %s header: got %q, want %q", backendHeader, got, want)
+			}
+			latency := rr.Header().Get(backendLatencyHeader)
+			if !tc.debug {
+				if latency != "" {
+					t.Errorf("unexpected %s header: got %q, want none", backendLatencyHeader, latency)
+				}
+				return
+			}
+			if _, err := time.ParseDuration(latency); err != nil {
+				t.Errorf("malformed %s header %q: %v", backendLatencyHeader, latency, err)
+			}
+		})
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Failure parsing the test server URL %q: %v", server.URL, err)
+	}
+	testCases := []struct {
+		desc        string
+		userAgent   string
+		remote      bool
+		clientAgent string
+		want        string
+	}{
+		{
+			desc: "Default agent without a client agent",
+			want: DefaultUserAgent(),
+		},
+		{
+			desc:        "Default agent appended to the client agent",
+			clientAgent: "Mozilla/5.0",
+			want:        "Mozilla/5.0 " + DefaultUserAgent(),
+		},
+		{
+			desc:        "Configured agent on the local backend",
+			userAgent:   "test-mixer/1.0",
+			clientAgent: "Mozilla/5.0",
+			want:        "Mozilla/5.0 test-mixer/1.0",
+		},
+		{
+			desc:        "Configured agent on the remote backend",
+			userAgent:   "test-mixer/1.0",
+			remote:      true,
+			clientAgent: "Mozilla/5.0",
+			want:        "Mozilla/5.0 test-mixer/1.0",
+		},
+		{
+			desc:        "Agent already forwarded by the mixer",
+			userAgent:   "test-mixer/1.0",
+			clientAgent: "Mozilla/5.0 test-mixer/1.0",
+			want:        "Mozilla/5.0 test-mixer/1.0",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := MixerOptions{UserAgent: tc.userAgent}
+			var handler http.Handler = newLocalBackend(serverURL, opts)
+			if tc.remote {
+				handler = newRemoteBackend(serverURL, opts)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/api/kernels", nil)
+			if tc.clientAgent != "" {
+				r.Header.Set("User-Agent", tc.clientAgent)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got := <-received; got != tc.want {
+				t.Errorf("Unexpected forwarded User-Agent: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+	if got, want := DefaultUserAgent(), userAgentProduct+"/"; !strings.HasPrefix(got, want) {
+		t.Errorf("Unexpected default User-Agent: got %q, want a %q prefix", got, want)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// userIdentityHeader is the request header holding the identity of the authenticated user, as set by the authenticating proxy in front of the mixer.
+//
+// Clients can set this header themselves, so it is only trusted on requests received from one of the configured TrustedProxies.
+const userIdentityHeader = "X-Goog-Authenticated-User-Email"
+
+// parseTrustedProxies parses the given IP addresses and CIDR ranges of trusted proxies.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("malformed trusted proxy address %q", proxy)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("malformed trusted proxy range %q: %w", proxy, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// fromTrustedProxy reports whether or not the given request was received from one of the configured trusted proxies.
+func (m *Mixer) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range m.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// userIdentity returns the verified identity of the authenticated user that sent the given request.
+//
+// If the mixer has no Identity func, then the identity is read from the userIdentityHeader, but only
+// when the request was received from a trusted proxy. Requests whose identity cannot be verified
+// result in an error with a 401 status, so that callers fail closed.
+func (m *Mixer) userIdentity(r *http.Request) (string, error) {
+	if m.opts.Identity != nil {
+		return m.opts.Identity(r)
+	}
+	if !m.fromTrustedProxy(r) {
+		return "", fmt.Errorf("the request was not received from a trusted proxy, so the identity of its user cannot be verified: %w", util.HTTPError(http.StatusUnauthorized))
+	}
+	identity := r.Header.Get(userIdentityHeader)
+	if identity == "" {
+		return "", fmt.Errorf("the request has no %q header: %w", userIdentityHeader, util.HTTPError(http.StatusUnauthorized))
+	}
+	return identity, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// testProxyAddress is the remote address of the requests built by httptest.NewRequest.
+const testProxyAddress = "192.0.2.1"
+
+func TestUserIdentity(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		opts       MixerOptions
+		remoteAddr string
+		identity   string
+		want       string
+		wantStatus int
+	}{
+		{
+			desc:       "Header from a trusted proxy",
+			opts:       MixerOptions{TrustedProxies: []string{testProxyAddress}},
+			identity:   "alice@example.com",
+			want:       "alice@example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			desc:       "Header from a trusted range",
+			opts:       MixerOptions{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.1.2.3:4567",
+			identity:   "alice@example.com",
+			want:       "alice@example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			desc:       "Spoofed header from an untrusted address",
+			opts:       MixerOptions{TrustedProxies: []string{"10.0.0.0/8"}},
+			identity:   "admin@example.com",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:       "Header without trusted proxies",
+			identity:   "admin@example.com",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:       "Trusted proxy without the header",
+			opts:       MixerOptions{TrustedProxies: []string{testProxyAddress}},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			desc: "Identity func ignores the header",
+			opts: MixerOptions{
+				TrustedProxies: []string{testProxyAddress},
+				Identity: func(*http.Request) (string, error) {
+					return "bob@example.com", nil
+				},
+			},
+			identity:   "alice@example.com",
+			want:       "bob@example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			desc: "Identity func failure",
+			opts: MixerOptions{
+				Identity: func(*http.Request) (string, error) {
+					return "", fmt.Errorf("no credentials: %w", util.HTTPError(http.StatusUnauthorized))
+				},
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), tc.opts)
+			r := httptest.NewRequest(http.MethodGet, "/api/kernels", nil)
+			if tc.remoteAddr != "" {
+				r.RemoteAddr = tc.remoteAddr
+			}
+			if tc.identity != "" {
+				r.Header.Set(userIdentityHeader, tc.identity)
+			}
+			got, err := m.userIdentity(r)
+			if gotStatus := util.HTTPStatusCode(err); gotStatus != tc.wantStatus {
+				t.Fatalf("Unexpected status identifying the user: got %d, want %d: %v", gotStatus, tc.wantStatus, err)
+			}
+			if got != tc.want {
+				t.Errorf("Unexpected identity: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	for _, proxy := range []string{"not-an-address", "10.0.0.0/99"} {
+		opts := MixerOptions{LocalOnly: true, TrustedProxies: []string{proxy}}
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Unexpected success validating the trusted proxy %q", proxy)
+		}
+	}
+}
+
+func TestForwardedRequestsOmitIdentity(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Failure parsing the test server URL %q: %v", server.URL, err)
+	}
+	testCases := []struct {
+		desc    string
+		backend *backends.Backend
+	}{
+		{
+			desc:    "Local backend",
+			backend: newLocalBackend(serverURL, MixerOptions{}),
+		},
+		{
+			desc:    "Remote backend",
+			backend: newRemoteBackend(serverURL, MixerOptions{}),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/kernels", nil)
+			r.Header.Set(userIdentityHeader, "alice@example.com")
+			tc.backend.ServeHTTP(httptest.NewRecorder(), r)
+			if got := (<-received).Get(userIdentityHeader); got != "" {
+				t.Errorf("Unexpected identity header forwarded to the backend: %q", got)
+			}
+		})
+	}
+}
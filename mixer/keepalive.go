@@ -0,0 +1,179 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// frameTracker follows the websocket frames written to a connection, so that control frames can be interleaved between them.
+type frameTracker struct {
+	// header holds the bytes of a partially written frame header.
+	header []byte
+	// remaining is the number of payload bytes of the current frame that have not been written yet.
+	remaining uint64
+}
+
+// frameHeaderSize returns the size of the frame header that starts with the given bytes, or false if not enough bytes are available to tell.
+func frameHeaderSize(header []byte) (int, bool) {
+	if len(header) < 2 {
+		return 0, false
+	}
+	size := 2
+	switch header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+	return size, true
+}
+
+// framePayloadLength returns the payload length encoded in the given complete frame header.
+func framePayloadLength(header []byte) uint64 {
+	switch length := header[1] & 0x7f; length {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:10])
+	default:
+		return uint64(length)
+	}
+}
+
+// write records that the given bytes were written to the connection.
+func (t *frameTracker) write(bs []byte) {
+	for len(bs) > 0 {
+		if t.remaining > 0 {
+			n := t.remaining
+			if n > uint64(len(bs)) {
+				n = uint64(len(bs))
+			}
+			bs = bs[n:]
+			t.remaining -= n
+			continue
+		}
+		t.header = append(t.header, bs[0])
+		bs = bs[1:]
+		if size, ok := frameHeaderSize(t.header); ok && len(t.header) == size {
+			t.remaining = framePayloadLength(t.header)
+			t.header = t.header[:0]
+		}
+	}
+}
+
+// atFrameBoundary reports whether or not the last frame written to the connection is complete.
+func (t *frameTracker) atFrameBoundary() bool {
+	return len(t.header) == 0 && t.remaining == 0
+}
+
+// pingFrame returns a masked ping frame with an empty payload, as sent by a websocket client.
+func pingFrame() []byte {
+	frame := []byte{0x89, 0x80, 0, 0, 0, 0}
+	rand.Read(frame[2:])
+	return frame
+}
+
+// keepaliveConn wraps the upgraded connection to a backend so that ping frames are periodically sent on it.
+//
+// Pings are only written between the frames forwarded from the frontend, so they never split a frame.
+// The backend's pongs are forwarded to the frontend, which ignores them as unsolicited pongs.
+type keepaliveConn struct {
+	io.ReadWriteCloser
+
+	// mu serializes writes to the connection.
+	mu      sync.Mutex
+	tracker frameTracker
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newKeepaliveConn wraps the given backend connection and starts sending pings on it at the given interval until it is closed.
+func newKeepaliveConn(conn io.ReadWriteCloser, interval time.Duration) *keepaliveConn {
+	c := &keepaliveConn{
+		ReadWriteCloser: conn,
+		done:            make(chan struct{}),
+	}
+	go c.ping(interval)
+	return c
+}
+
+// Write implements the io.Writer interface
+func (c *keepaliveConn) Write(bs []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.ReadWriteCloser.Write(bs)
+	c.tracker.write(bs[:n])
+	return n, err
+}
+
+// Close implements the io.Closer interface
+func (c *keepaliveConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.ReadWriteCloser.Close()
+}
+
+// ping sends a ping frame at each tick of the given interval until the connection is closed or a write fails.
+//
+// If a frame from the frontend is partially written at a tick, then that ping is skipped.
+func (c *keepaliveConn) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		var err error
+		if c.tracker.atFrameBoundary() {
+			_, err = c.ReadWriteCloser.Write(pingFrame())
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// keepaliveModifyResponse returns a reverse proxy response modifier that sends pings at the given interval on upgraded websocket connections.
+//
+// If the interval is not positive, then nil is returned and no pings are sent.
+func keepaliveModifyResponse(interval time.Duration) func(*http.Response) error {
+	if interval <= 0 {
+		return nil
+	}
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			return nil
+		}
+		if conn, ok := resp.Body.(io.ReadWriteCloser); ok {
+			resp.Body = newKeepaliveConn(conn, interval)
+		}
+		return nil
+	}
+}
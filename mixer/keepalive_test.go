@@ -0,0 +1,115 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketPingKeepalive(t *testing.T) {
+	var upgrader websocket.Upgrader
+	var pings int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case kernels.APIPath:
+			w.Write([]byte(`[{"id":"kernel1","name":"python3"}]`))
+		case kernels.APIPath + "/kernel1/channels":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.SetPingHandler(func(data string) error {
+				atomic.AddInt32(&pings, 1)
+				return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			})
+			for {
+				msgType, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				conn.WriteMessage(msgType, msg)
+			}
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer local.Close()
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusBadGateway)
+	}))
+	defer remote.Close()
+	m, err := NewMixer(MixerOptions{
+		LocalBackendURL:       local.URL,
+		RemoteBackendURL:      remote.URL,
+		WebSocketPingInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failure creating the mixer: %v", err)
+	}
+	mixerServer := httptest.NewServer(m)
+	defer mixerServer.Close()
+	listResp, err := http.Get(mixerServer.URL + kernels.APIPath)
+	if err != nil {
+		t.Fatalf("failure listing the kernels: %v", err)
+	}
+	listResp.Body.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(mixerServer.URL, "http") + kernels.APIPath + "/kernel1/channels"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("failure connecting to the kernel: %v", err)
+	}
+	defer conn.Close()
+
+	// Keep sending messages, including ones large enough to be written in several pieces, so that
+	// the pings are interleaved with the forwarded frames.
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for i := 0; time.Now().Before(deadline); i++ {
+		msg := strings.Repeat("x", i%3*40000+i)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("failure sending a message: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failure reading a message: %v", err)
+		}
+		if string(got) != msg {
+			t.Fatalf("unexpected echoed message: got %d bytes, want %d bytes", len(got), len(msg))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := atomic.LoadInt32(&pings), int32(5); got < want {
+		t.Errorf("unexpected number of pings received by the backend: got %d, want at least %d", got, want)
+	}
+
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	before := atomic.LoadInt32(&pings)
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&pings); after != before {
+		t.Errorf("unexpected pings after the frontend closed the connection: got %d more", after-before)
+	}
+}
@@ -0,0 +1,912 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// dryRunParam is the query parameter that requests a dry run of a kernel start.
+const dryRunParam = "dryRun"
+
+// StartResolution describes how a request to start a kernel would be routed.
+type StartResolution struct {
+	// SpecID is the unified ID of the requested kernelspec.
+	SpecID string `json:"name"`
+	// Backend is the name of the backend that would start the kernel.
+	Backend string `json:"backend"`
+	// BackendSpecID is the ID of the kernelspec within that backend.
+	BackendSpecID string `json:"backend_name"`
+	// EndpointParentResource identifies the remote endpoint hosting the kernelspec, if any.
+	EndpointParentResource string `json:"endpoint_parent_resource,omitempty"`
+}
+
+// ResolveStart resolves the backend that would start the given kernel, without starting it.
+//
+// This checks that the backend is reachable and that it reports the kernel's spec.
+//
+// If the kernel's spec cannot be resolved, then the resolution is that of the fallback backend's
+// default kernelspec, or a RoutingError if there is no fallback.
+func (m *Mixer) ResolveStart(ctx context.Context, k *resources.Kernel) (*StartResolution, error) {
+	specID := k.SpecID
+	backend, backendSpecID, err := m.router.resolve(specID)
+	if err != nil {
+		backend, backendSpecID, err = m.fallbackStart(ctx, specID, err)
+		if err != nil {
+			return nil, err
+		}
+		specID = backend.UnifiedID(backendSpecID)
+	}
+	ks, err := backend.ListKernelSpecs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q is not reachable: %v: %w", backend.Name(), err, util.HTTPError(http.StatusBadGateway))
+	}
+	spec, ok := ks.KernelSpecs[backendSpecID]
+	if !ok || spec == nil {
+		backend, backendSpecID, err = m.fallbackStart(ctx, specID, fmt.Errorf("unknown kernelspec %q: %w", specID, util.HTTPError(http.StatusNotFound)))
+		if err != nil {
+			return nil, err
+		}
+		specID = backend.UnifiedID(backendSpecID)
+		if ks, err = backend.ListKernelSpecs(ctx); err != nil {
+			return nil, fmt.Errorf("backend %q is not reachable: %v: %w", backend.Name(), err, util.HTTPError(http.StatusBadGateway))
+		}
+		spec = ks.KernelSpecs[backendSpecID]
+	}
+	return &StartResolution{
+		SpecID:                 specID,
+		Backend:                backend.Name(),
+		BackendSpecID:          backendSpecID,
+		EndpointParentResource: spec.Resources[endpointParentResourceKey],
+	}, nil
+}
+
+// isDryRunStart reports whether or not the given request is a dry run of starting a kernel.
+func isDryRunStart(r *http.Request) bool {
+	if r.Method != http.MethodPost || r.URL.Path != kernels.APIPath {
+		return false
+	}
+	dryRun, err := strconv.ParseBool(r.URL.Query().Get(dryRunParam))
+	return err == nil && dryRun
+}
+
+// dryRunStartHandler wraps the given kernels handler so that dry runs of starting a kernel are resolved without starting one.
+func (m *Mixer) dryRunStartHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isDryRunStart(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure reading the request body: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		var k resources.Kernel
+		if err := json.Unmarshal(reqBytes, &k); err != nil {
+			errorMsg := fmt.Sprintf("failure parsing the request body: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusBadRequest)
+			return
+		}
+		resolution, err := m.ResolveStart(r.Context(), &k)
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure resolving the kernel start: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		respBytes, err := json.Marshal(resolution)
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure marshalling the kernel start resolution: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		w.Write(respBytes)
+	})
+}
+
+// backendDefault returns the ID within the named backend of its default kernelspec, as recorded with the spec table.
+//
+// If the backend has no default in the table, e.g. because it was added since the table was
+// fetched, then the table is refreshed before trying again.
+func (m *Mixer) backendDefault(ctx context.Context, name string) (string, bool) {
+	if _, err := m.specTable(ctx); err != nil {
+		log.Printf("Failure fetching the kernelspecs table: %v", err)
+		return "", false
+	}
+	m.mu.Lock()
+	defaultID, ok := m.backendDefaults[name]
+	m.mu.Unlock()
+	if ok {
+		return defaultID, true
+	}
+	if _, err := m.refreshSpecTable(ctx); err != nil {
+		log.Printf("Failure refreshing the kernelspecs table: %v", err)
+		return "", false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defaultID, ok = m.backendDefaults[name]
+	return defaultID, ok
+}
+
+// fallbackStart returns the backend, and the kernelspec ID within it, to start a kernel on in place of the given unresolvable kernelspec.
+//
+// That is the default kernelspec of the FallbackBackend, as recorded with the spec table. If no
+// fallback backend is configured, or it cannot be used, then a RoutingError is returned, wrapping
+// the given cause for the former.
+func (m *Mixer) fallbackStart(ctx context.Context, specID string, cause error) (*backends.Backend, string, error) {
+	if m.opts.FallbackBackend == "" {
+		return nil, "", &RoutingError{SpecID: specID, Err: cause}
+	}
+	backend, ok := m.router.lookup(m.opts.FallbackBackend)
+	if !ok {
+		return nil, "", &RoutingError{SpecID: specID, Err: fmt.Errorf("unknown fallback backend %q: %w", m.opts.FallbackBackend, util.HTTPError(http.StatusInternalServerError))}
+	}
+	defaultID, ok := m.backendDefault(ctx, backend.Name())
+	if !ok {
+		return nil, "", &RoutingError{SpecID: specID, Err: fmt.Errorf("fallback backend %q has no default kernelspec: %w", backend.Name(), util.HTTPError(http.StatusBadGateway))}
+	}
+	log.Printf("Falling back to the default kernelspec %q of %q for the kernelspec %q: %v", defaultID, backend.Name(), specID, cause)
+	return backend, defaultID, nil
+}
+
+// resolveStartSpecID returns the unified ID of the kernelspec to start a kernel from in place of the given one.
+//
+// That is the given kernelspec if it can be resolved. Otherwise, it is the fallback backend's
+// default kernelspec, or a RoutingError is returned if there is no fallback.
+func (m *Mixer) resolveStartSpecID(ctx context.Context, specID string) (string, error) {
+	if _, ok := m.lookupSpec(ctx, specID); ok {
+		return specID, nil
+	}
+	backend, localSpecID, err := m.router.resolve(specID)
+	if err == nil {
+		ks, err := backend.ListKernelSpecs(ctx)
+		if err != nil {
+			// The backend is not reachable, so leave it to the start request to report that.
+			return specID, nil
+		}
+		if _, ok := ks.KernelSpecs[localSpecID]; ok {
+			return specID, nil
+		}
+	}
+	backend, backendSpecID, err := m.fallbackStart(ctx, specID, fmt.Errorf("unknown kernelspec %q: %w", specID, util.HTTPError(http.StatusBadRequest)))
+	if err != nil {
+		return "", err
+	}
+	return backend.UnifiedID(backendSpecID), nil
+}
+
+// validateStart checks that the given request to start a kernel is well formed and references a known kernelspec.
+//
+// If the kernelspec cannot be resolved, then the request's kernelspec is replaced with the
+// fallback backend's default kernelspec, or a RoutingError is returned if there is no fallback.
+func (m *Mixer) validateStart(ctx context.Context, req *resources.KernelStartRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	specID, err := m.resolveStartSpecID(ctx, req.SpecID)
+	if err != nil {
+		return err
+	}
+	req.SpecID = specID
+	return nil
+}
+
+// withStartSpecID returns the given request body to start a kernel with its kernelspec replaced by the given one.
+//
+// The other fields of the request are preserved as is.
+func withStartSpecID(reqBytes []byte, specID string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(reqBytes, &fields); err != nil {
+		return nil, fmt.Errorf("failure parsing the request body: %v: %w", err, util.HTTPError(http.StatusBadRequest))
+	}
+	specIDBytes, err := json.Marshal(specID)
+	if err != nil {
+		return nil, err
+	}
+	fields["name"] = specIDBytes
+	return json.Marshal(fields)
+}
+
+// validateStartHandler wraps the given kernels handler so that malformed requests to start a kernel are rejected before reaching any backend.
+func (m *Mixer) validateStartHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != kernels.APIPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure reading the request body: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		var req resources.KernelStartRequest
+		if err := json.Unmarshal(reqBytes, &req); err != nil {
+			errorMsg := fmt.Sprintf("failure parsing the request body: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusBadRequest)
+			return
+		}
+		requestedSpecID := req.SpecID
+		if err := m.validateStart(r.Context(), &req); err != nil {
+			errorMsg := fmt.Sprintf("invalid request to start a kernel: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		if req.SpecID != requestedSpecID {
+			if reqBytes, err = withStartSpecID(reqBytes, req.SpecID); err != nil {
+				errorMsg := fmt.Sprintf("failure rewriting the kernelspec of the request: %v", err)
+				util.Log(r, errorMsg)
+				http.Error(w, errorMsg, util.HTTPStatusCode(err))
+				return
+			}
+			r.ContentLength = int64(len(reqBytes))
+			r.Header.Del("Content-Length")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(reqBytes))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// routesPath is the URL path of the admin endpoint that reports which backend hosts each kernel.
+const routesPath = "/mixer/routes"
+
+// RoutingSnapshot returns a copy of the mixer's table of which backend hosts each kernel, mapping kernel IDs to backend names.
+//
+// The table only includes the kernels the mixer has seen, e.g. by listing or starting them.
+func (m *Mixer) RoutingSnapshot() map[string]string {
+	return m.kernelRoutes.Snapshot()
+}
+
+// routesHandler returns a handler that reports the mixer's routing table, for debugging misrouted kernel requests.
+//
+// The table includes the kernels of every user, so it is restricted to admins.
+func (m *Mixer) routesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errorMsg := fmt.Sprintf("unsupported method %q", r.Method)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusMethodNotAllowed)
+			return
+		}
+		if err := m.checkAdmin(r); err != nil {
+			errorMsg := fmt.Sprintf("inspecting the routes is restricted to admins: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		respBytes, err := json.Marshal(m.RoutingSnapshot())
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure marshalling the routes: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(respBytes)
+	})
+}
+
+// displayNameParam is the query parameter that selects the kernelspec to start a kernel from by its display name, rather than its ID.
+const displayNameParam = "displayName"
+
+// findSpecByDisplayName returns the kernelspec with the given display name in the spec table.
+//
+// If no kernelspec in the table has the display name, then the table is refreshed before trying
+// again, at most once per minSpecTableRefreshInterval.
+func (m *Mixer) findSpecByDisplayName(ctx context.Context, name string) (*resources.KernelSpec, error) {
+	ks, err := m.specTable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failure fetching the kernelspecs: %w", err)
+	}
+	spec, err := ks.FindByDisplayName(name)
+	if util.HTTPStatusCode(err) != http.StatusBadRequest {
+		return spec, err
+	}
+	if ks, err = m.refreshSpecTable(ctx); err != nil {
+		return nil, fmt.Errorf("failure refreshing the kernelspecs: %w", err)
+	}
+	return ks.FindByDisplayName(name)
+}
+
+// displayNameStartHandler wraps the given kernels handler so that kernels can be started from the kernelspec with a given display name.
+//
+// The display name is given in the `displayName` query parameter, and must match exactly one
+// kernelspec as listed by the mixer, e.g. "Python 3 (Local)". The request is then forwarded with
+// that kernelspec's ID as its `name`. Unknown display names are rejected with a 400 status, and
+// ambiguous ones with a 409 status. Other requests are passed through unmodified.
+func (m *Mixer) displayNameStartHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.Method != http.MethodPost || r.URL.Path != kernels.APIPath || !q.Has(displayNameParam) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure reading the request body: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		fields := make(map[string]json.RawMessage)
+		if len(bytes.TrimSpace(reqBytes)) > 0 {
+			if err := json.Unmarshal(reqBytes, &fields); err != nil {
+				errorMsg := fmt.Sprintf("failure parsing the request body: %v", err)
+				util.Log(r, errorMsg)
+				http.Error(w, errorMsg, http.StatusBadRequest)
+				return
+			}
+		}
+		if _, ok := fields["name"]; ok {
+			errorMsg := fmt.Sprintf("the kernelspec must be selected by either its 'name' or the %q query parameter, not both", displayNameParam)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusBadRequest)
+			return
+		}
+		spec, err := m.findSpecByDisplayName(r.Context(), q.Get(displayNameParam))
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure resolving the kernelspec to start: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		specID, err := json.Marshal(spec.ID)
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure marshalling the kernelspec ID: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		fields["name"] = specID
+		reqBytes, err = json.Marshal(fields)
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure marshalling the request body: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		util.Log(r, fmt.Sprintf("Resolved the display name %q to the kernelspec %q", q.Get(displayNameParam), spec.ID))
+		q.Del(displayNameParam)
+		r.URL.RawQuery = q.Encode()
+		r.Body = ioutil.NopCloser(bytes.NewReader(reqBytes))
+		r.ContentLength = int64(len(reqBytes))
+		r.Header.Del("Content-Length")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// frontendConnectionsMetadataKey is the kernel metadata entry reporting the mixer's open frontend connections to the kernel.
+const frontendConnectionsMetadataKey = "mixer_frontend_connections"
+
+// FrontendConnections returns the number of frontend websocket connections to the given kernel that are currently proxied by the mixer.
+//
+// This can differ from the kernel's Connections value, which is reported by the backend
+// and so only reflects the connections the backend sees.
+func (m *Mixer) FrontendConnections(kernelID string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.frontendConnections[kernelID]
+}
+
+// hasFrontendConnections reports whether or not the mixer is proxying any frontend connections to kernels.
+func (m *Mixer) hasFrontendConnections() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.frontendConnections) > 0
+}
+
+// addFrontendConnection adjusts the number of open frontend connections to the given kernel by delta.
+func (m *Mixer) addFrontendConnection(kernelID string, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.frontendConnections[kernelID] += delta
+	if m.frontendConnections[kernelID] <= 0 {
+		delete(m.frontendConnections, kernelID)
+	}
+}
+
+// kernelIDFromPath returns the ID of the kernel addressed by the given path, if any.
+func kernelIDFromPath(path string) string {
+	relativePath := strings.TrimPrefix(strings.TrimPrefix(path, kernels.APIPath), "/")
+	return strings.Split(relativePath, "/")[0]
+}
+
+// annotateFrontendConnections records the mixer's frontend connection count in the metadata of the given kernel.
+func (m *Mixer) annotateFrontendConnections(k *resources.Kernel) {
+	if k == nil {
+		return
+	}
+	count := m.FrontendConnections(k.ID)
+	if count == 0 {
+		return
+	}
+	if k.Metadata == nil {
+		k.Metadata = make(map[string]any)
+	}
+	k.Metadata[frontendConnectionsMetadataKey] = count
+}
+
+// annotateListedFrontendConnections is a kernels list hook that records the mixer's frontend connection counts in the metadata of the listed kernels.
+func (m *Mixer) annotateListedFrontendConnections(r *http.Request, ks []*resources.Kernel) ([]*resources.Kernel, error) {
+	if !m.hasFrontendConnections() {
+		return ks, nil
+	}
+	for _, k := range ks {
+		m.annotateFrontendConnections(k)
+	}
+	return ks, nil
+}
+
+// frontendConnectionsHandler wraps the given kernels handler to track the frontend websocket connections it proxies.
+//
+// The tracked counts are reported in the metadata of the kernels returned by GET requests for a
+// single kernel; listed kernels are annotated by the annotateListedFrontendConnections hook.
+func (m *Mixer) frontendConnectionsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kernelID := kernelIDFromPath(r.URL.Path)
+		if websocket.IsWebSocketUpgrade(r) {
+			if kernelID != "" {
+				m.addFrontendConnection(kernelID, 1)
+				defer m.addFrontendConnection(kernelID, -1)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet || kernelID == "" || m.FrontendConnections(kernelID) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		resp := rr.Result()
+		for key, val := range resp.Header {
+			if key != "Content-Length" {
+				w.Header()[key] = val
+			}
+		}
+		respBytes := rr.Body.Bytes()
+		if resp.StatusCode == http.StatusOK {
+			var k resources.Kernel
+			if err := json.Unmarshal(respBytes, &k); err == nil {
+				m.annotateFrontendConnections(&k)
+				if annotated, err := json.Marshal(k); err == nil {
+					respBytes = annotated
+				}
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	})
+}
+
+// unifiedKernels returns the global view of the kernels running on every reachable backend.
+//
+// The error for each backend whose kernels could not be listed is returned keyed by the backend's name.
+func (m *Mixer) unifiedKernels(ctx context.Context) ([]*resources.Kernel, map[string]error) {
+	var unified []*resources.Kernel
+	failed := make(map[string]error)
+	for _, b := range m.router.Backends() {
+		ks, err := b.ListKernels(ctx)
+		if err != nil {
+			log.Printf("Failure listing the kernels: %v", err)
+			failed[b.Name()] = err
+			continue
+		}
+		for _, k := range ks {
+			unified = append(unified, kernels.UnifiedView(k, b))
+		}
+	}
+	return unified, failed
+}
+
+// IdleKernels returns the kernels that have been idle for longer than the given duration.
+//
+// A kernel's idle time is measured from its reported last activity, and kernels whose last
+// activity is missing or malformed are not reported. This only reports the idle kernels so
+// that an external culler can act on every backend uniformly; it does not cull them.
+//
+// The backends are listed using the given context. The error for each backend whose kernels
+// could not be listed is returned keyed by the backend's name, so that a culler can tell that
+// backend's kernels were skipped rather than found to be in use.
+func (m *Mixer) IdleKernels(ctx context.Context, d time.Duration) ([]*resources.Kernel, map[string]error) {
+	cutoff := m.now().Add(-d)
+	var idle []*resources.Kernel
+	ks, failed := m.unifiedKernels(ctx)
+	for _, k := range ks {
+		lastActivity, ok := k.LastActivityTime()
+		if ok && lastActivity.Before(cutoff) {
+			idle = append(idle, k)
+		}
+	}
+	return idle, failed
+}
+
+// backendParam is the query parameter that restricts the listed kernels to those of a single backend.
+//
+// Its value is either the endpointParentResource of a remote backend, or the name of the local backend.
+const backendParam = "backend"
+
+// onBackend returns the given kernels whose spec, as found in the given spec table, routes to the backend identified by the given endpointParentResource.
+//
+// The empty string, or the name of the local backend, identifies the local backend. Kernels whose spec is unknown are omitted.
+func onBackend(ks []*resources.Kernel, specs *resources.KernelSpecs, backend string) []*resources.Kernel {
+	if backend == localBackendName {
+		backend = ""
+	}
+	filtered := []*resources.Kernel{}
+	for _, k := range ks {
+		if k == nil {
+			continue
+		}
+		spec, ok := specs.KernelSpecs[k.SpecID]
+		if !ok || spec == nil {
+			continue
+		}
+		if spec.Resources[endpointParentResourceKey] == backend {
+			filtered = append(filtered, k)
+		}
+	}
+	return filtered
+}
+
+// KernelsForBackend returns the kernels whose spec routes to the backend identified by the given endpointParentResource.
+//
+// The empty string, or the name of the local backend, identifies the local backend. Kernels whose spec is unknown are omitted.
+func (m *Mixer) KernelsForBackend(ctx context.Context, backend string) ([]*resources.Kernel, error) {
+	specs, err := m.specTable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failure fetching the kernelspecs: %w", err)
+	}
+	ks, _ := m.unifiedKernels(ctx)
+	return onBackend(ks, specs, backend), nil
+}
+
+// filterKernelsByBackend is a kernels list hook that restricts the listed kernels to the backend selected by the backend query parameter.
+//
+// Listings without that query parameter are left unchanged.
+func (m *Mixer) filterKernelsByBackend(r *http.Request, ks []*resources.Kernel) ([]*resources.Kernel, error) {
+	backend := r.URL.Query().Get(backendParam)
+	if backend == "" {
+		return ks, nil
+	}
+	specs, err := m.specTable(r.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failure fetching the kernelspecs to filter the kernels for the backend %q: %w", backend, err)
+	}
+	return onBackend(ks, specs, backend), nil
+}
+
+// dropCulledKernels is a kernels ListHook that omits the kernels that their backend has culled for being idle.
+//
+// Culled kernels can no longer be used, but some backends keep listing them until they are reaped.
+func (m *Mixer) dropCulledKernels(r *http.Request, ks []*resources.Kernel) ([]*resources.Kernel, error) {
+	live := make([]*resources.Kernel, 0, len(ks))
+	for _, k := range ks {
+		if k.IsCulled() {
+			util.Log(r, fmt.Sprintf("Omitting the culled kernel %q from the listed kernels", k.ID))
+			continue
+		}
+		live = append(live, k)
+	}
+	return live, nil
+}
+
+const (
+	// enrichParam is the query parameter that requests additional details in the metadata of the listed kernels.
+	enrichParam = "enrich"
+	// enrichPath is the enrichParam value that requests the path of the notebook using each kernel.
+	enrichPath = "path"
+	// notebookPathMetadataKey is the kernel metadata entry reporting the path of the session using the kernel.
+	notebookPathMetadataKey = "path"
+)
+
+// sessionPaths returns the path of the session using each kernel, keyed by the backend hosting the kernel and then the kernel's ID.
+//
+// Backends whose sessions could not be listed are omitted from the result.
+func (m *Mixer) sessionPaths(ctx context.Context) map[*backends.Backend]map[string]string {
+	paths := make(map[*backends.Backend]map[string]string)
+	for _, b := range m.router.Backends() {
+		sessions, err := b.ListSessions(ctx)
+		if err != nil {
+			log.Printf("Failure listing the sessions to enrich the kernels: %v", err)
+			continue
+		}
+		backendPaths := make(map[string]string)
+		for _, sess := range sessions {
+			if sess != nil && sess.Kernel != nil {
+				backendPaths[sess.Kernel.ID] = sess.Path
+			}
+		}
+		paths[b] = backendPaths
+	}
+	return paths
+}
+
+// enrichKernelPaths adds the path of the session using each of the given kernels to that kernel's metadata.
+//
+// Kernels that are not used by any session are left unchanged.
+func (m *Mixer) enrichKernelPaths(ctx context.Context, ks []*resources.Kernel) {
+	paths := m.sessionPaths(ctx)
+	for _, k := range ks {
+		if k == nil {
+			continue
+		}
+		b, _, err := m.router.resolve(k.SpecID)
+		if err != nil {
+			continue
+		}
+		path, ok := paths[b][k.ID]
+		if !ok {
+			continue
+		}
+		if k.Metadata == nil {
+			k.Metadata = make(map[string]any)
+		}
+		k.Metadata[notebookPathMetadataKey] = path
+	}
+}
+
+// enrichListedKernels is a kernels list hook that adds the path of the notebook using each listed kernel to its metadata.
+//
+// This is requested with the `enrich=path` query parameter, and other values are rejected.
+// Listings without that query parameter are left unchanged.
+func (m *Mixer) enrichListedKernels(r *http.Request, ks []*resources.Kernel) ([]*resources.Kernel, error) {
+	enrich := r.URL.Query().Get(enrichParam)
+	if enrich == "" {
+		return ks, nil
+	}
+	if enrich != enrichPath {
+		return nil, fmt.Errorf("unsupported value for the %q query parameter: %q: %w", enrichParam, enrich, util.HTTPError(http.StatusBadRequest))
+	}
+	m.enrichKernelPaths(r.Context(), ks)
+	return ks, nil
+}
+
+// displayNameMetadataKey is the kernel metadata entry reporting the display name of the kernel's kernelspec.
+const displayNameMetadataKey = "display_name"
+
+// specTable returns the mixer's spec table, fetching it if it has not been fetched yet.
+func (m *Mixer) specTable(ctx context.Context) (*resources.KernelSpecs, error) {
+	m.mu.Lock()
+	ks := m.kernelSpecs
+	m.mu.Unlock()
+	if ks != nil {
+		return ks, nil
+	}
+	return m.KernelSpecs(ctx)
+}
+
+// annotateDisplayNames records the display name of each kernel's kernelspec, taken from the given spec table, in the kernel's metadata.
+//
+// Kernels whose kernelspec is not in the table, or that already report a display name, are left unchanged.
+func annotateDisplayNames(ks []*resources.Kernel, specs *resources.KernelSpecs) {
+	for _, k := range ks {
+		if k == nil {
+			continue
+		}
+		if _, ok := k.Metadata[displayNameMetadataKey]; ok {
+			continue
+		}
+		spec, ok := specs.KernelSpecs[k.SpecID]
+		if !ok || spec == nil || spec.Spec == nil || spec.Spec.DisplayName == "" {
+			continue
+		}
+		if k.Metadata == nil {
+			k.Metadata = make(map[string]any)
+		}
+		k.Metadata[displayNameMetadataKey] = spec.Spec.DisplayName
+	}
+}
+
+// annotateListedDisplayNames is a kernels list hook that records the display name of each listed kernel's kernelspec in its metadata.
+//
+// The spec ID that the frontend shows for a kernel is not readable for remote kernels, so the
+// display name is added to each kernel's metadata from the spec table. That is the same name the
+// launcher lists for the kernelspec, including its backend's suffix, e.g. "Python 3 (Local)". If
+// the spec table cannot be fetched, then the kernels are listed without display names.
+func (m *Mixer) annotateListedDisplayNames(r *http.Request, ks []*resources.Kernel) ([]*resources.Kernel, error) {
+	specs, err := m.specTable(r.Context())
+	if err != nil {
+		util.Log(r, fmt.Sprintf("Failure fetching the kernelspecs for the kernels' display names: %v", err))
+		return ks, nil
+	}
+	annotateDisplayNames(ks, specs)
+	return ks, nil
+}
+
+// idempotencyKeyHeader is the request header holding a client-supplied key that makes a kernel start safe to retry.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKeyTTL is how long the kernel started for an idempotency key is remembered.
+const idempotencyKeyTTL = 10 * time.Minute
+
+// idempotentStart records the kernel started for an idempotency key.
+type idempotentStart struct {
+	// done is closed once the start has completed, successfully or not.
+	done chan struct{}
+	// kernelID is the ID of the started kernel, or empty if the start failed.
+	kernelID string
+	expires  time.Time
+}
+
+// claimIdempotencyKey returns the start recorded for the given key, and whether or not the caller is responsible for performing that start.
+func (m *Mixer) claimIdempotencyKey(key string) (*idempotentStart, bool) {
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, start := range m.idempotentStarts {
+		if start.kernelID != "" && now.After(start.expires) {
+			delete(m.idempotentStarts, k)
+		}
+	}
+	if start, ok := m.idempotentStarts[key]; ok {
+		return start, false
+	}
+	start := &idempotentStart{done: make(chan struct{})}
+	m.idempotentStarts[key] = start
+	return start, true
+}
+
+// completeIdempotentStart records the outcome of the start for the given key.
+//
+// If the start failed, then the key is released so that a retry starts a kernel.
+func (m *Mixer) completeIdempotentStart(key string, start *idempotentStart, kernelID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if kernelID == "" {
+		delete(m.idempotentStarts, key)
+	} else {
+		start.kernelID = kernelID
+		start.expires = m.now().Add(idempotencyKeyTTL)
+	}
+	close(start.done)
+}
+
+// forgetIdempotencyKey releases the given key if it still refers to the given start.
+func (m *Mixer) forgetIdempotencyKey(key string, start *idempotentStart) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.idempotentStarts[key] == start {
+		delete(m.idempotentStarts, key)
+	}
+}
+
+// serveExistingKernel responds to a repeated kernel start with the kernel that was already started.
+//
+// It reports false, without writing a response, if that kernel no longer exists.
+func serveExistingKernel(h http.Handler, w http.ResponseWriter, r *http.Request, kernelID string) bool {
+	getReq := r.Clone(r.Context())
+	getReq.Method = http.MethodGet
+	getReq.URL.Path = kernels.APIPath + "/" + kernelID
+	getReq.URL.RawPath = ""
+	getReq.Body = http.NoBody
+	getReq.ContentLength = 0
+	getReq.Header.Del("Content-Length")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, getReq)
+	resp := rr.Result()
+	if resp.StatusCode != http.StatusOK {
+		util.Log(r, fmt.Sprintf("Kernel %q for a repeated start is no longer available: %s", kernelID, resp.Status))
+		return false
+	}
+	for key, val := range resp.Header {
+		if key != "Content-Length" {
+			w.Header()[key] = val
+		}
+	}
+	w.Header().Set("Location", getReq.URL.Path)
+	// Report the same status as the original start, which clients check for.
+	w.WriteHeader(http.StatusCreated)
+	w.Write(rr.Body.Bytes())
+	return true
+}
+
+// idempotentStartHandler wraps the given kernels handler so that kernel starts carrying an idempotency key are safe to retry.
+//
+// The first start for a key is forwarded as usual, and repeated starts with the same key from the
+// same user return the kernel it started instead of starting another one. Keys are remembered for
+// idempotencyKeyTTL, and are released if the start fails or the kernel is gone.
+func (m *Mixer) idempotentStartHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != http.MethodPost || r.URL.Path != kernels.APIPath || idempotencyKey == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Scope the keys by user so that one user cannot retrieve the kernel of another.
+		identity, err := m.userIdentity(r)
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure identifying the user of an idempotent kernel start: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		key := identity + "\x00" + idempotencyKey
+		start, owner := m.claimIdempotencyKey(key)
+		if !owner {
+			select {
+			case <-start.done:
+			case <-r.Context().Done():
+				errorMsg := fmt.Sprintf("canceled while waiting for a concurrent kernel start with the same idempotency key: %v", r.Context().Err())
+				util.Log(r, errorMsg)
+				http.Error(w, errorMsg, http.StatusServiceUnavailable)
+				return
+			}
+			if start.kernelID != "" {
+				if serveExistingKernel(h, w, r, start.kernelID) {
+					return
+				}
+				m.forgetIdempotencyKey(key, start)
+			}
+			// The earlier start failed or its kernel is gone, so start a new kernel for this key.
+			start, owner = m.claimIdempotencyKey(key)
+			if !owner {
+				errorMsg := "conflicting concurrent kernel starts with the same idempotency key"
+				util.Log(r, errorMsg)
+				http.Error(w, errorMsg, http.StatusConflict)
+				return
+			}
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		resp := rr.Result()
+		var kernelID string
+		if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK {
+			var k resources.Kernel
+			if err := json.Unmarshal(rr.Body.Bytes(), &k); err == nil {
+				kernelID = k.ID
+			}
+		}
+		m.completeIdempotentStart(key, start, kernelID)
+		for name, val := range resp.Header {
+			if name != "Content-Length" {
+				w.Header()[name] = val
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(rr.Body.Bytes())
+	})
+}
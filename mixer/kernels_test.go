@@ -0,0 +1,973 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+)
+
+// startCounter counts the requests to start a kernel that are sent to a backend.
+type startCounter struct {
+	mu     sync.Mutex
+	starts int
+}
+
+func (c *startCounter) wrap(b *backends.Backend) *backends.Backend {
+	return backends.New(b.Name(), " ("+b.Name()+")", b.Name()+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, kernels.APIPath) {
+			c.mu.Lock()
+			c.starts++
+			c.mu.Unlock()
+		}
+		b.ServeHTTP(w, r)
+	}))
+}
+
+func (c *startCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.starts
+}
+
+func TestDryRunStart(t *testing.T) {
+	var counter startCounter
+	unreachable := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unreachable", http.StatusBadGateway)
+	}))
+	testCases := []struct {
+		desc       string
+		remote     *backends.Backend
+		body       string
+		wantStatus int
+		want       *StartResolution
+	}{
+		{
+			desc:       "Local kernelspec",
+			remote:     newFakeBackend(t, "remote", remoteKernelSpecs),
+			body:       `{"name":"local-python3"}`,
+			wantStatus: http.StatusOK,
+			want: &StartResolution{
+				SpecID:        "local-python3",
+				Backend:       "local",
+				BackendSpecID: "python3",
+			},
+		},
+		{
+			desc:       "Remote kernelspec",
+			remote:     newFakeBackend(t, "remote", remoteKernelSpecs),
+			body:       `{"name":"remote-pyspark"}`,
+			wantStatus: http.StatusOK,
+			want: &StartResolution{
+				SpecID:                 "remote-pyspark",
+				Backend:                "remote",
+				BackendSpecID:          "pyspark",
+				EndpointParentResource: testClusterResource,
+			},
+		},
+		{
+			desc:       "Unknown kernelspec",
+			remote:     newFakeBackend(t, "remote", remoteKernelSpecs),
+			body:       `{"name":"remote-unknown"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:       "Unroutable kernelspec",
+			remote:     newFakeBackend(t, "remote", remoteKernelSpecs),
+			body:       `{"name":"python3"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:       "Unreachable backend",
+			remote:     unreachable,
+			body:       `{"name":"remote-pyspark"}`,
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m := newMixer(counter.wrap(newFakeBackend(t, "local", localKernelSpecs)), counter.wrap(tc.remote), MixerOptions{})
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/kernels?dryRun=true", strings.NewReader(tc.body)))
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Fatalf("Unexpected status code for %q: got %d, want %d: %q", tc.body, got, want, rr.Body.String())
+			}
+			if tc.want != nil {
+				var got StartResolution
+				if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+					t.Fatalf("Failure parsing the dry run response %q: %v", rr.Body.String(), err)
+				}
+				if diff := cmp.Diff(tc.want, &got); diff != "" {
+					t.Errorf("Unexpected dry run response: diff (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+	if got := counter.count(); got != 0 {
+		t.Errorf("Unexpected kernel start requests sent to the backends during a dry run: got %d, want 0", got)
+	}
+}
+
+func TestFrontendConnections(t *testing.T) {
+	kernel := &resources.Kernel{ID: "kernel1", SpecID: "python3"}
+	fake := newFakeBackend(t, "local", localKernelSpecs, kernel)
+	release := make(chan struct{})
+	connected := make(chan struct{}, 2)
+	local := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			connected <- struct{}{}
+			<-release
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	m := newMixer(local, newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+	// Wait for the kernels handler to record which backend hosts the kernel.
+	listReq := httptest.NewRequest(http.MethodGet, "/api/kernels", nil)
+	m.ServeHTTP(httptest.NewRecorder(), listReq)
+
+	connect := func(done chan<- struct{}) {
+		r := httptest.NewRequest(http.MethodGet, "/api/kernels/kernel1/channels", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		m.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}
+	if got, want := m.FrontendConnections("kernel1"), 0; got != want {
+		t.Errorf("Unexpected frontend connections before connecting: got %d, want %d", got, want)
+	}
+	done1, done2 := make(chan struct{}), make(chan struct{})
+	go connect(done1)
+	go connect(done2)
+	<-connected
+	<-connected
+	if got, want := m.FrontendConnections("kernel1"), 2; got != want {
+		t.Errorf("Unexpected frontend connections after connecting: got %d, want %d", got, want)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernels", nil))
+	var listed []*resources.Kernel
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("Failure parsing the kernels %q: %v", rr.Body.String(), err)
+	}
+	if len(listed) != 1 || listed[0].Metadata[frontendConnectionsMetadataKey] != float64(2) {
+		t.Errorf("Unexpected kernels listed while connected: got %q, want the frontend connection count 2", rr.Body.String())
+	}
+
+	release <- struct{}{}
+	select {
+	case <-done1:
+	case <-done2:
+	}
+	if got, want := m.FrontendConnections("kernel1"), 1; got != want {
+		t.Errorf("Unexpected frontend connections after one disconnect: got %d, want %d", got, want)
+	}
+	release <- struct{}{}
+	<-done1
+	<-done2
+	if got, want := m.FrontendConnections("kernel1"), 0; got != want {
+		t.Errorf("Unexpected frontend connections after disconnecting: got %d, want %d", got, want)
+	}
+}
+
+func TestValidateStart(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		body       string
+		wantStatus int
+		wantStarts int
+	}{
+		{
+			desc:       "Missing name",
+			body:       `{"path":"notebook.ipynb"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:       "Unknown spec name",
+			body:       `{"name":"local-unknown"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:       "Unprefixed spec name",
+			body:       `{"name":"python3"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:       "Malformed path",
+			body:       `{"name":"local-python3","path":42}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:       "Valid request",
+			body:       `{"name":"local-python3","path":"notebook.ipynb"}`,
+			wantStatus: http.StatusCreated,
+			wantStarts: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var counter startCounter
+			m := newMixer(counter.wrap(newFakeBackend(t, "local", localKernelSpecs)), counter.wrap(newFakeBackend(t, "remote", remoteKernelSpecs)), MixerOptions{})
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/kernels", strings.NewReader(tc.body)))
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Errorf("Unexpected status code for %q: got %d, want %d: %q", tc.body, got, want, rr.Body.String())
+			}
+			if got, want := counter.count(), tc.wantStarts; got != want {
+				t.Errorf("Unexpected kernel start requests sent to the backends for %q: got %d, want %d", tc.body, got, want)
+			}
+		})
+	}
+}
+
+func TestIdleKernels(t *testing.T) {
+	now := time.Date(2023, 2, 14, 12, 0, 0, 0, time.UTC)
+	m := newMixer(
+		newFakeBackend(t, "local", localKernelSpecs,
+			&resources.Kernel{ID: "active", SpecID: "python3", LastActivity: "2023-02-14T11:59:30.123456Z"},
+			&resources.Kernel{ID: "idle", SpecID: "python3", LastActivity: "2023-02-14T11:00:00.000000Z"},
+			&resources.Kernel{ID: "unknown", SpecID: "python3"},
+			&resources.Kernel{ID: "malformed", SpecID: "python3", LastActivity: "yesterday"}),
+		newFakeBackend(t, "remote", remoteKernelSpecs,
+			&resources.Kernel{ID: "remote-idle", SpecID: "pyspark", LastActivity: "2023-02-14T11:45:00Z"}),
+		MixerOptions{})
+	m.now = func() time.Time { return now }
+	testCases := []struct {
+		desc string
+		d    time.Duration
+		want []string
+	}{
+		{
+			desc: "Idle for over a minute",
+			d:    time.Minute,
+			want: []string{"idle", "remote-idle"},
+		},
+		{
+			desc: "Idle for over half an hour",
+			d:    30 * time.Minute,
+			want: []string{"idle"},
+		},
+		{
+			desc: "Idle for over a day",
+			d:    24 * time.Hour,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			idle, failed := m.IdleKernels(context.Background(), tc.d)
+			if len(failed) > 0 {
+				t.Fatalf("Unexpected failures listing the idle kernels: %v", failed)
+			}
+			var got []string
+			for _, k := range idle {
+				got = append(got, k.ID)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Unexpected idle kernels for %v: diff (-want +got):\n%s", tc.d, diff)
+			}
+		})
+	}
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case kernels.APIPath:
+			w.Write([]byte(`[{"id":"kernel1","name":"python3"}]`))
+		case kernels.APIPath + "/kernel1/channels":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(msgType, msg)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer local.Close()
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusBadGateway)
+	}))
+	defer remote.Close()
+	m, err := NewMixer(MixerOptions{
+		LocalBackendURL:  local.URL,
+		RemoteBackendURL: remote.URL,
+	})
+	if err != nil {
+		t.Fatalf("failure creating the mixer: %v", err)
+	}
+	mixerServer := httptest.NewServer(m)
+	defer mixerServer.Close()
+	// List the kernels so that the mixer knows which backend hosts the kernel.
+	listResp, err := http.Get(mixerServer.URL + kernels.APIPath)
+	if err != nil {
+		t.Fatalf("failure listing the kernels: %v", err)
+	}
+	listResp.Body.Close()
+
+	testCases := []struct {
+		desc     string
+		compress bool
+	}{
+		{
+			desc:     "frontend and backend both offer compression",
+			compress: true,
+		},
+		{
+			desc: "only the backend offers compression",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			dialer := websocket.Dialer{EnableCompression: tc.compress}
+			wsURL := "ws" + strings.TrimPrefix(mixerServer.URL, "http") + kernels.APIPath + "/kernel1/channels"
+			conn, resp, err := dialer.Dial(wsURL, nil)
+			if err != nil {
+				t.Fatalf("failure connecting to the kernel: %v", err)
+			}
+			defer conn.Close()
+			extensions := resp.Header.Get("Sec-Websocket-Extensions")
+			if got, want := strings.Contains(extensions, "permessage-deflate"), tc.compress; got != want {
+				t.Errorf("unexpected negotiated extensions %q: got compression %v, want %v", extensions, got, want)
+			}
+			want := strings.Repeat("large kernel output ", 100)
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(want)); err != nil {
+				t.Fatalf("failure sending a message: %v", err)
+			}
+			_, got, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("failure reading a message: %v", err)
+			}
+			if string(got) != want {
+				t.Errorf("unexpected echoed message: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestKernelsForBackend(t *testing.T) {
+	localKernel := &resources.Kernel{ID: "kernel1", SpecID: "python3"}
+	remoteKernel := &resources.Kernel{ID: "kernel2", SpecID: "pyspark"}
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs, localKernel), newFakeBackend(t, "remote", remoteKernelSpecs, remoteKernel), MixerOptions{})
+	testCases := []struct {
+		desc    string
+		backend string
+		wantIDs []string
+	}{
+		{
+			desc:    "remote cluster",
+			backend: testClusterResource,
+			wantIDs: []string{"kernel2"},
+		},
+		{
+			desc:    "other cluster",
+			backend: "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/other-cluster",
+			wantIDs: []string{},
+		},
+		{
+			desc:    "local backend",
+			backend: localBackendName,
+			wantIDs: []string{"kernel1"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ks, err := m.KernelsForBackend(context.Background(), tc.backend)
+			if err != nil {
+				t.Fatalf("failure listing the kernels for the backend: %v", err)
+			}
+			gotIDs := []string{}
+			for _, k := range ks {
+				gotIDs = append(gotIDs, k.ID)
+			}
+			if diff := cmp.Diff(tc.wantIDs, gotIDs); diff != "" {
+				t.Errorf("unexpected kernels for the backend: diff %v", diff)
+			}
+
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, kernels.APIPath+"?backend="+url.QueryEscape(tc.backend), nil))
+			if got, want := rr.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response status: got %d, want %d", got, want)
+			}
+			if got, want := rr.Header().Get("Content-Type"), "application/json"; got != want {
+				t.Errorf("unexpected content type: got %q, want %q", got, want)
+			}
+			var listed []*resources.Kernel
+			if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+				t.Fatalf("failure parsing the listed kernels %q: %v", rr.Body.String(), err)
+			}
+			listedIDs := []string{}
+			for _, k := range listed {
+				listedIDs = append(listedIDs, k.ID)
+			}
+			if diff := cmp.Diff(tc.wantIDs, listedIDs); diff != "" {
+				t.Errorf("unexpected listed kernels for the backend: diff %v", diff)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, kernels.APIPath, nil))
+	var listed []*resources.Kernel
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("failure parsing the listed kernels %q: %v", rr.Body.String(), err)
+	}
+	if got, want := len(listed), 2; got != want {
+		t.Errorf("unexpected number of kernels listed without a filter: got %d, want %d", got, want)
+	}
+}
+
+func TestListCulledKernels(t *testing.T) {
+	var live, culled resources.Kernel
+	if err := json.Unmarshal([]byte(`{"id":"kernel1","name":"pyspark","metadata":{"accelerator":{"type":"nvidia-tesla-t4","count":2}},"vendor_field":"preserved"}`), &live); err != nil {
+		t.Fatalf("Failure parsing the live kernel: %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{"id":"kernel2","name":"pyspark","metadata":{"culled":true}}`), &culled); err != nil {
+		t.Fatalf("Failure parsing the culled kernel: %v", err)
+	}
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs, &live, &culled), MixerOptions{})
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, kernels.APIPath, nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("Unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	var listed []map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("Failure parsing the listed kernels %q: %v", rr.Body.String(), err)
+	}
+	if len(listed) != 1 || listed[0]["id"] != "kernel1" {
+		t.Fatalf("Unexpected listed kernels: got %v, want only the kernel %q", listed, "kernel1")
+	}
+	if got, want := listed[0]["vendor_field"], "preserved"; got != want {
+		t.Errorf("Unexpected vendor field of the listed kernel: got %v, want %q", got, want)
+	}
+	var ks []*resources.Kernel
+	if err := json.Unmarshal(rr.Body.Bytes(), &ks); err != nil {
+		t.Fatalf("Failure parsing the listed kernels %q: %v", rr.Body.String(), err)
+	}
+	if gpuType, count, ok := ks[0].GPUInfo(); !ok || gpuType != "nvidia-tesla-t4" || count != 2 {
+		t.Errorf("Unexpected GPU info of the listed kernel: got %q, %d, %v, want %q, %d, true", gpuType, count, ok, "nvidia-tesla-t4", 2)
+	}
+}
+
+// withStartedKernel wraps the given backend so that it reports the kernel started by newFakeBackend when it is fetched directly.
+func withStartedKernel(b *backends.Backend) *backends.Backend {
+	return backends.New(b.Name(), " ("+b.Name()+")", b.Name()+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == kernels.APIPath+"/new-kernel" {
+			json.NewEncoder(w).Encode(&resources.Kernel{ID: "new-kernel", SpecID: "python3", ExecutionState: "idle"})
+			return
+		}
+		b.ServeHTTP(w, r)
+	}))
+}
+
+func TestIdempotentStart(t *testing.T) {
+	var counter startCounter
+	m := newMixer(counter.wrap(withStartedKernel(newFakeBackend(t, "local", localKernelSpecs))), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{TrustedProxies: []string{testProxyAddress}})
+	testCases := []struct {
+		desc           string
+		identity       string
+		idempotencyKey string
+		wantStarts     int
+	}{
+		{
+			desc:           "first start with a key",
+			identity:       "alice@example.com",
+			idempotencyKey: "key1",
+			wantStarts:     1,
+		},
+		{
+			desc:           "retried start with the same key",
+			identity:       "alice@example.com",
+			idempotencyKey: "key1",
+			wantStarts:     1,
+		},
+		{
+			desc:           "start with a different key",
+			identity:       "alice@example.com",
+			idempotencyKey: "key2",
+			wantStarts:     2,
+		},
+		{
+			desc:           "start with the same key by another user",
+			identity:       "bob@example.com",
+			idempotencyKey: "key1",
+			wantStarts:     3,
+		},
+		{
+			desc:       "start without a key",
+			identity:   "alice@example.com",
+			wantStarts: 4,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, kernels.APIPath, strings.NewReader(`{"name":"local-python3"}`))
+			req.Header.Set(userIdentityHeader, tc.identity)
+			if tc.idempotencyKey != "" {
+				req.Header.Set(idempotencyKeyHeader, tc.idempotencyKey)
+			}
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, req)
+			if got, want := rr.Code, http.StatusCreated; got != want {
+				t.Fatalf("unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+			var k resources.Kernel
+			if err := json.Unmarshal(rr.Body.Bytes(), &k); err != nil {
+				t.Fatalf("failure parsing the started kernel %q: %v", rr.Body.String(), err)
+			}
+			if got, want := k.ID, "new-kernel"; got != want {
+				t.Errorf("unexpected kernel ID: got %q, want %q", got, want)
+			}
+			if got, want := counter.count(), tc.wantStarts; got != want {
+				t.Errorf("unexpected number of backend starts: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestEnrichKernelPaths(t *testing.T) {
+	fake := newFakeBackend(t, "local", localKernelSpecs,
+		&resources.Kernel{ID: "kernel1", SpecID: "python3"},
+		&resources.Kernel{ID: "kernel2", SpecID: "python3"})
+	local := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/sessions" {
+			w.Write([]byte(`[{"id":"session1","path":"notebooks/analysis.ipynb","kernel":{"id":"kernel1","name":"python3"}}]`))
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	m := newMixer(local, newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernels?enrich=path", nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("Unexpected response status listing the enriched kernels: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	var listed []*resources.Kernel
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("Failure parsing the kernels %q: %v", rr.Body.String(), err)
+	}
+	paths := make(map[string]any)
+	for _, k := range listed {
+		paths[k.ID] = k.Metadata[notebookPathMetadataKey]
+	}
+	want := map[string]any{
+		"kernel1": "notebooks/analysis.ipynb",
+		"kernel2": nil,
+	}
+	if diff := cmp.Diff(want, paths); diff != "" {
+		t.Errorf("Unexpected kernel paths: diff (-want +got):\n%s", diff)
+	}
+
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernels?enrich=owner", nil))
+	if got, want := rr.Code, http.StatusBadRequest; got != want {
+		t.Errorf("Unexpected response status for an unsupported enrichment: got %d, want %d", got, want)
+	}
+}
+
+func TestListKernelsCanceled(t *testing.T) {
+	started := make(chan struct{}, 1)
+	backendErrs := make(chan error, 1)
+	local := backends.New("local", " (Local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Done() == nil {
+			// Background fetches that are not tied to a client request.
+			w.Write([]byte("[]"))
+			return
+		}
+		started <- struct{}{}
+		<-r.Context().Done()
+		backendErrs <- r.Context().Err()
+	}))
+	m := newMixer(local, newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/kernels", nil).WithContext(ctx))
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the backend request")
+	}
+	// The client goes away while the backend is still being listed.
+	cancel()
+	select {
+	case err := <-backendErrs:
+		if err != context.Canceled {
+			t.Errorf("Unexpected backend request context error: got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The backend request was not canceled when the client went away")
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the canceled request to be served")
+	}
+}
+
+// withKernelID wraps the given backend so that the kernels it starts have the given ID.
+func withKernelID(b *backends.Backend, kernelID string) *backends.Backend {
+	return backends.New(b.Name(), " ("+b.Name()+")", b.Name()+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != kernels.APIPath {
+			b.ServeHTTP(w, r)
+			return
+		}
+		var k resources.Kernel
+		if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		k.ID = kernelID
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(k)
+	}))
+}
+
+func TestRoutingSnapshot(t *testing.T) {
+	m := newMixer(
+		withKernelID(newFakeBackend(t, "local", localKernelSpecs), "local-kernel"),
+		withKernelID(newFakeBackend(t, "remote", remoteKernelSpecs), "remote-kernel"),
+		MixerOptions{AdminIdentities: []string{"admin@example.com"}, TrustedProxies: []string{testProxyAddress}})
+	for _, specID := range []string{"local-python3", "remote-pyspark"} {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, kernels.APIPath, strings.NewReader(`{"name":"`+specID+`"}`)))
+		if got, want := rr.Code, http.StatusCreated; got != want {
+			t.Fatalf("unexpected response status starting a %q kernel: got %d, want %d: %s", specID, got, want, rr.Body.String())
+		}
+	}
+	want := map[string]string{
+		"local-kernel":  "local",
+		"remote-kernel": "remote",
+	}
+	if diff := cmp.Diff(want, m.RoutingSnapshot()); diff != "" {
+		t.Errorf("unexpected routing snapshot: diff (-want +got):\n%s", diff)
+	}
+
+	testCases := []struct {
+		desc       string
+		identity   string
+		remoteAddr string
+		wantStatus int
+		wantRoutes map[string]string
+	}{
+		{
+			desc:       "admin",
+			identity:   "admin@example.com",
+			wantStatus: http.StatusOK,
+			wantRoutes: want,
+		},
+		{
+			desc:       "not an admin",
+			identity:   "user@example.com",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			desc:       "admin header from an untrusted address",
+			identity:   "admin@example.com",
+			remoteAddr: "203.0.113.7:1234",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, routesPath, nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			req.Header.Set(userIdentityHeader, tc.identity)
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, req)
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Fatalf("unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+			if tc.wantRoutes == nil {
+				return
+			}
+			var routes map[string]string
+			if err := json.Unmarshal(rr.Body.Bytes(), &routes); err != nil {
+				t.Fatalf("failure parsing the routes %q: %v", rr.Body.String(), err)
+			}
+			if diff := cmp.Diff(tc.wantRoutes, routes); diff != "" {
+				t.Errorf("unexpected routes: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestKernelDisplayNames(t *testing.T) {
+	m := newMixer(
+		newFakeBackend(t, "local", localKernelSpecs, &resources.Kernel{ID: "kernel1", SpecID: "python3"}),
+		newFakeBackend(t, "remote", remoteKernelSpecs, &resources.Kernel{ID: "kernel2", SpecID: "unknown"}),
+		MixerOptions{})
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, kernels.APIPath, nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected response status listing the kernels: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	var listed []*resources.Kernel
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("failure parsing the kernels %q: %v", rr.Body.String(), err)
+	}
+	displayNames := make(map[string]any)
+	for _, k := range listed {
+		displayNames[k.ID] = k.Metadata[displayNameMetadataKey]
+	}
+	// The display name is the one listed in the launcher, which includes the backend's suffix.
+	want := map[string]any{
+		"kernel1": "Python 3 (local)",
+		"kernel2": nil,
+	}
+	if diff := cmp.Diff(want, displayNames); diff != "" {
+		t.Errorf("unexpected kernel display names: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFindUnknownDisplayName(t *testing.T) {
+	var mu sync.Mutex
+	fetches := 0
+	local := newFakeBackend(t, "local", localKernelSpecs)
+	counted := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == kernelspecs.APIPath {
+			mu.Lock()
+			fetches++
+			mu.Unlock()
+		}
+		local.ServeHTTP(w, r)
+	}))
+	m := newMixer(counted, newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := m.findSpecByDisplayName(context.Background(), "Unknown Kernel"); util.HTTPStatusCode(err) != http.StatusBadRequest {
+			t.Fatalf("Unexpected error finding an unknown display name: got %v, want a %d status", err, http.StatusBadRequest)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// One fetch for the initial spec table, and one refresh for the unknown display name.
+	if got, want := fetches, 2; got != want {
+		t.Errorf("Unexpected number of kernelspec fetches for repeated unknown display names: got %d, want %d", got, want)
+	}
+}
+
+func TestDisplayNameStart(t *testing.T) {
+	ambiguousKernelSpecs := &resources.KernelSpecs{
+		Default: "pyspark",
+		KernelSpecs: map[string]*resources.KernelSpec{
+			"pyspark": &resources.KernelSpec{
+				ID:   "pyspark",
+				Spec: &resources.Spec{Language: "python", DisplayName: "PySpark"},
+			},
+			"pyspark-copy": &resources.KernelSpec{
+				ID:   "pyspark-copy",
+				Spec: &resources.Spec{Language: "python", DisplayName: "PySpark"},
+			},
+		},
+	}
+	testCases := []struct {
+		desc        string
+		displayName string
+		body        string
+		wantStatus  int
+		wantStarts  int
+		wantSpecID  string
+	}{
+		{
+			desc:        "Unique display name",
+			displayName: "Python 3 (local)",
+			body:        `{"path":"notebook.ipynb"}`,
+			wantStatus:  http.StatusCreated,
+			wantStarts:  1,
+		},
+		{
+			desc:        "Empty body",
+			displayName: "Python 3 (local)",
+			wantStatus:  http.StatusCreated,
+			wantStarts:  1,
+		},
+		{
+			desc:        "Unknown display name",
+			displayName: "Python 2 (local)",
+			body:        `{"path":"notebook.ipynb"}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			desc:        "Display name shared by kernelspecs on the same backend",
+			displayName: "PySpark (remote)",
+			body:        `{"path":"notebook.ipynb"}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			desc:        "Disambiguated display name",
+			displayName: "PySpark (remote) (remote-pyspark-copy)",
+			body:        `{"path":"notebook.ipynb"}`,
+			wantStatus:  http.StatusCreated,
+			wantStarts:  1,
+			wantSpecID:  "remote-pyspark-copy",
+		},
+		{
+			desc:        "Both a display name and a spec name",
+			displayName: "Python 3 (local)",
+			body:        `{"name":"local-python3"}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var counter startCounter
+			m := newMixer(counter.wrap(newFakeBackend(t, "local", localKernelSpecs)), counter.wrap(newFakeBackend(t, "remote", ambiguousKernelSpecs)), MixerOptions{})
+			q := url.Values{displayNameParam: []string{tc.displayName}}
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, kernels.APIPath+"?"+q.Encode(), strings.NewReader(tc.body)))
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Fatalf("Unexpected status code for %q: got %d, want %d: %q", tc.displayName, got, want, rr.Body.String())
+			}
+			if got, want := counter.count(), tc.wantStarts; got != want {
+				t.Errorf("Unexpected kernel start requests sent to the backends for %q: got %d, want %d", tc.displayName, got, want)
+			}
+			if tc.wantStatus != http.StatusCreated {
+				return
+			}
+			var started resources.Kernel
+			if err := json.Unmarshal(rr.Body.Bytes(), &started); err != nil {
+				t.Fatalf("failure parsing the started kernel %q: %v", rr.Body.String(), err)
+			}
+			wantSpecID := tc.wantSpecID
+			if wantSpecID == "" {
+				wantSpecID = "local-python3"
+			}
+			if got, want := started.SpecID, wantSpecID; got != want {
+				t.Errorf("Unexpected kernelspec of the started kernel: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFallbackBackend(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		fallbackBackend string
+		specID          string
+		wantStatus      int
+		wantSpecID      string
+	}{
+		{
+			desc:            "Known kernelspec with a fallback",
+			fallbackBackend: "local",
+			specID:          "remote-pyspark",
+			wantStatus:      http.StatusCreated,
+			wantSpecID:      "remote-pyspark",
+		},
+		{
+			desc:            "Stale kernelspec with a fallback",
+			fallbackBackend: "local",
+			specID:          "remote-removed",
+			wantStatus:      http.StatusCreated,
+			wantSpecID:      "local-python3",
+		},
+		{
+			desc:            "Unknown backend with a fallback",
+			fallbackBackend: "local",
+			specID:          "removed-python3",
+			wantStatus:      http.StatusCreated,
+			wantSpecID:      "local-python3",
+		},
+		{
+			desc:       "Stale kernelspec without a fallback",
+			specID:     "remote-removed",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:       "Unknown backend without a fallback",
+			specID:     "removed-python3",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:            "Unknown fallback backend",
+			fallbackBackend: "removed",
+			specID:          "remote-removed",
+			wantStatus:      http.StatusInternalServerError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{FallbackBackend: tc.fallbackBackend})
+			body := `{"name":"` + tc.specID + `","path":"notebook.ipynb"}`
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, kernels.APIPath, strings.NewReader(body)))
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Fatalf("Unexpected status code for %q: got %d, want %d: %q", tc.specID, got, want, rr.Body.String())
+			}
+
+			resolution, err := m.ResolveStart(context.Background(), &resources.Kernel{SpecID: tc.specID})
+			if tc.wantStatus != http.StatusCreated {
+				var routingErr *RoutingError
+				if !errors.As(err, &routingErr) {
+					t.Fatalf("Unexpected error resolving %q: got %v, want a RoutingError", tc.specID, err)
+				}
+				if got, want := routingErr.SpecID, tc.specID; got != want {
+					t.Errorf("Unexpected kernelspec in the routing error: got %q, want %q", got, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failure resolving %q: %v", tc.specID, err)
+			}
+			if got, want := resolution.SpecID, tc.wantSpecID; got != want {
+				t.Errorf("Unexpected resolved kernelspec: got %q, want %q", got, want)
+			}
+			var started resources.Kernel
+			if err := json.Unmarshal(rr.Body.Bytes(), &started); err != nil {
+				t.Fatalf("Failure parsing the started kernel %q: %v", rr.Body.String(), err)
+			}
+			if got, want := started.SpecID, tc.wantSpecID; got != want {
+				t.Errorf("Unexpected kernelspec of the started kernel: got %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// kernelSpecResourcesPath is the URL path prefix for the files (e.g. icons) of each kernelspec.
+const kernelSpecResourcesPath = "/kernelspecs/"
+
+// refreshKernelSpecsPath is the URL path of the admin endpoint that force-refreshes the spec table.
+const refreshKernelSpecsPath = "/mixer/refresh-kernelspecs"
+
+// rawKernelSpecsPath is the URL path of the admin endpoint that reports the unmerged kernelspecs responses of each backend.
+const rawKernelSpecsPath = "/mixer/debug/kernelspecs/raw"
+
+// rawKernelSpecsTimeout bounds how long the raw kernelspecs of every backend are waited on.
+const rawKernelSpecsTimeout = 10 * time.Second
+
+// rawBackendResponse is what a single backend returned when its kernelspecs were listed for debugging.
+type rawBackendResponse struct {
+	// Backend is the name of the backend.
+	Backend string `json:"backend"`
+	// Status is the status code of the backend's response, if it responded.
+	Status int `json:"status,omitempty"`
+	// Response is the body of the backend's response, as is.
+	//
+	// Bodies that are not valid JSON are reported as a JSON string.
+	Response json.RawMessage `json:"response,omitempty"`
+	// Error describes why the backend's kernelspecs could not be read, if they could not.
+	Error string `json:"error,omitempty"`
+
+	// kernelSpecs is the backend's kernelspecs, if its response could be parsed.
+	kernelSpecs *resources.KernelSpecs
+}
+
+// fetchRawKernelSpecs returns the kernelspecs response of the given backend, as is.
+func fetchRawKernelSpecs(ctx context.Context, b *backends.Backend) *rawBackendResponse {
+	raw := &rawBackendResponse{Backend: b.Name()}
+	status, respBytes, err := b.GetRaw(ctx, kernelspecs.APIPath)
+	if err != nil {
+		raw.Error = err.Error()
+		return raw
+	}
+	raw.Status = status
+	if status != http.StatusOK {
+		raw.Error = fmt.Sprintf("unexpected response status %d", status)
+	} else {
+		var ks resources.KernelSpecs
+		if err := json.Unmarshal(respBytes, &ks); err == nil {
+			raw.kernelSpecs = &ks
+		}
+	}
+	if !json.Valid(respBytes) {
+		respBytes, _ = json.Marshal(string(respBytes))
+	}
+	raw.Response = respBytes
+	return raw
+}
+
+// resource returns the resource identifying the backend that returned the given raw kernelspecs.
+//
+// That is the endpointParentResource shared by the backend's kernelspecs, as used by the backend
+// query parameter of the kernels list, or the name of the local backend for that one. If the
+// backend's kernelspecs do not share a single endpointParentResource, then it is the backend's name.
+func (raw *rawBackendResponse) resource() string {
+	if raw.Backend == localBackendName {
+		return localBackendName
+	}
+	if raw.kernelSpecs == nil {
+		return raw.Backend
+	}
+	resource := ""
+	for _, spec := range raw.kernelSpecs.KernelSpecs {
+		if spec == nil {
+			continue
+		}
+		specResource := spec.Resources[endpointParentResourceKey]
+		if specResource == "" || (resource != "" && specResource != resource) {
+			return raw.Backend
+		}
+		resource = specResource
+	}
+	if resource == "" {
+		return raw.Backend
+	}
+	return resource
+}
+
+// cacheControlResponseWriter sets the Cache-Control header on successful responses written through it.
+type cacheControlResponseWriter struct {
+	http.ResponseWriter
+	cacheControl string
+	wroteHeader  bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface
+func (w *cacheControlResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code == http.StatusOK || code == http.StatusNotModified {
+			w.Header().Set("Cache-Control", w.cacheControl)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface
+func (w *cacheControlResponseWriter) Write(bs []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(bs)
+}
+
+// Flush implements the http.Flusher interface
+func (w *cacheControlResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// kernelSpecResourcesHandler returns a handler for the kernelspec resource files, e.g. `/kernelspecs/{name}/logo-64x64.png`.
+//
+// Each request is routed to the backend that owns the named kernelspec, as recorded in the
+// spec table, and the backend's response is streamed back to the client. The files are static,
+// so successful responses are marked as cacheable per the KernelSpecResourcesMaxAge option.
+func (m *Mixer) kernelSpecResourcesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			errorMsg := fmt.Sprintf("unsupported method %q", r.Method)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusMethodNotAllowed)
+			return
+		}
+		subPath := strings.TrimPrefix(r.URL.Path, kernelSpecResourcesPath)
+		unifiedID, file, _ := strings.Cut(subPath, "/")
+		if _, ok := m.lookupSpec(r.Context(), unifiedID); !ok {
+			util.Log(r, fmt.Sprintf("Unknown kernelspec %q for a resource file request", unifiedID))
+			http.NotFound(w, r)
+			return
+		}
+		backend, localID, err := m.router.resolve(unifiedID)
+		if err != nil {
+			util.Log(r, fmt.Sprintf("Failure resolving the backend for the kernelspec %q: %v", unifiedID, err))
+			http.NotFound(w, r)
+			return
+		}
+		r.URL.Path = kernelSpecResourcesPath + localID + "/" + file
+		r.URL.RawPath = ""
+		if cacheControl := m.opts.kernelSpecResourcesCacheControl(); cacheControl != "" {
+			w = &cacheControlResponseWriter{ResponseWriter: w, cacheControl: cacheControl}
+		}
+		backend.ServeHTTP(w, r)
+	})
+}
+
+// checkAdmin returns an error unless the given request was sent by one of the configured admins.
+//
+// Requests whose identity cannot be verified are rejected with a 401 status, and those from other users with a 403 status.
+func (m *Mixer) checkAdmin(r *http.Request) error {
+	identity, err := m.userIdentity(r)
+	if err != nil {
+		return err
+	}
+	for _, admin := range m.opts.AdminIdentities {
+		if admin == identity {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not an admin: %w", identity, util.HTTPError(http.StatusForbidden))
+}
+
+// invalidateKernelSpecs discards the spec table, so that it is re-fetched the next time it is needed.
+func (m *Mixer) invalidateKernelSpecs() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kernelSpecs = nil
+	m.specTableRefreshed = time.Time{}
+}
+
+// refreshKernelSpecsHandler returns a handler that discards the spec table and immediately re-fetches it.
+//
+// This lets admins make newly-attached kernelspecs available without waiting for the table
+// to be refreshed otherwise. The response body is the freshly fetched combined kernelspecs.
+func (m *Mixer) refreshKernelSpecsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errorMsg := fmt.Sprintf("unsupported method %q", r.Method)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusMethodNotAllowed)
+			return
+		}
+		if err := m.checkAdmin(r); err != nil {
+			errorMsg := fmt.Sprintf("refreshing the kernelspecs is restricted to admins: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		m.invalidateKernelSpecs()
+		ks, err := m.KernelSpecs(r.Context())
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure refreshing the kernelspecs: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		respBytes, err := json.Marshal(ks)
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure marshalling the kernelspecs: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(respBytes)
+	})
+}
+
+// rawKernelSpecs returns the kernelspecs response of each backend the mixer routes to, keyed by the backend's resource.
+//
+// The backends are fetched concurrently, and those that have not responded within the
+// rawKernelSpecsTimeout are reported as having timed out. The responses are read separately
+// from the spec table, so that this does not affect it.
+func (m *Mixer) rawKernelSpecs(ctx context.Context) map[string]*rawBackendResponse {
+	ctx, cancel := context.WithTimeout(ctx, rawKernelSpecsTimeout)
+	defer cancel()
+	bs := m.router.Backends()
+	pending := make([]chan *rawBackendResponse, len(bs))
+	for i, b := range bs {
+		pending[i] = make(chan *rawBackendResponse, 1)
+		go func(b *backends.Backend, ch chan<- *rawBackendResponse) {
+			ch <- fetchRawKernelSpecs(ctx, b)
+		}(b, pending[i])
+	}
+	raw := make(map[string]*rawBackendResponse)
+	for i, b := range bs {
+		var resp *rawBackendResponse
+		select {
+		case resp = <-pending[i]:
+		case <-ctx.Done():
+			resp = &rawBackendResponse{Backend: b.Name(), Error: fmt.Sprintf("no response: %v", ctx.Err())}
+		}
+		key := resp.resource()
+		if _, ok := raw[key]; ok {
+			// Another backend shares the resource, so tell them apart by their names.
+			key = b.Name()
+		}
+		raw[key] = resp
+	}
+	return raw
+}
+
+// rawKernelSpecsHandler returns a handler that reports each backend's kernelspecs response before they are merged, for debugging the aggregated kernelspecs.
+//
+// The responses may include kernelspecs that are hidden from some users, so this is restricted to admins.
+func (m *Mixer) rawKernelSpecsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errorMsg := fmt.Sprintf("unsupported method %q", r.Method)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusMethodNotAllowed)
+			return
+		}
+		if err := m.checkAdmin(r); err != nil {
+			errorMsg := fmt.Sprintf("inspecting the raw kernelspecs is restricted to admins: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		respBytes, err := json.Marshal(m.rawKernelSpecs(r.Context()))
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure marshalling the raw kernelspecs: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(respBytes)
+	})
+}
@@ -0,0 +1,482 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// withResourceFiles wraps the given backend so that it serves a PNG icon for each of the given kernelspecs, recording the requested paths.
+func withResourceFiles(b *backends.Backend, requested *[]string, specIDs ...string) *backends.Backend {
+	icons := make(map[string]bool)
+	for _, id := range specIDs {
+		icons["/kernelspecs/"+id+"/logo-64x64.png"] = true
+	}
+	return backends.New(b.Name(), " ("+b.Name()+")", b.Name()+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if icons[r.URL.Path] {
+			*requested = append(*requested, r.URL.Path)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(b.Name() + " icon"))
+			return
+		}
+		b.ServeHTTP(w, r)
+	}))
+}
+
+func TestKernelSpecsPathForms(t *testing.T) {
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+	listKernelSpecs := func(path string) string {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if got, want := rr.Code, http.StatusOK; got != want {
+			t.Fatalf("Unexpected response status for %q: got %d, want %d: %s", path, got, want, rr.Body.String())
+		}
+		return rr.Body.String()
+	}
+	want := listKernelSpecs(kernelspecs.APIPath)
+	var ks resources.KernelSpecs
+	if err := json.Unmarshal([]byte(want), &ks); err != nil || len(ks.KernelSpecs) != 2 {
+		t.Fatalf("Unexpected aggregated kernelspecs %q: %v", want, err)
+	}
+	testCases := []struct {
+		desc string
+		path string
+	}{
+		{
+			desc: "notebook 7 with a cache-busting query",
+			path: "/api/kernelspecs?1700000000000",
+		},
+		{
+			desc: "nbclassic",
+			path: "/api/kernelspecs",
+		},
+		{
+			desc: "classic notebook with a trailing slash",
+			path: "/api/kernelspecs/",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if diff := cmp.Diff(want, listKernelSpecs(tc.path)); diff != "" {
+				t.Errorf("Unexpected kernelspecs for %q: diff (-want +got):\n%s", tc.path, diff)
+			}
+		})
+	}
+}
+
+func TestKernelSpecResources(t *testing.T) {
+	var localRequests, remoteRequests []string
+	m := newMixer(
+		withResourceFiles(newFakeBackend(t, "local", localKernelSpecs), &localRequests, "python3"),
+		withResourceFiles(newFakeBackend(t, "remote", remoteKernelSpecs), &remoteRequests, "pyspark"),
+		MixerOptions{})
+	testCases := []struct {
+		desc            string
+		path            string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+		wantLocal       []string
+		wantRemote      []string
+	}{
+		{
+			desc:            "Local icon",
+			path:            "/kernelspecs/local-python3/logo-64x64.png",
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+			wantBody:        "local icon",
+			wantLocal:       []string{"/kernelspecs/python3/logo-64x64.png"},
+		},
+		{
+			desc:            "Remote icon",
+			path:            "/kernelspecs/remote-pyspark/logo-64x64.png",
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+			wantBody:        "remote icon",
+			wantRemote:      []string{"/kernelspecs/pyspark/logo-64x64.png"},
+		},
+		{
+			desc:       "Unknown kernelspec",
+			path:       "/kernelspecs/remote-unknown/logo-64x64.png",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			localRequests, remoteRequests = nil, nil
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			m.ServeHTTP(rr, r)
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Fatalf("Unexpected status code for %q: got %d, want %d", tc.path, got, want)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			if got, want := rr.Header().Get("Content-Type"), tc.wantContentType; got != want {
+				t.Errorf("Unexpected content type for %q: got %q, want %q", tc.path, got, want)
+			}
+			if got, want := rr.Body.String(), tc.wantBody; got != want {
+				t.Errorf("Unexpected body for %q: got %q, want %q", tc.path, got, want)
+			}
+			if diff := cmp.Diff(tc.wantLocal, localRequests); diff != "" {
+				t.Errorf("Unexpected local backend requests for %q: diff (-want +got):\n%s", tc.path, diff)
+			}
+			if diff := cmp.Diff(tc.wantRemote, remoteRequests); diff != "" {
+				t.Errorf("Unexpected remote backend requests for %q: diff (-want +got):\n%s", tc.path, diff)
+			}
+		})
+	}
+}
+
+func TestKernelSpecResourcesCacheControl(t *testing.T) {
+	var localRequests, remoteRequests []string
+	m := newMixer(
+		withResourceFiles(newFakeBackend(t, "local", localKernelSpecs), &localRequests, "python3"),
+		withResourceFiles(newFakeBackend(t, "remote", remoteKernelSpecs), &remoteRequests, "pyspark"),
+		MixerOptions{KernelSpecResourcesMaxAge: 10 * time.Minute})
+	testCases := []struct {
+		desc             string
+		path             string
+		wantCacheControl string
+	}{
+		{
+			desc:             "Icon",
+			path:             "/kernelspecs/local-python3/logo-64x64.png",
+			wantCacheControl: "private, max-age=600",
+		},
+		{
+			desc: "API response",
+			path: "/api/kernelspecs",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if got, want := rr.Code, http.StatusOK; got != want {
+				t.Fatalf("Unexpected status code for %q: got %d, want %d", tc.path, got, want)
+			}
+			if got, want := rr.Header().Get("Cache-Control"), tc.wantCacheControl; got != want {
+				t.Errorf("Unexpected Cache-Control header for %q: got %q, want %q", tc.path, got, want)
+			}
+		})
+	}
+}
+
+func TestRefreshKernelSpecs(t *testing.T) {
+	var mu sync.Mutex
+	remoteSpecs := &resources.KernelSpecs{
+		Default:     remoteKernelSpecs.Default,
+		KernelSpecs: map[string]*resources.KernelSpec{"pyspark": remoteKernelSpecs.KernelSpecs["pyspark"]},
+	}
+	remote := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != kernelspecs.APIPath {
+			w.Write([]byte("[]"))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(remoteSpecs)
+	}))
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), remote, MixerOptions{AdminIdentities: []string{"admin@example.com"}, TrustedProxies: []string{testProxyAddress}})
+	if _, err := m.KernelSpecs(context.Background()); err != nil {
+		t.Fatalf("Failure fetching the initial kernelspecs: %v", err)
+	}
+
+	// Attach a new cluster to the remote backend.
+	mu.Lock()
+	remoteSpecs.KernelSpecs["new-cluster-pyspark"] = &resources.KernelSpec{
+		ID:        "new-cluster-pyspark",
+		Spec:      &resources.Spec{Language: "python", DisplayName: "PySpark on new-cluster"},
+		Resources: map[string]string{"endpointParentResource": "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/new-cluster"},
+	}
+	mu.Unlock()
+	m.mu.Lock()
+	_, stale := m.kernelSpecs.KernelSpecs["remote-new-cluster-pyspark"]
+	m.mu.Unlock()
+	if stale {
+		t.Fatalf("Unexpected new kernelspec in the spec table before the refresh")
+	}
+
+	testCases := []struct {
+		desc       string
+		method     string
+		identity   string
+		remoteAddr string
+		wantStatus int
+	}{
+		{
+			desc:       "Wrong method",
+			method:     http.MethodGet,
+			identity:   "admin@example.com",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			desc:       "Not an admin",
+			method:     http.MethodPost,
+			identity:   "user@example.com",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			desc:       "Anonymous",
+			method:     http.MethodPost,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:       "Admin header from an untrusted address",
+			method:     http.MethodPost,
+			identity:   "admin@example.com",
+			remoteAddr: "203.0.113.7:1234",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:       "Admin",
+			method:     http.MethodPost,
+			identity:   "admin@example.com",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, refreshKernelSpecsPath, nil)
+			if tc.remoteAddr != "" {
+				r.RemoteAddr = tc.remoteAddr
+			}
+			if tc.identity != "" {
+				r.Header.Set(userIdentityHeader, tc.identity)
+			}
+			m.ServeHTTP(rr, r)
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Fatalf("Unexpected status code: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			var got resources.KernelSpecs
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatalf("Failure parsing the response body %q: %v", rr.Body.String(), err)
+			}
+			if _, ok := got.KernelSpecs["remote-new-cluster-pyspark"]; !ok {
+				t.Errorf("Missing the new kernelspec from the refreshed kernelspecs: %s", rr.Body.String())
+			}
+			if _, ok := m.lookupSpec(context.Background(), "remote-new-cluster-pyspark"); !ok {
+				t.Errorf("Missing the new kernelspec from the spec table after the refresh")
+			}
+		})
+	}
+}
+
+func TestLookupUnknownSpec(t *testing.T) {
+	var mu sync.Mutex
+	fetches := 0
+	local := newFakeBackend(t, "local", localKernelSpecs)
+	counted := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == kernelspecs.APIPath {
+			mu.Lock()
+			fetches++
+			mu.Unlock()
+		}
+		local.ServeHTTP(w, r)
+	}))
+	m := newMixer(counted, newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, ok := m.lookupSpec(context.Background(), "local-unknown"); ok {
+			t.Fatalf("Unexpected kernelspec found for an unknown ID")
+		}
+	}
+	if _, ok := m.lookupSpec(context.Background(), "local-python3"); !ok {
+		t.Errorf("Missing a known kernelspec from the spec table")
+	}
+	mu.Lock()
+	if got, want := fetches, 1; got != want {
+		t.Errorf("Unexpected number of kernelspec fetches for repeated unknown lookups: got %d, want %d", got, want)
+	}
+	mu.Unlock()
+
+	now = now.Add(minSpecTableRefreshInterval)
+	m.lookupSpec(context.Background(), "local-unknown")
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := fetches, 2; got != want {
+		t.Errorf("Unexpected number of kernelspec fetches once the refresh interval passed: got %d, want %d", got, want)
+	}
+}
+
+func TestRawKernelSpecs(t *testing.T) {
+	remote := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusBadGateway)
+	}))
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), remote, MixerOptions{AdminIdentities: []string{"admin@example.com"}, TrustedProxies: []string{testProxyAddress}})
+
+	testCases := []struct {
+		desc       string
+		method     string
+		identity   string
+		remoteAddr string
+		wantStatus int
+	}{
+		{
+			desc:       "Wrong method",
+			method:     http.MethodPost,
+			identity:   "admin@example.com",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			desc:       "Not an admin",
+			method:     http.MethodGet,
+			identity:   "user@example.com",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			desc:       "Admin header from an untrusted address",
+			method:     http.MethodGet,
+			identity:   "admin@example.com",
+			remoteAddr: "203.0.113.7:1234",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:       "Admin",
+			method:     http.MethodGet,
+			identity:   "admin@example.com",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, rawKernelSpecsPath, nil)
+			if tc.remoteAddr != "" {
+				r.RemoteAddr = tc.remoteAddr
+			}
+			if tc.identity != "" {
+				r.Header.Set(userIdentityHeader, tc.identity)
+			}
+			m.ServeHTTP(rr, r)
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Fatalf("Unexpected status code: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			var got map[string]*rawBackendResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatalf("Failure parsing the response body %q: %v", rr.Body.String(), err)
+			}
+			if len(got) != 2 {
+				t.Errorf("Unexpected backends in the raw kernelspecs: got %v, want local and remote", got)
+			}
+			var localSpecs resources.KernelSpecs
+			if local, ok := got["local"]; !ok || local.Error != "" {
+				t.Errorf("Unexpected raw kernelspecs for the local backend: %+v", local)
+			} else if err := json.Unmarshal(local.Response, &localSpecs); err != nil {
+				t.Errorf("Failure parsing the raw kernelspecs of the local backend %q: %v", local.Response, err)
+			} else if _, ok := localSpecs.KernelSpecs["python3"]; !ok {
+				t.Errorf("Missing the unprefixed kernelspec from the raw kernelspecs of the local backend: %s", local.Response)
+			}
+			if remote, ok := got["remote"]; !ok || remote.Error == "" || remote.Status != http.StatusBadGateway {
+				t.Errorf("Unexpected raw kernelspecs for the failing remote backend: got %+v, want an error with status %d", remote, http.StatusBadGateway)
+			}
+		})
+	}
+}
+
+func TestRawKernelSpecsKeyedByResource(t *testing.T) {
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+	raw := m.rawKernelSpecs(context.Background())
+	var keys []string
+	for key, resp := range raw {
+		keys = append(keys, key)
+		if resp.Error != "" {
+			t.Errorf("Unexpected error in the raw kernelspecs of %q: %s", key, resp.Error)
+		}
+	}
+	if diff := cmp.Diff([]string{localBackendName, testClusterResource}, keys, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("Unexpected keys of the raw kernelspecs: diff (-want +got):\n%s", diff)
+	}
+	if got, want := raw[testClusterResource].Backend, "remote"; got != want {
+		t.Errorf("Unexpected backend of the raw kernelspecs for %q: got %q, want %q", testClusterResource, got, want)
+	}
+}
+
+func TestKernelSpecsDisplayNameCollisions(t *testing.T) {
+	clusterResource := "//dataproc.googleapis.com/projects/p1/regions/us-west1/clusters/test-cluster"
+	newSpec := func(id, displayName, resource string) *resources.KernelSpec {
+		spec := &resources.KernelSpec{ID: id, Spec: &resources.Spec{DisplayName: displayName, Language: "python"}}
+		if resource != "" {
+			spec.Resources = map[string]string{endpointParentResourceKey: resource}
+		}
+		return spec
+	}
+	local := newFakeBackend(t, "local", &resources.KernelSpecs{
+		Default: "python3",
+		KernelSpecs: map[string]*resources.KernelSpec{
+			"python3": newSpec("python3", "Python 3", ""),
+		},
+	})
+	remote := newFakeBackend(t, "remote", &resources.KernelSpecs{
+		Default: "python3",
+		KernelSpecs: map[string]*resources.KernelSpec{
+			"python3": newSpec("python3", "Python 3", clusterResource),
+			"ir":      newSpec("ir", "R", clusterResource),
+			"ir-copy": newSpec("ir-copy", "R", clusterResource),
+			"julia":   newSpec("julia", "Julia", clusterResource),
+		},
+	})
+	// Drop the backends' display name suffixes, so that the display names collide across backends.
+	m := newMixer(backends.New("local", "", "local host", local), backends.New("remote", "", "remote host", remote), MixerOptions{})
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, kernelspecs.APIPath, nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("Unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	var ks resources.KernelSpecs
+	if err := json.Unmarshal(rr.Body.Bytes(), &ks); err != nil {
+		t.Fatalf("Failure parsing the kernelspecs %q: %v", rr.Body.String(), err)
+	}
+	got := make(map[string]string)
+	for id, spec := range ks.KernelSpecs {
+		got[id] = spec.Spec.DisplayName
+	}
+	want := map[string]string{
+		"local-python3":  "Python 3 (Local)",
+		"remote-python3": "Python 3 (Dataproc: test-cluster (us-west1))",
+		"remote-ir":      "R (remote-ir)",
+		"remote-ir-copy": "R (remote-ir-copy)",
+		"remote-julia":   "Julia",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected display names: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+	"github.com/gorilla/websocket"
+)
+
+// backendConcurrencyHandler wraps the given backend proxy so that at most the given number of requests are in flight to the backend at once.
+//
+// Requests over the limit wait for an earlier request to complete. If a waiting request's
+// context is done first, e.g. because its deadline passed, then it fails with a 503 status
+// without being forwarded. Websocket upgrade requests are not limited, as their connections
+// outlive the request. A limit of zero or less leaves the requests unlimited.
+func backendConcurrencyHandler(limit int, h http.Handler) http.Handler {
+	if limit <= 0 {
+		return h
+	}
+	inFlight := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case inFlight <- struct{}{}:
+		case <-r.Context().Done():
+			errorMsg := fmt.Sprintf("gave up waiting for one of the %d concurrent backend requests to complete: %v", limit, r.Context().Err())
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-inFlight }()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackendConcurrencyLimit(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight, served := 0, 0, 0
+	release := make(chan struct{})
+	h := backendConcurrencyHandler(1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inFlight--
+		served++
+		mu.Unlock()
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/kernels", nil))
+		}()
+	}
+	// Give both requests time to reach the backend if they were not limited.
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if got, want := inFlight, 1; got != want {
+		t.Errorf("Unexpected number of requests in flight while the first is pending: got %d, want %d", got, want)
+	}
+	mu.Unlock()
+
+	// A queued request gives up once its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernels", nil).WithContext(ctx))
+	if got, want := rr.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Unexpected response status for a queued request whose deadline passed: got %d, want %d", got, want)
+	}
+
+	close(release)
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := served, 2; got != want {
+		t.Errorf("Unexpected number of requests served: got %d, want %d", got, want)
+	}
+	if got, want := maxInFlight, 1; got != want {
+		t.Errorf("Unexpected maximum number of requests in flight: got %d, want %d", got, want)
+	}
+}
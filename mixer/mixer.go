@@ -0,0 +1,801 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mixer implements the combined Jupyter API served on top of a local and a remote backend.
+package mixer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/sessions"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/terminals"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// endpointParentResourceKey is the kernelspec resources entry identifying the remote endpoint hosting a kernelspec.
+const endpointParentResourceKey = "endpointParentResource"
+
+const (
+	localBackendName        = "local"
+	localResourceNameSuffix = " (Local)"
+
+	remoteBackendName        = "remote"
+	remoteResourceNameSuffix = " (Remote)"
+)
+
+// MixerOptions holds the configuration for a Mixer.
+type MixerOptions struct {
+	// LocalBackendURL is the base URL of the locally-running Jupyter server, e.g. "http://localhost:8082".
+	LocalBackendURL string
+	// LocalBackendToken is the token used to authenticate calls to the locally-running Jupyter server.
+	LocalBackendToken string
+	// LocalBackendBasePath is the path prefix under which the locally-running Jupyter server serves its API, e.g. "/jupyter".
+	//
+	// It is joined after any path in the LocalBackendURL.
+	LocalBackendBasePath string
+	// LocalOnly disables the remote backend, so that the mixer only serves the locally-running Jupyter server.
+	//
+	// The remote backend is never contacted and its configuration is ignored. Resource IDs,
+	// including kernelspec IDs, are those of the local server, without a backend prefix.
+	LocalOnly bool
+
+	// RemoteBackendURL is the full URL for the remote backend.
+	//
+	// If unset, this is constructed from the Project, Region, and Host.
+	RemoteBackendURL string
+	// Project is the GCP project of the remote backend.
+	Project string
+	// Region is the GCP region of the remote backend.
+	Region string
+	// Host is the parent hostname of the remote backend.
+	Host string
+	// RemoteBackendBasePath is the path prefix under which the remote backend serves its API, e.g. "/jupyter".
+	//
+	// It is joined after any path in the remote backend's URL.
+	RemoteBackendBasePath string
+	// TokenSource provides the OAuth tokens used to authenticate calls to the remote backend.
+	//
+	// If nil, then requests are forwarded to the remote backend without modifying their authorization.
+	TokenSource oauth2.TokenSource
+
+	// BackendTimeouts bounds the requests forwarded to every backend, unless overridden for that backend.
+	BackendTimeouts BackendTimeouts
+	// LocalBackendTimeouts overrides the BackendTimeouts for the local backend; its unset timeouts are taken from those.
+	LocalBackendTimeouts BackendTimeouts
+	// RemoteBackendTimeouts overrides the BackendTimeouts for the remote backend; its unset timeouts are taken from those.
+	RemoteBackendTimeouts BackendTimeouts
+
+	// MaxConcurrentBackendRequests is the maximum number of requests that are in flight to each backend at once.
+	//
+	// Requests over the limit wait until an earlier request completes or their context is done.
+	// Websocket connections do not count toward the limit. If unset, then requests are not limited.
+	MaxConcurrentBackendRequests int
+
+	// CircuitBreaker controls when the mixer stops forwarding requests to a backend that keeps failing.
+	//
+	// Each remote backend has its own breaker. The local backend has none, as it also serves the
+	// Lab UI, which should stay reachable. If unset, then requests are always forwarded.
+	CircuitBreaker CircuitBreakerPolicy
+
+	// WebSocketPingInterval is how often the mixer sends a ping on each websocket connection it proxies to a backend.
+	//
+	// This keeps idle kernel connections from being dropped by intermediaries between the mixer and the
+	// backend. Pings from the frontend are forwarded to the backend, which answers them. If unset, then
+	// the mixer sends no pings of its own.
+	WebSocketPingInterval time.Duration
+
+	// LocalHeaderPolicy controls which request headers are forwarded to the local backend.
+	LocalHeaderPolicy HeaderPolicy
+	// RemoteHeaderPolicy controls which request headers are forwarded to the remote backend.
+	//
+	// If unset, then DefaultRemoteHeaderPolicy is used.
+	RemoteHeaderPolicy HeaderPolicy
+
+	// UserAgent is the product token that the mixer adds to the User-Agent of every request it forwards to a backend, e.g. "my-mixer/1.0".
+	//
+	// It is appended to any User-Agent sent by the client, so that backends can tell that the
+	// requests were forwarded by the mixer. If unset, then DefaultUserAgent is used.
+	UserAgent string
+
+	// ExternalHostname is the hostname users actually connect to in order to use the mixer.
+	ExternalHostname string
+	// ListenAddress is the address the mixer itself listens on, e.g. "[::1]:8081".
+	//
+	// It is used to reject backends that would forward requests back to the mixer. If unset, then this is not checked.
+	ListenAddress string
+
+	// GzipMinSize is the minimum size, in bytes, of an aggregated response body before it is
+	// gzip-compressed for clients that accept that.
+	GzipMinSize int
+
+	// DeadSessionPolicy determines how sessions whose kernel no longer exists are reported when listing sessions.
+	//
+	// If unset, then such sessions are dropped.
+	DeadSessionPolicy DeadSessionPolicy
+
+	// FallbackBackend is the name of the backend, e.g. "local", on which kernels are started when their kernelspec cannot be resolved.
+	//
+	// Such kernels are started from the fallback backend's default kernelspec. This covers kernelspec
+	// IDs that have gone stale, e.g. after a backend was removed. If unset, then those requests are
+	// rejected with a RoutingError.
+	FallbackBackend string
+
+	// DebugBackendHeaders adds headers to proxied responses naming the backend that served
+	// them and how long it took to respond.
+	//
+	// This exposes backend identifiers to clients, so it should only be enabled for debugging.
+	DebugBackendHeaders bool
+
+	// KernelSpecResourcesMaxAge is how long clients may cache the kernelspec resource files, e.g. icons, that the mixer proxies.
+	//
+	// If zero, then DefaultKernelSpecResourcesMaxAge is used. If negative, then no Cache-Control
+	// header is added. API responses are never marked as cacheable.
+	KernelSpecResourcesMaxAge time.Duration
+
+	// MaxRequestBodySize is the maximum size, in bytes, of the body of a request to create a kernel, session, or terminal.
+	//
+	// If unset, then DefaultMaxRequestBodySize is used.
+	MaxRequestBodySize int64
+
+	// StartRateLimit limits how often each user can start kernels.
+	//
+	// If its Rate is zero, then kernel starts are not limited.
+	StartRateLimit RateLimit
+	// Identity returns the verified identity of the authenticated user that sent a request.
+	//
+	// The identity keys the start rate limits and idempotency keys, and is checked by the admin
+	// endpoints and the Authorizer. If nil, then the identity is read from the
+	// "X-Goog-Authenticated-User-Email" header, but only on requests received from one of the
+	// TrustedProxies. Requests whose identity cannot be verified are rejected wherever one is needed.
+	Identity func(*http.Request) (string, error)
+	// TrustedProxies are the IP addresses or CIDR ranges of the authenticating proxies that set the
+	// "X-Goog-Authenticated-User-Email" header on the requests they forward to the mixer.
+	//
+	// The header is stripped from every request forwarded to a backend.
+	TrustedProxies []string
+
+	// AdminIdentities are the user identities allowed to call the mixer's admin endpoints, e.g. to refresh the kernelspecs.
+	//
+	// Requests whose identity cannot be verified are rejected. If empty, then the admin endpoints reject every request.
+	AdminIdentities []string
+	// Authorizer decides which backends each user may start kernels on.
+	//
+	// The kernelspecs of other backends are not listed for the user. If nil, then every user may use every backend.
+	Authorizer Authorizer
+
+	// Discovery finds the backends that the mixer routes to; it is re-run periodically by RunDiscovery.
+	//
+	// If nil, then the mixer only routes to its local and remote backends.
+	Discovery Discovery
+	// DiscoveryInterval is the time between runs of backend discovery.
+	//
+	// If unset, then DefaultDiscoveryInterval is used.
+	DiscoveryInterval time.Duration
+	// DiscoveryJitter is the fraction of the DiscoveryInterval that is randomly added to each wait between runs.
+	//
+	// If unset, then DefaultDiscoveryJitter is used.
+	DiscoveryJitter float64
+
+	// CORS controls which cross-origin frontends may call the mixer's API.
+	//
+	// If it allows no origins, then cross-origin requests are served without any CORS headers.
+	CORS CORSPolicy
+
+	// TracerProvider provides the tracer used to record spans for each request the mixer serves and each request it forwards to a backend.
+	//
+	// If nil, then no spans are recorded. The trace context is read from and propagated to backends in W3C Trace Context headers.
+	TracerProvider trace.TracerProvider
+}
+
+// userAgent returns the product token added to the User-Agent of forwarded requests.
+func (opts MixerOptions) userAgent() string {
+	if opts.UserAgent == "" {
+		return DefaultUserAgent()
+	}
+	return opts.UserAgent
+}
+
+// remoteHeaderPolicy returns the policy for the request headers forwarded to the remote backend.
+func (opts MixerOptions) remoteHeaderPolicy() HeaderPolicy {
+	if opts.RemoteHeaderPolicy.isEmpty() {
+		return DefaultRemoteHeaderPolicy()
+	}
+	return opts.RemoteHeaderPolicy
+}
+
+// DefaultMaxRequestBodySize is the default limit on the size of the body of a request to create a resource.
+const DefaultMaxRequestBodySize = 4 << 20
+
+// DefaultKernelSpecResourcesMaxAge is the default time that clients may cache the kernelspec resource files.
+const DefaultKernelSpecResourcesMaxAge = time.Hour
+
+// kernelSpecResourcesCacheControl returns the Cache-Control header value for the kernelspec resource files, or the empty string if none is added.
+func (opts MixerOptions) kernelSpecResourcesCacheControl() string {
+	maxAge := opts.KernelSpecResourcesMaxAge
+	if maxAge < 0 {
+		return ""
+	}
+	if maxAge == 0 {
+		maxAge = DefaultKernelSpecResourcesMaxAge
+	}
+	return fmt.Sprintf("private, max-age=%d", int64(maxAge/time.Second))
+}
+
+// maxRequestBodySize returns the limit on the size of the body of a request to create a resource.
+func (opts MixerOptions) maxRequestBodySize() int64 {
+	if opts.MaxRequestBodySize <= 0 {
+		return DefaultMaxRequestBodySize
+	}
+	return opts.MaxRequestBodySize
+}
+
+// parseBackendURL parses and validates the base URL for a backend.
+func parseBackendURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("malformed backend URL %q: %w", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme in the backend URL %q; it must be either http or https", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in the backend URL %q", rawURL)
+	}
+	return u, nil
+}
+
+// withBasePath returns the given backend URL with the given base path joined onto its path.
+//
+// Redundant slashes are removed, and the result has no trailing slash, so that the reverse
+// proxy joins it with each request path using a single slash.
+func withBasePath(u *url.URL, basePath string) *url.URL {
+	joined := strings.TrimSuffix(path.Join("/", u.Path, basePath), "/")
+	withBase := *u
+	withBase.Path = joined
+	withBase.RawPath = ""
+	return &withBase
+}
+
+// localBackendURL returns the validated URL for the local backend.
+func (opts MixerOptions) localBackendURL() (*url.URL, error) {
+	u, err := parseBackendURL(opts.LocalBackendURL)
+	if err != nil {
+		return nil, err
+	}
+	return withBasePath(u, opts.LocalBackendBasePath), nil
+}
+
+// remoteBackendURL returns the validated URL for the remote backend.
+func (opts MixerOptions) remoteBackendURL() (*url.URL, error) {
+	rawURL := opts.RemoteBackendURL
+	if rawURL == "" {
+		if opts.Project == "" || opts.Region == "" {
+			return nil, fmt.Errorf("the project and region of the remote backend are required when its URL is not specified")
+		}
+		rawURL = fmt.Sprintf("https://%s-dot-%s.%s", opts.Project, opts.Region, opts.Host)
+	}
+	u, err := parseBackendURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return withBasePath(u, opts.RemoteBackendBasePath), nil
+}
+
+// Validate reports whether or not the options describe a usable mixer configuration.
+//
+// Besides malformed backend URLs and unsupported policies, this rejects backends whose URL
+// refers to the mixer's own ListenAddress, as requests to those would loop back through the
+// mixer until its resources are exhausted.
+func (opts MixerOptions) Validate() error {
+	_, err := opts.validate()
+	return err
+}
+
+// validate is like Validate, but also returns the parsed URLs of the backends, keyed by backend name.
+//
+// There is no remote backend URL if the options are LocalOnly.
+func (opts MixerOptions) validate() (map[string]*url.URL, error) {
+	localURL, err := opts.localBackendURL()
+	if err != nil {
+		return nil, fmt.Errorf("invalid local backend configuration: %w", err)
+	}
+	if err := opts.LocalHeaderPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid local header policy: %w", err)
+	}
+	if err := opts.RemoteHeaderPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid remote header policy: %w", err)
+	}
+	backendURLs := map[string]*url.URL{localBackendName: localURL}
+	if !opts.LocalOnly {
+		remoteURL, err := opts.remoteBackendURL()
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote backend configuration: %w", err)
+		}
+		backendURLs[remoteBackendName] = remoteURL
+	}
+	if _, err := parseTrustedProxies(opts.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	switch opts.DeadSessionPolicy {
+	case "", DropDeadSessions, ClearDeadSessionKernels:
+	default:
+		return nil, fmt.Errorf("unsupported dead session policy %q", opts.DeadSessionPolicy)
+	}
+	if _, ok := backendURLs[opts.FallbackBackend]; !ok && opts.FallbackBackend != "" && opts.Discovery == nil {
+		// Discovered backends are only known once the mixer is running, so they cannot be checked here.
+		return nil, fmt.Errorf("unknown fallback backend %q", opts.FallbackBackend)
+	}
+	if opts.ListenAddress == "" {
+		return backendURLs, nil
+	}
+	for _, name := range []string{localBackendName, remoteBackendName} {
+		if u, ok := backendURLs[name]; ok && isListenAddress(u, opts.ListenAddress) {
+			return nil, fmt.Errorf("invalid %s backend configuration: the backend URL %q refers to the mixer's own listen address %q", name, u, opts.ListenAddress)
+		}
+	}
+	return backendURLs, nil
+}
+
+// isListenAddress reports whether or not requests to the given backend URL would be received on the given listen address.
+//
+// Hostnames are not resolved, so that this does not depend on the network: "localhost" refers to
+// the loopback addresses, and other hostnames only match the same listen hostname. A listen address
+// with an unspecified host, e.g. ":8081", matches any address of the local machine.
+func isListenAddress(backendURL *url.URL, listenAddress string) bool {
+	listenHost, listenPort, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return false
+	}
+	backendPort := backendURL.Port()
+	if backendPort == "" {
+		backendPort = "80"
+		if backendURL.Scheme == "https" {
+			backendPort = "443"
+		}
+	}
+	if backendPort != listenPort {
+		return false
+	}
+	backendHost := backendURL.Hostname()
+	if listenHost != "" && strings.EqualFold(backendHost, listenHost) {
+		return true
+	}
+	backendIPs := hostIPs(backendHost)
+	listenIP := net.ParseIP(listenHost)
+	if listenHost == "" || (listenIP != nil && listenIP.IsUnspecified()) {
+		for _, ip := range backendIPs {
+			if isLocalIP(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, listenIP := range hostIPs(listenHost) {
+		for _, ip := range backendIPs {
+			if ip.Equal(listenIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostIPs returns the IP addresses that the given host refers to, without resolving it.
+//
+// Those are the host itself if it is an IP address literal, and the loopback addresses for
+// "localhost"; other hostnames have none.
+func hostIPs(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	if strings.EqualFold(host, "localhost") {
+		return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	return nil
+}
+
+// isLocalIP reports whether or not the given IP address belongs to the local machine.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyErrorHandler returns an error handler for a reverse proxy that logs the given message along with the error.
+func proxyErrorHandler(msg string) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		util.Log(r, fmt.Sprintf("%s: %v", msg, err))
+		if websocket.IsWebSocketUpgrade(r) {
+			// Do not report the error via the response status code, as if we do then JupyterLab will
+			// not retry the websocket connection and will unnecessarily report the kernel as disconnected.
+			return
+		}
+		// Report the proxy error using the same status as the default error handler.
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// clearExternalOriginForWebsocketRequests removes the origin header from websocket requests that come from the external hostname.
+func clearExternalOriginForWebsocketRequests(r *http.Request, externalHostname string) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return
+	}
+
+	// The mixer does not allow cross origin websocket requests, so we clear out the
+	// origin header if it is set to something we allow.
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		util.Log(r, fmt.Sprintf("Malformed URL in origin header: %q", origin))
+		return
+	}
+	if originURL.Host == externalHostname {
+		r.Header.Del("Origin")
+	}
+}
+
+// remoteTokenKey is the request context key for the OAuth token that authorizes a request forwarded to the remote backend.
+type remoteTokenKey struct{}
+
+// newRemoteBackend returns the backend that forwards requests to the given remote URL.
+func newRemoteBackend(remoteURL *url.URL, opts MixerOptions) *backends.Backend {
+	remoteProxy := httputil.NewSingleHostReverseProxy(remoteURL)
+	baseDirector := remoteProxy.Director
+	userAgent := opts.userAgent()
+	headerPolicy := opts.remoteHeaderPolicy()
+	remoteProxy.Director = func(r *http.Request) {
+		baseDirector(r)
+		if errs := util.ModifyProxiedRequestForHost(r, remoteURL.Host); len(errs) > 0 {
+			util.Log(r, fmt.Sprintf("Unexpected errors modifying proxied request headers: %v\n", errs))
+		}
+		clearExternalOriginForWebsocketRequests(r, opts.ExternalHostname)
+		headerPolicy.apply(r.Header)
+		r.Header.Del(userIdentityHeader)
+		if token, ok := r.Context().Value(remoteTokenKey{}).(*oauth2.Token); ok {
+			r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+		}
+		addUserAgent(r.Header, userAgent)
+	}
+	remoteProxy.ErrorHandler = proxyErrorHandler("Error forwarding a request to the kernels mixer")
+	remoteProxy.ModifyResponse = keepaliveModifyResponse(opts.WebSocketPingInterval)
+	var handler http.Handler = remoteProxy
+	if opts.TokenSource != nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := opts.TokenSource.Token()
+			if err != nil {
+				msg := fmt.Sprintf("failure generating the authorization header: %v", err)
+				util.Log(r, msg)
+				http.Error(w, msg, util.HTTPStatusCode(err))
+				return
+			}
+			// The token is added by the proxy's director, after the header policy is applied.
+			remoteProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), remoteTokenKey{}, token)))
+		})
+	}
+	handler = backendCircuitBreakerHandler(remoteBackendName, newCircuitBreaker(opts.CircuitBreaker), handler)
+	handler = backendConcurrencyHandler(opts.MaxConcurrentBackendRequests, handler)
+	handler = backendTimeoutHandler(opts.remoteBackendTimeouts(), handler)
+	if opts.DebugBackendHeaders {
+		handler = backendDebugHandler(remoteBackendName, handler)
+	}
+	handler = backendTraceHandler(opts.tracer(), remoteBackendName, handler)
+	return backends.New(remoteBackendName, remoteResourceNameSuffix, remoteURL.Host, handler)
+}
+
+// newLocalBackend returns the backend that forwards requests to the given local URL.
+func newLocalBackend(localURL *url.URL, opts MixerOptions) *backends.Backend {
+	localProxy := httputil.NewSingleHostReverseProxy(localURL)
+	localProxy.ErrorHandler = proxyErrorHandler(fmt.Sprintf("Error forwarding a request to the local Jupyter server. Verify %s is active.", localURL.String()))
+	localProxy.ModifyResponse = keepaliveModifyResponse(opts.WebSocketPingInterval)
+	localProxyBaseDirector := localProxy.Director
+	userAgent := opts.userAgent()
+	localProxy.Director = func(r *http.Request) {
+		localProxyBaseDirector(r)
+		if len(opts.LocalBackendToken) > 0 {
+			q := r.URL.Query()
+			q.Set("token", opts.LocalBackendToken)
+			r.URL.RawQuery = q.Encode()
+		}
+		opts.LocalHeaderPolicy.apply(r.Header)
+		r.Header.Del(userIdentityHeader)
+		addUserAgent(r.Header, userAgent)
+	}
+	var handler http.Handler = localProxy
+	handler = backendConcurrencyHandler(opts.MaxConcurrentBackendRequests, handler)
+	handler = backendTimeoutHandler(opts.localBackendTimeouts(), handler)
+	if opts.DebugBackendHeaders {
+		handler = backendDebugHandler(localBackendName, handler)
+	}
+	handler = backendTraceHandler(opts.tracer(), localBackendName, handler)
+	return backends.New(localBackendName, localResourceNameSuffix, localURL.Host, handler)
+}
+
+// Mixer serves the combined view of the Jupyter API for a local and a remote backend.
+type Mixer struct {
+	opts         MixerOptions
+	localBackend *backends.Backend
+	// router resolves unified IDs to backends for the mixer's own routing decisions.
+	router  *router
+	mux     *http.ServeMux
+	handler http.Handler
+
+	// kernelRoutes records which backend hosts each kernel, as used by the kernels handler.
+	kernelRoutes kernels.RoutingTable
+
+	// now returns the current time, and is overridden in tests.
+	now func() time.Time
+
+	// trustedProxies are the parsed TrustedProxies from the mixer's options.
+	trustedProxies []*net.IPNet
+	// startLimiter limits how often each user can start kernels.
+	startLimiter *rateLimiter
+
+	// mu protects the fields below it.
+	mu sync.Mutex
+
+	// kernelSpecs is the most recently fetched combined kernelspecs, used as the spec table.
+	kernelSpecs *resources.KernelSpecs
+	// backendDefaults is the ID within each backend of its default kernelspec, as of the spec table, keyed by the backend's name.
+	backendDefaults map[string]string
+	// specTableRefreshed is when the spec table was last refreshed to look up an unknown kernelspec.
+	specTableRefreshed time.Time
+
+	// idempotentStarts records the kernel starts for each idempotency key, scoped by user.
+	idempotentStarts map[string]*idempotentStart
+
+	// webSockets is the set of open frontend websocket connections proxied by the mixer.
+	webSockets map[*trackedConn]bool
+	// shuttingDown is set once Shutdown is called, after which new websockets are rejected.
+	shuttingDown bool
+
+	// frontendConnections is the number of open frontend websocket connections proxied by the mixer for each kernel ID.
+	frontendConnections map[string]int
+}
+
+// NewMixer returns a new Mixer with the given options.
+//
+// The backend URLs are validated up front, so that a malformed configuration is
+// reported here rather than as a failure while serving a request.
+func NewMixer(opts MixerOptions) (*Mixer, error) {
+	backendURLs, err := opts.validate()
+	if err != nil {
+		return nil, err
+	}
+	localBackend := newLocalBackend(backendURLs[localBackendName], opts)
+	if opts.LocalOnly {
+		return newMixer(localBackend, nil, opts), nil
+	}
+	return newMixer(localBackend, newRemoteBackend(backendURLs[remoteBackendName], opts), opts), nil
+}
+
+// kernelSpecsPaths are the mux patterns under which the aggregated kernelspecs handler is registered.
+//
+// The deployed frontends list the kernelspecs using these path forms, which must all return the same output:
+//   - Notebook 7 and JupyterLab request "/api/kernelspecs" via @jupyterlab/services, which appends
+//     a cache-busting timestamp query, e.g. "/api/kernelspecs?1700000000000". normalizeLegacyPaths
+//     drops that query before routing.
+//   - The nbclassic kernel selector requests "/api/kernelspecs" without a query.
+//   - The notebook 4 and IPython 3 classic frontends request "/api/kernelspecs/", which
+//     normalizeLegacyPaths maps onto "/api/kernelspecs" before routing.
+//
+// The subtree pattern also serves the single kernelspec paths, e.g. "/api/kernelspecs/{name}".
+var kernelSpecsPaths = []string{kernelspecs.APIPath, kernelspecs.APIPath + "/"}
+
+// newMixer returns a new Mixer for the given backends.
+//
+// If the options are LocalOnly, then the remote backend is ignored and may be nil, and the
+// resource IDs of the local backend are used as is.
+func newMixer(localBackend, remoteBackend *backends.Backend, opts MixerOptions) *Mixer {
+	bs := []*backends.Backend{localBackend, remoteBackend}
+	if opts.LocalOnly {
+		localBackend = localBackend.Unqualified()
+		bs = []*backends.Backend{localBackend}
+	}
+	// The options were validated by NewMixer, so malformed trusted proxies only occur in tests and trust nothing.
+	trustedProxies, _ := parseTrustedProxies(opts.TrustedProxies)
+	m := &Mixer{
+		opts:           opts,
+		localBackend:   localBackend,
+		router:         newRouter(bs...),
+		mux:            http.NewServeMux(),
+		now:            time.Now,
+		trustedProxies: trustedProxies,
+		startLimiter:   newRateLimiter(opts.StartRateLimit),
+
+		idempotentStarts:    make(map[string]*idempotentStart),
+		webSockets:          make(map[*trackedConn]bool),
+		frontendConnections: make(map[string]int),
+	}
+	gzipMinSize := opts.GzipMinSize
+	kernelSpecsHandler := util.GzipHandler(m.authorizeKernelSpecsHandler(kernelspecs.PoolHandler(m.router)), gzipMinSize)
+	kernelsAPIHandler, kernelRoutes := kernels.HandlerWithRoutingTable(m.router, m.dropCulledKernels, m.filterKernelsByBackend, m.annotateListedFrontendConnections, m.annotateListedDisplayNames, m.enrichListedKernels)
+	m.kernelRoutes = kernelRoutes
+	kernelsHandler := util.GzipHandler(m.limitRequestBodyHandler(kernels.APIPath, m.displayNameStartHandler(m.validateStartHandler(m.authorizeStartHandler(m.dryRunStartHandler(m.idempotentStartHandler(m.rateLimitStartHandler(m.frontendConnectionsHandler(kernelsAPIHandler)))))))), gzipMinSize)
+	sessionsHandler := util.GzipHandler(m.limitRequestBodyHandler(sessions.APIPath, m.fallbackSessionStartHandler(m.authorizeStartHandler(sessions.PoolHandler(m.router, kernelRoutes, m.reconcileListedSessions)))), gzipMinSize)
+	terminalsHandler := util.GzipHandler(m.limitRequestBodyHandler(terminals.APIPath, terminals.Handler(localBackend)), gzipMinSize)
+
+	for _, p := range kernelSpecsPaths {
+		m.mux.Handle(p, kernelSpecsHandler)
+	}
+	m.mux.Handle(kernelSpecResourcesPath, m.kernelSpecResourcesHandler())
+	m.mux.Handle(refreshKernelSpecsPath, m.refreshKernelSpecsHandler())
+	m.mux.Handle(routesPath, m.routesHandler())
+	m.mux.Handle(orphanKernelsPath, m.orphanKernelsHandler())
+	m.mux.Handle(rawKernelSpecsPath, m.rawKernelSpecsHandler())
+
+	m.mux.Handle("/api/kernels", kernelsHandler)
+	m.mux.Handle("/api/kernels/", kernelsHandler)
+
+	m.mux.Handle("/api/sessions", sessionsHandler)
+	m.mux.Handle("/api/sessions/", sessionsHandler)
+
+	m.mux.Handle("/api/terminals", terminalsHandler)
+	m.mux.Handle("/api/terminals/", terminalsHandler)
+	m.mux.Handle("/terminals/websocket/", terminalsHandler)
+	m.mux.Handle("/", localBackend)
+	m.handler = m.traceHandler(m.webSocketHandler(normalizeLegacyPaths(m.corsHandler(m.mux))))
+	return m
+}
+
+// limitRequestBodyHandler wraps the given handler so that requests to create a resource in the given collection have a bounded body size.
+//
+// The body is read in full before the wrapped handler is called, and requests whose body is too
+// large are rejected with a 413 status without being forwarded to any backend.
+func (m *Mixer) limitRequestBodyHandler(collectionPath string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != collectionPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+		reqBytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, m.opts.maxRequestBodySize()))
+		r.Body.Close()
+		if err != nil {
+			statusCode := http.StatusBadRequest
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				statusCode = http.StatusRequestEntityTooLarge
+			}
+			errorMsg := fmt.Sprintf("failure reading the request body: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, statusCode)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(reqBytes))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (m *Mixer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// KernelSpecs fetches the combined kernelspecs from the backends the mixer routes to and records them as the mixer's spec table.
+//
+// The backends are fetched using the given context, so that the fetch is bounded by its deadline.
+func (m *Mixer) KernelSpecs(ctx context.Context) (*resources.KernelSpecs, error) {
+	ks, backendDefaults, err := kernelspecs.CombinedKernelSpecsWithDefaults(ctx, m.router.Backends()...)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kernelSpecs = ks
+	m.backendDefaults = backendDefaults
+	return ks, nil
+}
+
+// minSpecTableRefreshInterval is the minimum time between refreshes of the spec table to look up an unknown kernelspec.
+//
+// This bounds the load on the backends from clients that keep requesting kernelspecs that do not exist.
+const minSpecTableRefreshInterval = 5 * time.Second
+
+// refreshSpecTable refreshes the spec table to look up an unknown kernelspec.
+//
+// If the table was already refreshed for that within the minSpecTableRefreshInterval, then the
+// table is returned as is instead, or an error if it has never been fetched.
+func (m *Mixer) refreshSpecTable(ctx context.Context) (*resources.KernelSpecs, error) {
+	now := m.now()
+	m.mu.Lock()
+	if now.Sub(m.specTableRefreshed) < minSpecTableRefreshInterval {
+		defer m.mu.Unlock()
+		if m.kernelSpecs == nil {
+			return nil, fmt.Errorf("the kernelspecs were refreshed too recently: %w", util.HTTPError(http.StatusServiceUnavailable))
+		}
+		return m.kernelSpecs, nil
+	}
+	m.specTableRefreshed = now
+	m.mu.Unlock()
+	return m.KernelSpecs(ctx)
+}
+
+// lookupSpec returns the kernelspec with the given unified ID from the spec table.
+//
+// If the kernelspec is not in the table, then the table is refreshed before trying again, at
+// most once per minSpecTableRefreshInterval.
+func (m *Mixer) lookupSpec(ctx context.Context, specID string) (*resources.KernelSpec, bool) {
+	m.mu.Lock()
+	ks := m.kernelSpecs
+	m.mu.Unlock()
+	if ks != nil {
+		if spec, ok := ks.KernelSpecs[specID]; ok {
+			return spec, true
+		}
+	}
+	ks, err := m.refreshSpecTable(ctx)
+	if err != nil {
+		log.Printf("Failure refreshing the kernelspecs table: %v", err)
+		return nil, false
+	}
+	spec, ok := ks.KernelSpecs[specID]
+	return spec, ok
+}
+
+// isLocalEndpoint reports whether or not the given endpointParentResource value identifies the local backend.
+//
+// Kernelspecs from the local backend are not hosted by a remote endpoint, so they do not have one.
+func isLocalEndpoint(endpointParentResource string) bool {
+	return endpointParentResource == ""
+}
+
+// IsRemoteKernel reports whether or not the given kernel runs on a remote backend.
+//
+// The kernel's spec is resolved using the mixer's spec table, and the kernel is
+// remote unless that spec belongs to the local backend. Kernels whose spec is
+// unknown are not reported as remote.
+func (m *Mixer) IsRemoteKernel(ctx context.Context, k *resources.Kernel) bool {
+	if k == nil {
+		return false
+	}
+	spec, ok := m.lookupSpec(ctx, k.SpecID)
+	if !ok || spec == nil {
+		return false
+	}
+	return !isLocalEndpoint(spec.Resources[endpointParentResourceKey])
+}
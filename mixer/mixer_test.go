@@ -0,0 +1,519 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+)
+
+const testClusterResource = "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/test-cluster"
+
+var localKernelSpecs = &resources.KernelSpecs{
+	Default: "python3",
+	KernelSpecs: map[string]*resources.KernelSpec{
+		"python3": &resources.KernelSpec{
+			ID:   "python3",
+			Spec: &resources.Spec{Language: "python", DisplayName: "Python 3"},
+		},
+	},
+}
+
+var remoteKernelSpecs = &resources.KernelSpecs{
+	Default: "pyspark",
+	KernelSpecs: map[string]*resources.KernelSpec{
+		"pyspark": &resources.KernelSpec{
+			ID:        "pyspark",
+			Spec:      &resources.Spec{Language: "python", DisplayName: "PySpark"},
+			Resources: map[string]string{"endpointParentResource": testClusterResource},
+		},
+	},
+}
+
+// newFakeBackend returns a backend that reports the given kernelspecs and kernels, and no other resources.
+//
+// Requests to start a kernel succeed, but the new kernel is not added to the reported kernels.
+func newFakeBackend(t *testing.T, name string, ks *resources.KernelSpecs, kernelList ...*resources.Kernel) *backends.Backend {
+	t.Helper()
+	ksBytes, err := json.Marshal(ks)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v) got error %v want nil", ks, err)
+	}
+	if kernelList == nil {
+		kernelList = []*resources.Kernel{}
+	}
+	kernelsBytes, err := json.Marshal(kernelList)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v) got error %v want nil", kernelList, err)
+	}
+	return backends.New(name, " ("+name+")", name+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case kernelspecs.APIPath:
+			w.Write(ksBytes)
+		case kernels.APIPath:
+			if r.Method == http.MethodPost {
+				var k resources.Kernel
+				if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				k.ID = "new-kernel"
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(k)
+				return
+			}
+			w.Write(kernelsBytes)
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+}
+
+func TestIsRemoteKernel(t *testing.T) {
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{GzipMinSize: util.DefaultGzipMinSize})
+	testCases := []struct {
+		desc   string
+		kernel *resources.Kernel
+		want   bool
+	}{
+		{
+			desc:   "Local kernel",
+			kernel: &resources.Kernel{ID: "kernel1", SpecID: "local-python3"},
+			want:   false,
+		},
+		{
+			desc:   "Remote kernel",
+			kernel: &resources.Kernel{ID: "kernel2", SpecID: "remote-pyspark"},
+			want:   true,
+		},
+		{
+			desc:   "Kernel with an unknown spec",
+			kernel: &resources.Kernel{ID: "kernel3", SpecID: "remote-unknown"},
+			want:   false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got, want := m.IsRemoteKernel(context.Background(), tc.kernel), tc.want; got != want {
+				t.Errorf("IsRemoteKernel(%+v): got %v, want %v", tc.kernel, got, want)
+			}
+		})
+	}
+}
+
+func TestNewMixer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case kernelspecs.APIPath:
+			w.Write([]byte(`{"default":"python3","kernelspecs":{}}`))
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer backend.Close()
+	testCases := []struct {
+		desc    string
+		opts    MixerOptions
+		wantErr bool
+	}{
+		{
+			desc: "Valid remote URL",
+			opts: MixerOptions{
+				LocalBackendURL:  backend.URL,
+				RemoteBackendURL: backend.URL,
+			},
+		},
+		{
+			desc: "Malformed local URL",
+			opts: MixerOptions{
+				LocalBackendURL:  "http://[::1",
+				RemoteBackendURL: "https://remote.example.com",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Local URL missing a scheme",
+			opts: MixerOptions{
+				LocalBackendURL:  "localhost:8082",
+				RemoteBackendURL: "https://remote.example.com",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Missing local URL",
+			opts: MixerOptions{
+				RemoteBackendURL: "https://remote.example.com",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Remote URL missing a host",
+			opts: MixerOptions{
+				LocalBackendURL:  "http://localhost:8082",
+				RemoteBackendURL: "https:///path",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Unsupported dead session policy",
+			opts: MixerOptions{
+				LocalBackendURL:   "http://localhost:8082",
+				RemoteBackendURL:  "https://remote.example.com",
+				DeadSessionPolicy: "ignore",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Missing remote project and region",
+			opts: MixerOptions{
+				LocalBackendURL: "http://localhost:8082",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m, err := NewMixer(tc.opts)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error from NewMixer(%+v): got %v, want error: %v", tc.opts, err, tc.wantErr)
+			}
+			if err == nil && m == nil {
+				t.Errorf("NewMixer(%+v) returned a nil mixer", tc.opts)
+			}
+		})
+	}
+
+	// The remote URL constructed from the project and region is checked without creating a mixer, which would contact it.
+	opts := MixerOptions{Project: "example-project", Region: "us-central1", Host: "kernels.googleusercontent.com"}
+	remoteURL, err := opts.remoteBackendURL()
+	if err != nil {
+		t.Fatalf("Failure constructing the remote URL from the project and region: %v", err)
+	}
+	if got, want := remoteURL.String(), "https://example-project-dot-us-central1.kernels.googleusercontent.com"; got != want {
+		t.Errorf("Unexpected remote URL constructed from the project and region: got %q, want %q", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case kernelspecs.APIPath:
+			w.Write([]byte(`{"default":"python3","kernelspecs":{}}`))
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer backend.Close()
+	testCases := []struct {
+		desc    string
+		opts    MixerOptions
+		wantErr bool
+	}{
+		{
+			desc: "Backends on other ports",
+			opts: MixerOptions{
+				LocalBackendURL:  backend.URL,
+				RemoteBackendURL: backend.URL,
+				ListenAddress:    "[::1]:8081",
+			},
+		},
+		{
+			desc: "Listen address unset",
+			opts: MixerOptions{
+				LocalBackendURL:  backend.URL,
+				RemoteBackendURL: backend.URL,
+			},
+		},
+		{
+			desc: "Local backend is the mixer itself",
+			opts: MixerOptions{
+				LocalBackendURL:  "http://[::1]:8081",
+				RemoteBackendURL: backend.URL,
+				ListenAddress:    "[::1]:8081",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Local backend is the mixer itself by hostname",
+			opts: MixerOptions{
+				LocalBackendURL:  "http://localhost:8081",
+				RemoteBackendURL: backend.URL,
+				ListenAddress:    "[::1]:8081",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Local-only backend is the mixer itself",
+			opts: MixerOptions{
+				LocalBackendURL: "http://[::1]:8081/jupyter",
+				LocalOnly:       true,
+				ListenAddress:   "[::1]:8081",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Remote backend is the mixer listening on every address",
+			opts: MixerOptions{
+				LocalBackendURL:  backend.URL,
+				RemoteBackendURL: "http://127.0.0.1:8081",
+				ListenAddress:    ":8081",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Known fallback backend",
+			opts: MixerOptions{
+				LocalBackendURL:  backend.URL,
+				RemoteBackendURL: backend.URL,
+				FallbackBackend:  "local",
+			},
+		},
+		{
+			desc: "Unknown fallback backend",
+			opts: MixerOptions{
+				LocalBackendURL:  backend.URL,
+				RemoteBackendURL: backend.URL,
+				FallbackBackend:  "removed",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.opts.Validate()
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("Unexpected error from Validate(): got %v, want error: %v", err, tc.wantErr)
+			}
+			if _, err := NewMixer(tc.opts); (err != nil) != tc.wantErr {
+				t.Errorf("Unexpected error from NewMixer(%+v): got %v, want error: %v", tc.opts, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	var mu sync.Mutex
+	var backendRequests int
+	counted := func(b *backends.Backend) *backends.Backend {
+		return backends.New(b.Name(), " ("+b.Name()+")", b.Name()+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			backendRequests++
+			mu.Unlock()
+			b.ServeHTTP(w, r)
+		}))
+	}
+	m := newMixer(counted(newFakeBackend(t, "local", localKernelSpecs)), counted(newFakeBackend(t, "remote", remoteKernelSpecs)), MixerOptions{MaxRequestBodySize: 64})
+	oversized := `{"name":"local-python3","env":{"PADDING":"` + strings.Repeat("x", 64) + `"}}`
+	testCases := []struct {
+		desc             string
+		path             string
+		body             string
+		wantStatus       int
+		wantBackendCalls bool
+	}{
+		{
+			desc:       "oversized kernel start",
+			path:       "/api/kernels",
+			body:       oversized,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:       "oversized session create",
+			path:       "/api/sessions",
+			body:       oversized,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:       "oversized terminal create",
+			path:       "/api/terminals",
+			body:       oversized,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:             "kernel start within the limit",
+			path:             "/api/kernels",
+			body:             `{"name":"local-python3"}`,
+			wantStatus:       http.StatusCreated,
+			wantBackendCalls: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			mu.Lock()
+			backendRequests = 0
+			mu.Unlock()
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, req)
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Errorf("unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got, want := backendRequests > 0, tc.wantBackendCalls; got != want {
+				t.Errorf("unexpected backend calls: got %d requests, want calls: %v", backendRequests, want)
+			}
+		})
+	}
+}
+
+func TestBackendBasePath(t *testing.T) {
+	var mu sync.Mutex
+	var upstreamPaths []string
+	var upgrader websocket.Upgrader
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstreamPaths = append(upstreamPaths, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/jupyter" + kernels.APIPath:
+			w.Write([]byte(`[{"id":"kernel1","name":"python3"}]`))
+		case "/jupyter" + kernels.APIPath + "/kernel1/channels":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer local.Close()
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusBadGateway)
+	}))
+	defer remote.Close()
+	testCases := []struct {
+		desc string
+		opts MixerOptions
+	}{
+		{
+			desc: "base path in the backend URL",
+			opts: MixerOptions{LocalBackendURL: local.URL + "/jupyter/"},
+		},
+		{
+			desc: "separate base path",
+			opts: MixerOptions{LocalBackendURL: local.URL, LocalBackendBasePath: "jupyter/"},
+		},
+		{
+			desc: "separate base path with redundant slashes",
+			opts: MixerOptions{LocalBackendURL: local.URL + "/", LocalBackendBasePath: "//jupyter//"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			mu.Lock()
+			upstreamPaths = nil
+			mu.Unlock()
+			tc.opts.RemoteBackendURL = remote.URL
+			m, err := NewMixer(tc.opts)
+			if err != nil {
+				t.Fatalf("failure creating the mixer: %v", err)
+			}
+			mixerServer := httptest.NewServer(m)
+			defer mixerServer.Close()
+			resp, err := http.Get(mixerServer.URL + kernels.APIPath)
+			if err != nil {
+				t.Fatalf("failure listing the kernels: %v", err)
+			}
+			resp.Body.Close()
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Errorf("unexpected status listing the kernels: got %d, want %d", got, want)
+			}
+			wsURL := "ws" + strings.TrimPrefix(mixerServer.URL, "http") + kernels.APIPath + "/kernel1/channels"
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			if err != nil {
+				t.Fatalf("failure connecting to the kernel: %v", err)
+			}
+			conn.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			for _, want := range []string{"/jupyter" + kernels.APIPath, "/jupyter" + kernels.APIPath + "/kernel1/channels"} {
+				found := false
+				for _, got := range upstreamPaths {
+					found = found || got == want
+				}
+				if !found {
+					t.Errorf("missing the upstream request path %q: got %v", want, upstreamPaths)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	var mu sync.Mutex
+	remoteRequests := 0
+	remote := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remoteRequests++
+		mu.Unlock()
+		w.Write([]byte("[]"))
+	}))
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs, &resources.Kernel{ID: "k1", SpecID: "python3"}), remote, MixerOptions{LocalOnly: true})
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernelspecs", nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("Unexpected response status listing the kernelspecs: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	var ks resources.KernelSpecs
+	if err := json.Unmarshal(rr.Body.Bytes(), &ks); err != nil {
+		t.Fatalf("Failure parsing the kernelspecs %q: %v", rr.Body.String(), err)
+	}
+	if _, ok := ks.KernelSpecs["python3"]; len(ks.KernelSpecs) != 1 || !ok || ks.Default != "python3" {
+		t.Errorf("Unexpected kernelspecs in local-only mode: got %s, want only the unqualified local kernelspecs", rr.Body.String())
+	}
+	if _, err := m.KernelSpecs(context.Background()); err != nil {
+		t.Errorf("Unexpected error fetching the kernelspecs table in local-only mode: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernels", nil))
+	var kernelList []*resources.Kernel
+	if err := json.Unmarshal(rr.Body.Bytes(), &kernelList); err != nil {
+		t.Fatalf("Failure parsing the kernels %q: %v", rr.Body.String(), err)
+	}
+	if len(kernelList) != 1 || kernelList[0].SpecID != "python3" {
+		t.Errorf("Unexpected kernels in local-only mode: got %s, want only the kernel with its unqualified kernelspec", rr.Body.String())
+	}
+	if diff := cmp.Diff(map[string]string{"k1": "local"}, m.RoutingSnapshot()); diff != "" {
+		t.Errorf("Unexpected routing table in local-only mode (-want +got):\n%s", diff)
+	}
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/sessions", nil))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if remoteRequests != 0 {
+		t.Errorf("Unexpected requests to the remote backend in local-only mode: got %d, want 0", remoteRequests)
+	}
+
+	if _, err := NewMixer(MixerOptions{LocalBackendURL: "http://localhost:8082", LocalOnly: true}); err != nil {
+		t.Errorf("Unexpected error creating a local-only mixer without a remote backend: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// maxIdleRateLimitBuckets is the number of tracked users above which the buckets of idle users are discarded.
+const maxIdleRateLimitBuckets = 1024
+
+// RateLimit configures a token-bucket rate limit.
+type RateLimit struct {
+	// Rate is the number of operations per second that are allowed on average.
+	//
+	// If zero, then operations are not limited.
+	Rate float64
+	// Burst is the number of operations that are allowed at once.
+	//
+	// If less than 1, then a single operation is allowed at once.
+	Burst int
+}
+
+// burst returns the capacity of the token bucket for the rate limit.
+func (rl RateLimit) burst() float64 {
+	if rl.Burst < 1 {
+		return 1
+	}
+	return float64(rl.Burst)
+}
+
+// tokenBucket tracks the remaining operations a single user may perform.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter applies a RateLimit separately for each user identity.
+type rateLimiter struct {
+	limit RateLimit
+
+	// mu protects the fields below it.
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns a rate limiter for the given limit.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// refill returns the number of tokens the given bucket holds at the given time.
+func (rl *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rl.limit.Rate
+	if burst := rl.limit.burst(); tokens > burst {
+		return burst
+	}
+	return tokens
+}
+
+// allow reports whether or not the given user may perform an operation at the given time.
+//
+// If not, then it also returns how long the user has to wait before they may.
+func (rl *rateLimiter) allow(identity string, now time.Time) (bool, time.Duration) {
+	if rl.limit.Rate <= 0 {
+		return true, 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if len(rl.buckets) > maxIdleRateLimitBuckets {
+		// Buckets that have refilled completely are equivalent to missing ones.
+		for id, b := range rl.buckets {
+			if rl.refill(b, now) >= rl.limit.burst() {
+				delete(rl.buckets, id)
+			}
+		}
+	}
+	b, ok := rl.buckets[identity]
+	if !ok {
+		b = &tokenBucket{tokens: rl.limit.burst(), last: now}
+		rl.buckets[identity] = b
+	}
+	b.tokens = rl.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.limit.Rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimitStartHandler wraps the given kernels handler so that each user can only start kernels at the configured rate.
+//
+// Requests exceeding the rate are rejected with a 429 status and a `Retry-After` header,
+// without being forwarded to any backend. Other kernel operations are not limited.
+func (m *Mixer) rateLimitStartHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != kernels.APIPath || m.opts.StartRateLimit.Rate <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		identity, err := m.userIdentity(r)
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure identifying the user to rate limit a kernel start: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		if ok, wait := m.startLimiter.allow(identity, m.now()); !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			errorMsg := fmt.Sprintf("too many requests to start a kernel by %q; retry after %d seconds", identity, retryAfter)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
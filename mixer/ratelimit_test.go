@@ -0,0 +1,114 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartRateLimit(t *testing.T) {
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{
+		StartRateLimit: RateLimit{Rate: 0.5, Burst: 2},
+		TrustedProxies: []string{testProxyAddress},
+	})
+	now := time.Date(2023, 2, 14, 1, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	start := func(identity string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/kernels", strings.NewReader(`{"name":"local-python3"}`))
+		req.Header.Set(userIdentityHeader, identity)
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, req)
+		return rr
+	}
+	list := func(identity string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/kernels", nil)
+		req.Header.Set(userIdentityHeader, identity)
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, req)
+		return rr
+	}
+	testCases := []struct {
+		desc           string
+		identity       string
+		do             func(string) *httptest.ResponseRecorder
+		advance        time.Duration
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{
+			desc:       "first start within the burst",
+			identity:   "alice@example.com",
+			do:         start,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			desc:       "second start within the burst",
+			identity:   "alice@example.com",
+			do:         start,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			desc:           "start exceeding the burst",
+			identity:       "alice@example.com",
+			do:             start,
+			wantStatus:     http.StatusTooManyRequests,
+			wantRetryAfter: "2",
+		},
+		{
+			desc:       "list is not limited",
+			identity:   "alice@example.com",
+			do:         list,
+			wantStatus: http.StatusOK,
+		},
+		{
+			desc:       "another identity is unaffected",
+			identity:   "bob@example.com",
+			do:         start,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			desc:           "start before a token is refilled",
+			identity:       "alice@example.com",
+			do:             start,
+			advance:        time.Second,
+			wantStatus:     http.StatusTooManyRequests,
+			wantRetryAfter: "1",
+		},
+		{
+			desc:       "start after a token is refilled",
+			identity:   "alice@example.com",
+			do:         start,
+			advance:    time.Second,
+			wantStatus: http.StatusCreated,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			now = now.Add(tc.advance)
+			rr := tc.do(tc.identity)
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Errorf("unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+			if got, want := rr.Header().Get("Retry-After"), tc.wantRetryAfter; got != want {
+				t.Errorf("unexpected Retry-After header: got %q, want %q", got, want)
+			}
+		})
+	}
+}
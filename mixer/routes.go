@@ -0,0 +1,86 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernelspecs"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/sessions"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/terminals"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// legacyAPIPaths lists the variants of the Jupyter API collection paths that the mixer accepts, along with the path it serves for each.
+//
+// The Jupyter server serves each collection without a trailing slash, and only the variants
+// with one are accepted here, so that clients that append it are not routed to the local
+// backend's passthrough.
+var legacyAPIPaths = []struct {
+	legacy string
+	modern string
+}{
+	{legacy: kernelspecs.APIPath + "/", modern: kernelspecs.APIPath},
+	{legacy: kernels.APIPath + "/", modern: kernels.APIPath},
+	{legacy: sessions.APIPath + "/", modern: sessions.APIPath},
+	{legacy: terminals.APIPath + "/", modern: terminals.APIPath},
+}
+
+// apiVersionQuery matches a query that consists solely of an API version, e.g. the `?1.0` of "/api/kernels?1.0".
+var apiVersionQuery = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// normalizeAPIPath maps the given request path onto the path the mixer serves for it.
+//
+// Older clients that join their base URL with API paths produce repeated slashes
+// (e.g. "//api/kernels"), which are collapsed for API paths before looking the
+// result up in legacyAPIPaths. All other paths are returned unmodified.
+func normalizeAPIPath(path string) string {
+	normalized := path
+	for strings.Contains(normalized, "//") {
+		normalized = strings.ReplaceAll(normalized, "//", "/")
+	}
+	if !strings.HasPrefix(normalized, "/api/") {
+		return path
+	}
+	for _, variant := range legacyAPIPaths {
+		if normalized == variant.legacy {
+			return variant.modern
+		}
+	}
+	return normalized
+}
+
+// normalizeLegacyPaths wraps the given handler so that requests for legacy API path variants are served by the modern path's handler.
+func normalizeLegacyPaths(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if normalized := normalizeAPIPath(r.URL.Path); normalized != r.URL.Path {
+			util.Log(r, fmt.Sprintf("Normalized the legacy API path %q to %q", r.URL.Path, normalized))
+			r.URL.Path = normalized
+			r.URL.RawPath = ""
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") && apiVersionQuery.MatchString(r.URL.RawQuery) {
+			// The version is not a query parameter of the Jupyter API, so it is not forwarded to the backends.
+			util.Log(r, fmt.Sprintf("Dropped the API version query %q from %q", r.URL.RawQuery, r.URL.Path))
+			r.URL.RawQuery = ""
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+)
+
+func TestNormalizeAPIPath(t *testing.T) {
+	testCases := []struct {
+		path string
+		want string
+	}{
+		{path: "/api/kernelspecs", want: "/api/kernelspecs"},
+		{path: "/api/kernelspecs/", want: "/api/kernelspecs"},
+		{path: "//api/kernelspecs", want: "/api/kernelspecs"},
+		{path: "/api/kernels", want: "/api/kernels"},
+		{path: "/api/kernels/", want: "/api/kernels"},
+		{path: "//api//kernels/", want: "/api/kernels"},
+		{path: "/api/kernels/kernel1", want: "/api/kernels/kernel1"},
+		{path: "/api/sessions/", want: "/api/sessions"},
+		{path: "/api/terminals/", want: "/api/terminals"},
+		{path: "/kernelspecs/local-python3/logo-64x64.png", want: "/kernelspecs/local-python3/logo-64x64.png"},
+		{path: "/lab//tree", want: "/lab//tree"},
+	}
+	for _, tc := range testCases {
+		if got := normalizeAPIPath(tc.path); got != tc.want {
+			t.Errorf("Unexpected normalized path for %q: got %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeLegacyPathsVersionQuery(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		target    string
+		wantQuery string
+	}{
+		{
+			desc:      "API version",
+			target:    "/api/kernels?1.0",
+			wantQuery: "",
+		},
+		{
+			desc:      "API query parameter",
+			target:    "/api/kernels?backend=cluster",
+			wantQuery: "backend=cluster",
+		},
+		{
+			desc:      "Non-API path",
+			target:    "/lab?1.0",
+			wantQuery: "1.0",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var gotQuery string
+			h := normalizeLegacyPaths(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotQuery = r.URL.RawQuery
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.target, nil))
+			if gotQuery != tc.wantQuery {
+				t.Errorf("Unexpected query for %q: got %q, want %q", tc.target, gotQuery, tc.wantQuery)
+			}
+		})
+	}
+}
+
+func TestLegacyAPIPaths(t *testing.T) {
+	localKernel := &resources.Kernel{ID: "kernel1", SpecID: "python3"}
+	m := newMixer(
+		newFakeBackend(t, "local", localKernelSpecs, localKernel),
+		newFakeBackend(t, "remote", remoteKernelSpecs),
+		MixerOptions{})
+	testCases := []struct {
+		desc  string
+		paths []string
+		check func(t *testing.T, body []byte)
+	}{
+		{
+			desc:  "List kernelspecs",
+			paths: []string{"/api/kernelspecs", "/api/kernelspecs/", "//api/kernelspecs", "/api/kernelspecs?1.0"},
+			check: func(t *testing.T, body []byte) {
+				var ks resources.KernelSpecs
+				if err := json.Unmarshal(body, &ks); err != nil {
+					t.Fatalf("Failure parsing the kernelspecs %q: %v", string(body), err)
+				}
+				if _, ok := ks.KernelSpecs["local-python3"]; !ok {
+					t.Errorf("Missing the local kernelspec from %q", string(body))
+				}
+			},
+		},
+		{
+			desc:  "List kernels",
+			paths: []string{"/api/kernels", "/api/kernels/", "//api/kernels", "/api/kernels?1.0"},
+			check: func(t *testing.T, body []byte) {
+				var ks []*resources.Kernel
+				if err := json.Unmarshal(body, &ks); err != nil {
+					t.Fatalf("Failure parsing the kernels %q: %v", string(body), err)
+				}
+				if len(ks) != 1 || ks[0].ID != localKernel.ID {
+					t.Errorf("Unexpected kernels %q: want the kernel %q", string(body), localKernel.ID)
+				}
+			},
+		},
+	}
+	for _, tc := range testCases {
+		for _, path := range tc.paths {
+			t.Run(tc.desc+" "+path, func(t *testing.T) {
+				rr := httptest.NewRecorder()
+				m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+				if got, want := rr.Code, http.StatusOK; got != want {
+					t.Fatalf("Unexpected status code for %q: got %d, want %d: %q", path, got, want, rr.Body.String())
+				}
+				tc.check(t, rr.Body.Bytes())
+			})
+		}
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/sessions"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// DeadSessionPolicy determines how sessions that reference a kernel which no longer exists are handled.
+type DeadSessionPolicy string
+
+const (
+	// DropDeadSessions removes sessions whose kernel no longer exists.
+	DropDeadSessions DeadSessionPolicy = "drop"
+	// ClearDeadSessionKernels keeps sessions whose kernel no longer exists, but clears their kernel.
+	ClearDeadSessionKernels DeadSessionPolicy = "clear-kernel"
+)
+
+// ReconcileSessions cross-checks the kernels of the given sessions against the kernels routing table.
+//
+// Sessions whose kernel is not hosted by the backend of that kernel's spec are either dropped or
+// have their kernel cleared, according to the mixer's DeadSessionPolicy. Sessions whose kernel
+// might be on a backend that could not be reached are left unchanged, as are sessions without a kernel.
+//
+// The supplied sessions are not modified.
+func (m *Mixer) ReconcileSessions(ctx context.Context, sessions []*resources.Session) []*resources.Session {
+	reconciled := make([]*resources.Session, 0, len(sessions))
+	for _, sess := range sessions {
+		if sess == nil || sess.Kernel == nil || m.hasLiveKernel(ctx, sess.Kernel) {
+			reconciled = append(reconciled, sess)
+			continue
+		}
+		if m.opts.DeadSessionPolicy == ClearDeadSessionKernels {
+			cleared := *sess
+			cleared.Kernel = nil
+			reconciled = append(reconciled, &cleared)
+		}
+	}
+	return reconciled
+}
+
+// hasLiveKernel reports whether or not the given kernel might still be running.
+//
+// This is only false if the kernels routing table knows that no backend hosts the kernel, or
+// that it is hosted by a backend other than the one of the kernel's spec. Unknown kernels are
+// looked up with the table's rate-limited refresh, rather than listing the kernels every time.
+func (m *Mixer) hasLiveKernel(ctx context.Context, k *resources.Kernel) bool {
+	b, err := m.kernelRoutes.Lookup(ctx, k.ID)
+	if err != nil {
+		// If any backend could not be reached, then the kernel might be running there.
+		return util.HTTPStatusCode(err) != http.StatusNotFound
+	}
+	if specBackend, _, err := m.router.resolve(k.SpecID); err == nil {
+		return specBackend == b
+	}
+	// The kernel's spec does not identify a backend, so accept it on any of them.
+	return true
+}
+
+// OrphanKernels returns the global view of the kernels that are not referenced by any session, such as kernels started outside of the mixer.
+//
+// Each backend's kernels are only matched against the sessions of that same backend, since
+// kernel IDs are not unique across backends. The backends are listed concurrently, and the
+// error for each backend whose kernels or sessions cannot be listed is returned keyed by the
+// backend's name, rather than reporting that backend's kernels as orphans.
+func (m *Mixer) OrphanKernels(ctx context.Context) ([]*resources.Kernel, map[string]error) {
+	bs := m.router.Backends()
+	backendOrphans := make([][]*resources.Kernel, len(bs))
+	errs := make([]error, len(bs))
+	var wg sync.WaitGroup
+	for i, b := range bs {
+		wg.Add(1)
+		go func(i int, b *backends.Backend) {
+			defer wg.Done()
+			backendOrphans[i], errs[i] = backendOrphanKernels(ctx, b)
+		}(i, b)
+	}
+	wg.Wait()
+	orphans := []*resources.Kernel{}
+	failed := make(map[string]error)
+	for i, b := range bs {
+		if errs[i] != nil {
+			failed[b.Name()] = errs[i]
+			continue
+		}
+		orphans = append(orphans, backendOrphans[i]...)
+	}
+	return orphans, failed
+}
+
+// backendOrphanKernels returns the global view of the kernels of the given backend that are not referenced by any of its sessions.
+func backendOrphanKernels(ctx context.Context, b *backends.Backend) ([]*resources.Kernel, error) {
+	ks, err := b.ListKernels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failure listing the kernels for orphan detection: %w", err)
+	}
+	sessions, err := b.ListSessions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failure listing the sessions for orphan detection: %w", err)
+	}
+	referenced := make(map[string]bool)
+	for _, sess := range sessions {
+		if sess != nil && sess.Kernel != nil {
+			referenced[sess.Kernel.ID] = true
+		}
+	}
+	var orphans []*resources.Kernel
+	for _, k := range ks {
+		if !referenced[k.ID] {
+			orphans = append(orphans, kernels.UnifiedView(k, b))
+		}
+	}
+	return orphans, nil
+}
+
+// orphanKernelsPath is the URL path of the admin endpoint reporting the kernels that are not referenced by any session.
+const orphanKernelsPath = "/mixer/orphan-kernels"
+
+// orphanKernelsHandler returns a handler that reports the kernels that are not referenced by any session, so that admins can find and reap them.
+//
+// The response body is a JSON object with the orphaned kernels under "kernels", and the error
+// for each backend that could not be checked under "failed_backends". If no backend could be
+// checked, then the response has a 502 status.
+func (m *Mixer) orphanKernelsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errorMsg := fmt.Sprintf("unsupported method %q", r.Method)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusMethodNotAllowed)
+			return
+		}
+		if err := m.checkAdmin(r); err != nil {
+			errorMsg := fmt.Sprintf("inspecting the orphaned kernels is restricted to admins: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		orphans, failed := m.OrphanKernels(r.Context())
+		failures := make(map[string]string)
+		for name, err := range failed {
+			util.Log(r, fmt.Sprintf("Failure checking the backend %q for orphaned kernels: %v", name, err))
+			failures[name] = err.Error()
+		}
+		respBytes, err := json.Marshal(map[string]any{
+			"kernels":         orphans,
+			"failed_backends": failures,
+		})
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure marshalling the orphaned kernels: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if len(failed) > 0 && len(failed) == len(m.router.Backends()) {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		w.Write(respBytes)
+	})
+}
+
+// reconcileListedSessions is a sessions list hook that reconciles the listed sessions against the running kernels.
+func (m *Mixer) reconcileListedSessions(r *http.Request, ss []*resources.Session) ([]*resources.Session, error) {
+	return m.ReconcileSessions(r.Context(), ss), nil
+}
+
+// withSessionKernelSpecID returns the given request body to create a session with the kernelspec of its kernel replaced by the given one.
+//
+// The other fields of the request, and of its kernel, are preserved as is.
+func withSessionKernelSpecID(reqBytes []byte, specID string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(reqBytes, &fields); err != nil {
+		return nil, fmt.Errorf("failure parsing the request body: %v: %w", err, util.HTTPError(http.StatusBadRequest))
+	}
+	kernelBytes, err := withStartSpecID(fields["kernel"], specID)
+	if err != nil {
+		return nil, err
+	}
+	fields["kernel"] = kernelBytes
+	return json.Marshal(fields)
+}
+
+// fallbackSessionStartHandler wraps the given sessions handler so that sessions whose kernelspec cannot be resolved start their kernel on the fallback backend.
+//
+// Such requests have their kernelspec replaced with the fallback backend's default kernelspec, or
+// are rejected with a RoutingError's status if there is no fallback. Requests for an existing
+// kernel, or without a kernel, are passed through unmodified.
+func (m *Mixer) fallbackSessionStartHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != sessions.APIPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure reading the request body: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(reqBytes))
+		var sess resources.Session
+		if err := json.Unmarshal(reqBytes, &sess); err != nil || sess.Kernel == nil || sess.Kernel.ID != "" || sess.Kernel.SpecID == "" {
+			// Leave malformed requests for the sessions handler to report.
+			h.ServeHTTP(w, r)
+			return
+		}
+		specID, err := m.resolveStartSpecID(r.Context(), sess.Kernel.SpecID)
+		if err != nil {
+			errorMsg := fmt.Sprintf("invalid request to create a session: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		if specID != sess.Kernel.SpecID {
+			if reqBytes, err = withSessionKernelSpecID(reqBytes, specID); err != nil {
+				errorMsg := fmt.Sprintf("failure rewriting the kernelspec of the request: %v", err)
+				util.Log(r, errorMsg)
+				http.Error(w, errorMsg, util.HTTPStatusCode(err))
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(reqBytes))
+			r.ContentLength = int64(len(reqBytes))
+			r.Header.Del("Content-Length")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,619 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/sessions"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestReconcileSessions(t *testing.T) {
+	localKernel := &resources.Kernel{ID: "kernel1", SpecID: "python3"}
+	remoteKernel := &resources.Kernel{ID: "kernel2", SpecID: "pyspark"}
+	liveSession := &resources.Session{
+		ID:     "session1",
+		Path:   "live.ipynb",
+		Kernel: &resources.Kernel{ID: "kernel1", SpecID: "local-python3"},
+	}
+	remoteSession := &resources.Session{
+		ID:     "session2",
+		Path:   "remote.ipynb",
+		Kernel: &resources.Kernel{ID: "kernel2", SpecID: "remote-pyspark"},
+	}
+	deadSession := &resources.Session{
+		ID:     "session3",
+		Path:   "dead.ipynb",
+		Kernel: &resources.Kernel{ID: "nonexistent", SpecID: "local-python3"},
+	}
+	misroutedSession := &resources.Session{
+		ID:     "session4",
+		Path:   "misrouted.ipynb",
+		Kernel: &resources.Kernel{ID: "kernel1", SpecID: "remote-pyspark"},
+	}
+	kernellessSession := &resources.Session{
+		ID:   "session5",
+		Path: "kernelless.ipynb",
+	}
+	sessions := []*resources.Session{liveSession, remoteSession, deadSession, misroutedSession, kernellessSession}
+	testCases := []struct {
+		desc   string
+		policy DeadSessionPolicy
+		want   []*resources.Session
+	}{
+		{
+			desc: "Default policy",
+			want: []*resources.Session{liveSession, remoteSession, kernellessSession},
+		},
+		{
+			desc:   "Drop dead sessions",
+			policy: DropDeadSessions,
+			want:   []*resources.Session{liveSession, remoteSession, kernellessSession},
+		},
+		{
+			desc:   "Clear the kernels of dead sessions",
+			policy: ClearDeadSessionKernels,
+			want: []*resources.Session{
+				liveSession,
+				remoteSession,
+				&resources.Session{ID: "session3", Path: "dead.ipynb"},
+				&resources.Session{ID: "session4", Path: "misrouted.ipynb"},
+				kernellessSession,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m := newMixer(
+				newFakeBackend(t, "local", localKernelSpecs, localKernel),
+				newFakeBackend(t, "remote", remoteKernelSpecs, remoteKernel),
+				MixerOptions{DeadSessionPolicy: tc.policy})
+			got := m.ReconcileSessions(context.Background(), sessions)
+			if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreUnexported(resources.Session{}, resources.Kernel{})); diff != "" {
+				t.Errorf("Unexpected result from ReconcileSessions: diff (-want +got):\n%s", diff)
+			}
+			if deadSession.Kernel == nil {
+				t.Errorf("ReconcileSessions modified the supplied session %q", deadSession.ID)
+			}
+		})
+	}
+}
+
+func TestReconcileListedSessions(t *testing.T) {
+	var listed []*resources.Session
+	if err := json.Unmarshal([]byte(`[
+		{"id":"session1","path":"live.ipynb","type":"notebook","custom":{"nested":true},"kernel":{"id":"kernel1","name":"python3"}},
+		{"id":"session2","path":"dead.ipynb","type":"notebook","custom":"dead","kernel":{"id":"nonexistent","name":"python3"}}
+	]`), &listed); err != nil {
+		t.Fatalf("Failure parsing the test sessions: %v", err)
+	}
+	local := &fakeBackend{
+		name:     "local",
+		specs:    localKernelSpecs,
+		kernels:  []*resources.Kernel{{ID: "kernel1", SpecID: "python3"}},
+		sessions: listed,
+	}
+	remote := &fakeBackend{name: "remote", specs: remoteKernelSpecs}
+	m := newMixer(local.backend(), remote.backend(), MixerOptions{DeadSessionPolicy: ClearDeadSessionKernels})
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/sessions", nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("Unexpected response status listing the sessions: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Failure parsing the listed sessions %q: %v", rr.Body.String(), err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i]["id"].(string) < got[j]["id"].(string) })
+	want := []map[string]any{
+		{
+			"id":     "session1",
+			"path":   "live.ipynb",
+			"type":   "notebook",
+			"custom": map[string]any{"nested": true},
+			"kernel": map[string]any{"id": "kernel1", "name": "local-python3", "connections": float64(0)},
+		},
+		{
+			"id":     "session2",
+			"path":   "dead.ipynb",
+			"type":   "notebook",
+			"custom": "dead",
+			"kernel": nil,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected listed sessions: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestOrphanKernels(t *testing.T) {
+	local := &fakeBackend{
+		name:    "local",
+		kernels: []*resources.Kernel{{ID: "kernel1", SpecID: "python3"}},
+		sessions: []*resources.Session{
+			{ID: "session1", Path: "notebook.ipynb", Kernel: &resources.Kernel{ID: "kernel1", SpecID: "python3"}},
+		},
+	}
+	// The remote kernel shares its ID with the local one, but no remote session references it.
+	remote := &fakeBackend{
+		name:    "remote",
+		kernels: []*resources.Kernel{{ID: "kernel1", SpecID: "pyspark"}},
+	}
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+	m.router = newRouter(local.backend(), remote.backend())
+
+	got, failed := m.OrphanKernels(context.Background())
+	if len(failed) > 0 {
+		t.Fatalf("Unexpected failures from OrphanKernels: %v", failed)
+	}
+	want := []*resources.Kernel{{ID: "kernel1", SpecID: "remote-pyspark"}}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(resources.Kernel{})); diff != "" {
+		t.Errorf("Unexpected result from OrphanKernels: diff (-want +got):\n%s", diff)
+	}
+
+	// The local kernel is now orphaned too, and is still reported while the remote backend is unreachable.
+	local.mu.Lock()
+	local.sessions = nil
+	local.mu.Unlock()
+	remote.setErr(errors.New("unreachable"))
+	got, failed = m.OrphanKernels(context.Background())
+	if _, ok := failed["remote"]; !ok || len(failed) != 1 {
+		t.Errorf("Unexpected failures from OrphanKernels with an unreachable backend: got %v, want only %q", failed, "remote")
+	}
+	want = []*resources.Kernel{{ID: "kernel1", SpecID: "local-python3"}}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(resources.Kernel{})); diff != "" {
+		t.Errorf("Unexpected result from OrphanKernels with an unreachable backend: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestOrphanKernelsHandler(t *testing.T) {
+	local := &fakeBackend{
+		name:    "local",
+		kernels: []*resources.Kernel{{ID: "kernel1", SpecID: "python3"}},
+	}
+	remote := &fakeBackend{name: "remote"}
+	remote.setErr(errors.New("unreachable"))
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), newFakeBackend(t, "remote", remoteKernelSpecs),
+		MixerOptions{AdminIdentities: []string{"admin@example.com"}, TrustedProxies: []string{testProxyAddress}})
+	m.router = newRouter(local.backend(), remote.backend())
+	testCases := []struct {
+		desc       string
+		identity   string
+		wantStatus int
+	}{
+		{
+			desc:       "Admin",
+			identity:   "admin@example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			desc:       "Non-admin",
+			identity:   "user@example.com",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			desc:       "Unidentified",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, orphanKernelsPath, nil)
+			if tc.identity != "" {
+				r.Header.Set(userIdentityHeader, tc.identity)
+			}
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, r)
+			if got := rr.Code; got != tc.wantStatus {
+				t.Fatalf("Unexpected response status: got %d, want %d: %s", got, tc.wantStatus, rr.Body.String())
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			var report struct {
+				Kernels        []*resources.Kernel `json:"kernels"`
+				FailedBackends map[string]string   `json:"failed_backends"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+				t.Fatalf("Failure parsing the orphaned kernels %q: %v", rr.Body.String(), err)
+			}
+			if len(report.Kernels) != 1 || report.Kernels[0].SpecID != "local-python3" {
+				t.Errorf("Unexpected orphaned kernels: got %s", rr.Body.String())
+			}
+			if _, ok := report.FailedBackends["remote"]; !ok || len(report.FailedBackends) != 1 {
+				t.Errorf("Unexpected failed backends: got %v, want only %q", report.FailedBackends, "remote")
+			}
+		})
+	}
+}
+
+func TestCreateSessionForExistingKernel(t *testing.T) {
+	var mu sync.Mutex
+	var sessionRequests []*resources.Session
+	kernelStarts := 0
+	remote := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == kernels.APIPath:
+			w.Write([]byte(`[{"id":"kernel2","name":"pyspark","execution_state":"idle"}]`))
+		case r.Method == http.MethodPost && r.URL.Path == kernels.APIPath:
+			kernelStarts++
+			http.Error(w, "unexpected kernel start", http.StatusInternalServerError)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/sessions":
+			var sess resources.Session
+			if err := json.NewDecoder(r.Body).Decode(&sess); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sessionRequests = append(sessionRequests, &sess)
+			sess.ID = "session1"
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&sess)
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), remote, MixerOptions{})
+
+	testCases := []struct {
+		desc string
+		url  string
+		body string
+	}{
+		{
+			desc: "kernel ID in the body",
+			url:  "/api/sessions",
+			body: `{"path":"notebook.ipynb","type":"notebook","kernel":{"id":"kernel2"}}`,
+		},
+		{
+			desc: "kernel ID in the query",
+			url:  "/api/sessions?kernel=kernel2",
+			body: `{"path":"notebook.ipynb","type":"notebook"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			mu.Lock()
+			sessionRequests = nil
+			mu.Unlock()
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body)))
+			if got, want := rr.Code, http.StatusCreated; got != want {
+				t.Fatalf("Unexpected response status creating the session: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+			var created resources.Session
+			if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+				t.Fatalf("Failure parsing the created session %q: %v", rr.Body.String(), err)
+			}
+			if created.Kernel == nil || created.Kernel.ID != "kernel2" || created.Kernel.SpecID != "remote-pyspark" {
+				t.Errorf("Unexpected kernel for the created session: got %+v, want the existing remote kernel", created.Kernel)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(sessionRequests) != 1 {
+				t.Fatalf("Unexpected session requests to the remote backend: got %d, want 1", len(sessionRequests))
+			}
+			if k := sessionRequests[0].Kernel; k == nil || k.ID != "kernel2" || k.SpecID != "pyspark" {
+				t.Errorf("Unexpected kernel in the session request to the remote backend: got %+v", k)
+			}
+			if kernelStarts != 0 {
+				t.Errorf("Unexpected kernel starts: got %d, want 0", kernelStarts)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/sessions", strings.NewReader(`{"path":"notebook.ipynb","kernel":{"id":"unknown"}}`)))
+	if got, want := rr.Code, http.StatusNotFound; got != want {
+		t.Errorf("Unexpected response status creating a session for an unknown kernel: got %d, want %d", got, want)
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	remote := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/sessions":
+			w.Write([]byte(`[
+				{"id":"session1","path":"a.ipynb","type":"notebook","kernel":{"id":"kernel2","name":"pyspark"}},
+				{"id":"session2","path":"b.ipynb","type":"notebook","kernel":{"id":"kernel3","name":"pyspark"}}
+			]`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/sessions/session1":
+			deleted = append(deleted, "session1")
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete:
+			// The session was already deleted, e.g. by another client.
+			http.NotFound(w, r)
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	m := newMixer(newFakeBackend(t, "local", localKernelSpecs), remote, MixerOptions{})
+
+	testCases := []struct {
+		desc       string
+		sessionID  string
+		wantStatus int
+	}{
+		{
+			desc:       "remote session",
+			sessionID:  "session1",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			desc:       "session already deleted from its backend",
+			sessionID:  "session2",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			desc:       "unknown session",
+			sessionID:  "session3",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/api/sessions/"+tc.sessionID, nil))
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Errorf("Unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+		})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([]string{"session1"}, deleted); diff != "" {
+		t.Errorf("Unexpected sessions deleted from the remote backend: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCreateSessionForExistingPath(t *testing.T) {
+	var mu sync.Mutex
+	var created []*resources.Session
+	local := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/sessions":
+			json.NewEncoder(w).Encode(created)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/sessions":
+			var sess resources.Session
+			if err := json.NewDecoder(r.Body).Decode(&sess); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sess.ID = "session" + strconv.Itoa(len(created)+1)
+			sess.Kernel.ID = "kernel" + strconv.Itoa(len(created)+1)
+			created = append(created, &sess)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&sess)
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	m := newMixer(local, newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{})
+
+	createSession := func(path string) *resources.Session {
+		body := `{"path":"` + path + `","type":"notebook","kernel":{"name":"local-python3"}}`
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/sessions", strings.NewReader(body)))
+		if got, want := rr.Code, http.StatusCreated; got != want {
+			t.Fatalf("Unexpected response status creating a session for %q: got %d, want %d: %s", path, got, want, rr.Body.String())
+		}
+		var sess resources.Session
+		if err := json.Unmarshal(rr.Body.Bytes(), &sess); err != nil {
+			t.Fatalf("Failure parsing the created session %q: %v", rr.Body.String(), err)
+		}
+		return &sess
+	}
+	first := createSession("notebook.ipynb")
+	second := createSession("notebook.ipynb")
+	if diff := cmp.Diff(first, second, cmpopts.IgnoreUnexported(resources.Session{}, resources.Kernel{})); diff != "" {
+		t.Errorf("Unexpected session returned for a duplicate create: diff (-want +got):\n%s", diff)
+	}
+	other := createSession("other.ipynb")
+	if other.ID == first.ID {
+		t.Errorf("Unexpected session returned for a different path: got %q, want a new session", other.ID)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := len(created), 2; got != want {
+		t.Errorf("Unexpected number of sessions created on the backend: got %d, want %d", got, want)
+	}
+}
+
+func TestCreateSessionWithoutKernel(t *testing.T) {
+	var mu sync.Mutex
+	created := make(map[string][]*resources.Session)
+	fakeSessionsBackend := func(name string) *backends.Backend {
+		return backends.New(name, " ("+name+")", name+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case r.Method == http.MethodGet && r.URL.Path == "/api/sessions":
+				json.NewEncoder(w).Encode(created[name])
+			case r.Method == http.MethodPost && r.URL.Path == "/api/sessions":
+				var sess resources.Session
+				if err := json.NewDecoder(r.Body).Decode(&sess); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				sess.ID = name + "-session" + strconv.Itoa(len(created[name])+1)
+				created[name] = append(created[name], &sess)
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(&sess)
+			default:
+				w.Write([]byte("[]"))
+			}
+		}))
+	}
+	m := newMixer(fakeSessionsBackend("local"), fakeSessionsBackend("remote"), MixerOptions{})
+
+	body := `{"path":"console-1","type":"console","kernel":null}`
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/sessions", strings.NewReader(body)))
+	if got, want := rr.Code, http.StatusCreated; got != want {
+		t.Fatalf("Unexpected response status creating a session without a kernel: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	var sess resources.Session
+	if err := json.Unmarshal(rr.Body.Bytes(), &sess); err != nil {
+		t.Fatalf("Failure parsing the created session %q: %v", rr.Body.String(), err)
+	}
+	if sess.Kernel != nil {
+		t.Errorf("Unexpected kernel for the created session: got %+v, want nil", sess.Kernel)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := len(created["local"]), 1; got != want {
+		t.Errorf("Unexpected number of sessions created on the local backend: got %d, want %d", got, want)
+	}
+	if got, want := len(created["remote"]), 0; got != want {
+		t.Errorf("Unexpected number of sessions created on the remote backend: got %d, want %d", got, want)
+	}
+}
+
+func TestListSessionsWithDuplicateIDs(t *testing.T) {
+	backendSessions := map[string][]*resources.Session{
+		"local": {
+			{ID: "session1", Path: "local.ipynb", Type: resources.SessionTypeNotebook},
+			{ID: "session2", Path: "shared.ipynb", Type: resources.SessionTypeNotebook},
+		},
+		"remote": {
+			{ID: "session2", Path: "shared.ipynb", Type: resources.SessionTypeNotebook},
+			{ID: "session3", Path: "remote.ipynb", Type: resources.SessionTypeNotebook},
+		},
+	}
+	fakeSessionsBackend := func(name string) *backends.Backend {
+		return backends.New(name, " ("+name+")", name+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && r.URL.Path == "/api/sessions" {
+				json.NewEncoder(w).Encode(backendSessions[name])
+				return
+			}
+			w.Write([]byte("[]"))
+		}))
+	}
+	m := newMixer(fakeSessionsBackend("local"), fakeSessionsBackend("remote"), MixerOptions{})
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/sessions", nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("Unexpected response status listing the sessions: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	var listed []*resources.Session
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("Failure parsing the listed sessions %q: %v", rr.Body.String(), err)
+	}
+	var ids []string
+	for _, sess := range listed {
+		ids = append(ids, sess.ID)
+	}
+	sort.Strings(ids)
+	if diff := cmp.Diff([]string{"remote-session2", "session1", "session2", "session3"}, ids); diff != "" {
+		t.Errorf("Unexpected sessions listed: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFallbackSessionStart(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		fallbackBackend string
+		specID          string
+		wantStatus      int
+		wantSpecID      string
+	}{
+		{
+			desc:            "Known kernelspec with a fallback",
+			fallbackBackend: "local",
+			specID:          "local-python3",
+			wantStatus:      http.StatusCreated,
+			wantSpecID:      "python3",
+		},
+		{
+			desc:            "Stale kernelspec with a fallback",
+			fallbackBackend: "local",
+			specID:          "remote-removed",
+			wantStatus:      http.StatusCreated,
+			wantSpecID:      "python3",
+		},
+		{
+			desc:       "Stale kernelspec without a fallback",
+			specID:     "remote-removed",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var created []map[string]any
+			fake := newFakeBackend(t, "local", localKernelSpecs)
+			local := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != sessions.APIPath {
+					fake.ServeHTTP(w, r)
+					return
+				}
+				var sess map[string]any
+				if err := json.NewDecoder(r.Body).Decode(&sess); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				created = append(created, sess)
+				sess["id"] = "session1"
+				sess["kernel"].(map[string]any)["id"] = "kernel1"
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(sess)
+			}))
+			m := newMixer(local, newFakeBackend(t, "remote", remoteKernelSpecs), MixerOptions{FallbackBackend: tc.fallbackBackend})
+			body := `{"path":"notebook.ipynb","type":"notebook","kernel":{"name":"` + tc.specID + `"}}`
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, sessions.APIPath, strings.NewReader(body)))
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Fatalf("Unexpected status code for %q: got %d, want %d: %q", tc.specID, got, want, rr.Body.String())
+			}
+			if tc.wantStatus != http.StatusCreated {
+				if len(created) > 0 {
+					t.Errorf("Unexpected sessions created on the backend: %v", created)
+				}
+				return
+			}
+			if len(created) != 1 {
+				t.Fatalf("Unexpected sessions created on the backend: got %v, want one", created)
+			}
+			kernel := created[0]["kernel"].(map[string]any)
+			if got, want := kernel["name"], tc.wantSpecID; got != want {
+				t.Errorf("Unexpected kernelspec of the created session: got %q, want %q", got, want)
+			}
+		})
+	}
+}
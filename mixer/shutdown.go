@@ -0,0 +1,245 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+const (
+	// shutdownPollInterval is how often Shutdown checks whether the proxied websockets have drained.
+	shutdownPollInterval = 50 * time.Millisecond
+	// closeFrameWriteTimeout bounds how long sending a close frame to each frontend may block.
+	closeFrameWriteTimeout = time.Second
+)
+
+// closeMessage is the payload of the close frame sent to each frontend when the mixer shuts down.
+var closeMessage = websocket.FormatCloseMessage(websocket.CloseGoingAway, "the kernels mixer is shutting down")
+
+// handshakeDiscardingConn is a net.Conn that drops the first write to it, which is the handshake response written by websocket.Upgrader.
+type handshakeDiscardingConn struct {
+	net.Conn
+	wroteHandshake bool
+}
+
+// Write implements the net.Conn interface.
+func (c *handshakeDiscardingConn) Write(b []byte) (int, error) {
+	if !c.wroteHandshake {
+		c.wroteHandshake = true
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// hijackedResponseWriter is an http.ResponseWriter whose Hijack method returns an already hijacked connection.
+type hijackedResponseWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+// Hijack implements the http.Hijacker interface.
+func (w *hijackedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// serverWebSocket wraps a frontend connection whose websocket handshake was already completed by a backend, so that the mixer can write control frames to it.
+//
+// The websocket package does not export a way to wrap an established connection, so this runs
+// its server handshake on a synthetic upgrade request and discards the handshake response. The
+// returned connection must only be used for writing control frames, as the proxy owns reads.
+func serverWebSocket(conn net.Conn) (*websocket.Conn, error) {
+	r := &http.Request{
+		Method: http.MethodGet,
+		Header: http.Header{
+			"Connection":            []string{"Upgrade"},
+			"Upgrade":               []string{"websocket"},
+			"Sec-Websocket-Version": []string{"13"},
+			"Sec-Websocket-Key":     []string{"unused"},
+		},
+	}
+	w := &hijackedResponseWriter{ResponseWriter: httptest.NewRecorder(), conn: &handshakeDiscardingConn{Conn: conn}}
+	return (&websocket.Upgrader{}).Upgrade(w, r, nil)
+}
+
+// trackedConn is a hijacked frontend connection for a proxied websocket.
+type trackedConn struct {
+	net.Conn
+	onClose func(*trackedConn)
+
+	closeOnce sync.Once
+
+	// mu serializes writes, so that the close frame is only ever written between the proxy's writes.
+	mu sync.Mutex
+	// closing is set once the close frame has been sent; anything the backend sends after that is discarded.
+	closing bool
+}
+
+// Write implements the net.Conn interface.
+func (c *trackedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		// No data frames may follow a close frame, so drop them while the frontend finishes the closing handshake.
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// Close implements the net.Conn interface.
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { c.onClose(c) })
+	return err
+}
+
+// sendClose sends a close frame to the frontend, after which the frontend is expected to close the connection.
+//
+// The proxy copies the backend's stream in arbitrary chunks, so this can interrupt a message
+// that the backend split across several writes. The frontend then sees a malformed final frame,
+// which it handles the same way as the connection closing.
+func (c *trackedConn) sendClose() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	ws, err := serverWebSocket(c.Conn)
+	if err != nil {
+		return fmt.Errorf("failure wrapping the websocket connection: %w", err)
+	}
+	return ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(closeFrameWriteTimeout))
+}
+
+// trackingResponseWriter wraps an http.ResponseWriter so that the connection it hijacks for a websocket is tracked by the mixer.
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	m *Mixer
+}
+
+// Hijack implements the http.Hijacker interface.
+func (tw *trackingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := tw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("wrapped writer %+v does not implement http.Hijacker", tw.ResponseWriter)
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	tracked := &trackedConn{Conn: conn, onClose: tw.m.untrackWebSocket}
+	tw.m.mu.Lock()
+	defer tw.m.mu.Unlock()
+	tw.m.webSockets[tracked] = true
+	return tracked, brw, nil
+}
+
+// untrackWebSocket stops tracking the given closed websocket connection.
+func (m *Mixer) untrackWebSocket(c *trackedConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.webSockets, c)
+}
+
+// trackedWebSockets returns the currently open websocket connections.
+func (m *Mixer) trackedWebSockets() []*trackedConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conns := make([]*trackedConn, 0, len(m.webSockets))
+	for c := range m.webSockets {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// webSocketHandler wraps the given handler so that the websockets it proxies can be closed cleanly by Shutdown.
+//
+// Once the mixer is shutting down, new websocket connections are rejected with a 503 status.
+func (m *Mixer) webSocketHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		m.mu.Lock()
+		shuttingDown := m.shuttingDown
+		m.mu.Unlock()
+		if shuttingDown {
+			errorMsg := "the kernels mixer is shutting down"
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(&trackingResponseWriter{ResponseWriter: w, m: m}, r)
+	})
+}
+
+// Shutdown gracefully closes the websockets proxied by the mixer.
+//
+// New websocket connections are rejected, and each open one is sent a close frame. Shutdown then
+// waits for the frontends to close them until the given context is done, at which point any
+// remaining connections are closed forcibly and the context's error is returned.
+//
+// http.Server.Shutdown does not close or wait for hijacked connections such as websockets, so
+// this should be called alongside it, e.g.:
+//
+//	srv.Shutdown(ctx)
+//	m.Shutdown(ctx)
+func (m *Mixer) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.shuttingDown = true
+	m.mu.Unlock()
+	// Send the close frames concurrently, so that a frontend that is slow to read does not hold up the others.
+	var wg sync.WaitGroup
+	for _, c := range m.trackedWebSockets() {
+		wg.Add(1)
+		go func(c *trackedConn) {
+			defer wg.Done()
+			if err := c.sendClose(); err != nil {
+				log.Printf("Failure sending a close frame to %v: %v", c.RemoteAddr(), err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if len(m.trackedWebSockets()) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, c := range m.trackedWebSockets() {
+				c.Close()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
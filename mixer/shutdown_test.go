@@ -0,0 +1,113 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	var upgrader websocket.Upgrader
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case kernels.APIPath:
+			w.Write([]byte(`[{"id":"kernel1","name":"python3"}]`))
+		case kernels.APIPath + "/kernel1/channels":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for {
+				msgType, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				conn.WriteMessage(msgType, msg)
+			}
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer local.Close()
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusBadGateway)
+	}))
+	defer remote.Close()
+	m, err := NewMixer(MixerOptions{LocalBackendURL: local.URL, RemoteBackendURL: remote.URL})
+	if err != nil {
+		t.Fatalf("failure creating the mixer: %v", err)
+	}
+	mixerServer := httptest.NewServer(m)
+	defer mixerServer.Close()
+	// List the kernels so that the mixer knows which backend hosts the kernel.
+	listResp, err := http.Get(mixerServer.URL + kernels.APIPath)
+	if err != nil {
+		t.Fatalf("failure listing the kernels: %v", err)
+	}
+	listResp.Body.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(mixerServer.URL, "http") + kernels.APIPath + "/kernel1/channels"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("failure connecting to the kernel: %v", err)
+	}
+	defer conn.Close()
+	// Round trip a message so that the connection is fully established before shutting down.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+		t.Fatalf("failure sending a message: %v", err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("failure reading a message: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- m.Shutdown(ctx)
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("unexpected result reading from the websocket during shutdown: got %v, want a close frame", err)
+	}
+	if got, want := closeErr.Code, websocket.CloseGoingAway; got != want {
+		t.Errorf("unexpected close code: got %d, want %d", got, want)
+	}
+	conn.Close()
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("unexpected error shutting down: %v", err)
+	}
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil {
+		t.Errorf("unexpected websocket connection after shutdown")
+	} else if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected response to a websocket connection after shutdown: %+v", resp)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/kernels"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/sessions"
+	"github.com/gorilla/websocket"
+)
+
+// BackendTimeouts bounds how long the mixer waits on the requests it forwards to a backend.
+//
+// The timeouts cannot extend the deadline of the client's request, if it has one. A zero
+// timeout leaves the corresponding requests bounded only by that deadline.
+type BackendTimeouts struct {
+	// Default bounds each request to the backend besides those to start kernels and sessions, e.g. to list the kernels.
+	Default time.Duration
+	// Start bounds each request to start a kernel or a session on the backend.
+	//
+	// Starts can take much longer than other requests, e.g. while a Dataproc session is
+	// provisioned. If zero, then the Default timeout is used.
+	Start time.Duration
+}
+
+// orElse returns the timeouts with each unset timeout taken from the given defaults.
+func (t BackendTimeouts) orElse(defaults BackendTimeouts) BackendTimeouts {
+	if t.Default <= 0 {
+		t.Default = defaults.Default
+	}
+	if t.Start <= 0 {
+		t.Start = defaults.Start
+	}
+	return t
+}
+
+// isStart reports whether or not the given request starts a kernel or a session.
+func isStart(r *http.Request) bool {
+	return r.Method == http.MethodPost && (r.URL.Path == kernels.APIPath || r.URL.Path == sessions.APIPath)
+}
+
+// timeout returns the timeout for the given request to the backend, or zero if it is unbounded.
+func (t BackendTimeouts) timeout(r *http.Request) time.Duration {
+	if isStart(r) && t.Start > 0 {
+		return t.Start
+	}
+	return t.Default
+}
+
+// localBackendTimeouts returns the timeouts for the requests forwarded to the local backend.
+func (opts MixerOptions) localBackendTimeouts() BackendTimeouts {
+	return opts.LocalBackendTimeouts.orElse(opts.BackendTimeouts)
+}
+
+// remoteBackendTimeouts returns the timeouts for the requests forwarded to the remote backend.
+func (opts MixerOptions) remoteBackendTimeouts() BackendTimeouts {
+	return opts.RemoteBackendTimeouts.orElse(opts.BackendTimeouts)
+}
+
+// backendTimeoutHandler wraps the given backend proxy so that each request forwarded to the backend is bounded by the given timeouts.
+//
+// The timeout is applied to the context of each backend request, so during a fan-out every
+// backend is bounded by its own timeout. Websocket upgrade requests are passed through
+// unmodified, as the connection outlives the request.
+func backendTimeoutHandler(timeouts BackendTimeouts, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := timeouts.timeout(r)
+		if timeout <= 0 || websocket.IsWebSocketUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestTimeoutHandler wraps the given handler so that each request it serves is bounded by the given timeout.
+//
+// Requests to start a kernel or a session are instead bounded by the longest timeout that any
+// backend allows for a start, if that is longer, so that the configured start timeouts are not
+// cut short by the timeout for every other request. Websocket upgrade requests are passed
+// through unmodified, as the connection outlives the request.
+func (m *Mixer) RequestTimeoutHandler(timeout time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		requestTimeout := timeout
+		if start := m.startTimeout(r); start > requestTimeout {
+			requestTimeout = start
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// startTimeout returns the longest timeout that any backend allows for the given request, if it starts a kernel or a session, and zero otherwise.
+func (m *Mixer) startTimeout(r *http.Request) time.Duration {
+	if !isStart(r) {
+		return 0
+	}
+	longest := m.opts.localBackendTimeouts().timeout(r)
+	if remote := m.opts.remoteBackendTimeouts().timeout(r); !m.opts.LocalOnly && remote > longest {
+		longest = remote
+	}
+	return longest
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+)
+
+// deadlineRecorder records the remaining time until the deadline of each request forwarded to a backend.
+type deadlineRecorder struct {
+	mu        sync.Mutex
+	remaining map[string]time.Duration
+}
+
+// wrap returns a backend with the given name that records its request deadlines, with the given timeouts applied, before forwarding to the given backend.
+func (d *deadlineRecorder) wrap(name string, timeouts BackendTimeouts, b *backends.Backend) *backends.Backend {
+	return backends.New(name, " ("+name+")", name+" host", backendTimeoutHandler(timeouts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deadline, ok := r.Context().Deadline(); ok {
+			d.mu.Lock()
+			d.remaining[name+" "+r.Method+" "+r.URL.Path] = time.Until(deadline)
+			d.mu.Unlock()
+		}
+		b.ServeHTTP(w, r)
+	})))
+}
+
+func TestBackendTimeouts(t *testing.T) {
+	opts := MixerOptions{
+		BackendTimeouts:       BackendTimeouts{Default: time.Minute},
+		RemoteBackendTimeouts: BackendTimeouts{Default: 5 * time.Minute, Start: 30 * time.Minute},
+	}
+	d := &deadlineRecorder{remaining: make(map[string]time.Duration)}
+	local := d.wrap("local", opts.localBackendTimeouts(), newFakeBackend(t, "local", localKernelSpecs))
+	remote := d.wrap("remote", opts.remoteBackendTimeouts(), newFakeBackend(t, "remote", remoteKernelSpecs))
+	m := newMixer(local, remote, opts)
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernels", nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("Unexpected response status listing the kernels: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/kernels", strings.NewReader(`{"name":"remote-pyspark"}`)))
+	if got, want := rr.Code, http.StatusCreated; got != want {
+		t.Fatalf("Unexpected response status starting a kernel: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+
+	testCases := []struct {
+		desc    string
+		request string
+		timeout time.Duration
+	}{
+		{
+			desc:    "local list uses the global default",
+			request: "local GET /api/kernels",
+			timeout: time.Minute,
+		},
+		{
+			desc:    "remote list uses the remote default",
+			request: "remote GET /api/kernels",
+			timeout: 5 * time.Minute,
+		},
+		{
+			desc:    "remote start uses the remote start timeout",
+			request: "remote POST /api/kernels",
+			timeout: 30 * time.Minute,
+		},
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, ok := d.remaining[tc.request]
+			if !ok {
+				t.Fatalf("No deadline recorded for %q: got %v", tc.request, d.remaining)
+			}
+			// Allow for the time spent serving the requests.
+			if got > tc.timeout || got < tc.timeout-time.Minute/2 {
+				t.Errorf("Unexpected time remaining until the deadline of %q: got %v, want about %v", tc.request, got, tc.timeout)
+			}
+		})
+	}
+}
+
+// slowBackend returns a backend with the given name that delays each request to start a kernel or a session by the given amount before forwarding it to the given backend.
+//
+// If the request is canceled first, then it fails with a 504 status.
+func slowBackend(name string, delay time.Duration, b *backends.Backend) *backends.Backend {
+	return backends.New(name, " ("+name+")", name+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStart(r) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				http.Error(w, r.Context().Err().Error(), http.StatusGatewayTimeout)
+				return
+			}
+		}
+		b.ServeHTTP(w, r)
+	}))
+}
+
+func TestRequestTimeoutHandler(t *testing.T) {
+	const (
+		requestTimeout = 50 * time.Millisecond
+		startDelay     = 4 * requestTimeout
+	)
+	testCases := []struct {
+		desc       string
+		opts       MixerOptions
+		wantStatus int
+	}{
+		{
+			desc:       "Start outlives the request timeout",
+			opts:       MixerOptions{RemoteBackendTimeouts: BackendTimeouts{Start: time.Minute}},
+			wantStatus: http.StatusCreated,
+		},
+		{
+			desc:       "Start outlives the request timeout with a global start timeout",
+			opts:       MixerOptions{BackendTimeouts: BackendTimeouts{Default: requestTimeout, Start: time.Minute}},
+			wantStatus: http.StatusCreated,
+		},
+		{
+			desc:       "Start without a start timeout",
+			opts:       MixerOptions{},
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			desc:       "Start timeout shorter than the request timeout",
+			opts:       MixerOptions{RemoteBackendTimeouts: BackendTimeouts{Start: requestTimeout / 2}},
+			wantStatus: http.StatusGatewayTimeout,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			remote := slowBackend("remote", startDelay, newFakeBackend(t, "remote", remoteKernelSpecs))
+			m := newMixer(newFakeBackend(t, "local", localKernelSpecs), remote, tc.opts)
+			h := m.RequestTimeoutHandler(requestTimeout, m)
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/kernels", nil))
+			if got, want := rr.Code, http.StatusOK; got != want {
+				t.Fatalf("Unexpected response status listing the kernels: got %d, want %d: %s", got, want, rr.Body.String())
+			}
+			rr = httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/kernels", strings.NewReader(`{"name":"remote-pyspark"}`)))
+			if got := rr.Code; got != tc.wantStatus {
+				t.Errorf("Unexpected response status starting a kernel: got %d, want %d: %s", got, tc.wantStatus, rr.Body.String())
+			}
+		})
+	}
+}
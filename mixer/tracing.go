@@ -0,0 +1,163 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mixer
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the instrumentation library reported for the mixer's spans.
+const tracerName = "github.com/GoogleCloudPlatform/notebook-kernels-mixer/mixer"
+
+// Span attribute keys for the mixer's spans.
+const (
+	resourceKindAttribute = attribute.Key("mixer.resource.kind")
+	resourceIDAttribute   = attribute.Key("mixer.resource.id")
+	backendAttribute      = attribute.Key("mixer.backend")
+	statusCodeAttribute   = attribute.Key("http.status_code")
+)
+
+// tracePropagator reads and writes the trace context carried in request headers, using the W3C Trace Context format.
+var tracePropagator = propagation.TraceContext{}
+
+// tracer returns the tracer for the mixer's spans.
+func (opts MixerOptions) tracer() trace.Tracer {
+	tp := opts.TracerProvider
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// apiResource returns the kind and ID of the Jupyter API resource that the given path refers to, e.g. "kernels" and the kernel ID.
+//
+// The ID is empty for collection paths, and both are empty for paths outside of the API.
+func apiResource(path string) (kind, id string) {
+	relativePath, ok := strings.CutPrefix(path, "/api/")
+	if !ok {
+		return "", ""
+	}
+	segments := strings.SplitN(relativePath, "/", 3)
+	if len(segments) > 1 {
+		id = segments[1]
+	}
+	return segments[0], id
+}
+
+// resourceAttributes returns the span attributes describing the API resource that the given request refers to.
+func resourceAttributes(r *http.Request) []attribute.KeyValue {
+	kind, id := apiResource(r.URL.Path)
+	if kind == "" {
+		return nil
+	}
+	attrs := []attribute.KeyValue{resourceKindAttribute.String(kind)}
+	if id != "" {
+		attrs = append(attrs, resourceIDAttribute.String(id))
+	}
+	return attrs
+}
+
+// statusRecordingResponseWriter records the status code of the response written through it.
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+// WriteHeader implements the http.ResponseWriter interface
+func (w *statusRecordingResponseWriter) WriteHeader(code int) {
+	if w.statusCode == 0 {
+		w.statusCode = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface
+func (w *statusRecordingResponseWriter) Write(bs []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.ResponseWriter.Write(bs)
+}
+
+// Flush implements the http.Flusher interface
+func (w *statusRecordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// endSpan records the given response status on the span and ends it.
+func endSpan(span trace.Span, statusCode int) {
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	span.SetAttributes(statusCodeAttribute.Int(statusCode))
+	if statusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	span.End()
+}
+
+// traceHandler wraps the given handler so that each request it serves is recorded as a span.
+//
+// The span continues the trace from the request's trace context headers, if any, and it is
+// the parent of the spans for the requests the mixer forwards to its backends.
+func (m *Mixer) traceHandler(h http.Handler) http.Handler {
+	tracer := m.opts.tracer()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(resourceAttributes(r)...))
+		if websocket.IsWebSocketUpgrade(r) {
+			// The connection outlives the handler's response, so only the upgrade itself is recorded.
+			defer span.End()
+			h.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		sw := &statusRecordingResponseWriter{ResponseWriter: w}
+		defer func() { endSpan(span, sw.statusCode) }()
+		h.ServeHTTP(sw, r.WithContext(ctx))
+	})
+}
+
+// backendTraceHandler wraps the given backend proxy so that each request forwarded to the backend is recorded as a span.
+//
+// The trace context is propagated to the backend in the request headers. Websocket upgrade
+// requests are passed through unmodified, apart from the trace context headers.
+func backendTraceHandler(tracer trace.Tracer, backendName string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attrs := append(resourceAttributes(r), backendAttribute.String(backendName))
+		ctx, span := tracer.Start(r.Context(), backendName+" "+r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+		// The request is cloned so that the trace context headers of concurrent requests to different backends do not collide.
+		r = r.Clone(ctx)
+		tracePropagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+		if websocket.IsWebSocketUpgrade(r) {
+			span.End()
+			h.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusRecordingResponseWriter{ResponseWriter: w}
+		defer func() { endSpan(span, sw.statusCode) }()
+		h.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mixer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	localTraceParents := make(map[string]bool)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		localTraceParents[r.Header.Get("Traceparent")] = true
+		mu.Unlock()
+		w.Write([]byte("[]"))
+	}))
+	defer local.Close()
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer remote.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	m, err := NewMixer(MixerOptions{
+		LocalBackendURL:  local.URL,
+		RemoteBackendURL: remote.URL,
+		TracerProvider:   sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	})
+	if err != nil {
+		t.Fatalf("failure creating the mixer: %v", err)
+	}
+	const incomingTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/api/kernels", nil)
+	req.Header.Set("Traceparent", "00-"+incomingTraceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected response status: got %d, want %d: %s", got, want, rr.Body.String())
+	}
+
+	var backendSpan sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if !span.Parent().IsValid() {
+			// Skip the kernels handler's background fetches, which are not part of any request.
+			continue
+		}
+		// The kernelspecs fetched to annotate the listed kernels are part of the request too, so only the span listing the kernels is checked.
+		isLocal, isKernels := false, false
+		for _, attr := range span.Attributes() {
+			switch {
+			case attr.Key == backendAttribute && attr.Value.AsString() == localBackendName:
+				isLocal = true
+			case attr.Key == resourceKindAttribute && attr.Value.AsString() == "kernels":
+				isKernels = true
+			}
+		}
+		if isLocal && isKernels {
+			backendSpan = span
+		}
+	}
+	if backendSpan == nil {
+		t.Fatalf("no span recorded for the local backend: got %d spans", len(recorder.Ended()))
+	}
+	if got, want := backendSpan.SpanContext().TraceID().String(), incomingTraceID; got != want {
+		t.Errorf("unexpected trace ID for the backend span: got %q, want %q", got, want)
+	}
+	wantAttrs := map[string]string{
+		string(resourceKindAttribute): "kernels",
+		string(statusCodeAttribute):   "200",
+	}
+	for _, attr := range backendSpan.Attributes() {
+		if want, ok := wantAttrs[string(attr.Key)]; ok {
+			if got := attr.Value.Emit(); got != want {
+				t.Errorf("unexpected %q attribute: got %q, want %q", attr.Key, got, want)
+			}
+			delete(wantAttrs, string(attr.Key))
+		}
+	}
+	for key := range wantAttrs {
+		t.Errorf("missing %q attribute on the backend span", key)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := "00-" + incomingTraceID + "-" + backendSpan.SpanContext().SpanID().String() + "-01"; !localTraceParents[want] {
+		t.Errorf("traceparent header %q not forwarded to the local backend: got %v", want, localTraceParents)
+	}
+}
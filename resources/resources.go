@@ -20,14 +20,26 @@ package resources
 import (
 	"bytes"
 	"cmp"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"math"
 	"net/http"
+	"path"
+	"reflect"
 	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
 )
 
+// endpointParentResourceKey is the kernelspec resources entry identifying the remote endpoint hosting a kernelspec.
+const endpointParentResourceKey = "endpointParentResource"
+
 // KernelSpecs represents the collection of kernel specs returned by a kernel spec list call.
 type KernelSpecs struct {
 	Default     string  `json:"default"`
@@ -57,6 +69,12 @@ func (ks *KernelSpecs) UnmarshalJSON(b []byte) error {
 		ks.rawFields = rawFields
 		return nil
 	}
+	if specs == nil {
+		// Some backends report a null collection when they have no kernelspecs.
+		ks.KernelSpecs = make(map[string]*KernelSpec)
+		ks.rawFields = rawFields
+		return nil
+	}
 	ksMap, ok := specs.(map[string]any)
 	if !ok {
 		return fmt.Errorf("invalid value for the field 'kernelspecs': %+v: %w", specs, util.HTTPError(http.StatusBadRequest))
@@ -77,6 +95,18 @@ func (ks *KernelSpecs) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// StripRawFields drops the fields that are not known to the KernelSpecs type, including those of each kernelspec.
+//
+// This lets callers produce a marshalled form with only the known fields, e.g. for backends that reject unknown fields.
+func (ks *KernelSpecs) StripRawFields() {
+	ks.rawFields = nil
+	for _, spec := range ks.KernelSpecs {
+		if spec != nil {
+			spec.StripRawFields()
+		}
+	}
+}
+
 // MarshalJSON implements the json.Marshaler interface
 func (ks KernelSpecs) MarshalJSON() ([]byte, error) {
 	rawFields := make(map[string]any)
@@ -90,6 +120,442 @@ func (ks KernelSpecs) MarshalJSON() ([]byte, error) {
 	return json.Marshal(rawFields)
 }
 
+// MarshalSubset marshals a kernelspecs collection containing only the kernelspecs with the given IDs.
+//
+// This is meant for incremental updates, so the default and any other fields of the collection
+// are omitted, and IDs that are not in the collection are skipped. The kernelspecs are encoded
+// in the same sorted order as for the full collection.
+func (ks *KernelSpecs) MarshalSubset(ids []string) ([]byte, error) {
+	subset := make(SpecMap)
+	for _, id := range ids {
+		if spec, ok := ks.KernelSpecs[id]; ok {
+			subset[id] = spec
+		}
+	}
+	return json.Marshal(KernelSpecs{KernelSpecs: subset})
+}
+
+// EngineInfo returns the vendor-specific `engine_info` object reported alongside the kernelspecs.
+//
+// This field is not part of the Jupyter API, so it is preserved as one of the raw fields.
+func (ks *KernelSpecs) EngineInfo() (map[string]any, bool) {
+	engineInfo, ok := ks.rawFields["engine_info"].(map[string]any)
+	return engineInfo, ok
+}
+
+// ValidateSeparatorConsistency checks that every prefixed kernelspec ID uses the given separator.
+//
+// The set of prefixes is derived from the IDs that do contain the separator, and an error
+// is returned for each ID that starts with one of those prefixes followed by some other
+// punctuation character instead. Such a mix indicates a bug in how the specs were combined.
+func (ks *KernelSpecs) ValidateSeparatorConsistency(sep string) []error {
+	if sep == "" {
+		return []error{fmt.Errorf("the kernelspec ID separator must not be empty")}
+	}
+	prefixes := make(map[string]bool)
+	for id := range ks.KernelSpecs {
+		if prefix, _, ok := strings.Cut(id, sep); ok && prefix != "" {
+			prefixes[prefix] = true
+		}
+	}
+	var errs []error
+	for _, id := range slices.Sorted(maps.Keys(ks.KernelSpecs)) {
+		for _, prefix := range slices.Sorted(maps.Keys(prefixes)) {
+			if !strings.HasPrefix(id, prefix) || strings.HasPrefix(id, prefix+sep) {
+				continue
+			}
+			next, _ := utf8.DecodeRuneInString(strings.TrimPrefix(id, prefix))
+			if unicode.IsPunct(next) || unicode.IsSymbol(next) || unicode.IsSpace(next) {
+				errs = append(errs, fmt.Errorf("kernelspec %q is prefixed with %q rather than %q", id, prefix+string(next), prefix+sep))
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// Collision describes a kernelspec ID that was reported by more than one source when merging kernelspecs.
+type Collision struct {
+	// ID is the kernelspec ID reported by multiple sources.
+	ID string
+	// Keys lists the distinct keys the colliding kernelspecs were stored under, in source order.
+	Keys []string
+}
+
+// MergeKernelSpecs combines the given kernelspecs into a single collection.
+//
+// The first source to report a given ID keeps it. Later sources reporting the same ID have
+// their kernelspec stored under a distinct key, formed by prefixing the ID with a qualifier
+// derived from the spec's endpointParentResource (or the source's position if that is not set).
+// Every such collision is reported in the returned slice so callers can surface it.
+//
+// The default kernelspec is taken from the first source that specifies one.
+func MergeKernelSpecs(sources ...*KernelSpecs) (*KernelSpecs, []Collision) {
+	merged := &KernelSpecs{
+		KernelSpecs: make(map[string]*KernelSpec),
+	}
+	var collisions []Collision
+	collisionIndices := make(map[string]int)
+	for sourceIdx, source := range sources {
+		if source == nil {
+			continue
+		}
+		keys := make(map[string]string)
+		for _, id := range slices.Sorted(maps.Keys(source.KernelSpecs)) {
+			spec := source.KernelSpecs[id]
+			if _, ok := merged.KernelSpecs[id]; !ok {
+				merged.KernelSpecs[id] = spec
+				keys[id] = id
+				continue
+			}
+			key := uniqueKey(merged.KernelSpecs, specQualifier(spec, sourceIdx)+"-"+id)
+			qualified := *spec
+			qualified.ID = key
+			merged.KernelSpecs[key] = &qualified
+			keys[id] = key
+			idx, ok := collisionIndices[id]
+			if !ok {
+				idx = len(collisions)
+				collisionIndices[id] = idx
+				collisions = append(collisions, Collision{ID: id, Keys: []string{id}})
+			}
+			collisions[idx].Keys = append(collisions[idx].Keys, key)
+		}
+		if merged.Default == "" && source.Default != "" {
+			if key, ok := keys[source.Default]; ok {
+				merged.Default = key
+			} else {
+				merged.Default = source.Default
+			}
+		}
+	}
+	return merged, collisions
+}
+
+// DefaultConflicts returns the names of the backends whose default kernelspec lost to the default of the combined kernelspecs.
+//
+// The sources map backend names to the kernelspecs each of them reported. Each backend's default
+// is compared to the combined default after prefixing it with the backend name, as that is how
+// the combined kernelspecs identify it. Backends without a default are ignored. The losing
+// backends are returned in sorted order, so that operators can see whose default was overridden
+// and configure their priority. If every default was chosen, then the result is empty.
+func (ks *KernelSpecs) DefaultConflicts(sources map[string]*KernelSpecs) []string {
+	var lost []string
+	for _, name := range slices.Sorted(maps.Keys(sources)) {
+		source := sources[name]
+		if source == nil || source.Default == "" {
+			continue
+		}
+		if name+"-"+source.Default != ks.Default {
+			lost = append(lost, name)
+		}
+	}
+	return lost
+}
+
+// DefaultSpec returns the default kernelspec.
+//
+// If the default is unset or does not name one of the kernelspecs, then this falls back to
+// the first kernelspec in the order they are marshalled. The returned `ok` value is false
+// only if there are no kernelspecs.
+func (ks *KernelSpecs) DefaultSpec() (*KernelSpec, bool) {
+	if spec, ok := ks.KernelSpecs[ks.Default]; ok && spec != nil {
+		return spec, true
+	}
+	var first *KeyValue[KernelSpec]
+	for id, spec := range ks.KernelSpecs {
+		if spec == nil {
+			continue
+		}
+		kv := KeyValue[KernelSpec]{id, *spec}
+		if first == nil || compareSpec(kv, *first) < 0 {
+			first = &kv
+		}
+	}
+	if first == nil {
+		return nil, false
+	}
+	return ks.KernelSpecs[first.Key], true
+}
+
+// DefaultsByLanguage returns the preferred kernelspec for each language.
+//
+// Languages are normalized by trimming surrounding whitespace and lowercasing them. The
+// preferred kernelspec for a language is the default kernelspec if that is for the language,
+// and otherwise is the kernelspec for the language with the lowest ID in sorted order.
+// Kernelspecs that do not specify a language are omitted.
+func (ks *KernelSpecs) DefaultsByLanguage() map[string]*KernelSpec {
+	defaults := make(map[string]*KernelSpec)
+	for _, id := range slices.Sorted(maps.Keys(ks.KernelSpecs)) {
+		spec := ks.KernelSpecs[id]
+		if spec == nil || spec.Spec == nil {
+			continue
+		}
+		lang := strings.ToLower(strings.TrimSpace(spec.Spec.Language))
+		if lang == "" {
+			continue
+		}
+		if _, ok := defaults[lang]; !ok || id == ks.Default {
+			defaults[lang] = spec
+		}
+	}
+	return defaults
+}
+
+// EndpointsDigest returns a digest of the remote endpoints hosting the kernelspecs.
+//
+// The digest is computed over the sorted set of distinct endpointParentResource values, so
+// it only changes when the set of endpoints does. Kernelspecs without an endpoint are ignored.
+func (ks *KernelSpecs) EndpointsDigest() string {
+	endpoints := make(map[string]bool)
+	for _, spec := range ks.KernelSpecs {
+		if spec == nil {
+			continue
+		}
+		if endpoint := spec.Resources[endpointParentResourceKey]; endpoint != "" {
+			endpoints[endpoint] = true
+		}
+	}
+	h := sha256.New()
+	for _, endpoint := range slices.Sorted(maps.Keys(endpoints)) {
+		// Terminate each value so that distinct sets cannot produce the same input.
+		h.Write([]byte(endpoint))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// StableHash returns a hash of the canonical JSON content of the kernelspecs, excluding the named resource keys.
+//
+// This is meant for caching content derived from the kernelspecs, where some resource
+// entries (e.g. signed logo URLs) change on every fetch without the kernelspecs changing.
+// The result is empty if the kernelspecs cannot be marshalled.
+func (ks *KernelSpecs) StableHash(ignoreResourceKeys []string) string {
+	filtered := *ks
+	filtered.KernelSpecs = make(SpecMap, len(ks.KernelSpecs))
+	for id, spec := range ks.KernelSpecs {
+		if spec == nil {
+			filtered.KernelSpecs[id] = nil
+			continue
+		}
+		filteredSpec := *spec
+		filteredSpec.Resources = maps.Clone(spec.Resources)
+		filteredSpec.rawFields = maps.Clone(spec.rawFields)
+		for _, key := range ignoreResourceKeys {
+			delete(filteredSpec.Resources, key)
+		}
+		if len(filteredSpec.Resources) == 0 {
+			// Otherwise the unfiltered raw value would be re-emitted when marshalling.
+			delete(filteredSpec.rawFields, "resources")
+		}
+		filtered.KernelSpecs[id] = &filteredSpec
+	}
+	// Maps are marshalled with sorted keys, so the JSON encoding is canonical.
+	content, err := json.Marshal(filtered)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// RemoveHidden removes the kernelspecs whose `metadata.hidden` value is true, returning their IDs in sorted order.
+//
+// Admins use that value to suppress deprecated kernelspecs from the launcher. If the default
+// kernelspec is removed, then the remaining kernelspec with the lowest ID in sorted order
+// becomes the default, or the default is cleared if no kernelspecs remain.
+func (ks *KernelSpecs) RemoveHidden() []string {
+	var removed []string
+	for _, id := range slices.Sorted(maps.Keys(ks.KernelSpecs)) {
+		spec := ks.KernelSpecs[id]
+		if spec == nil || spec.Spec == nil {
+			continue
+		}
+		if hidden, ok := spec.Spec.Metadata["hidden"].(bool); ok && hidden {
+			delete(ks.KernelSpecs, id)
+			removed = append(removed, id)
+		}
+	}
+	if _, ok := ks.KernelSpecs[ks.Default]; !ok && len(removed) > 0 {
+		ks.Default = ""
+		if remaining := slices.Sorted(maps.Keys(ks.KernelSpecs)); len(remaining) > 0 {
+			ks.Default = remaining[0]
+		}
+	}
+	return removed
+}
+
+// localBackendLabel is the label that DisambiguateDisplayNames gives to kernelspecs without an endpointParentResource, which are those of the local backend.
+const localBackendLabel = "Local"
+
+// DisambiguateDisplayNames appends a label naming the backend to the display names that more than one kernelspec shares.
+//
+// The label is derived from each kernelspec's endpointParentResource by BackendLabelFromEndpointResource,
+// e.g. "Python 3" becomes "Python 3 (Dataproc: test-cluster (us-central1))", and kernelspecs without
+// one are labelled as "Local". If that does not tell the colliding kernelspecs apart, e.g. because they
+// are on the same backend or their backend cannot be labelled, then their IDs are used as the label
+// instead. Kernelspecs whose display name is unique are left unchanged.
+func (ks *KernelSpecs) DisambiguateDisplayNames() {
+	colliding := make(map[string][]string)
+	for _, id := range slices.Sorted(maps.Keys(ks.KernelSpecs)) {
+		if spec := ks.KernelSpecs[id]; spec != nil && spec.Spec != nil {
+			colliding[spec.Spec.DisplayName] = append(colliding[spec.Spec.DisplayName], id)
+		}
+	}
+	for _, ids := range colliding {
+		if len(ids) < 2 {
+			continue
+		}
+		labels := make(map[string]string)
+		labelCounts := make(map[string]int)
+		for _, id := range ids {
+			labels[id] = backendLabel(ks.KernelSpecs[id])
+			labelCounts[labels[id]]++
+		}
+		for _, id := range ids {
+			spec := ks.KernelSpecs[id]
+			label := labels[id]
+			if label == "" || labelCounts[label] > 1 {
+				label = id
+			}
+			// Copy the spec so that the change does not affect any other view that shares it.
+			disambiguated := *spec.Spec
+			disambiguated.DisplayName = fmt.Sprintf("%s (%s)", spec.Spec.DisplayName, label)
+			spec.Spec = &disambiguated
+		}
+	}
+}
+
+// backendLabel returns the label naming the backend of the given kernelspec, or an empty string if its backend cannot be labelled.
+func backendLabel(spec *KernelSpec) string {
+	resource, ok := spec.Resources[endpointParentResourceKey]
+	if !ok {
+		return localBackendLabel
+	}
+	label, err := BackendLabelFromEndpointResource(resource)
+	if err != nil {
+		return ""
+	}
+	return label
+}
+
+// KernelSpecsPatch returns a JSON merge patch (RFC 7386) that transforms the old kernelspecs into the new ones.
+//
+// Added and changed kernelspecs are present in the patch, while removed kernelspecs are set to null.
+// A nil KernelSpecs is treated as an empty collection.
+func KernelSpecsPatch(oldSpecs, newSpecs *KernelSpecs) map[string]any {
+	return mergePatch(jsonObject(oldSpecs), jsonObject(newSpecs))
+}
+
+// jsonObject returns the generic JSON object representation of the given kernelspecs.
+func jsonObject(ks *KernelSpecs) map[string]any {
+	obj := make(map[string]any)
+	if ks == nil {
+		return obj
+	}
+	if b, err := json.Marshal(ks); err == nil {
+		json.Unmarshal(b, &obj)
+	}
+	return obj
+}
+
+// mergePatch returns the JSON merge patch describing the changes from the source object to the target.
+func mergePatch(source, target map[string]any) map[string]any {
+	patch := make(map[string]any)
+	for k := range source {
+		if _, ok := target[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, targetVal := range target {
+		sourceVal, ok := source[k]
+		if !ok {
+			patch[k] = targetVal
+			continue
+		}
+		sourceObj, sourceIsObj := sourceVal.(map[string]any)
+		targetObj, targetIsObj := targetVal.(map[string]any)
+		if sourceIsObj && targetIsObj {
+			if nested := mergePatch(sourceObj, targetObj); len(nested) > 0 {
+				patch[k] = nested
+			}
+			continue
+		}
+		if !reflect.DeepEqual(sourceVal, targetVal) {
+			patch[k] = targetVal
+		}
+	}
+	return patch
+}
+
+// specQualifier returns a short qualifier identifying where the given kernelspec came from.
+func specQualifier(spec *KernelSpec, sourceIdx int) string {
+	if resource := spec.Resources[endpointParentResourceKey]; resource != "" {
+		if idx := strings.LastIndex(resource, "/"); idx >= 0 && idx < len(resource)-1 {
+			return resource[idx+1:]
+		}
+	}
+	return fmt.Sprintf("source%d", sourceIdx)
+}
+
+// uniqueKey returns the given key, with a numeric suffix added if necessary to avoid existing entries.
+func uniqueKey(specs SpecMap, key string) string {
+	if _, ok := specs[key]; !ok {
+		return key
+	}
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s-%d", key, i)
+		if _, ok := specs[candidate]; !ok {
+			return candidate
+		}
+	}
+}
+
+// IsEmpty reports whether or not the collection has no kernelspecs.
+func (ks *KernelSpecs) IsEmpty() bool {
+	return ks == nil || len(ks.KernelSpecs) == 0
+}
+
+// Names returns the IDs of the kernelspecs, in the same order that they are marshalled in.
+//
+// That is by `metadata.order`, then by endpointParentResource, then by display name, and then by ID.
+func (ks *KernelSpecs) Names() []string {
+	var specs []KeyValue[KernelSpec]
+	for id, spec := range ks.KernelSpecs {
+		kv := KeyValue[KernelSpec]{Key: id}
+		if spec != nil {
+			kv.Value = *spec
+		}
+		specs = append(specs, kv)
+	}
+	names := make([]string, 0, len(specs))
+	for _, kv := range slices.SortedStableFunc(slices.Values(specs), compareSpec) {
+		names = append(names, kv.Key)
+	}
+	return names
+}
+
+// FindByDisplayName returns the kernelspec with the given display name.
+//
+// An error wrapping a 400 status is returned if no kernelspec has the display name, and one
+// wrapping a 409 status is returned if more than one does, as the name does not identify a
+// single kernelspec then.
+func (ks *KernelSpecs) FindByDisplayName(name string) (*KernelSpec, error) {
+	var matches []string
+	for _, id := range ks.Names() {
+		if spec := ks.KernelSpecs[id]; spec != nil && spec.Spec != nil && spec.Spec.DisplayName == name {
+			matches = append(matches, id)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no kernelspec has the display name %q: %w", name, util.HTTPError(http.StatusBadRequest))
+	case 1:
+		return ks.KernelSpecs[matches[0]], nil
+	default:
+		return nil, fmt.Errorf("the display name %q is ambiguous, as it is shared by the kernelspecs %q: %w", name, matches, util.HTTPError(http.StatusConflict))
+	}
+}
+
 // SpecMap represents a map of kernel specs by name
 type SpecMap map[string]*KernelSpec
 
@@ -128,19 +594,164 @@ func (sm SpecMap) MarshalJSON() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func compareSpec(a, b KeyValue[KernelSpec]) int {
-	endpointParentResourcePropertyKey := "endpointParentResource"
+// specOrderKey is the kernelspec metadata entry that admins use to pin kernelspecs to an explicit position in the launcher.
+const specOrderKey = "order"
+
+// specOrder returns the explicit launcher position of the given kernelspec, with lower values listed first.
+//
+// Kernelspecs without a numeric `metadata.order` value are listed after those with one.
+func specOrder(ks KernelSpec) float64 {
+	if ks.Spec == nil {
+		return math.Inf(1)
+	}
+	switch order := ks.Spec.Metadata[specOrderKey].(type) {
+	case float64:
+		return order
+	case int:
+		return float64(order)
+	}
+	return math.Inf(1)
+}
 
-	// sort by endpointParentResource first, then by display_name
+// specDisplayName returns the display name of the given kernelspec, or the empty string if it has no spec.
+func specDisplayName(ks KernelSpec) string {
+	if ks.Spec == nil {
+		return ""
+	}
+	return ks.Spec.DisplayName
+}
+
+func compareSpec(a, b KeyValue[KernelSpec]) int {
+	// sort by metadata.order first, then by endpointParentResource, then by display_name, then by ID
 	return cmp.Or(
+		cmp.Compare(specOrder(a.Value), specOrder(b.Value)),
 		cmp.Compare(
-			a.Value.Resources[endpointParentResourcePropertyKey],
-			b.Value.Resources[endpointParentResourcePropertyKey],
+			a.Value.Resources[endpointParentResourceKey],
+			b.Value.Resources[endpointParentResourceKey],
 		),
-		cmp.Compare(a.Value.Spec.DisplayName, b.Value.Spec.DisplayName),
+		cmp.Compare(specDisplayName(a.Value), specDisplayName(b.Value)),
+		// Break any remaining ties by ID, so that the order is deterministic.
+		cmp.Compare(a.Key, b.Key),
 	)
 }
 
+// dataprocResourcePrefix is the prefix of the endpointParentResource values for Dataproc endpoints.
+const dataprocResourcePrefix = "//dataproc.googleapis.com/"
+
+// Kinds of Dataproc resources that host kernels.
+const (
+	DataprocClusterKind = "cluster"
+	DataprocSessionKind = "session"
+)
+
+// DataprocResource is the parsed form of an endpointParentResource value for a Dataproc endpoint.
+type DataprocResource struct {
+	Project string
+	// Location is the region of a cluster or the location of a session.
+	Location string
+	// Region is the region of a cluster, and is empty for a session.
+	Region string
+	// Kind is either DataprocClusterKind or DataprocSessionKind.
+	Kind string
+	Name string
+}
+
+// ParseDataprocResource parses the given endpointParentResource value into its components.
+//
+// Both Dataproc clusters (`//dataproc.googleapis.com/projects/{project}/regions/{region}/clusters/{cluster}`)
+// and Dataproc Serverless sessions (`//dataproc.googleapis.com/projects/{project}/locations/{location}/sessions/{session}`)
+// are supported. Any other value results in an error.
+func ParseDataprocResource(resource string) (*DataprocResource, error) {
+	relative, ok := strings.CutPrefix(resource, dataprocResourcePrefix)
+	if !ok {
+		return nil, fmt.Errorf("unrecognized endpoint resource %q: %w", resource, util.HTTPError(http.StatusBadRequest))
+	}
+	parts := strings.Split(relative, "/")
+	if len(parts) != 6 || parts[0] != "projects" {
+		return nil, fmt.Errorf("unrecognized endpoint resource %q: %w", resource, util.HTTPError(http.StatusBadRequest))
+	}
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("unrecognized endpoint resource %q: %w", resource, util.HTTPError(http.StatusBadRequest))
+		}
+	}
+	parsed := &DataprocResource{
+		Project:  parts[1],
+		Location: parts[3],
+		Name:     parts[5],
+	}
+	switch {
+	case parts[2] == "regions" && parts[4] == "clusters":
+		parsed.Region = parts[3]
+		parsed.Kind = DataprocClusterKind
+	case parts[2] == "locations" && parts[4] == "sessions":
+		parsed.Kind = DataprocSessionKind
+	default:
+		return nil, fmt.Errorf("unrecognized endpoint resource %q: %w", resource, util.HTTPError(http.StatusBadRequest))
+	}
+	return parsed, nil
+}
+
+// BackendLabelFromEndpointResource returns a human-readable label for the backend identified by the given endpointParentResource value.
+//
+// The supported values are those of ParseDataprocResource, e.g. a cluster results in a label
+// like "Dataproc: test-cluster (us-central1)". Any other value results in an error.
+func BackendLabelFromEndpointResource(resource string) (string, error) {
+	parsed, err := ParseDataprocResource(resource)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Kind == DataprocSessionKind {
+		return fmt.Sprintf("Dataproc Serverless: %s (%s)", parsed.Name, parsed.Location), nil
+	}
+	return fmt.Sprintf("Dataproc: %s (%s)", parsed.Name, parsed.Location), nil
+}
+
+// CanonicalSpecID returns a deterministic kernelspec ID for the given display name and language.
+//
+// The result is a lowercase slug of the display name and the language joined by a hyphen,
+// e.g. "Python 3" and "python" result in "python3-python". Whitespace is dropped and every
+// other run of characters besides ASCII letters and digits becomes a single hyphen. If any
+// such characters had to be replaced, then a short hash of the original inputs is appended
+// so that names differing only in those characters (e.g. "C" and "C++") do not collide.
+func CanonicalSpecID(displayName, language string) string {
+	nameSlug, nameLossy := slugify(displayName)
+	languageSlug, languageLossy := slugify(language)
+	var parts []string
+	for _, part := range []string{nameSlug, languageSlug} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if nameLossy || languageLossy || len(parts) == 0 {
+		hash := sha256.Sum256([]byte(displayName + "\x00" + language))
+		parts = append(parts, fmt.Sprintf("%x", hash[:4]))
+	}
+	return strings.Join(parts, "-")
+}
+
+// slugify returns a lowercase, hyphenated form of the given string, and whether or not any characters were replaced.
+func slugify(s string) (slug string, lossy bool) {
+	var sb strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			if pendingHyphen && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			pendingHyphen = false
+			sb.WriteRune(r)
+		case unicode.IsSpace(r):
+			continue
+		default:
+			lossy = true
+			pendingHyphen = true
+		}
+	}
+	return sb.String(), lossy
+}
+
 // Spec defines the `spec` field nested within a KernelSpec
 type Spec struct {
 	Language       string            `json:"language"`
@@ -151,12 +762,125 @@ type Spec struct {
 	HelpLinks      map[string]string `json:"help_links,omitempty"`
 	Metadata       map[string]any    `json:"metadata"`
 	InterruptMode  string            `json:"interrupt_mode,omitempty"`
+	rawFields      map[string]any
+}
+
+// specFields is used to (un)marshal the structured fields of a Spec without recursing into its custom methods.
+type specFields Spec
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+//
+// Fields within the `spec` object that are not known to the Spec type are preserved.
+func (s *Spec) UnmarshalJSON(b []byte) error {
+	rawFields := make(map[string]any)
+	if err := json.Unmarshal(b, &rawFields); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, (*specFields)(s)); err != nil {
+		return err
+	}
+	s.rawFields = rawFields
+	return nil
+}
+
+// StripRawFields drops the fields that are not known to the Spec type.
+func (s *Spec) StripRawFields() {
+	s.rawFields = nil
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (s Spec) MarshalJSON() ([]byte, error) {
+	fieldsBytes, err := json.Marshal(specFields(s))
+	if err != nil {
+		return nil, err
+	}
+	fieldsMap := make(map[string]any)
+	if err := json.Unmarshal(fieldsBytes, &fieldsMap); err != nil {
+		return nil, err
+	}
+	rawFields := make(map[string]any)
+	for k, v := range s.rawFields {
+		rawFields[k] = v
+	}
+	for k, v := range fieldsMap {
+		rawFields[k] = v
+	}
+	return json.Marshal(rawFields)
+}
+
+// OverlayDefaults fills in the fields of the spec that are unset using the given default spec.
+//
+// The `metadata` maps are shallow-merged rather than replaced, with the spec's own keys
+// winning over those of the default. Values copied from the default are not shared with it.
+func (s *Spec) OverlayDefaults(defaults *Spec) {
+	if defaults == nil {
+		return
+	}
+	if s.Language == "" {
+		s.Language = defaults.Language
+	}
+	if len(s.Argv) == 0 {
+		s.Argv = slices.Clone(defaults.Argv)
+	}
+	if s.DisplayName == "" {
+		s.DisplayName = defaults.DisplayName
+	}
+	if s.CodemirrorMode == "" {
+		s.CodemirrorMode = defaults.CodemirrorMode
+	}
+	if len(s.Env) == 0 {
+		s.Env = maps.Clone(defaults.Env)
+	}
+	if len(s.HelpLinks) == 0 {
+		s.HelpLinks = maps.Clone(defaults.HelpLinks)
+	}
+	if s.InterruptMode == "" {
+		s.InterruptMode = defaults.InterruptMode
+	}
+	for key, val := range defaults.Metadata {
+		if _, ok := s.Metadata[key]; ok {
+			continue
+		}
+		if s.Metadata == nil {
+			s.Metadata = make(map[string]any)
+		}
+		s.Metadata[key] = val
+	}
+}
+
+// OverlayDefaults fills in the unset fields of every kernelspec using the given default spec.
+//
+// See Spec.OverlayDefaults for how the fields are merged.
+func (ks *KernelSpecs) OverlayDefaults(defaults *Spec) {
+	for _, spec := range ks.KernelSpecs {
+		if spec == nil {
+			continue
+		}
+		if spec.Spec == nil {
+			spec.Spec = &Spec{}
+		}
+		spec.Spec.OverlayDefaults(defaults)
+	}
+}
+
+// VSCodeMetadata returns the `vscode` block from the kernelspec's metadata.
+//
+// This block is read by VS Code's Jupyter extension. The returned `ok` value is
+// false if the block is missing or is not a JSON object.
+func (s *Spec) VSCodeMetadata() (map[string]any, bool) {
+	if s == nil {
+		return nil, false
+	}
+	vscode, ok := s.Metadata["vscode"].(map[string]any)
+	return vscode, ok
 }
 
 // KernelSpec defines one of the available kernel configurations supported by a Jupyter server.
 type KernelSpec struct {
-	ID        string            `json:"name"`
-	Spec      *Spec             `json:"spec"`
+	ID   string `json:"name"`
+	Spec *Spec  `json:"spec"`
+	// Resources are always marshalled with their keys in sorted order, so that the
+	// marshalled kernelspec is byte-for-byte stable and can be parsed in order.
 	Resources map[string]string `json:"resources"`
 	rawFields map[string]any
 }
@@ -166,7 +890,46 @@ func (ks *KernelSpec) Identify() string {
 	return ks.ID
 }
 
+// HasLocalAbsoluteInterpreter reports whether or not the kernelspec is hosted by a remote endpoint but launches an interpreter at an absolute path.
+//
+// Absolute interpreter paths (e.g. `/usr/local/bin/python`) usually come from a local
+// installation and are unlikely to exist on the remote endpoint, so such a kernelspec is
+// probably misconfigured for its backend.
+func (ks *KernelSpec) HasLocalAbsoluteInterpreter() bool {
+	if ks == nil || ks.Spec == nil || len(ks.Spec.Argv) == 0 {
+		return false
+	}
+	if ks.Resources[endpointParentResourceKey] == "" {
+		return false
+	}
+	return path.IsAbs(ks.Spec.Argv[0])
+}
+
+// resourcePairsMap converts kernelspec resources encoded as an array of key/value objects into the standard map form.
+//
+// Some nonstandard backends report resources as `[{"key": "...", "value": "..."}]`.
+func resourcePairsMap(pairs []any) (map[string]any, error) {
+	resourcesMap := make(map[string]any)
+	for _, pair := range pairs {
+		pairMap, ok := pair.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid entry in the field 'resources': %+v: %w", pair, util.HTTPError(http.StatusBadRequest))
+		}
+		key, ok := pairMap["key"].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid key in the field 'resources': %+v: %w", pair, util.HTTPError(http.StatusBadRequest))
+		}
+		if _, ok := resourcesMap[key]; ok {
+			return nil, fmt.Errorf("duplicate key %q in the field 'resources': %w", key, util.HTTPError(http.StatusBadRequest))
+		}
+		resourcesMap[key] = pairMap["value"]
+	}
+	return resourcesMap, nil
+}
+
 // UnmarshalJSON implements the json.Unmarshaler interface
+//
+// The `resources` field may be either a JSON object or an array of key/value objects.
 func (ks *KernelSpec) UnmarshalJSON(b []byte) error {
 	rawFields := make(map[string]any)
 	if err := json.Unmarshal(b, &rawFields); err != nil {
@@ -185,6 +948,15 @@ func (ks *KernelSpec) UnmarshalJSON(b []byte) error {
 	}
 	if resources, ok := rawFields["resources"]; ok {
 		resourcesMap, ok := resources.(map[string]any)
+		if pairs, isArray := resources.([]any); isArray {
+			var err error
+			if resourcesMap, err = resourcePairsMap(pairs); err != nil {
+				return err
+			}
+			// Normalize the raw field too, so that the kernelspec is re-encoded in the standard form.
+			rawFields["resources"] = resourcesMap
+			ok = true
+		}
 		if !ok {
 			return fmt.Errorf("invalid value for the field 'resources': %+v: %w", resources, util.HTTPError(http.StatusBadRequest))
 		}
@@ -211,6 +983,14 @@ func (ks *KernelSpec) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// StripRawFields drops the fields that are not known to the KernelSpec type, including those of its nested spec.
+func (ks *KernelSpec) StripRawFields() {
+	ks.rawFields = nil
+	if ks.Spec != nil {
+		ks.Spec.StripRawFields()
+	}
+}
+
 // MarshalJSON implements the json.Marshaler interface
 func (ks KernelSpec) MarshalJSON() ([]byte, error) {
 	rawFields := make(map[string]any)
@@ -249,6 +1029,8 @@ type Kernel struct {
 	LastActivity   string `json:"last_activity,omitempty"`
 	Connections    int    `json:"connections"`
 	ExecutionState string `json:"execution_state,omitempty"`
+	// The `ready` field is not part of the documented API, but is reported by some backends.
+	Ready bool `json:"ready,omitempty"`
 
 	// The `env` field is not part of the documented API, but is set by the notebook
 	// server when calling into gateway servers. See here:
@@ -310,6 +1092,13 @@ func (k *Kernel) UnmarshalJSON(b []byte) error {
 		}
 		k.ExecutionState = executionStateString
 	}
+	if readyVal, ok := rawFields["ready"]; ok {
+		readyBool, err := parseBool("ready", readyVal)
+		if err != nil {
+			return err
+		}
+		k.Ready = readyBool
+	}
 	if envVal, ok := rawFields["env"]; ok {
 		envMap, ok := envVal.(map[string]any)
 		if !ok {
@@ -328,6 +1117,13 @@ func (k *Kernel) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// StripRawFields drops the fields that are not known to the Kernel type.
+//
+// For a KernelStartRequest, this includes its `path` field.
+func (k *Kernel) StripRawFields() {
+	k.rawFields = nil
+}
+
 // MarshalJSON implements the json.Marshaler interface
 func (k Kernel) MarshalJSON() ([]byte, error) {
 	rawFields := make(map[string]any)
@@ -348,6 +1144,10 @@ func (k Kernel) MarshalJSON() ([]byte, error) {
 	if len(k.ExecutionState) > 0 {
 		rawFields["execution_state"] = k.ExecutionState
 	}
+	if _, ok := rawFields["ready"]; ok || k.Ready {
+		// Always report a real boolean, even if the backend sent a number.
+		rawFields["ready"] = k.Ready
+	}
 	if len(k.Env) > 0 {
 		rawFields["env"] = k.Env
 	}
@@ -357,6 +1157,258 @@ func (k Kernel) MarshalJSON() ([]byte, error) {
 	return json.Marshal(rawFields)
 }
 
+// parseBool parses the value of a boolean field.
+//
+// Some backends report booleans as the numbers 0 and 1, so those are accepted in addition to real booleans.
+func parseBool(fieldName string, val any) (bool, error) {
+	switch v := val.(type) {
+	case bool:
+		return v, nil
+	case float64:
+		if v == 0 {
+			return false, nil
+		}
+		if v == 1 {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("invalid value for the field '%s': %+v: %w", fieldName, val, util.HTTPError(http.StatusBadRequest))
+}
+
+// GPUInfo returns the type and number of GPUs allocated to the kernel.
+//
+// These are read from the `accelerator` entry in the kernel's metadata. The returned
+// `ok` value is false if either the type or the count is missing or malformed.
+func (k *Kernel) GPUInfo() (gpuType string, count int, ok bool) {
+	accelerator, ok := k.Metadata["accelerator"].(map[string]any)
+	if !ok {
+		return "", 0, false
+	}
+	gpuType, ok = accelerator["type"].(string)
+	if !ok {
+		return "", 0, false
+	}
+	// JSON numbers are unmarshalled as floating point values.
+	countNumber, ok := accelerator["count"].(float64)
+	if !ok {
+		return "", 0, false
+	}
+	return gpuType, int(countNumber), true
+}
+
+// IsCulled reports whether or not the backend has marked the kernel as culled for being idle.
+//
+// This is read from the `culled` entry in the kernel's metadata, and is false if that is missing.
+func (k *Kernel) IsCulled() bool {
+	culled, ok := k.Metadata["culled"].(bool)
+	return ok && culled
+}
+
+// LastActivityTime returns the parsed time of the kernel's last activity.
+//
+// The returned `ok` value is false if the last activity is missing or is not an RFC 3339 timestamp.
+func (k *Kernel) LastActivityTime() (time.Time, bool) {
+	return parseTimestamp(k.LastActivity)
+}
+
+// StateChangedAt returns the parsed time of the kernel's last execution state transition.
+//
+// This is read from the `state_changed_at` entry in the kernel's metadata, which only some
+// backends report. The returned `ok` value is false if that is missing or is not an RFC 3339 timestamp.
+func (k *Kernel) StateChangedAt() (time.Time, bool) {
+	stateChangedAt, ok := k.Metadata["state_changed_at"].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	return parseTimestamp(stateChangedAt)
+}
+
+// parseTimestamp parses an RFC 3339 timestamp as reported by Jupyter, e.g. "2023-02-14T02:50:02.922555Z".
+func parseTimestamp(timestamp string) (time.Time, bool) {
+	if timestamp == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// TruncateEnv limits the kernel's environment to at most max entries, returning the number of entries dropped.
+//
+// The entries with the first max keys in sorted order are kept, and the kernel is modified in place.
+func (k *Kernel) TruncateEnv(max int) int {
+	if max < 0 {
+		max = 0
+	}
+	if len(k.Env) <= max {
+		return 0
+	}
+	keys := slices.Sorted(maps.Keys(k.Env))
+	for _, key := range keys[max:] {
+		delete(k.Env, key)
+	}
+	if len(k.Env) == 0 {
+		// Also drop the raw value, as otherwise it would be re-emitted when marshalling.
+		k.Env = nil
+		delete(k.rawFields, "env")
+	}
+	return len(keys) - max
+}
+
+// InUse reports whether or not the kernel is actively connected to by any clients.
+func (k *Kernel) InUse() bool {
+	return k.Connections > 0
+}
+
+// WebSocketRoute splits the kernel's ID into the name of the backend and the backend's native kernel ID, for routing channel connections.
+//
+// The ID is split at the first occurrence of the separator. The returned `ok` value is false
+// if the ID is not prefixed with a backend name, in which case the native kernel ID is the
+// whole ID and the caller should route the connection to its default backend.
+func (k *Kernel) WebSocketRoute(separator string) (backend, kernelID string, ok bool) {
+	if separator == "" {
+		return "", k.ID, false
+	}
+	backend, kernelID, ok = strings.Cut(k.ID, separator)
+	if !ok || backend == "" || kernelID == "" {
+		return "", k.ID, false
+	}
+	return backend, kernelID, true
+}
+
+// EnforceKernelQuota limits the number of kernels kept for each backend to that backend's quota.
+//
+// A kernel's backend is identified by the `endpointParentResource` entry in the resources of its
+// kernelspec in the given kernelspecs, with the kernels of kernelspecs lacking that entry or not
+// listed belonging to the local backend, identified by the empty string.
+// Within each backend the kernels with the oldest last activity are kept first, and kernels
+// whose last activity is missing or malformed are kept last. Backends without a quota are not
+// limited. Both returned slices preserve the order of the given kernels.
+func EnforceKernelQuota(specs *KernelSpecs, kernels []*Kernel, quotas map[string]int) (kept, dropped []*Kernel) {
+	byBackend := make(map[string][]*Kernel)
+	for _, k := range kernels {
+		resource := specs.kernelBackend(k)
+		byBackend[resource] = append(byBackend[resource], k)
+	}
+	droppedKernels := make(map[*Kernel]bool)
+	for resource, backendKernels := range byBackend {
+		quota, ok := quotas[resource]
+		if !ok || len(backendKernels) <= quota {
+			continue
+		}
+		byActivity := slices.Clone(backendKernels)
+		slices.SortStableFunc(byActivity, func(a, b *Kernel) int {
+			aTime, aOK := a.LastActivityTime()
+			bTime, bOK := b.LastActivityTime()
+			if aOK != bOK {
+				if aOK {
+					return -1
+				}
+				return 1
+			}
+			switch {
+			case aTime.Before(bTime):
+				return -1
+			case bTime.Before(aTime):
+				return 1
+			}
+			return 0
+		})
+		if quota < 0 {
+			quota = 0
+		}
+		for _, k := range byActivity[quota:] {
+			droppedKernels[k] = true
+		}
+	}
+	for _, k := range kernels {
+		if droppedKernels[k] {
+			dropped = append(dropped, k)
+		} else {
+			kept = append(kept, k)
+		}
+	}
+	return kept, dropped
+}
+
+// ConnectionShareByBackend returns each backend's fraction of the total connections across the given kernels.
+//
+// Each kernel belongs to the backend of its kernelspec in the given kernelspecs, as in EnforceKernelQuota.
+// If there are no connections in total, then the returned map is empty.
+func ConnectionShareByBackend(specs *KernelSpecs, kernels []*Kernel) map[string]float64 {
+	byBackend := make(map[string]int)
+	total := 0
+	for _, k := range kernels {
+		if k == nil {
+			continue
+		}
+		byBackend[specs.kernelBackend(k)] += k.Connections
+		total += k.Connections
+	}
+	shares := make(map[string]float64)
+	if total == 0 {
+		return shares
+	}
+	for resource, connections := range byBackend {
+		shares[resource] = float64(connections) / float64(total)
+	}
+	return shares
+}
+
+// KernelStartRequest is the body of a request to start a new kernel.
+//
+// This has the same shape as a kernel, with an additional, optional `path` field.
+type KernelStartRequest struct {
+	Kernel
+}
+
+// Path returns the optional path reported in the start request.
+func (req *KernelStartRequest) Path() string {
+	path, _ := req.rawFields["path"].(string)
+	return path
+}
+
+// Validate checks that the start request has the expected shape.
+//
+// This does not check that the requested kernelspec exists, as that requires knowing the available kernelspecs.
+func (req *KernelStartRequest) Validate() error {
+	if req.SpecID == "" {
+		return fmt.Errorf("missing the kernelspec 'name' for the new kernel: %w", util.HTTPError(http.StatusBadRequest))
+	}
+	if pathVal, ok := req.rawFields["path"]; ok && pathVal != nil {
+		if _, ok := pathVal.(string); !ok {
+			return fmt.Errorf("invalid value for the field 'path': %+v: %w", pathVal, util.HTTPError(http.StatusBadRequest))
+		}
+	}
+	return nil
+}
+
+// SessionType is the kind of document that a session connects to its kernel.
+type SessionType string
+
+// The session types that Jupyter frontends use.
+//
+// These are untyped, so that they can be used for the Type of a Session as well as a SessionType.
+const (
+	SessionTypeNotebook = "notebook"
+	SessionTypeConsole  = "console"
+	SessionTypeFile     = "file"
+)
+
+// sessionTypes are the session types that the frontend understands.
+var sessionTypes = map[SessionType]bool{
+	SessionTypeNotebook: true,
+	SessionTypeConsole:  true,
+	SessionTypeFile:     true,
+}
+
+// IsKnown reports whether or not the session type is one that the frontend understands.
+func (t SessionType) IsKnown() bool {
+	return sessionTypes[t]
+}
+
 // Session defines a mapping between a file path and a kernel.
 type Session struct {
 	ID        string            `json:"id"`
@@ -373,6 +1425,30 @@ func (s *Session) Identify() string {
 	return s.ID
 }
 
+// LastActivityTime returns the time of the last activity of the session's kernel.
+func (s *Session) LastActivityTime() (time.Time, error) {
+	if s.Kernel == nil {
+		return time.Time{}, fmt.Errorf("session %q does not have a kernel", s.ID)
+	}
+	t, ok := s.Kernel.LastActivityTime()
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid last activity %q for the kernel of session %q", s.Kernel.LastActivity, s.ID)
+	}
+	return t, nil
+}
+
+// Validate checks the session for values that the frontend does not expect.
+//
+// Jupyter accepts sessions of any type, so the returned errors are warnings that do not prevent
+// the session from being used. A missing type is not reported, as older clients omit it.
+func (s *Session) Validate() []error {
+	var warnings []error
+	if s.Type != "" && !SessionType(s.Type).IsKnown() {
+		warnings = append(warnings, fmt.Errorf("unexpected type %q for the session %q", s.Type, s.ID))
+	}
+	return warnings
+}
+
 // UnmarshalJSON implements the json.Unmarshaler interface
 func (s *Session) UnmarshalJSON(b []byte) error {
 	rawFields := make(map[string]any)
@@ -425,6 +1501,7 @@ func (s *Session) UnmarshalJSON(b []byte) error {
 	}
 	k, ok := rawFields["kernel"]
 	if !ok {
+		s.rawFields = rawFields
 		return nil
 	}
 	kernelBytes, err := json.Marshal(k)
@@ -438,6 +1515,14 @@ func (s *Session) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// StripRawFields drops the fields that are not known to the Session type, including those of its kernel.
+func (s *Session) StripRawFields() {
+	s.rawFields = nil
+	if s.Kernel != nil {
+		s.Kernel.StripRawFields()
+	}
+}
+
 // MarshalJSON implements the json.Marshaler interface
 func (s Session) MarshalJSON() ([]byte, error) {
 	rawFields := make(map[string]any)
@@ -460,6 +1545,10 @@ func (s Session) MarshalJSON() ([]byte, error) {
 		rawFields["notebook"] = s.Notebook
 	}
 	if s.Kernel == nil {
+		if _, ok := rawFields["kernel"]; ok {
+			// The kernel was cleared since the session was parsed.
+			rawFields["kernel"] = nil
+		}
 		return json.Marshal(rawFields)
 	}
 	kernelBytes, err := json.Marshal(s.Kernel)
@@ -479,17 +1568,195 @@ func (s Session) MarshalJSON() ([]byte, error) {
 	return json.Marshal(rawFields)
 }
 
+// sessionFields are the JSON fields of a session that are represented as structured fields.
+var sessionFields = map[string]bool{
+	"id":       true,
+	"path":     true,
+	"name":     true,
+	"type":     true,
+	"kernel":   true,
+	"notebook": true,
+}
+
+// ApplyPatch updates the session with the fields set in the given patch, as for a `PATCH /api/sessions/{id}` request.
+//
+// Fields that are empty in the patch are left unchanged, so the session's kernel, notebook,
+// and any fields not defined by the Jupyter API survive unless the patch replaces them. The
+// legacy `notebook` block is kept in sync with updates to the path and name. The session's
+// ID is never changed, and the session's maps are copied rather than modified in place, so
+// that shallow copies of a session can be patched independently.
+func (s *Session) ApplyPatch(patch *Session) {
+	if patch == nil {
+		return
+	}
+	notebook := maps.Clone(s.Notebook)
+	for key, val := range patch.Notebook {
+		if notebook == nil {
+			notebook = make(map[string]string)
+		}
+		notebook[key] = val
+	}
+	newPath, newName := patch.Path, patch.Name
+	if newPath == "" {
+		newPath = patch.Notebook["path"]
+	}
+	if newName == "" {
+		newName = patch.Notebook["name"]
+	}
+	if newPath != "" {
+		s.Path = newPath
+		if _, ok := notebook["path"]; ok {
+			notebook["path"] = newPath
+		}
+	}
+	if newName != "" {
+		s.Name = newName
+		if _, ok := notebook["name"]; ok {
+			notebook["name"] = newName
+		}
+	}
+	s.Notebook = notebook
+	if patch.Type != "" {
+		s.Type = patch.Type
+	}
+	if patch.Kernel != nil {
+		s.Kernel = patch.Kernel
+	}
+	rawFields := maps.Clone(s.rawFields)
+	for key, val := range patch.rawFields {
+		if sessionFields[key] {
+			continue
+		}
+		if rawFields == nil {
+			rawFields = make(map[string]any)
+		}
+		rawFields[key] = val
+	}
+	s.rawFields = rawFields
+}
+
+// EffectiveName returns the name to display for the session.
+//
+// This is the session's name if set, or else the base name of its path, or else its ID.
+func (s *Session) EffectiveName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if p := strings.TrimRight(s.Path, "/"); p != "" {
+		return path.Base(p)
+	}
+	return s.ID
+}
+
+// Sessions is a list of sessions.
+type Sessions []*Session
+
+// deadExecutionState is the execution state that Jupyter reports for a kernel whose process has died.
+const deadExecutionState = "dead"
+
+// UnknownExecutionState is the execution state reported for a kernel whose backend reports a state that the frontend does not understand.
+const UnknownExecutionState = "unknown"
+
+// executionStates are the kernel execution states that the frontend understands.
+var executionStates = map[string]bool{
+	UnknownExecutionState: true,
+	"starting":            true,
+	"idle":                true,
+	"busy":                true,
+	"terminating":         true,
+	"restarting":          true,
+	"autorestarting":      true,
+	deadExecutionState:    true,
+}
+
+// executionStateAliases maps the execution states that some backends report onto the equivalent states that the frontend understands.
+var executionStateAliases = map[string]string{
+	"initializing":  "starting",
+	"launching":     "starting",
+	"pending":       "starting",
+	"provisioning":  "starting",
+	"executing":     "busy",
+	"stopping":      "terminating",
+	"shutting_down": "terminating",
+	"stopped":       deadExecutionState,
+	"terminated":    deadExecutionState,
+}
+
+// NormalizeExecutionState maps the given kernel execution state onto one that the frontend understands.
+//
+// States are matched ignoring case and surrounding whitespace. Known aliases, e.g. "initializing",
+// are mapped onto their canonical state, and any other unrecognized state becomes "unknown". The
+// empty string, which means that no state was reported, is returned unchanged.
+func NormalizeExecutionState(s string) string {
+	if s == "" {
+		return ""
+	}
+	normalized := strings.ToLower(strings.TrimSpace(s))
+	if executionStates[normalized] {
+		return normalized
+	}
+	if canonical, ok := executionStateAliases[normalized]; ok {
+		return canonical
+	}
+	return UnknownExecutionState
+}
+
+// SessionsWithDeadKernels returns the sessions whose kernel is no longer alive.
+//
+// A session's kernel is not alive if its ID is missing from the given list of
+// live kernels, or if the matching kernel reports a dead execution state.
+// Sessions without a kernel are not included.
+func SessionsWithDeadKernels(sessions Sessions, kernels []*Kernel) Sessions {
+	kernelsByID := make(map[string]*Kernel)
+	for _, k := range kernels {
+		if k != nil {
+			kernelsByID[k.ID] = k
+		}
+	}
+	var dead Sessions
+	for _, s := range sessions {
+		if s == nil || s.Kernel == nil {
+			continue
+		}
+		k, ok := kernelsByID[s.Kernel.ID]
+		if !ok || k.ExecutionState == deadExecutionState {
+			dead = append(dead, s)
+		}
+	}
+	return dead
+}
+
 // Terminal defines an interactive terminal running inside of a Jupyter server.
 type Terminal struct {
-	ID        string `json:"name"`
-	rawFields map[string]any
+	ID string `json:"name"`
+	// The `last_activity` and `connections` fields are only reported by newer Jupyter servers.
+	LastActivity string `json:"last_activity,omitempty"`
+	Connections  int    `json:"connections,omitempty"`
+	rawFields    map[string]any
 }
 
+// Terminals is a list of terminals.
+type Terminals []*Terminal
+
 // Identify returns the ID of the kernel.
 func (t *Terminal) Identify() string {
 	return t.ID
 }
 
+// Validate checks that the terminal can be used by the frontend.
+//
+// The terminal's ID is used as a segment in the terminal's URL paths, so it must be
+// non-empty and must not contain a slash.
+func (t *Terminal) Validate() error {
+	if t.ID == "" {
+		return fmt.Errorf("missing the terminal 'name'")
+	}
+	if strings.Contains(t.ID, "/") {
+		return fmt.Errorf("invalid terminal 'name' %q: names must not contain a slash", t.ID)
+	}
+	return nil
+}
+
 // UnmarshalJSON implements the json.Unmarshaler interface
 func (t *Terminal) UnmarshalJSON(b []byte) error {
 	rawFields := make(map[string]any)
@@ -507,10 +1774,36 @@ func (t *Terminal) UnmarshalJSON(b []byte) error {
 		}
 		t.ID = idString
 	}
+	if lastActivityVal, ok := rawFields["last_activity"]; ok {
+		lastActivityString, ok := lastActivityVal.(string)
+		if !ok {
+			return fmt.Errorf("invalid value for the field 'last_activity': %+v: %w", lastActivityVal, util.HTTPError(http.StatusBadRequest))
+		}
+		t.LastActivity = lastActivityString
+	}
+	if connectionsVal, ok := rawFields["connections"]; ok {
+		connectionsNumber, ok := connectionsVal.(float64)
+		if !ok {
+			return fmt.Errorf("invalid type for the field 'connections': %+v: %w", connectionsVal, util.HTTPError(http.StatusBadRequest))
+		}
+		t.Connections = int(connectionsNumber)
+	}
 	t.rawFields = rawFields
 	return nil
 }
 
+// LastActivityTime returns the parsed time of the terminal's last activity.
+//
+// The returned `ok` value is false if the last activity is missing or is not an RFC 3339 timestamp.
+func (t *Terminal) LastActivityTime() (time.Time, bool) {
+	return parseTimestamp(t.LastActivity)
+}
+
+// StripRawFields drops the fields that are not known to the Terminal type.
+func (t *Terminal) StripRawFields() {
+	t.rawFields = nil
+}
+
 // MarshalJSON implements the json.Marshaler interface
 func (t Terminal) MarshalJSON() ([]byte, error) {
 	rawFields := make(map[string]any)
@@ -520,5 +1813,94 @@ func (t Terminal) MarshalJSON() ([]byte, error) {
 	if len(t.ID) > 0 {
 		rawFields["name"] = t.ID
 	}
+	if len(t.LastActivity) > 0 {
+		rawFields["last_activity"] = t.LastActivity
+	}
+	if _, ok := rawFields["connections"]; ok || t.Connections != 0 {
+		rawFields["connections"] = t.Connections
+	}
 	return json.Marshal(rawFields)
 }
+
+// kernelBackend returns the endpointParentResource of the kernelspec that the given kernel was started from.
+//
+// Kernels do not record their backend themselves, so this is the empty string both for
+// kernels of local kernelspecs and for kernels whose kernelspec is not listed.
+func (ks *KernelSpecs) kernelBackend(k *Kernel) string {
+	if ks == nil {
+		return ""
+	}
+	spec, ok := ks.KernelSpecs[k.SpecID]
+	if !ok || spec == nil {
+		return ""
+	}
+	return spec.Resources[endpointParentResourceKey]
+}
+
+// healthReportLocalBackend is the label for the local backend in a health report.
+const healthReportLocalBackend = "local"
+
+// BuildHealthReport aggregates the given resources into a single report of the mixer's health.
+//
+// The report has the following sections, and can be marshalled as JSON:
+//
+//   - "counts": the number of kernelspecs, kernels, sessions, and terminals.
+//   - "backends": the number of kernelspecs, kernels, and kernel connections for each backend,
+//     keyed by endpointParentResource, with the local backend keyed as "local". Kernels are
+//     counted against the backend of their kernelspec.
+//   - "issues": descriptions of inconsistencies, e.g. sessions whose kernel is dead or kernels
+//     whose kernelspec is not listed.
+//   - "endpoints_digest": the EndpointsDigest of the kernelspecs.
+func BuildHealthReport(specs *KernelSpecs, kernels []*Kernel, sessions Sessions, terminals Terminals) map[string]any {
+	if specs == nil {
+		specs = &KernelSpecs{}
+	}
+	backends := make(map[string]map[string]int)
+	backendCounts := func(resource string) map[string]int {
+		if resource == "" {
+			resource = healthReportLocalBackend
+		}
+		counts, ok := backends[resource]
+		if !ok {
+			counts = map[string]int{"kernelspecs": 0, "kernels": 0, "connections": 0}
+			backends[resource] = counts
+		}
+		return counts
+	}
+	issues := []string{}
+	for _, spec := range specs.KernelSpecs {
+		if spec != nil {
+			backendCounts(spec.Resources[endpointParentResourceKey])["kernelspecs"]++
+		}
+	}
+	if specs.Default != "" {
+		if _, ok := specs.KernelSpecs[specs.Default]; !ok {
+			issues = append(issues, fmt.Sprintf("the default kernelspec %q is not listed", specs.Default))
+		}
+	}
+	for _, k := range kernels {
+		if k == nil {
+			continue
+		}
+		counts := backendCounts(specs.kernelBackend(k))
+		counts["kernels"]++
+		counts["connections"] += k.Connections
+		if _, ok := specs.KernelSpecs[k.SpecID]; !ok {
+			issues = append(issues, fmt.Sprintf("the kernel %q uses the unlisted kernelspec %q", k.ID, k.SpecID))
+		}
+	}
+	for _, s := range SessionsWithDeadKernels(sessions, kernels) {
+		issues = append(issues, fmt.Sprintf("the session %q uses the missing or dead kernel %q", s.ID, s.Kernel.ID))
+	}
+	return map[string]any{
+		"counts": map[string]int{
+			"kernelspecs": len(specs.KernelSpecs),
+			"kernels":     len(kernels),
+			"sessions":    len(sessions),
+			"terminals":   len(terminals),
+		},
+		"backends":         backends,
+		"issues":           issues,
+		"endpoints_digest": specs.EndpointsDigest(),
+	}
+}
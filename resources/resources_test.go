@@ -16,11 +16,17 @@ limitations under the License.
 package resources
 
 import (
+	"bytes"
 	"encoding/json"
+	"maps"
+	"net/http"
+	"reflect"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 )
@@ -137,6 +143,19 @@ func TestUnmarshalAndMarshalRoundtrip(t *testing.T) {
 				},
 			},
 		},
+		{
+			Description: "KernelSpec with unknown fields in the spec",
+			Source:      "{\"name\": \"id\", \"spec\": {\"language\": \"python\", \"argv\": [], \"custom_thing\": 42}}",
+			Got:         &KernelSpec{},
+			Want: &KernelSpec{
+				ID: "id",
+				Spec: &Spec{
+					Language: "python",
+					Argv:     []string{},
+				},
+			},
+			WantMarshalled: "{\"name\":\"id\",\"spec\":{\"argv\":[],\"custom_thing\":42,\"display_name\":\"\",\"language\":\"python\"}}",
+		},
 		{
 			Description: "Empty Kernel",
 			Source:      "{\"connections\": 0}",
@@ -292,11 +311,29 @@ func TestUnmarshalAndMarshalRoundtrip(t *testing.T) {
 				},
 			},
 		},
+		{
+			Description: "Terminal with activity and connections",
+			Source:      "{\"name\": \"Name\", \"last_activity\": \"2023-02-14T02:50:02.922555Z\", \"connections\": 2, \"foo\": \"bar\"}",
+			Got:         &Terminal{},
+			Want: &Terminal{
+				ID:           "Name",
+				LastActivity: "2023-02-14T02:50:02.922555Z",
+				Connections:  2,
+			},
+		},
+		{
+			Description: "Terminal with zero connections",
+			Source:      "{\"name\": \"Name\", \"connections\": 0}",
+			Got:         &Terminal{},
+			Want: &Terminal{
+				ID: "Name",
+			},
+		},
 	}
 	for _, testCase := range testCases {
 		if err := json.Unmarshal([]byte(testCase.Source), testCase.Got); err != nil {
 			t.Errorf("Failure unmarshalling the resource for %q: %v", testCase.Description, err)
-		} else if diff := cmp.Diff(testCase.Got, testCase.Want, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(KernelSpecs{}, KernelSpec{}, Kernel{}, Session{}, Terminal{})); len(diff) > 0 {
+		} else if diff := cmp.Diff(testCase.Got, testCase.Want, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(KernelSpecs{}, KernelSpec{}, Spec{}, Kernel{}, Session{}, Terminal{})); len(diff) > 0 {
 			t.Errorf("Unexpected diff when unmarshalling the source for %q:\n\t %v", testCase.Description, diff)
 		} else if output, err := json.Marshal(testCase.Got); err != nil {
 			t.Errorf("Failure marshalling the unmarshalled resource for %q: %v", testCase.Description, err)
@@ -308,7 +345,7 @@ func TestUnmarshalAndMarshalRoundtrip(t *testing.T) {
 			}
 			if err := json.Unmarshal(output, testCase.Got); err != nil {
 				t.Errorf("Failure unmarshalling the marshalled resource for %q: %v", testCase.Description, err)
-			} else if diff := cmp.Diff(testCase.Got, testCase.Want, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(KernelSpecs{}, KernelSpec{}, Kernel{}, Session{}, Terminal{})); len(diff) > 0 {
+			} else if diff := cmp.Diff(testCase.Got, testCase.Want, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(KernelSpecs{}, KernelSpec{}, Spec{}, Kernel{}, Session{}, Terminal{})); len(diff) > 0 {
 				t.Errorf("Unexpected diff when unmarshalling the marshalled resource for %q:\n\t %v", testCase.Description, diff)
 			} else if len(testCase.WantMarshalled) == 0 {
 				sourceRawFields := make(map[string]any)
@@ -405,3 +442,1914 @@ func TestKernelSpecsOrdering(t *testing.T) {
 		t.Errorf("Output is not sorted correctly for %q", testCaseDescription)
 	}
 }
+
+func TestKernelSpecsNames(t *testing.T) {
+	var ks KernelSpecs
+	source := `{
+		"default": "spec1",
+		"kernelspecs": {
+			"spec1": {
+				"name": "spec1",
+				"resources": {"endpointParentResource": "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/test-cluster"},
+				"spec": {"display_name": "b", "language": "python"}
+			},
+			"spec2": {
+				"name": "spec2",
+				"resources": {"endpointParentResource": "//dataproc.googleapis.com/projects/project-id/locations/test-location/sessions/test-session"},
+				"spec": {"display_name": "b", "language": "python"}
+			},
+			"spec3": {
+				"name": "spec3",
+				"resources": {"endpointParentResource": "//dataproc.googleapis.com/projects/project-id/locations/test-location/sessions/test-session"},
+				"spec": {"display_name": "a", "language": "python"}
+			}
+		}
+	}`
+	if err := json.Unmarshal([]byte(source), &ks); err != nil {
+		t.Fatalf("Failure unmarshalling the kernelspecs: %v", err)
+	}
+	names := ks.Names()
+	if diff := cmp.Diff([]string{"spec3", "spec2", "spec1"}, names); len(diff) > 0 {
+		t.Errorf("Unexpected kernelspec names: diff %v", diff)
+	}
+	output, err := json.Marshal(ks)
+	if err != nil {
+		t.Fatalf("Failure marshalling the kernelspecs: %v", err)
+	}
+	var marshalledIndices []int
+	for _, name := range names {
+		marshalledIndices = append(marshalledIndices, strings.Index(string(output), `"`+name+`":`))
+	}
+	if !slices.IsSorted(marshalledIndices) {
+		t.Errorf("Names %v do not match the marshalled order: %s", names, output)
+	}
+}
+
+func TestKernelSpecsFindByDisplayName(t *testing.T) {
+	var ks KernelSpecs
+	source := `{
+		"kernelspecs": {
+			"spec1": {"name": "spec1", "spec": {"display_name": "Python 3 on test-cluster", "language": "python"}},
+			"spec2": {"name": "spec2", "spec": {"display_name": "PySpark", "language": "python"}},
+			"spec3": {"name": "spec3", "spec": {"display_name": "PySpark", "language": "python"}}
+		}
+	}`
+	if err := json.Unmarshal([]byte(source), &ks); err != nil {
+		t.Fatalf("Failure unmarshalling the kernelspecs: %v", err)
+	}
+	testCases := []struct {
+		Description string
+		Name        string
+		WantID      string
+		WantStatus  int
+	}{
+		{Description: "Unique display name", Name: "Python 3 on test-cluster", WantID: "spec1"},
+		{Description: "Ambiguous display name", Name: "PySpark", WantStatus: http.StatusConflict},
+		{Description: "Missing display name", Name: "R", WantStatus: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		spec, err := ks.FindByDisplayName(testCase.Name)
+		if testCase.WantStatus != 0 {
+			if got := util.HTTPStatusCode(err); got != testCase.WantStatus {
+				t.Errorf("Unexpected error status for %q: got %d (%v), want %d", testCase.Description, got, err, testCase.WantStatus)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", testCase.Description, err)
+			continue
+		}
+		if spec.ID != testCase.WantID {
+			t.Errorf("Unexpected kernelspec for %q: got %q, want %q", testCase.Description, spec.ID, testCase.WantID)
+		}
+	}
+}
+
+func TestKernelGPUInfo(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Metadata    map[string]any
+		WantType    string
+		WantCount   int
+		WantOK      bool
+	}{
+		{
+			Description: "No metadata",
+		},
+		{
+			Description: "No accelerator",
+			Metadata:    map[string]any{"foo": "bar"},
+		},
+		{
+			Description: "Accelerator with type and count",
+			Metadata: map[string]any{
+				"accelerator": map[string]any{
+					"type":  "nvidia-tesla-t4",
+					"count": float64(2),
+				},
+			},
+			WantType:  "nvidia-tesla-t4",
+			WantCount: 2,
+			WantOK:    true,
+		},
+		{
+			Description: "Accelerator missing the count",
+			Metadata: map[string]any{
+				"accelerator": map[string]any{
+					"type": "nvidia-tesla-t4",
+				},
+			},
+		},
+		{
+			Description: "Accelerator missing the type",
+			Metadata: map[string]any{
+				"accelerator": map[string]any{
+					"count": float64(2),
+				},
+			},
+		},
+		{
+			Description: "Malformed accelerator",
+			Metadata:    map[string]any{"accelerator": "nvidia-tesla-t4"},
+		},
+	}
+	for _, testCase := range testCases {
+		k := &Kernel{Metadata: testCase.Metadata}
+		gotType, gotCount, gotOK := k.GPUInfo()
+		if gotType != testCase.WantType || gotCount != testCase.WantCount || gotOK != testCase.WantOK {
+			t.Errorf("Unexpected GPU info for %q: got (%q, %d, %v), want (%q, %d, %v)", testCase.Description, gotType, gotCount, gotOK, testCase.WantType, testCase.WantCount, testCase.WantOK)
+		}
+	}
+}
+
+func TestKernelSpecsValidateSeparatorConsistency(t *testing.T) {
+	testCases := []struct {
+		Description string
+		IDs         []string
+		WantErrs    int
+	}{
+		{
+			Description: "Consistent separators",
+			IDs:         []string{"local-python3", "local-ir", "remote-pyspark", "remote-python3"},
+		},
+		{
+			Description: "Mixed separators",
+			IDs:         []string{"local-python3", "local_ir", "remote-pyspark", "remote:python3"},
+			WantErrs:    2,
+		},
+		{
+			Description: "Unprefixed IDs sharing a prefix",
+			IDs:         []string{"local-python3", "localpython"},
+		},
+	}
+	for _, testCase := range testCases {
+		ks := &KernelSpecs{KernelSpecs: make(map[string]*KernelSpec)}
+		for _, id := range testCase.IDs {
+			ks.KernelSpecs[id] = &KernelSpec{ID: id}
+		}
+		if errs := ks.ValidateSeparatorConsistency("-"); len(errs) != testCase.WantErrs {
+			t.Errorf("Unexpected errors validating the separators for %q: got %v, want %d errors", testCase.Description, errs, testCase.WantErrs)
+		}
+	}
+}
+
+func TestMergeKernelSpecs(t *testing.T) {
+	clusterResource := "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/test-cluster"
+	first := &KernelSpecs{
+		Default: "python3",
+		KernelSpecs: map[string]*KernelSpec{
+			"python3": &KernelSpec{ID: "python3", Spec: &Spec{DisplayName: "Python 3"}},
+			"ir":      &KernelSpec{ID: "ir", Spec: &Spec{DisplayName: "R"}},
+		},
+	}
+	second := &KernelSpecs{
+		Default: "python3",
+		KernelSpecs: map[string]*KernelSpec{
+			"python3": &KernelSpec{
+				ID:        "python3",
+				Spec:      &Spec{DisplayName: "Python 3"},
+				Resources: map[string]string{"endpointParentResource": clusterResource},
+			},
+			"pyspark": &KernelSpec{ID: "pyspark", Spec: &Spec{DisplayName: "PySpark"}},
+		},
+	}
+	got, gotCollisions := MergeKernelSpecs(first, second)
+	want := &KernelSpecs{
+		Default: "python3",
+		KernelSpecs: map[string]*KernelSpec{
+			"python3": &KernelSpec{ID: "python3", Spec: &Spec{DisplayName: "Python 3"}},
+			"ir":      &KernelSpec{ID: "ir", Spec: &Spec{DisplayName: "R"}},
+			"test-cluster-python3": &KernelSpec{
+				ID:        "test-cluster-python3",
+				Spec:      &Spec{DisplayName: "Python 3"},
+				Resources: map[string]string{"endpointParentResource": clusterResource},
+			},
+			"pyspark": &KernelSpec{ID: "pyspark", Spec: &Spec{DisplayName: "PySpark"}},
+		},
+	}
+	if diff := cmp.Diff(got, want, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(KernelSpecs{}, KernelSpec{}, Spec{})); len(diff) > 0 {
+		t.Errorf("Unexpected diff for the merged kernelspecs:\n\t %v", diff)
+	}
+	wantCollisions := []Collision{
+		{ID: "python3", Keys: []string{"python3", "test-cluster-python3"}},
+	}
+	if diff := cmp.Diff(gotCollisions, wantCollisions); len(diff) > 0 {
+		t.Errorf("Unexpected diff for the merge collisions:\n\t %v", diff)
+	}
+}
+
+func TestKernelSpecsEngineInfo(t *testing.T) {
+	source := `{"default": "python3", "kernelspecs": {"python3": {"name": "python3"}}, "engine_info": {"name": "vendor-engine", "version": "1.2.3"}}`
+	var ks KernelSpecs
+	if err := json.Unmarshal([]byte(source), &ks); err != nil {
+		t.Fatalf("Failure unmarshalling the kernelspecs: %v", err)
+	}
+	want := map[string]any{"name": "vendor-engine", "version": "1.2.3"}
+	if got, ok := ks.EngineInfo(); !ok {
+		t.Errorf("Missing engine info for %q", source)
+	} else if diff := cmp.Diff(got, want); len(diff) > 0 {
+		t.Errorf("Unexpected diff for the engine info:\n\t %v", diff)
+	}
+
+	output, err := json.Marshal(ks)
+	if err != nil {
+		t.Fatalf("Failure marshalling the kernelspecs: %v", err)
+	}
+	var roundtripped KernelSpecs
+	if err := json.Unmarshal(output, &roundtripped); err != nil {
+		t.Fatalf("Failure unmarshalling the marshalled kernelspecs: %v", err)
+	}
+	if got, ok := roundtripped.EngineInfo(); !ok {
+		t.Errorf("Missing engine info after a roundtrip: %q", string(output))
+	} else if diff := cmp.Diff(got, want); len(diff) > 0 {
+		t.Errorf("Unexpected diff for the roundtripped engine info:\n\t %v", diff)
+	}
+
+	var withoutEngineInfo KernelSpecs
+	if err := json.Unmarshal([]byte(`{"kernelspecs": {}}`), &withoutEngineInfo); err != nil {
+		t.Fatalf("Failure unmarshalling the kernelspecs: %v", err)
+	}
+	if got, ok := withoutEngineInfo.EngineInfo(); ok {
+		t.Errorf("Unexpected engine info: %v", got)
+	}
+}
+
+// applyMergePatch applies the given JSON merge patch (RFC 7386) to the target value.
+func applyMergePatch(target any, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = make(map[string]any)
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = applyMergePatch(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
+
+func TestKernelSpecsPatch(t *testing.T) {
+	oldSpecs := &KernelSpecs{
+		Default: "python3",
+		KernelSpecs: map[string]*KernelSpec{
+			"python3": &KernelSpec{ID: "python3", Spec: &Spec{DisplayName: "Python 3", Language: "python"}},
+			"ir":      &KernelSpec{ID: "ir", Spec: &Spec{DisplayName: "R", Language: "R"}},
+			"julia": &KernelSpec{
+				ID:        "julia",
+				Spec:      &Spec{DisplayName: "Julia", Language: "julia"},
+				Resources: map[string]string{"logo-svg": "/kernelspecs/julia/logo-svg.svg"},
+			},
+		},
+	}
+	newSpecs := &KernelSpecs{
+		Default: "pyspark",
+		KernelSpecs: map[string]*KernelSpec{
+			"python3": &KernelSpec{ID: "python3", Spec: &Spec{DisplayName: "Python 3", Language: "python"}},
+			"julia":   &KernelSpec{ID: "julia", Spec: &Spec{DisplayName: "Julia 1.9", Language: "julia"}},
+			"pyspark": &KernelSpec{ID: "pyspark", Spec: &Spec{DisplayName: "PySpark", Language: "python"}},
+		},
+	}
+	patch := KernelSpecsPatch(oldSpecs, newSpecs)
+	specsPatch, ok := patch["kernelspecs"].(map[string]any)
+	if !ok {
+		t.Fatalf("Missing the kernelspecs in the patch: %v", patch)
+	}
+	if _, ok := specsPatch["python3"]; ok {
+		t.Errorf("Unexpected patch entry for an unchanged kernelspec: %v", specsPatch["python3"])
+	}
+	if got, ok := specsPatch["ir"]; !ok || got != nil {
+		t.Errorf("Unexpected patch entry for a removed kernelspec: got %v, want null", got)
+	}
+
+	oldBytes, err := json.Marshal(oldSpecs)
+	if err != nil {
+		t.Fatalf("Failure marshalling the old kernelspecs: %v", err)
+	}
+	newBytes, err := json.Marshal(newSpecs)
+	if err != nil {
+		t.Fatalf("Failure marshalling the new kernelspecs: %v", err)
+	}
+	var oldObj, newObj map[string]any
+	if err := json.Unmarshal(oldBytes, &oldObj); err != nil {
+		t.Fatalf("Failure unmarshalling the old kernelspecs: %v", err)
+	}
+	if err := json.Unmarshal(newBytes, &newObj); err != nil {
+		t.Fatalf("Failure unmarshalling the new kernelspecs: %v", err)
+	}
+	if diff := cmp.Diff(applyMergePatch(oldObj, patch), newObj); len(diff) > 0 {
+		t.Errorf("Unexpected diff after applying the kernelspecs patch:\n\t %v", diff)
+	}
+}
+
+func TestKernelIsCulled(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Metadata    map[string]any
+		Want        bool
+	}{
+		{
+			Description: "Culled kernel",
+			Metadata:    map[string]any{"culled": true},
+			Want:        true,
+		},
+		{
+			Description: "Kernel that was not culled",
+			Metadata:    map[string]any{"culled": false},
+		},
+		{
+			Description: "Kernel without the culled flag",
+			Metadata:    map[string]any{"foo": "bar"},
+		},
+		{
+			Description: "Kernel with a malformed culled flag",
+			Metadata:    map[string]any{"culled": "true"},
+		},
+	}
+	for _, testCase := range testCases {
+		k := &Kernel{Metadata: testCase.Metadata}
+		if got, want := k.IsCulled(), testCase.Want; got != want {
+			t.Errorf("Unexpected culled status for %q: got %v, want %v", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestParseDataprocResource(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Resource    string
+		Want        *DataprocResource
+	}{
+		{
+			Description: "Cluster",
+			Resource:    "//dataproc.googleapis.com/projects/project-id/regions/us-central1/clusters/test-cluster",
+			Want: &DataprocResource{
+				Project:  "project-id",
+				Location: "us-central1",
+				Region:   "us-central1",
+				Kind:     DataprocClusterKind,
+				Name:     "test-cluster",
+			},
+		},
+		{
+			Description: "Session",
+			Resource:    "//dataproc.googleapis.com/projects/project-id/locations/test-location/sessions/test-session",
+			Want: &DataprocResource{
+				Project:  "project-id",
+				Location: "test-location",
+				Kind:     DataprocSessionKind,
+				Name:     "test-session",
+			},
+		},
+		{
+			Description: "Malformed",
+			Resource:    "//dataproc.googleapis.com/projects/project-id/clusters/test-cluster",
+		},
+	}
+	for _, testCase := range testCases {
+		got, err := ParseDataprocResource(testCase.Resource)
+		if testCase.Want == nil {
+			if err == nil {
+				t.Errorf("Unexpected success for %q: got %+v", testCase.Description, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", testCase.Description, err)
+		} else if diff := cmp.Diff(testCase.Want, got); diff != "" {
+			t.Errorf("Unexpected parsed resource for %q: diff %v", testCase.Description, diff)
+		}
+	}
+}
+
+func TestBackendLabelFromEndpointResource(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Resource    string
+		Want        string
+		WantErr     bool
+	}{
+		{
+			Description: "Cluster",
+			Resource:    "//dataproc.googleapis.com/projects/project-id/regions/us-central1/clusters/test-cluster",
+			Want:        "Dataproc: test-cluster (us-central1)",
+		},
+		{
+			Description: "Session",
+			Resource:    "//dataproc.googleapis.com/projects/project-id/locations/test-location/sessions/test-session",
+			Want:        "Dataproc Serverless: test-session (test-location)",
+		},
+		{
+			Description: "Local",
+			Resource:    "",
+			WantErr:     true,
+		},
+		{
+			Description: "Other service",
+			Resource:    "//compute.googleapis.com/projects/project-id/zones/us-central1-a/instances/vm",
+			WantErr:     true,
+		},
+		{
+			Description: "Mismatched collections",
+			Resource:    "//dataproc.googleapis.com/projects/project-id/regions/us-central1/sessions/test-session",
+			WantErr:     true,
+		},
+		{
+			Description: "Missing cluster name",
+			Resource:    "//dataproc.googleapis.com/projects/project-id/regions/us-central1/clusters/",
+			WantErr:     true,
+		},
+	}
+	for _, testCase := range testCases {
+		got, err := BackendLabelFromEndpointResource(testCase.Resource)
+		if testCase.WantErr {
+			if err == nil {
+				t.Errorf("Unexpected success for %q: got %q", testCase.Description, got)
+			} else if got, want := util.HTTPStatusCode(err), http.StatusBadRequest; got != want {
+				t.Errorf("Unexpected error status for %q: got %d, want %d", testCase.Description, got, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", testCase.Description, err)
+		} else if got != testCase.Want {
+			t.Errorf("Unexpected label for %q: got %q, want %q", testCase.Description, got, testCase.Want)
+		}
+	}
+}
+
+func TestCanonicalSpecID(t *testing.T) {
+	testCases := []struct {
+		Description string
+		DisplayName string
+		Language    string
+		Want        string
+		WantPrefix  string
+	}{
+		{
+			Description: "Simple display name",
+			DisplayName: "Python 3",
+			Language:    "python",
+			Want:        "python3-python",
+		},
+		{
+			Description: "Mixed case display name",
+			DisplayName: "PySpark",
+			Language:    "Python",
+			Want:        "pyspark-python",
+		},
+		{
+			Description: "Display name with special characters",
+			DisplayName: "C++ (Beta)",
+			Language:    "c++",
+			WantPrefix:  "c-beta-c-",
+		},
+	}
+	for _, testCase := range testCases {
+		got := CanonicalSpecID(testCase.DisplayName, testCase.Language)
+		if testCase.Want != "" && got != testCase.Want {
+			t.Errorf("Unexpected canonical ID for %q: got %q, want %q", testCase.Description, got, testCase.Want)
+		}
+		if testCase.WantPrefix != "" && (!strings.HasPrefix(got, testCase.WantPrefix) || len(got) != len(testCase.WantPrefix)+8) {
+			t.Errorf("Unexpected canonical ID for %q: got %q, want %q followed by a hash", testCase.Description, got, testCase.WantPrefix)
+		}
+		if again := CanonicalSpecID(testCase.DisplayName, testCase.Language); again != got {
+			t.Errorf("Non-deterministic canonical ID for %q: got %q and %q", testCase.Description, got, again)
+		}
+	}
+	if a, b := CanonicalSpecID("C", "c"), CanonicalSpecID("C++", "c"); a == b {
+		t.Errorf("Colliding canonical IDs for %q and %q: %q", "C", "C++", a)
+	}
+}
+
+func TestKernelReady(t *testing.T) {
+	testCases := []struct {
+		Description    string
+		Input          string
+		Want           bool
+		WantErr        bool
+		WantMarshalled string
+	}{
+		{
+			Description:    "Boolean true",
+			Input:          `{"id":"kernel1","name":"python3","ready":true}`,
+			Want:           true,
+			WantMarshalled: `{"connections":0,"id":"kernel1","name":"python3","ready":true}`,
+		},
+		{
+			Description:    "Boolean false",
+			Input:          `{"id":"kernel1","name":"python3","ready":false}`,
+			WantMarshalled: `{"connections":0,"id":"kernel1","name":"python3","ready":false}`,
+		},
+		{
+			Description:    "Integer one",
+			Input:          `{"id":"kernel1","name":"python3","ready":1}`,
+			Want:           true,
+			WantMarshalled: `{"connections":0,"id":"kernel1","name":"python3","ready":true}`,
+		},
+		{
+			Description:    "Integer zero",
+			Input:          `{"id":"kernel1","name":"python3","ready":0}`,
+			WantMarshalled: `{"connections":0,"id":"kernel1","name":"python3","ready":false}`,
+		},
+		{
+			Description: "Invalid number",
+			Input:       `{"id":"kernel1","name":"python3","ready":2}`,
+			WantErr:     true,
+		},
+		{
+			Description: "Invalid type",
+			Input:       `{"id":"kernel1","name":"python3","ready":"true"}`,
+			WantErr:     true,
+		},
+	}
+	for _, testCase := range testCases {
+		var k Kernel
+		err := json.Unmarshal([]byte(testCase.Input), &k)
+		if testCase.WantErr {
+			if err == nil {
+				t.Errorf("Unexpected success unmarshalling %q: got %+v", testCase.Description, k)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error unmarshalling %q: %v", testCase.Description, err)
+			continue
+		}
+		if got, want := k.Ready, testCase.Want; got != want {
+			t.Errorf("Unexpected ready value for %q: got %v, want %v", testCase.Description, got, want)
+		}
+		if output, err := json.Marshal(k); err != nil {
+			t.Errorf("Unexpected error marshalling %q: %v", testCase.Description, err)
+		} else if got, want := string(output), testCase.WantMarshalled; got != want {
+			t.Errorf("Unexpected marshalled kernel for %q: got %s, want %s", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestSessionsWithDeadKernels(t *testing.T) {
+	liveSession := &Session{ID: "session1", Kernel: &Kernel{ID: "kernel1"}}
+	missingKernelSession := &Session{ID: "session2", Kernel: &Kernel{ID: "kernel2"}}
+	deadKernelSession := &Session{ID: "session3", Kernel: &Kernel{ID: "kernel3"}}
+	kernellessSession := &Session{ID: "session4"}
+	sessions := Sessions{liveSession, missingKernelSession, deadKernelSession, kernellessSession}
+	kernels := []*Kernel{
+		&Kernel{ID: "kernel1", ExecutionState: "idle"},
+		&Kernel{ID: "kernel3", ExecutionState: "dead"},
+	}
+	got := SessionsWithDeadKernels(sessions, kernels)
+	want := Sessions{missingKernelSession, deadKernelSession}
+	if diff := cmp.Diff(got, want, cmpopts.IgnoreUnexported(Kernel{}, Session{})); len(diff) > 0 {
+		t.Errorf("Unexpected sessions with dead kernels: diff %v", diff)
+	}
+}
+
+func TestSpecVSCodeMetadata(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Input       string
+		Want        map[string]any
+		WantOK      bool
+	}{
+		{
+			Description: "Spec with a vscode block",
+			Input:       `{"language":"python","display_name":"Python 3","metadata":{"debugger":true,"vscode":{"extension_id":"ms-toolsai.jupyter","hidden":false}}}`,
+			Want:        map[string]any{"extension_id": "ms-toolsai.jupyter", "hidden": false},
+			WantOK:      true,
+		},
+		{
+			Description: "Spec without a vscode block",
+			Input:       `{"language":"python","display_name":"Python 3","metadata":{"debugger":true}}`,
+		},
+		{
+			Description: "Spec without metadata",
+			Input:       `{"language":"python","display_name":"Python 3"}`,
+		},
+		{
+			Description: "Spec with a malformed vscode block",
+			Input:       `{"language":"python","display_name":"Python 3","metadata":{"vscode":"hidden"}}`,
+		},
+	}
+	for _, testCase := range testCases {
+		var s Spec
+		if err := json.Unmarshal([]byte(testCase.Input), &s); err != nil {
+			t.Errorf("Unexpected error unmarshalling %q: %v", testCase.Description, err)
+			continue
+		}
+		got, ok := s.VSCodeMetadata()
+		if ok != testCase.WantOK {
+			t.Errorf("Unexpected presence of the vscode metadata for %q: got %v, want %v", testCase.Description, ok, testCase.WantOK)
+		}
+		if diff := cmp.Diff(got, testCase.Want); len(diff) > 0 {
+			t.Errorf("Unexpected vscode metadata for %q: diff %v", testCase.Description, diff)
+		}
+	}
+}
+
+func TestKernelSpecsDefaultConflicts(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Default     string
+		Sources     map[string]*KernelSpecs
+		Want        []string
+	}{
+		{
+			Description: "Two backends that both set a default",
+			Default:     "remote-pyspark",
+			Sources: map[string]*KernelSpecs{
+				"remote": &KernelSpecs{Default: "pyspark"},
+				"local":  &KernelSpecs{Default: "python3"},
+			},
+			Want: []string{"local"},
+		},
+		{
+			Description: "Neither backend's default was chosen",
+			Default:     "remote-other",
+			Sources: map[string]*KernelSpecs{
+				"remote": &KernelSpecs{Default: "pyspark"},
+				"local":  &KernelSpecs{Default: "python3"},
+			},
+			Want: []string{"local", "remote"},
+		},
+		{
+			Description: "Only one backend sets a default",
+			Default:     "local-python3",
+			Sources: map[string]*KernelSpecs{
+				"local":  &KernelSpecs{Default: "python3"},
+				"remote": &KernelSpecs{},
+			},
+		},
+		{
+			Description: "No backends set a default",
+			Sources: map[string]*KernelSpecs{
+				"local":  &KernelSpecs{},
+				"remote": nil,
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		ks := &KernelSpecs{Default: testCase.Default}
+		if diff := cmp.Diff(ks.DefaultConflicts(testCase.Sources), testCase.Want); len(diff) > 0 {
+			t.Errorf("Unexpected default conflicts for %q: diff %v", testCase.Description, diff)
+		}
+	}
+}
+
+func TestKernelSpecsDisambiguateDisplayNames(t *testing.T) {
+	clusterResource := "//dataproc.googleapis.com/projects/project-id/regions/us-central1/clusters/test-cluster"
+	sessionResource := "//dataproc.googleapis.com/projects/project-id/locations/us-central1/sessions/test-session"
+	ks := &KernelSpecs{
+		KernelSpecs: SpecMap{
+			"remote-cluster-python3": &KernelSpec{
+				ID:        "remote-cluster-python3",
+				Spec:      &Spec{DisplayName: "Python 3 (Remote)", Language: "python"},
+				Resources: map[string]string{endpointParentResourceKey: clusterResource},
+			},
+			"remote-session-python3": &KernelSpec{
+				ID:        "remote-session-python3",
+				Spec:      &Spec{DisplayName: "Python 3 (Remote)", Language: "python"},
+				Resources: map[string]string{endpointParentResourceKey: sessionResource},
+			},
+			"remote-cluster-r": &KernelSpec{
+				ID:        "remote-cluster-r",
+				Spec:      &Spec{DisplayName: "R (Remote)", Language: "r"},
+				Resources: map[string]string{endpointParentResourceKey: clusterResource},
+			},
+			"local-python3": &KernelSpec{
+				ID:   "local-python3",
+				Spec: &Spec{DisplayName: "Python 3 (Local)", Language: "python"},
+			},
+			"local-pyspark": &KernelSpec{
+				ID:   "local-pyspark",
+				Spec: &Spec{DisplayName: "PySpark", Language: "python"},
+			},
+			"remote-cluster-pyspark": &KernelSpec{
+				ID:        "remote-cluster-pyspark",
+				Spec:      &Spec{DisplayName: "PySpark", Language: "python"},
+				Resources: map[string]string{endpointParentResourceKey: clusterResource},
+			},
+			"remote-cluster-ir": &KernelSpec{
+				ID:        "remote-cluster-ir",
+				Spec:      &Spec{DisplayName: "R", Language: "r"},
+				Resources: map[string]string{endpointParentResourceKey: clusterResource},
+			},
+			"remote-cluster-ir-copy": &KernelSpec{
+				ID:        "remote-cluster-ir-copy",
+				Spec:      &Spec{DisplayName: "R", Language: "r"},
+				Resources: map[string]string{endpointParentResourceKey: clusterResource},
+			},
+		},
+	}
+	ks.DisambiguateDisplayNames()
+	want := map[string]string{
+		"remote-cluster-python3": "Python 3 (Remote) (Dataproc: test-cluster (us-central1))",
+		"remote-session-python3": "Python 3 (Remote) (Dataproc Serverless: test-session (us-central1))",
+		"remote-cluster-r":       "R (Remote)",
+		"local-python3":          "Python 3 (Local)",
+		"local-pyspark":          "PySpark (Local)",
+		"remote-cluster-pyspark": "PySpark (Dataproc: test-cluster (us-central1))",
+		"remote-cluster-ir":      "R (remote-cluster-ir)",
+		"remote-cluster-ir-copy": "R (remote-cluster-ir-copy)",
+	}
+	got := make(map[string]string)
+	for id, spec := range ks.KernelSpecs {
+		got[id] = spec.Spec.DisplayName
+	}
+	if diff := cmp.Diff(want, got); len(diff) > 0 {
+		t.Errorf("Unexpected display names: diff %v", diff)
+	}
+}
+
+func TestStripRawFields(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Input       string
+		Resource    interface {
+			StripRawFields()
+		}
+	}{
+		{
+			Description: "Kernel",
+			Input:       `{"id":"kernel1","name":"python3","connections":0,"unknown":1}`,
+			Resource:    &Kernel{},
+		},
+		{
+			Description: "Session with a kernel",
+			Input:       `{"id":"session1","path":"notebook.ipynb","type":"notebook","unknown":1,"kernel":{"id":"kernel1","name":"python3","unknown":2}}`,
+			Resource:    &Session{},
+		},
+		{
+			Description: "Terminal",
+			Input:       `{"name":"1","unknown":1}`,
+			Resource:    &Terminal{},
+		},
+		{
+			Description: "KernelSpec with a spec",
+			Input:       `{"name":"python3","unknown":1,"spec":{"display_name":"Python 3","language":"python","unknown":2}}`,
+			Resource:    &KernelSpec{},
+		},
+		{
+			Description: "KernelSpecs",
+			Input:       `{"default":"python3","unknown":1,"kernelspecs":{"python3":{"name":"python3","unknown":2,"spec":{"display_name":"Python 3","language":"python","unknown":3}}}}`,
+			Resource:    &KernelSpecs{},
+		},
+	}
+	for _, testCase := range testCases {
+		if err := json.Unmarshal([]byte(testCase.Input), testCase.Resource); err != nil {
+			t.Errorf("Failure unmarshalling the resource for %q: %v", testCase.Description, err)
+			continue
+		}
+		if output, err := json.Marshal(testCase.Resource); err != nil || !strings.Contains(string(output), "unknown") {
+			t.Errorf("Unknown fields were not preserved before stripping them for %q: %s, %v", testCase.Description, output, err)
+		}
+		testCase.Resource.StripRawFields()
+		output, err := json.Marshal(testCase.Resource)
+		if err != nil {
+			t.Errorf("Failure marshalling the stripped resource for %q: %v", testCase.Description, err)
+		} else if strings.Contains(string(output), "unknown") {
+			t.Errorf("Unexpected unknown fields in the stripped resource for %q: %s", testCase.Description, output)
+		}
+	}
+}
+
+func TestNormalizeExecutionState(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Input       string
+		Want        string
+	}{
+		{Description: "Canonical state", Input: "idle", Want: "idle"},
+		{Description: "Canonical state with different case and whitespace", Input: " Busy ", Want: "busy"},
+		{Description: "Unknown state", Input: "unknown", Want: "unknown"},
+		{Description: "Not reported", Input: "", Want: ""},
+		{Description: "Initializing alias", Input: "initializing", Want: "starting"},
+		{Description: "Provisioning alias", Input: "PROVISIONING", Want: "starting"},
+		{Description: "Executing alias", Input: "executing", Want: "busy"},
+		{Description: "Shutting down alias", Input: "shutting_down", Want: "terminating"},
+		{Description: "Terminated alias", Input: "terminated", Want: "dead"},
+		{Description: "Unrecognized state", Input: "on fire", Want: "unknown"},
+	}
+	for _, testCase := range testCases {
+		if got := NormalizeExecutionState(testCase.Input); got != testCase.Want {
+			t.Errorf("Unexpected normalized execution state for %q: got %q, want %q", testCase.Description, got, testCase.Want)
+		}
+	}
+}
+
+func TestSessionValidate(t *testing.T) {
+	testCases := []struct {
+		Description  string
+		Type         string
+		WantWarnings int
+	}{
+		{Description: "Notebook session", Type: SessionTypeNotebook},
+		{Description: "Console session", Type: SessionTypeConsole},
+		{Description: "Missing type", Type: ""},
+		{Description: "Unknown type", Type: "spreadsheet", WantWarnings: 1},
+	}
+	for _, testCase := range testCases {
+		s := &Session{ID: "session1", Type: testCase.Type}
+		if got := s.Validate(); len(got) != testCase.WantWarnings {
+			t.Errorf("Unexpected warnings validating the session for %q: got %v, want %d warnings", testCase.Description, got, testCase.WantWarnings)
+		}
+	}
+}
+
+func TestKernelStartRequestValidate(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Input       string
+		WantPath    string
+		WantErr     bool
+	}{
+		{
+			Description: "Name only",
+			Input:       `{"name":"local-python3"}`,
+		},
+		{
+			Description: "Name, path, and env",
+			Input:       `{"name":"local-python3","path":"notebook.ipynb","env":{"FOO":"bar"}}`,
+			WantPath:    "notebook.ipynb",
+		},
+		{
+			Description: "Missing name",
+			Input:       `{"path":"notebook.ipynb"}`,
+			WantPath:    "notebook.ipynb",
+			WantErr:     true,
+		},
+		{
+			Description: "Malformed path",
+			Input:       `{"name":"local-python3","path":["notebook.ipynb"]}`,
+			WantErr:     true,
+		},
+	}
+	for _, testCase := range testCases {
+		var req KernelStartRequest
+		if err := json.Unmarshal([]byte(testCase.Input), &req); err != nil {
+			t.Errorf("Unexpected error unmarshalling %q: %v", testCase.Description, err)
+			continue
+		}
+		err := req.Validate()
+		if gotErr := err != nil; gotErr != testCase.WantErr {
+			t.Errorf("Unexpected validation result for %q: got %v, want error: %v", testCase.Description, err, testCase.WantErr)
+		}
+		if err != nil && !util.IsUserError(err) {
+			t.Errorf("Unexpected validation error for %q: got %v, want a user error", testCase.Description, err)
+		}
+		if got, want := req.Path(), testCase.WantPath; got != want {
+			t.Errorf("Unexpected path for %q: got %q, want %q", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestKernelInUse(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Connections int
+		Want        bool
+	}{
+		{
+			Description: "Kernel without connections",
+			Connections: 0,
+		},
+		{
+			Description: "Kernel with one connection",
+			Connections: 1,
+			Want:        true,
+		},
+		{
+			Description: "Kernel with several connections",
+			Connections: 3,
+			Want:        true,
+		},
+	}
+	for _, testCase := range testCases {
+		k := &Kernel{Connections: testCase.Connections}
+		if got, want := k.InUse(), testCase.Want; got != want {
+			t.Errorf("Unexpected in use status for %q: got %v, want %v", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestSpecMapMarshalOrder(t *testing.T) {
+	cluster := "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster1"
+	newSpec := func(id, displayName, resource string, order any) *KernelSpec {
+		ks := &KernelSpec{ID: id, Spec: &Spec{DisplayName: displayName}}
+		if resource != "" {
+			ks.Resources = map[string]string{"endpointParentResource": resource}
+		}
+		if order != nil {
+			ks.Spec.Metadata = map[string]any{"order": order}
+		}
+		return ks
+	}
+	specs := SpecMap{
+		"python3":  newSpec("python3", "Python 3", "", nil),
+		"ir":       newSpec("ir", "R", "", nil),
+		"pyspark":  newSpec("pyspark", "PySpark", cluster, nil),
+		"pinned":   newSpec("pinned", "Pinned", cluster, 1),
+		"first":    newSpec("first", "Zzz", cluster, 0),
+		"second":   newSpec("second", "Second", "", float64(1)),
+		"notOrder": newSpec("notOrder", "A", "", "first"),
+	}
+	specBytes, err := json.Marshal(specs)
+	if err != nil {
+		t.Fatalf("Failure marshalling the kernelspecs: %v", err)
+	}
+	var got []string
+	dec := json.NewDecoder(bytes.NewReader(specBytes))
+	dec.Token()
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			t.Fatalf("Failure reading the marshalled kernelspecs %q: %v", specBytes, err)
+		}
+		got = append(got, key.(string))
+		var spec json.RawMessage
+		if err := dec.Decode(&spec); err != nil {
+			t.Fatalf("Failure reading the marshalled kernelspecs %q: %v", specBytes, err)
+		}
+	}
+	// "pinned" and "second" have the same order, so they are sorted by their backends.
+	want := []string{"first", "second", "pinned", "notOrder", "python3", "ir", "pyspark"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected kernelspecs order: diff %v", diff)
+	}
+}
+
+func TestKernelSpecResourcesMarshalOrder(t *testing.T) {
+	ks := KernelSpec{
+		ID: "python3",
+		Resources: map[string]string{
+			"logo-64x64":             "/kernelspecs/python3/logo-64x64.png",
+			"endpointParentResource": "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster1",
+			"zone":                   "test-region-a",
+			"logo-32x32":             "/kernelspecs/python3/logo-32x32.png",
+		},
+	}
+	want := `{"name":"python3","resources":{` +
+		`"endpointParentResource":"//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster1",` +
+		`"logo-32x32":"/kernelspecs/python3/logo-32x32.png",` +
+		`"logo-64x64":"/kernelspecs/python3/logo-64x64.png",` +
+		`"zone":"test-region-a"}}`
+	for i := 0; i < 10; i++ {
+		got, err := json.Marshal(ks)
+		if err != nil {
+			t.Fatalf("Failure marshalling the kernelspec: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("Unexpected marshalled kernelspec: got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestKernelSpecHasLocalAbsoluteInterpreter(t *testing.T) {
+	remoteResources := map[string]string{"endpointParentResource": "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster1"}
+	testCases := []struct {
+		Description string
+		Spec        *KernelSpec
+		Want        bool
+	}{
+		{
+			Description: "Remote spec with an absolute interpreter path",
+			Spec:        &KernelSpec{ID: "pyspark", Spec: &Spec{Argv: []string{"/usr/local/bin/python", "-m", "ipykernel_launcher"}}, Resources: remoteResources},
+			Want:        true,
+		},
+		{
+			Description: "Remote spec with a relative command",
+			Spec:        &KernelSpec{ID: "pyspark", Spec: &Spec{Argv: []string{"python", "-m", "ipykernel_launcher"}}, Resources: remoteResources},
+		},
+		{
+			Description: "Local spec with an absolute interpreter path",
+			Spec:        &KernelSpec{ID: "python3", Spec: &Spec{Argv: []string{"/usr/local/bin/python", "-m", "ipykernel_launcher"}}},
+		},
+		{
+			Description: "Remote spec without argv",
+			Spec:        &KernelSpec{ID: "pyspark", Spec: &Spec{}, Resources: remoteResources},
+		},
+	}
+	for _, testCase := range testCases {
+		if got, want := testCase.Spec.HasLocalAbsoluteInterpreter(), testCase.Want; got != want {
+			t.Errorf("Unexpected result for %q: got %v, want %v", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestKernelSpecsDefaultSpec(t *testing.T) {
+	python3 := &KernelSpec{ID: "python3", Spec: &Spec{DisplayName: "Python 3"}}
+	ir := &KernelSpec{ID: "ir", Spec: &Spec{DisplayName: "R"}}
+	pyspark := &KernelSpec{
+		ID:        "pyspark",
+		Spec:      &Spec{DisplayName: "PySpark"},
+		Resources: map[string]string{"endpointParentResource": "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster1"},
+	}
+	specs := SpecMap{python3.ID: python3, ir.ID: ir, pyspark.ID: pyspark}
+	testCases := []struct {
+		Description string
+		Specs       *KernelSpecs
+		Want        *KernelSpec
+	}{
+		{
+			Description: "Default present",
+			Specs:       &KernelSpecs{Default: "ir", KernelSpecs: specs},
+			Want:        ir,
+		},
+		{
+			Description: "Empty default",
+			Specs:       &KernelSpecs{KernelSpecs: specs},
+			Want:        python3,
+		},
+		{
+			Description: "Missing default target",
+			Specs:       &KernelSpecs{Default: "removed", KernelSpecs: specs},
+			Want:        python3,
+		},
+		{
+			Description: "No specs",
+			Specs:       &KernelSpecs{Default: "python3"},
+		},
+	}
+	for _, testCase := range testCases {
+		got, ok := testCase.Specs.DefaultSpec()
+		if ok != (testCase.Want != nil) || got != testCase.Want {
+			t.Errorf("Unexpected default spec for %q: got %+v, %v, want %+v", testCase.Description, got, ok, testCase.Want)
+		}
+	}
+}
+
+func TestKernelSpecsDefaultsByLanguage(t *testing.T) {
+	python3 := &KernelSpec{ID: "local-python3", Spec: &Spec{Language: "python"}}
+	pyspark := &KernelSpec{ID: "remote-pyspark", Spec: &Spec{Language: "Python "}}
+	ir := &KernelSpec{ID: "local-ir", Spec: &Spec{Language: "R"}}
+	sparkR := &KernelSpec{ID: "remote-sparkr", Spec: &Spec{Language: "r"}}
+	noLanguage := &KernelSpec{ID: "local-nolang", Spec: &Spec{}}
+	specs := SpecMap{
+		python3.ID:    python3,
+		pyspark.ID:    pyspark,
+		ir.ID:         ir,
+		sparkR.ID:     sparkR,
+		noLanguage.ID: noLanguage,
+	}
+	testCases := []struct {
+		Description string
+		Default     string
+		Want        map[string]*KernelSpec
+	}{
+		{
+			Description: "Default matches one language",
+			Default:     "remote-pyspark",
+			Want:        map[string]*KernelSpec{"python": pyspark, "r": ir},
+		},
+		{
+			Description: "No default",
+			Want:        map[string]*KernelSpec{"python": python3, "r": ir},
+		},
+	}
+	for _, testCase := range testCases {
+		ks := &KernelSpecs{Default: testCase.Default, KernelSpecs: specs}
+		if diff := cmp.Diff(ks.DefaultsByLanguage(), testCase.Want, cmpopts.IgnoreUnexported(KernelSpec{}, Spec{})); len(diff) > 0 {
+			t.Errorf("Unexpected defaults by language for %q: diff %v", testCase.Description, diff)
+		}
+	}
+}
+
+func TestTerminalValidate(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Terminal    *Terminal
+		WantErr     bool
+	}{
+		{
+			Description: "Valid terminal",
+			Terminal:    &Terminal{ID: "1"},
+		},
+		{
+			Description: "Missing name",
+			Terminal:    &Terminal{},
+			WantErr:     true,
+		},
+		{
+			Description: "Name with a slash",
+			Terminal:    &Terminal{ID: "1/2"},
+			WantErr:     true,
+		},
+	}
+	for _, testCase := range testCases {
+		err := testCase.Terminal.Validate()
+		if gotErr := err != nil; gotErr != testCase.WantErr {
+			t.Errorf("Unexpected validation result for %q: got %v, want error: %v", testCase.Description, err, testCase.WantErr)
+		}
+	}
+}
+
+func TestKernelSpecsNullCollection(t *testing.T) {
+	var ks KernelSpecs
+	if err := json.Unmarshal([]byte(`{"default":"python3","kernelspecs":null}`), &ks); err != nil {
+		t.Fatalf("Unexpected error unmarshalling null kernelspecs: %v", err)
+	}
+	if ks.KernelSpecs == nil || len(ks.KernelSpecs) != 0 {
+		t.Errorf("Unexpected kernelspecs for a null collection: got %#v, want an empty map", ks.KernelSpecs)
+	}
+	output, err := json.Marshal(ks)
+	if err != nil {
+		t.Fatalf("Unexpected error marshalling null kernelspecs: %v", err)
+	}
+	if got, want := string(output), `{"default":"python3","kernelspecs":{}}`; got != want {
+		t.Errorf("Unexpected marshalled kernelspecs: got %s, want %s", got, want)
+	}
+}
+
+func TestKernelTruncateEnv(t *testing.T) {
+	testCases := []struct {
+		Description    string
+		Max            int
+		WantDropped    int
+		WantMarshalled string
+	}{
+		{
+			Description:    "Truncate to two entries",
+			Max:            2,
+			WantDropped:    3,
+			WantMarshalled: `{"connections":0,"env":{"A":"1","B":"2"},"id":"kernel1","name":"python3"}`,
+		},
+		{
+			Description:    "Limit above the number of entries",
+			Max:            10,
+			WantMarshalled: `{"connections":0,"env":{"A":"1","B":"2","C":"3","D":"4","E":"5"},"id":"kernel1","name":"python3"}`,
+		},
+		{
+			Description:    "Truncate to no entries",
+			Max:            0,
+			WantDropped:    5,
+			WantMarshalled: `{"connections":0,"id":"kernel1","name":"python3"}`,
+		},
+	}
+	for _, testCase := range testCases {
+		var k Kernel
+		if err := json.Unmarshal([]byte(`{"id":"kernel1","name":"python3","env":{"E":"5","C":"3","A":"1","D":"4","B":"2"}}`), &k); err != nil {
+			t.Fatalf("Unexpected error unmarshalling the kernel: %v", err)
+		}
+		if got, want := k.TruncateEnv(testCase.Max), testCase.WantDropped; got != want {
+			t.Errorf("Unexpected number of dropped env entries for %q: got %d, want %d", testCase.Description, got, want)
+		}
+		if output, err := json.Marshal(k); err != nil {
+			t.Errorf("Unexpected error marshalling %q: %v", testCase.Description, err)
+		} else if got, want := string(output), testCase.WantMarshalled; got != want {
+			t.Errorf("Unexpected marshalled kernel for %q: got %s, want %s", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestKernelLastActivityTime(t *testing.T) {
+	testCases := []struct {
+		Description  string
+		LastActivity string
+		Want         time.Time
+		WantOK       bool
+	}{
+		{
+			Description:  "Jupyter timestamp",
+			LastActivity: "2023-02-14T02:50:02.922555Z",
+			Want:         time.Date(2023, 2, 14, 2, 50, 2, 922555000, time.UTC),
+			WantOK:       true,
+		},
+		{
+			Description:  "Timestamp with an offset",
+			LastActivity: "2023-02-14T03:50:02+01:00",
+			Want:         time.Date(2023, 2, 14, 2, 50, 2, 0, time.UTC),
+			WantOK:       true,
+		},
+		{
+			Description: "Missing last activity",
+		},
+		{
+			Description:  "Malformed last activity",
+			LastActivity: "yesterday",
+		},
+	}
+	for _, testCase := range testCases {
+		k := &Kernel{LastActivity: testCase.LastActivity}
+		got, ok := k.LastActivityTime()
+		if ok != testCase.WantOK || !got.Equal(testCase.Want) {
+			t.Errorf("Unexpected last activity time for %q: got %v, %v, want %v, %v", testCase.Description, got, ok, testCase.Want, testCase.WantOK)
+		}
+	}
+}
+
+func TestKernelStateChangedAt(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Metadata    map[string]any
+		Want        time.Time
+		WantOK      bool
+	}{
+		{
+			Description: "Valid timestamp",
+			Metadata:    map[string]any{"state_changed_at": "2023-02-14T02:50:02.922555Z"},
+			Want:        time.Date(2023, 2, 14, 2, 50, 2, 922555000, time.UTC),
+			WantOK:      true,
+		},
+		{
+			Description: "Invalid timestamp",
+			Metadata:    map[string]any{"state_changed_at": "yesterday"},
+		},
+		{
+			Description: "Non-string timestamp",
+			Metadata:    map[string]any{"state_changed_at": float64(1676343002)},
+		},
+		{
+			Description: "Missing timestamp",
+			Metadata:    map[string]any{"other": "value"},
+		},
+		{
+			Description: "Missing metadata",
+		},
+	}
+	for _, testCase := range testCases {
+		k := &Kernel{Metadata: testCase.Metadata}
+		got, ok := k.StateChangedAt()
+		if ok != testCase.WantOK || !got.Equal(testCase.Want) {
+			t.Errorf("Unexpected state change time for %q: got %v, %v, want %v, %v", testCase.Description, got, ok, testCase.Want, testCase.WantOK)
+		}
+	}
+}
+
+func TestSessionLastActivityTime(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Session     *Session
+		Want        time.Time
+		WantErr     bool
+	}{
+		{
+			Description: "Session with a kernel",
+			Session:     &Session{ID: "session1", Kernel: &Kernel{ID: "kernel1", LastActivity: "2023-02-14T02:50:02.922555Z"}},
+			Want:        time.Date(2023, 2, 14, 2, 50, 2, 922555000, time.UTC),
+		},
+		{
+			Description: "Session without a kernel",
+			Session:     &Session{ID: "session2"},
+			WantErr:     true,
+		},
+		{
+			Description: "Session with a kernel missing its last activity",
+			Session:     &Session{ID: "session3", Kernel: &Kernel{ID: "kernel3"}},
+			WantErr:     true,
+		},
+	}
+	for _, testCase := range testCases {
+		got, err := testCase.Session.LastActivityTime()
+		if gotErr := err != nil; gotErr != testCase.WantErr {
+			t.Errorf("Unexpected error for %q: got %v, want error: %v", testCase.Description, err, testCase.WantErr)
+		}
+		if !got.Equal(testCase.Want) {
+			t.Errorf("Unexpected last activity time for %q: got %v, want %v", testCase.Description, got, testCase.Want)
+		}
+	}
+}
+
+func TestKernelSpecsEndpointsDigest(t *testing.T) {
+	cluster1 := "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster1"
+	cluster2 := "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster2"
+	original := &KernelSpecs{
+		KernelSpecs: SpecMap{
+			"python3":  &KernelSpec{ID: "python3"},
+			"pyspark1": &KernelSpec{ID: "pyspark1", Resources: map[string]string{"endpointParentResource": cluster1}},
+			"sparkr1":  &KernelSpec{ID: "sparkr1", Resources: map[string]string{"endpointParentResource": cluster1}},
+		},
+	}
+	sameEndpoints := &KernelSpecs{
+		Default: "pyspark1",
+		KernelSpecs: SpecMap{
+			"pyspark1": &KernelSpec{ID: "pyspark1", Resources: map[string]string{"endpointParentResource": cluster1, "logo-64x64": "/kernelspecs/pyspark1/logo-64x64.png"}},
+		},
+	}
+	addedEndpoint := &KernelSpecs{
+		KernelSpecs: SpecMap{
+			"python3":  &KernelSpec{ID: "python3"},
+			"pyspark1": &KernelSpec{ID: "pyspark1", Resources: map[string]string{"endpointParentResource": cluster1}},
+			"sparkr1":  &KernelSpec{ID: "sparkr1", Resources: map[string]string{"endpointParentResource": cluster1}},
+			"pyspark2": &KernelSpec{ID: "pyspark2", Resources: map[string]string{"endpointParentResource": cluster2}},
+		},
+	}
+	digest := original.EndpointsDigest()
+	if got := original.EndpointsDigest(); got != digest {
+		t.Errorf("Unstable endpoints digest: got %q, then %q", digest, got)
+	}
+	if got := sameEndpoints.EndpointsDigest(); got != digest {
+		t.Errorf("Unexpected endpoints digest change for the same endpoints: got %q, want %q", got, digest)
+	}
+	if got := addedEndpoint.EndpointsDigest(); got == digest {
+		t.Errorf("Unexpected endpoints digest after adding an endpoint: got %q, want a different digest", got)
+	}
+}
+
+func TestKernelSpecResourcesShapes(t *testing.T) {
+	testCases := []struct {
+		Description    string
+		Input          string
+		WantResources  map[string]string
+		WantMarshalled string
+		WantStatusCode int
+	}{
+		{
+			Description:    "Object form",
+			Input:          `{"name":"pyspark","resources":{"endpointParentResource":"//dataproc.googleapis.com/projects/p/regions/r/clusters/c"}}`,
+			WantResources:  map[string]string{"endpointParentResource": "//dataproc.googleapis.com/projects/p/regions/r/clusters/c"},
+			WantMarshalled: `{"name":"pyspark","resources":{"endpointParentResource":"//dataproc.googleapis.com/projects/p/regions/r/clusters/c"}}`,
+		},
+		{
+			Description:    "Array of key/value pairs",
+			Input:          `{"name":"pyspark","resources":[{"key":"endpointParentResource","value":"//dataproc.googleapis.com/projects/p/regions/r/clusters/c"},{"key":"logo-64x64","value":"/kernelspecs/pyspark/logo-64x64.png"}]}`,
+			WantResources:  map[string]string{"endpointParentResource": "//dataproc.googleapis.com/projects/p/regions/r/clusters/c", "logo-64x64": "/kernelspecs/pyspark/logo-64x64.png"},
+			WantMarshalled: `{"name":"pyspark","resources":{"endpointParentResource":"//dataproc.googleapis.com/projects/p/regions/r/clusters/c","logo-64x64":"/kernelspecs/pyspark/logo-64x64.png"}}`,
+		},
+		{
+			Description:    "Empty array",
+			Input:          `{"name":"pyspark","resources":[]}`,
+			WantResources:  map[string]string{},
+			WantMarshalled: `{"name":"pyspark","resources":{}}`,
+		},
+		{
+			Description:    "Array with a duplicate key",
+			Input:          `{"name":"pyspark","resources":[{"key":"endpointParentResource","value":"a"},{"key":"endpointParentResource","value":"b"}]}`,
+			WantStatusCode: http.StatusBadRequest,
+		},
+		{
+			Description:    "Array with a missing key",
+			Input:          `{"name":"pyspark","resources":[{"value":"a"}]}`,
+			WantStatusCode: http.StatusBadRequest,
+		},
+	}
+	for _, testCase := range testCases {
+		var ks KernelSpec
+		err := json.Unmarshal([]byte(testCase.Input), &ks)
+		if testCase.WantStatusCode != 0 {
+			if got, want := util.HTTPStatusCode(err), testCase.WantStatusCode; got != want {
+				t.Errorf("Unexpected status for %q: got %d, want %d: %v", testCase.Description, got, want, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error unmarshalling %q: %v", testCase.Description, err)
+			continue
+		}
+		if diff := cmp.Diff(testCase.WantResources, ks.Resources); diff != "" {
+			t.Errorf("Unexpected resources for %q: diff %v", testCase.Description, diff)
+		}
+		output, err := json.Marshal(ks)
+		if err != nil {
+			t.Errorf("Unexpected error marshalling %q: %v", testCase.Description, err)
+			continue
+		}
+		if got, want := string(output), testCase.WantMarshalled; got != want {
+			t.Errorf("Unexpected marshalled kernelspec for %q: got %s, want %s", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestKernelWebSocketRoute(t *testing.T) {
+	testCases := []struct {
+		Description  string
+		ID           string
+		Separator    string
+		WantBackend  string
+		WantKernelID string
+		WantOK       bool
+	}{
+		{
+			Description:  "Prefixed remote kernel",
+			ID:           "remote/02587c70-e1df-40a5-80f8-76534374817a",
+			Separator:    "/",
+			WantBackend:  "remote",
+			WantKernelID: "02587c70-e1df-40a5-80f8-76534374817a",
+			WantOK:       true,
+		},
+		{
+			Description:  "Unprefixed local kernel",
+			ID:           "02587c70-e1df-40a5-80f8-76534374817a",
+			Separator:    "/",
+			WantKernelID: "02587c70-e1df-40a5-80f8-76534374817a",
+		},
+		{
+			Description:  "Empty prefix",
+			ID:           "/02587c70",
+			Separator:    "/",
+			WantKernelID: "/02587c70",
+		},
+		{
+			Description:  "Empty separator",
+			ID:           "remote/02587c70",
+			WantKernelID: "remote/02587c70",
+		},
+	}
+	for _, testCase := range testCases {
+		k := &Kernel{ID: testCase.ID}
+		backend, kernelID, ok := k.WebSocketRoute(testCase.Separator)
+		if backend != testCase.WantBackend || kernelID != testCase.WantKernelID || ok != testCase.WantOK {
+			t.Errorf("Unexpected route for %q: got (%q, %q, %v), want (%q, %q, %v)", testCase.Description, backend, kernelID, ok, testCase.WantBackend, testCase.WantKernelID, testCase.WantOK)
+		}
+	}
+}
+
+func TestKernelSpecsRemoveHidden(t *testing.T) {
+	hidden := func(id string) *KernelSpec {
+		return &KernelSpec{ID: id, Spec: &Spec{DisplayName: id, Metadata: map[string]any{"hidden": true}}}
+	}
+	visible := func(id string) *KernelSpec {
+		return &KernelSpec{ID: id, Spec: &Spec{DisplayName: id, Metadata: map[string]any{"hidden": false}}}
+	}
+	testCases := []struct {
+		Description string
+		Specs       *KernelSpecs
+		WantRemoved []string
+		WantDefault string
+		WantIDs     []string
+	}{
+		{
+			Description: "Only visible specs",
+			Specs:       &KernelSpecs{Default: "python3", KernelSpecs: SpecMap{"python3": visible("python3"), "ir": &KernelSpec{ID: "ir", Spec: &Spec{DisplayName: "R"}}}},
+			WantDefault: "python3",
+			WantIDs:     []string{"ir", "python3"},
+		},
+		{
+			Description: "Hidden non-default spec",
+			Specs:       &KernelSpecs{Default: "python3", KernelSpecs: SpecMap{"python3": visible("python3"), "python2": hidden("python2")}},
+			WantRemoved: []string{"python2"},
+			WantDefault: "python3",
+			WantIDs:     []string{"python3"},
+		},
+		{
+			Description: "Hidden default spec",
+			Specs:       &KernelSpecs{Default: "python2", KernelSpecs: SpecMap{"python2": hidden("python2"), "python3": visible("python3"), "ir": visible("ir")}},
+			WantRemoved: []string{"python2"},
+			WantDefault: "ir",
+			WantIDs:     []string{"ir", "python3"},
+		},
+		{
+			Description: "Every spec hidden",
+			Specs:       &KernelSpecs{Default: "python2", KernelSpecs: SpecMap{"python2": hidden("python2")}},
+			WantRemoved: []string{"python2"},
+		},
+	}
+	for _, testCase := range testCases {
+		removed := testCase.Specs.RemoveHidden()
+		if diff := cmp.Diff(testCase.WantRemoved, removed); diff != "" {
+			t.Errorf("Unexpected removed specs for %q: diff %v", testCase.Description, diff)
+		}
+		if got, want := testCase.Specs.Default, testCase.WantDefault; got != want {
+			t.Errorf("Unexpected default for %q: got %q, want %q", testCase.Description, got, want)
+		}
+		if diff := cmp.Diff(testCase.WantIDs, slices.Sorted(maps.Keys(testCase.Specs.KernelSpecs)), cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("Unexpected remaining specs for %q: diff %v", testCase.Description, diff)
+		}
+	}
+}
+
+func TestEnforceKernelQuota(t *testing.T) {
+	cluster1 := "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster1"
+	cluster2 := "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster2"
+	specs := &KernelSpecs{
+		KernelSpecs: SpecMap{
+			"local-python3":   &KernelSpec{ID: "local-python3", Spec: &Spec{DisplayName: "Python 3"}},
+			"remote-pyspark1": &KernelSpec{ID: "remote-pyspark1", Spec: &Spec{DisplayName: "PySpark"}, Resources: map[string]string{"endpointParentResource": cluster1}},
+			"remote-pyspark2": &KernelSpec{ID: "remote-pyspark2", Spec: &Spec{DisplayName: "PySpark"}, Resources: map[string]string{"endpointParentResource": cluster2}},
+		},
+	}
+	newKernel := func(id, specID, lastActivity string) *Kernel {
+		return &Kernel{ID: id, SpecID: specID, LastActivity: lastActivity}
+	}
+	newest := newKernel("remote-newest", "remote-pyspark1", "2023-02-14T03:00:00Z")
+	oldest := newKernel("remote-oldest", "remote-pyspark1", "2023-02-14T01:00:00Z")
+	unknown := newKernel("remote-unknown", "remote-pyspark1", "")
+	middle := newKernel("remote-middle", "remote-pyspark1", "2023-02-14T02:00:00Z")
+	under := newKernel("remote-under", "remote-pyspark2", "2023-02-14T01:00:00Z")
+	local := newKernel("local-kernel", "local-python3", "2023-02-14T01:00:00Z")
+	unlisted := newKernel("remote-unlisted", "remote-removed", "2023-02-14T01:00:00Z")
+	kernels := []*Kernel{newest, oldest, unknown, under, middle, local, unlisted}
+
+	kept, dropped := EnforceKernelQuota(specs, kernels, map[string]int{cluster1: 2, cluster2: 3, "": 2})
+	if diff := cmp.Diff([]*Kernel{oldest, under, middle, local, unlisted}, kept, cmpopts.IgnoreUnexported(Kernel{})); diff != "" {
+		t.Errorf("Unexpected kept kernels: diff %v", diff)
+	}
+	if diff := cmp.Diff([]*Kernel{newest, unknown}, dropped, cmpopts.IgnoreUnexported(Kernel{})); diff != "" {
+		t.Errorf("Unexpected dropped kernels: diff %v", diff)
+	}
+}
+
+func TestConnectionShareByBackend(t *testing.T) {
+	cluster1 := "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster1"
+	cluster2 := "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster2"
+	specs := &KernelSpecs{
+		KernelSpecs: SpecMap{
+			"local-python3":   &KernelSpec{ID: "local-python3", Spec: &Spec{DisplayName: "Python 3"}},
+			"remote-pyspark1": &KernelSpec{ID: "remote-pyspark1", Spec: &Spec{DisplayName: "PySpark"}, Resources: map[string]string{"endpointParentResource": cluster1}},
+			"remote-pyspark2": &KernelSpec{ID: "remote-pyspark2", Spec: &Spec{DisplayName: "PySpark"}, Resources: map[string]string{"endpointParentResource": cluster2}},
+		},
+	}
+	kernels := []*Kernel{
+		&Kernel{ID: "remote-a", SpecID: "remote-pyspark1", Connections: 1},
+		&Kernel{ID: "remote-b", SpecID: "remote-pyspark1", Connections: 2},
+		&Kernel{ID: "remote-c", SpecID: "remote-pyspark2", Connections: 1},
+		&Kernel{ID: "remote-d", SpecID: "remote-pyspark2"},
+		&Kernel{ID: "local-e", SpecID: "local-python3", Connections: 4},
+	}
+	want := map[string]float64{
+		cluster1: 0.375,
+		cluster2: 0.125,
+		"":       0.5,
+	}
+	if diff := cmp.Diff(want, ConnectionShareByBackend(specs, kernels)); diff != "" {
+		t.Errorf("Unexpected connection shares: diff %v", diff)
+	}
+	for _, k := range kernels {
+		k.Connections = 0
+	}
+	if got := ConnectionShareByBackend(specs, kernels); len(got) != 0 {
+		t.Errorf("Unexpected connection shares without any connections: %v", got)
+	}
+}
+
+func TestSessionApplyPatch(t *testing.T) {
+	const saved = `{"id":"session1","path":"old/notebook.ipynb","name":"notebook.ipynb","type":"notebook","kernel":{"id":"kernel1","name":"python3"},"notebook":{"path":"old/notebook.ipynb","name":"notebook.ipynb"},"vendor_field":"preserved"}`
+	testCases := []struct {
+		Description string
+		Patch       string
+		Want        string
+	}{
+		{
+			Description: "Rename",
+			Patch:       `{"path":"new/renamed.ipynb","name":"renamed.ipynb"}`,
+			Want:        `{"id":"session1","kernel":{"connections":0,"id":"kernel1","name":"python3"},"name":"renamed.ipynb","notebook":{"name":"renamed.ipynb","path":"new/renamed.ipynb"},"path":"new/renamed.ipynb","type":"notebook","vendor_field":"preserved"}`,
+		},
+		{
+			Description: "Rename via the legacy notebook block",
+			Patch:       `{"notebook":{"path":"new/renamed.ipynb"}}`,
+			Want:        `{"id":"session1","kernel":{"connections":0,"id":"kernel1","name":"python3"},"name":"notebook.ipynb","notebook":{"name":"notebook.ipynb","path":"new/renamed.ipynb"},"path":"new/renamed.ipynb","type":"notebook","vendor_field":"preserved"}`,
+		},
+		{
+			Description: "Change the kernel",
+			Patch:       `{"kernel":{"id":"kernel2","name":"ir"}}`,
+			Want:        `{"id":"session1","kernel":{"connections":0,"id":"kernel2","name":"ir"},"name":"notebook.ipynb","notebook":{"name":"notebook.ipynb","path":"old/notebook.ipynb"},"path":"old/notebook.ipynb","type":"notebook","vendor_field":"preserved"}`,
+		},
+		{
+			Description: "Add a nonstandard field without changing the ID",
+			Patch:       `{"id":"other","extra":1}`,
+			Want:        `{"extra":1,"id":"session1","kernel":{"connections":0,"id":"kernel1","name":"python3"},"name":"notebook.ipynb","notebook":{"name":"notebook.ipynb","path":"old/notebook.ipynb"},"path":"old/notebook.ipynb","type":"notebook","vendor_field":"preserved"}`,
+		},
+	}
+	for _, testCase := range testCases {
+		var s, patch Session
+		if err := json.Unmarshal([]byte(saved), &s); err != nil {
+			t.Fatalf("Unexpected error unmarshalling the saved session: %v", err)
+		}
+		original := s
+		before, err := json.Marshal(original)
+		if err != nil {
+			t.Fatalf("Unexpected error marshalling the saved session: %v", err)
+		}
+		if err := json.Unmarshal([]byte(testCase.Patch), &patch); err != nil {
+			t.Fatalf("Unexpected error unmarshalling the patch for %q: %v", testCase.Description, err)
+		}
+		s.ApplyPatch(&patch)
+		output, err := json.Marshal(s)
+		if err != nil {
+			t.Fatalf("Unexpected error marshalling the patched session for %q: %v", testCase.Description, err)
+		}
+		if got, want := string(output), testCase.Want; got != want {
+			t.Errorf("Unexpected patched session for %q: got %s, want %s", testCase.Description, got, want)
+		}
+		after, err := json.Marshal(original)
+		if err != nil {
+			t.Fatalf("Unexpected error marshalling the original session for %q: %v", testCase.Description, err)
+		}
+		if got, want := string(after), string(before); got != want {
+			t.Errorf("Unexpected modification of the original session for %q: got %s, want %s", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestSessionMarshalClearedKernel(t *testing.T) {
+	var s Session
+	if err := json.Unmarshal([]byte(`{"id":"session1","kernel":{"id":"kernel1","name":"python3"},"vendor_field":"preserved"}`), &s); err != nil {
+		t.Fatalf("Unexpected error unmarshalling the session: %v", err)
+	}
+	s.Kernel = nil
+	output, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Unexpected error marshalling the session: %v", err)
+	}
+	if got, want := string(output), `{"id":"session1","kernel":null,"vendor_field":"preserved"}`; got != want {
+		t.Errorf("Unexpected session with a cleared kernel: got %s, want %s", got, want)
+	}
+}
+
+func TestSessionEffectiveName(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Session     *Session
+		Want        string
+	}{
+		{
+			Description: "Session with a name",
+			Session:     &Session{ID: "session1", Path: "notebooks/analysis.ipynb", Name: "Analysis"},
+			Want:        "Analysis",
+		},
+		{
+			Description: "Session with only a path",
+			Session:     &Session{ID: "session1", Path: "notebooks/analysis.ipynb"},
+			Want:        "analysis.ipynb",
+		},
+		{
+			Description: "Session with a top-level path",
+			Session:     &Session{ID: "session1", Path: "analysis.ipynb"},
+			Want:        "analysis.ipynb",
+		},
+		{
+			Description: "Session with only an ID",
+			Session:     &Session{ID: "session1"},
+			Want:        "session1",
+		},
+	}
+	for _, testCase := range testCases {
+		if got, want := testCase.Session.EffectiveName(), testCase.Want; got != want {
+			t.Errorf("Unexpected effective name for %q: got %q, want %q", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestKernelSpecsStableHash(t *testing.T) {
+	parse := func(source string) *KernelSpecs {
+		var ks KernelSpecs
+		if err := json.Unmarshal([]byte(source), &ks); err != nil {
+			t.Fatalf("Unexpected error unmarshalling %q: %v", source, err)
+		}
+		return &ks
+	}
+	ignored := []string{"logo-64x64"}
+	original := parse(`{"default":"python3","kernelspecs":{"python3":{"name":"python3","spec":{"display_name":"Python 3","language":"python"},"resources":{"logo-64x64":"/kernelspecs/python3/logo-64x64.png?sig=1","kernel.js":"/kernelspecs/python3/kernel.js"}}}}`)
+	hash := original.StableHash(ignored)
+	if hash == "" {
+		t.Fatalf("Unexpected empty hash")
+	}
+	testCases := []struct {
+		Description string
+		Source      string
+		WantSame    bool
+	}{
+		{
+			Description: "Only an ignored resource changed",
+			Source:      `{"default":"python3","kernelspecs":{"python3":{"name":"python3","spec":{"display_name":"Python 3","language":"python"},"resources":{"logo-64x64":"/kernelspecs/python3/logo-64x64.png?sig=2","kernel.js":"/kernelspecs/python3/kernel.js"}}}}`,
+			WantSame:    true,
+		},
+		{
+			Description: "Only an ignored resource removed",
+			Source:      `{"default":"python3","kernelspecs":{"python3":{"name":"python3","spec":{"display_name":"Python 3","language":"python"},"resources":{"kernel.js":"/kernelspecs/python3/kernel.js"}}}}`,
+			WantSame:    true,
+		},
+		{
+			Description: "Another resource changed",
+			Source:      `{"default":"python3","kernelspecs":{"python3":{"name":"python3","spec":{"display_name":"Python 3","language":"python"},"resources":{"logo-64x64":"/kernelspecs/python3/logo-64x64.png?sig=1","kernel.js":"/kernelspecs/python3/other.js"}}}}`,
+		},
+		{
+			Description: "Display name changed",
+			Source:      `{"default":"python3","kernelspecs":{"python3":{"name":"python3","spec":{"display_name":"Python","language":"python"},"resources":{"logo-64x64":"/kernelspecs/python3/logo-64x64.png?sig=1","kernel.js":"/kernelspecs/python3/kernel.js"}}}}`,
+		},
+	}
+	for _, testCase := range testCases {
+		if got := parse(testCase.Source).StableHash(ignored); (got == hash) != testCase.WantSame {
+			t.Errorf("Unexpected hash for %q: got %q, original %q, want same: %v", testCase.Description, got, hash, testCase.WantSame)
+		}
+	}
+	if got, want := original.KernelSpecs["python3"].Resources["logo-64x64"], "/kernelspecs/python3/logo-64x64.png?sig=1"; got != want {
+		t.Errorf("Unexpected modification of the hashed kernelspecs: got %q, want %q", got, want)
+	}
+}
+
+// structuredFields returns the JSON names of the structured fields of the given resource type.
+func structuredFields(resource any) map[string]bool {
+	fields := make(map[string]bool)
+	resourceType := reflect.TypeOf(resource).Elem()
+	for i := 0; i < resourceType.NumField(); i++ {
+		if name, _, _ := strings.Cut(resourceType.Field(i).Tag.Get("json"), ","); name != "" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func FuzzUnmarshalResources(f *testing.F) {
+	for _, seed := range []string{
+		`{}`,
+		`null`,
+		`{"default":"python3","kernelspecs":{"python3":{"name":"python3","spec":{"display_name":"Python 3","language":"python","metadata":{"debugger":true}},"resources":{"logo-64x64":"/logo.png"}}},"engine_info":{"name":"engine"}}`,
+		`{"name":"pyspark","spec":{"display_name":"PySpark","argv":["python"],"env":{"A":"1"}},"resources":[{"key":"endpointParentResource","value":"//dataproc"}],"extra":{"name":{"name":"nested"}}}`,
+		`{"id":"kernel1","name":"python3","last_activity":"2023-02-14T02:50:02.922555Z","connections":1,"execution_state":"idle","ready":1,"env":{"A":"1"},"metadata":{"accelerator":{"type":"T4","count":2}},"big":12345678901234567890}`,
+		`{"id":"session1","path":"a.ipynb","name":"a.ipynb","type":"notebook","kernel":{"id":"kernel1","name":"python3","kernel":{"id":"nested"}},"notebook":{"path":"a.ipynb"},"deep":{"a":{"b":{"c":[1,2,{"d":null}]}}}}`,
+		`{"name":"1","last_activity":"2023-02-14T02:50:02.922555Z","last_activity_extra":0.1}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var source map[string]any
+		if err := json.Unmarshal(data, &source); err != nil {
+			// Only JSON objects can be unmarshalled as resources.
+			return
+		}
+		for _, newResource := range []func() any{
+			func() any { return &KernelSpecs{} },
+			func() any { return &KernelSpec{} },
+			func() any { return &Kernel{} },
+			func() any { return &Session{} },
+			func() any { return &Terminal{} },
+		} {
+			resource := newResource()
+			if err := json.Unmarshal(data, resource); err != nil {
+				continue
+			}
+			output, err := json.Marshal(resource)
+			if err != nil {
+				t.Fatalf("Failure marshalling the %T unmarshalled from %q: %v", resource, data, err)
+			}
+			roundtripped := newResource()
+			if err := json.Unmarshal(output, roundtripped); err != nil {
+				t.Fatalf("Failure unmarshalling the %T marshalled as %q: %v", resource, output, err)
+			}
+			roundtrippedOutput, err := json.Marshal(roundtripped)
+			if err != nil {
+				t.Fatalf("Failure marshalling the roundtripped %T from %q: %v", resource, output, err)
+			}
+			if got, want := string(roundtrippedOutput), string(output); got != want {
+				t.Errorf("Unstable roundtrip for the %T unmarshalled from %q: got %s, want %s", resource, data, got, want)
+			}
+			var outputFields map[string]any
+			if err := json.Unmarshal(output, &outputFields); err != nil {
+				t.Fatalf("Failure unmarshalling the %T marshalled as %q as raw fields: %v", resource, output, err)
+			}
+			structured := structuredFields(resource)
+			for key, val := range source {
+				if structured[key] {
+					continue
+				}
+				if diff := cmp.Diff(val, outputFields[key]); diff != "" {
+					t.Errorf("Raw field %q of the %T unmarshalled from %q was not preserved: diff %v", key, resource, data, diff)
+				}
+			}
+		}
+	})
+}
+
+func TestKernelSpecsOverlayDefaults(t *testing.T) {
+	defaults := &Spec{
+		Language:      "python",
+		Argv:          []string{"python", "-m", "ipykernel"},
+		InterruptMode: "signal",
+		Metadata:      map[string]any{"team": "data", "debugger": false},
+	}
+	ks := &KernelSpecs{
+		KernelSpecs: SpecMap{
+			"python3": &KernelSpec{
+				ID: "python3",
+				Spec: &Spec{
+					DisplayName: "Python 3",
+					Metadata:    map[string]any{"debugger": true},
+				},
+			},
+			"bare": &KernelSpec{ID: "bare"},
+		},
+	}
+	ks.OverlayDefaults(defaults)
+	want := SpecMap{
+		"python3": &KernelSpec{
+			ID: "python3",
+			Spec: &Spec{
+				Language:      "python",
+				Argv:          []string{"python", "-m", "ipykernel"},
+				DisplayName:   "Python 3",
+				InterruptMode: "signal",
+				Metadata:      map[string]any{"debugger": true, "team": "data"},
+			},
+		},
+		"bare": &KernelSpec{
+			ID: "bare",
+			Spec: &Spec{
+				Language:      "python",
+				Argv:          []string{"python", "-m", "ipykernel"},
+				InterruptMode: "signal",
+				Metadata:      map[string]any{"debugger": false, "team": "data"},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, ks.KernelSpecs, cmpopts.IgnoreUnexported(KernelSpec{}, Spec{})); diff != "" {
+		t.Errorf("Unexpected kernelspecs after overlaying the defaults: diff %v", diff)
+	}
+	if got, want := len(defaults.Metadata), 2; got != want {
+		t.Errorf("Unexpected modification of the default metadata: got %d entries, want %d", got, want)
+	}
+}
+
+func TestKernelSpecsMarshalSubset(t *testing.T) {
+	var ks KernelSpecs
+	if err := json.Unmarshal([]byte(`{"default":"python3","engine_info":{"name":"engine"},"kernelspecs":{"python3":{"name":"python3","spec":{"display_name":"Python 3","language":"python"}},"ir":{"name":"ir","spec":{"display_name":"R","language":"R"}},"julia":{"name":"julia","spec":{"display_name":"Julia","language":"julia"}},"bash":{"name":"bash","spec":{"display_name":"Bash","language":"bash"}}}}`), &ks); err != nil {
+		t.Fatalf("Unexpected error unmarshalling the kernelspecs: %v", err)
+	}
+	output, err := ks.MarshalSubset([]string{"python3", "ir", "missing"})
+	if err != nil {
+		t.Fatalf("Unexpected error marshalling the subset: %v", err)
+	}
+	want := `{"kernelspecs":{"python3":{"name":"python3","spec":{"display_name":"Python 3","language":"python"}},"ir":{"name":"ir","spec":{"display_name":"R","language":"R"}}}}`
+	if got := string(output); got != want {
+		t.Errorf("Unexpected marshalled subset: got %s, want %s", got, want)
+	}
+}
+
+func TestTerminalLastActivityTime(t *testing.T) {
+	terminal := &Terminal{ID: "1", LastActivity: "2023-02-14T02:50:02.922555Z"}
+	got, ok := terminal.LastActivityTime()
+	if !ok {
+		t.Fatalf("Unexpected failure parsing the last activity %q", terminal.LastActivity)
+	}
+	if want := time.Date(2023, 2, 14, 2, 50, 2, 922555000, time.UTC); !got.Equal(want) {
+		t.Errorf("Unexpected last activity time: got %v, want %v", got, want)
+	}
+	if _, ok := (&Terminal{ID: "1"}).LastActivityTime(); ok {
+		t.Errorf("Unexpected last activity time for a terminal without one")
+	}
+}
+
+func TestBuildHealthReport(t *testing.T) {
+	cluster := "//dataproc.googleapis.com/projects/project-id/regions/test-region/clusters/cluster1"
+	specs := &KernelSpecs{
+		Default: "local-python3",
+		KernelSpecs: SpecMap{
+			"local-python3":  &KernelSpec{ID: "local-python3", Spec: &Spec{DisplayName: "Python 3"}},
+			"remote-pyspark": &KernelSpec{ID: "remote-pyspark", Spec: &Spec{DisplayName: "PySpark"}, Resources: map[string]string{"endpointParentResource": cluster}},
+		},
+	}
+	kernels := []*Kernel{
+		&Kernel{ID: "local-kernel1", SpecID: "local-python3", Connections: 1},
+		&Kernel{ID: "remote-kernel2", SpecID: "remote-pyspark", Connections: 2},
+		&Kernel{ID: "remote-kernel3", SpecID: "remote-removed"},
+	}
+	sessions := Sessions{
+		&Session{ID: "session1", Kernel: &Kernel{ID: "local-kernel1"}},
+		&Session{ID: "session2", Kernel: &Kernel{ID: "missing"}},
+	}
+	terminals := Terminals{&Terminal{ID: "1"}}
+
+	report := BuildHealthReport(specs, kernels, sessions, terminals)
+	for _, section := range []string{"counts", "backends", "issues", "endpoints_digest"} {
+		if _, ok := report[section]; !ok {
+			t.Errorf("Missing the section %q from the health report: %v", section, report)
+		}
+	}
+	wantCounts := map[string]int{"kernelspecs": 2, "kernels": 3, "sessions": 2, "terminals": 1}
+	if diff := cmp.Diff(wantCounts, report["counts"]); diff != "" {
+		t.Errorf("Unexpected counts: diff %v", diff)
+	}
+	wantBackends := map[string]map[string]int{
+		"local": {"kernelspecs": 1, "kernels": 2, "connections": 1},
+		cluster: {"kernelspecs": 1, "kernels": 1, "connections": 2},
+	}
+	if diff := cmp.Diff(wantBackends, report["backends"]); diff != "" {
+		t.Errorf("Unexpected backends: diff %v", diff)
+	}
+	wantIssues := []string{
+		`the kernel "remote-kernel3" uses the unlisted kernelspec "remote-removed"`,
+		`the session "session2" uses the missing or dead kernel "missing"`,
+	}
+	if diff := cmp.Diff(wantIssues, report["issues"]); diff != "" {
+		t.Errorf("Unexpected issues: diff %v", diff)
+	}
+	if got, want := report["endpoints_digest"], specs.EndpointsDigest(); got != want {
+		t.Errorf("Unexpected endpoints digest: got %v, want %v", got, want)
+	}
+	if _, err := json.Marshal(report); err != nil {
+		t.Errorf("Failure marshalling the health report: %v", err)
+	}
+}
@@ -18,6 +18,7 @@ limitations under the License.
 package sessions
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -36,37 +37,8 @@ import (
 // APIPath is the URL path to the sessions collection in the Jupyter REST API.
 const APIPath = "/api/sessions"
 
-func fillInMissingFields(saved, partial *resources.Session) {
-	if partial.ID == "" {
-		partial.ID = saved.ID
-	}
-	if partial.Notebook == nil {
-		partial.Notebook = make(map[string]string)
-		for k, v := range saved.Notebook {
-			partial.Notebook[k] = v
-		}
-	}
-	if partial.Notebook != nil && len(saved.Notebook) > 0 {
-		if len(partial.Path) > 0 {
-			partial.Notebook["path"] = partial.Path
-		}
-		if path, ok := partial.Notebook["path"]; ok {
-			partial.Path = path
-		}
-	}
-	if partial.Path == "" {
-		partial.Path = saved.Path
-	}
-	if partial.Name == "" {
-		partial.Name = saved.Name
-	}
-	if partial.Type == "" {
-		partial.Type = saved.Type
-	}
-	if partial.Kernel == nil {
-		partial.Kernel = saved.Kernel
-	}
-}
+// kernelParam is the query parameter that names an existing kernel for a new session to use, as an alternative to the kernel ID in the request body.
+const kernelParam = "kernel"
 
 // UnifiedView takes the backend view of the session and returns the global view.
 func UnifiedView(s *resources.Session, b *backends.Backend, sessionID string) *resources.Session {
@@ -80,8 +52,8 @@ func UnifiedView(s *resources.Session, b *backends.Backend, sessionID string) *r
 }
 
 // fetchSessions returns the list of sessions for the given backend.
-func fetchSessions(b *backends.Backend) ([]*resources.Session, error) {
-	backendRespBytes, err := b.Get(APIPath)
+func fetchSessions(ctx context.Context, b *backends.Backend) ([]*resources.Session, error) {
+	backendRespBytes, err := b.GetContext(ctx, APIPath)
 	if err != nil {
 		return nil, fmt.Errorf("failure reading the sessions from %q: %w", b.Name(), err)
 	}
@@ -95,80 +67,178 @@ func fetchSessions(b *backends.Backend) ([]*resources.Session, error) {
 type sessionRecord struct {
 	backend     *backends.Backend
 	backendView *resources.Session
+	// recorded is when the session was created or patched through the collection, if it was.
+	recorded time.Time
+}
+
+// sessionKey identifies a session by the name of its backend and its ID within that backend.
+//
+// Session IDs are only unique within a backend, so sessions from different backends may share an ID.
+type sessionKey struct {
+	backendName string
+	id          string
+}
+
+// keyFor returns the key for the session with the given backend ID in the given backend.
+func keyFor(b *backends.Backend, backendSessionID string) sessionKey {
+	return sessionKey{backendName: b.Name(), id: backendSessionID}
 }
 
 func (r *sessionRecord) UnifiedView(sessionID string) *resources.Session {
 	return UnifiedView(r.backendView, r.backend, sessionID)
 }
 
+// minListRefreshInterval is the minimum time between updating the collection from every backend to list the sessions.
+//
+// This bounds the load on the backends from clients that list the sessions repeatedly, e.g.
+// while polling for changes. Sessions created, patched, or deleted through the collection are
+// reflected immediately regardless.
+const minListRefreshInterval = 5 * time.Second
+
 type collection struct {
-	localBackend      *backends.Backend
-	remoteBackend     *backends.Backend
+	pool backends.Pool
+	// routes records which backend hosts each kernel, and is shared with the kernels collection.
+	routes            kernels.RoutingTable
 	sessionsMap       map[string]*sessionRecord
-	sessionUnifiedIDs map[string]string
+	sessionUnifiedIDs map[sessionKey]string
+	// refreshed is when the collection was last updated to list the sessions.
+	refreshed time.Time
+	// refreshErr is the error from that update, if any.
+	refreshErr error
+	// refreshing is closed once the in-flight update to list the sessions, if there is one, completes.
+	refreshing chan struct{}
 	sync.Mutex
 }
 
-func newCollection(localBackend, remoteBackend *backends.Backend) *collection {
+func newCollection(pool backends.Pool, routes kernels.RoutingTable) *collection {
 	return &collection{
-		localBackend:      localBackend,
-		remoteBackend:     remoteBackend,
+		pool:              pool,
+		routes:            routes,
 		sessionsMap:       make(map[string]*sessionRecord),
-		sessionUnifiedIDs: make(map[string]string),
+		sessionUnifiedIDs: make(map[sessionKey]string),
 	}
 }
 
-func (s *collection) Update() error {
+// localBackend returns the backend on which sessions without a kernel are created.
+func (s *collection) localBackend() *backends.Backend {
+	return s.pool.Backends()[0]
+}
+
+// Update refreshes the collection from the sessions of each backend.
+//
+// The backends are listed concurrently using the given context, so that they stop being listed
+// once it is canceled. The collection is only locked to swap in the listed sessions, and is left
+// unchanged if the listing was canceled, rather than treating the sessions of the backends that
+// were not listed as lost. Sessions created or patched through the collection while the backends
+// were being listed are kept.
+//
+// Each session keeps the unified ID it was first seen with. That is its backend ID, unless a
+// session from another backend already has that ID, in which case it is qualified by its backend.
+func (s *collection) Update(ctx context.Context) error {
+	listedAt := time.Now()
+	bs := s.pool.Backends()
+	backendSessions := make([][]*resources.Session, len(bs))
+	errs := make([]error, len(bs))
+	var wg sync.WaitGroup
+	for i, b := range bs {
+		wg.Add(1)
+		go func(i int, b *backends.Backend) {
+			defer wg.Done()
+			backendSessions[i], errs[i] = fetchSessions(ctx, b)
+		}(i, b)
+	}
+	wg.Wait()
+	if errs[0] != nil {
+		return fmt.Errorf("failure listing the local sessions: %w", errs[0])
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("listing the sessions was canceled: %w", err)
+	}
 	s.Lock()
 	defer s.Unlock()
-	localSessions, err := fetchSessions(s.localBackend)
-	if err != nil {
-		return fmt.Errorf("failure listing the local sessions: %w", err)
-	}
-	remoteSessions, err := fetchSessions(s.remoteBackend)
-	if err != nil {
-		// We don't treat failures communicating with the remote backend as terminal,
-		// and instead simply treat the sessions hosted there as being lost. If the
-		// remote backend becomes available again we will rediscover the remote sessions
-		// at that point.
-		log.Printf("failure listing the remote sessions: %v", err)
-		remoteSessions = nil
+	inUse := make(map[string]bool)
+	for _, unifiedID := range s.sessionUnifiedIDs {
+		inUse[unifiedID] = true
 	}
 	updatedSessions := make(map[string]*sessionRecord)
-	for _, session := range localSessions {
-		if session.ID == "" {
-			// Ignore incomplete sessions from the backend
+	for i, b := range bs {
+		if errs[i] != nil {
+			// We don't treat failures communicating with a remote backend as terminal,
+			// and instead simply treat the sessions hosted there as being lost. If the
+			// remote backend becomes available again we will rediscover the remote sessions
+			// at that point.
+			log.Printf("failure listing the remote sessions from %q: %v", b.Name(), errs[i])
 			continue
 		}
-		unifiedID, ok := s.sessionUnifiedIDs[session.ID]
-		if !ok {
-			unifiedID = session.ID
-			s.sessionUnifiedIDs[session.ID] = unifiedID
-		}
-		updatedSessions[unifiedID] = &sessionRecord{
-			backend:     s.localBackend,
-			backendView: session,
+		for _, session := range backendSessions[i] {
+			if session == nil || session.ID == "" {
+				// Ignore incomplete sessions from the backend
+				continue
+			}
+			key := keyFor(b, session.ID)
+			unifiedID, ok := s.sessionUnifiedIDs[key]
+			if !ok {
+				unifiedID = session.ID
+				if inUse[unifiedID] {
+					unifiedID = b.UnifiedID(session.ID)
+					log.Printf("listing the session %q from %q as %q, as another backend has a session with the same ID", session.ID, b.Name(), unifiedID)
+				}
+				s.sessionUnifiedIDs[key] = unifiedID
+				inUse[unifiedID] = true
+			}
+			updatedSessions[unifiedID] = &sessionRecord{
+				backend:     b,
+				backendView: session,
+			}
 		}
 	}
-	for _, session := range remoteSessions {
-		if session.ID == "" {
-			// Ignore incomplete sessions from the backend
-			continue
-		}
-		unifiedID, ok := s.sessionUnifiedIDs[session.ID]
-		if !ok {
-			unifiedID = session.ID
-			s.sessionUnifiedIDs[session.ID] = unifiedID
-		}
-		updatedSessions[unifiedID] = &sessionRecord{
-			backend:     s.remoteBackend,
-			backendView: session,
+	for unifiedID, record := range s.sessionsMap {
+		if _, ok := updatedSessions[unifiedID]; !ok && record.recorded.After(listedAt) {
+			updatedSessions[unifiedID] = record
 		}
 	}
 	s.sessionsMap = updatedSessions
 	return nil
 }
 
+// refresh updates the collection from the sessions of each backend in order to list them.
+//
+// Concurrent calls share a single update, and no update is made if the last one completed
+// within the minListRefreshInterval, in which case the error from that one is returned.
+func (s *collection) refresh(ctx context.Context) error {
+	s.Lock()
+	if done := s.refreshing; done != nil {
+		s.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.Lock()
+		defer s.Unlock()
+		return s.refreshErr
+	}
+	if time.Since(s.refreshed) < minListRefreshInterval {
+		defer s.Unlock()
+		return s.refreshErr
+	}
+	done := make(chan struct{})
+	s.refreshing = done
+	s.Unlock()
+	defer close(done)
+	err := s.Update(ctx)
+	s.Lock()
+	defer s.Unlock()
+	s.refreshing = nil
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// Only a complete update counts, so that a canceled request does not hide new sessions from others.
+		return ctxErr
+	}
+	s.refreshed = time.Now()
+	s.refreshErr = err
+	return err
+}
+
 func (s *collection) Get(unifiedID string) (*resources.Session, bool) {
 	s.Lock()
 	defer s.Unlock()
@@ -194,18 +264,77 @@ func (s *collection) List() []*resources.Session {
 	return sessions
 }
 
-func (s *collection) Insert(unifiedID string, sess *resources.Session) (*resources.Session, error) {
+// findByPathWithLock returns the global view of the session for the given path, if there is one.
+func (s *collection) findByPathWithLock(path string) (*resources.Session, bool) {
+	for unifiedID, record := range s.sessionsMap {
+		if record.backendView != nil && record.backendView.Path == path {
+			return record.UnifiedView(unifiedID), true
+		}
+	}
+	return nil, false
+}
+
+// Insert creates the given session on the backend hosting its kernel, and records it under the given unified ID.
+//
+// If the unified ID is empty, then the session is new and is recorded under the ID reported by
+// the backend. Like the Jupyter server, a new session for a path that already has one returns
+// the existing session rather than starting another kernel. Requests that name an existing
+// kernel are always passed through, as they do not start a kernel.
+func (s *collection) Insert(ctx context.Context, unifiedID string, sess *resources.Session) (*resources.Session, error) {
+	if sess.Kernel != nil && sess.Kernel.ID != "" {
+		// Look up the existing kernel before locking the collection, as that may call the backends.
+		existing, err := s.existingKernel(ctx, sess.Kernel)
+		if err != nil {
+			return nil, err
+		}
+		sess.Kernel = existing
+	}
 	s.Lock()
 	defer s.Unlock()
+	if unifiedID == "" && sess.Path != "" && (sess.Kernel == nil || sess.Kernel.ID == "") {
+		if existing, ok := s.findByPathWithLock(sess.Path); ok {
+			log.Printf("returning the existing session %q for the path %q rather than creating another", existing.ID, sess.Path)
+			return existing, nil
+		}
+	}
 	return s.insertWithLock(unifiedID, sess)
 }
 
+// existingKernel returns the global view of the running kernel that the given kernel from a session request refers to.
+//
+// The backend hosting the kernel is looked up in the kernels routing table, so that a session for
+// an existing kernel is created on that backend rather than the one its spec ID might suggest. If
+// no backend hosts the kernel, then the given kernel is returned unchanged as long as its spec
+// ID identifies a backend, so that backend can report the missing kernel.
+func (s *collection) existingKernel(ctx context.Context, k *resources.Kernel) (*resources.Kernel, error) {
+	backend, err := s.routes.Lookup(ctx, k.ID)
+	if err == nil {
+		backendKernels, err := kernels.Fetch(ctx, backend)
+		if err != nil {
+			log.Printf("failure fetching the kernels from %q to find the kernel %q: %v", backend.Name(), k.ID, err)
+		}
+		for _, backendKernel := range backendKernels {
+			if backendKernel.ID == k.ID {
+				return kernels.UnifiedView(backendKernel, backend), nil
+			}
+		}
+	}
+	if k.SpecID == "" {
+		return nil, fmt.Errorf("unknown kernel %q: %w", k.ID, util.HTTPError(http.StatusNotFound))
+	}
+	return k, nil
+}
+
+// insertWithLock creates the given session on the backend hosting its kernel.
+//
+// Sessions without a kernel, such as those JupyterLab creates with a null kernel, are not tied
+// to any kernelspec and are always created on the local backend.
 func (s *collection) insertWithLock(unifiedID string, sess *resources.Session) (*resources.Session, error) {
-	var backend *backends.Backend
+	backend := s.localBackend()
 	var backendK *resources.Kernel
 	var err error
 	if sess.Kernel != nil {
-		backend, backendK, err = kernels.BackendView(sess.Kernel, []*backends.Backend{s.localBackend, s.remoteBackend})
+		backend, backendK, err = kernels.BackendView(sess.Kernel, s.pool.Backends())
 		if err != nil {
 			return nil, fmt.Errorf("failure converting the kernel: %w", err)
 		}
@@ -228,36 +357,67 @@ func (s *collection) insertWithLock(unifiedID string, sess *resources.Session) (
 	record := &sessionRecord{
 		backend:     backend,
 		backendView: &newSess,
+		recorded:    time.Now(),
 	}
 	if unifiedID == "" {
-		// The unified ID of a session matches it's original backend session ID
+		// The unified ID of a session matches it's original backend session ID, unless another backend has a session with that ID.
 		unifiedID = newSess.ID
+		if existing, ok := s.sessionsMap[unifiedID]; ok && existing.backend.Name() != backend.Name() {
+			unifiedID = backend.UnifiedID(newSess.ID)
+		}
 	}
 	s.sessionsMap[unifiedID] = record
-	s.sessionUnifiedIDs[newSess.ID] = unifiedID
+	s.sessionUnifiedIDs[keyFor(backend, newSess.ID)] = unifiedID
+	if newSess.Kernel != nil && newSess.Kernel.ID != "" {
+		s.routes.Record(newSess.Kernel.ID, backend)
+	}
 	return record.UnifiedView(unifiedID), nil
 }
 
-func (s *collection) Delete(unifiedID string) bool {
+// Delete deletes the session with the given unified ID from the backend hosting it.
+//
+// If the session is not known, e.g. because it was created since the sessions were last
+// listed, then the sessions are listed again before looking it up.
+func (s *collection) Delete(ctx context.Context, unifiedID string) error {
+	s.Lock()
+	_, ok := s.sessionsMap[unifiedID]
+	s.Unlock()
+	if !ok {
+		if err := s.Update(ctx); err != nil {
+			log.Printf("failure updating the sessions to find the session %q: %v", unifiedID, err)
+		}
+	}
 	s.Lock()
 	defer s.Unlock()
 	return s.deleteWithLock(unifiedID)
 }
 
-func (s *collection) deleteWithLock(unifiedID string) bool {
+// deleteWithLock deletes the session with the given unified ID from the backend hosting it.
+//
+// The backend is resolved from the unified spec ID of the session's kernel, falling back to the
+// backend the session was listed from if it has no kernel. A session that the backend reports
+// as not found is treated as already deleted, so that deletes are idempotent.
+func (s *collection) deleteWithLock(unifiedID string) error {
 	record, ok := s.sessionsMap[unifiedID]
 	if !ok {
-		return false
+		return fmt.Errorf("session %q not found: %w", unifiedID, util.HTTPError(http.StatusNotFound))
 	}
 	backend := record.backend
+	if unified := record.UnifiedView(unifiedID); unified.Kernel != nil && unified.Kernel.SpecID != "" {
+		if b, _, err := backends.ParseUnifiedID(unified.Kernel.SpecID, s.pool.Backends()); err == nil {
+			backend = b
+		}
+	}
 	sessionPath := APIPath + "/" + record.backendView.ID
 	if err := backend.Delete(sessionPath); err != nil {
-		log.Printf("Failure trying to delete a kernel: %v", err)
-		return false
+		if util.HTTPStatusCode(err) != http.StatusNotFound {
+			return fmt.Errorf("failure deleting the session %q from %q: %w", unifiedID, backend.Name(), err)
+		}
+		log.Printf("session %q was already deleted from %q", unifiedID, backend.Name())
 	}
 	delete(s.sessionsMap, unifiedID)
-	delete(s.sessionUnifiedIDs, record.backendView.ID)
-	return true
+	delete(s.sessionUnifiedIDs, keyFor(record.backend, record.backendView.ID))
+	return nil
 }
 
 func (s *collection) Patch(r *http.Request, unifiedID string, sess *resources.Session) (*resources.Session, error) {
@@ -271,7 +431,7 @@ func (s *collection) Patch(r *http.Request, unifiedID string, sess *resources.Se
 	var err error
 	var k *resources.Kernel
 	if sess.Kernel != nil {
-		backend, k, err = kernels.BackendView(sess.Kernel, []*backends.Backend{s.localBackend, s.remoteBackend})
+		backend, k, err = kernels.BackendView(sess.Kernel, s.pool.Backends())
 		if err != nil {
 			err = fmt.Errorf("failure converting the session kernel: %w", err)
 			util.Log(r, err)
@@ -279,21 +439,25 @@ func (s *collection) Patch(r *http.Request, unifiedID string, sess *resources.Se
 		}
 		sess.Kernel = k
 	}
-	fillInMissingFields(record.backendView, sess)
+	// Apply the patch onto a copy of the saved session, so that fields the patch does not
+	// mention (including the kernel and any nonstandard fields) are preserved.
+	updated := *record.backendView
+	updated.ApplyPatch(sess)
 	if record.backend != backend {
 		// Change in location; delete the old session and create a new one.
-		s.deleteWithLock(unifiedID)
-		return s.insertWithLock(unifiedID, UnifiedView(sess, backend, ""))
+		if err := s.deleteWithLock(unifiedID); err != nil {
+			util.Log(r, fmt.Sprintf("Failure deleting the session from its previous backend: %v", err))
+		}
+		return s.insertWithLock(unifiedID, UnifiedView(&updated, backend, ""))
 	}
 	// The backend is unchanged, so simply forward the patch request to it.
-	sess.ID = record.backendView.ID
-	reqBytes, err := json.Marshal(sess)
+	reqBytes, err := json.Marshal(&updated)
 	if err != nil {
 		err = fmt.Errorf("failure marshalling the updated session: %w", err)
 		util.Log(r, err)
 		return nil, err
 	}
-	respBytes, err := backend.Patch("/api/sessions/"+sess.ID, reqBytes)
+	respBytes, err := backend.Patch(APIPath+"/"+updated.ID, reqBytes)
 	if err != nil {
 		err = fmt.Errorf("failure patching the session: %w", err)
 		util.Log(r, err)
@@ -305,17 +469,36 @@ func (s *collection) Patch(r *http.Request, unifiedID string, sess *resources.Se
 		util.Log(r, err)
 		return nil, err
 	}
-	record.backendView = &resp
+	// Merge the backend's response onto the update, in case the backend omits some fields.
+	updated.ApplyPatch(&resp)
+	record.backendView = &updated
+	record.recorded = time.Now()
 	return record.UnifiedView(unifiedID), nil
 }
 
+// ListHook adjusts the global view of the sessions listed by a sessions handler before they are returned.
+//
+// The hook may not modify the given sessions, and returns those to list. If it returns an error,
+// then the listing fails with that error's HTTP status.
+type ListHook func(r *http.Request, ss []*resources.Session) ([]*resources.Session, error)
+
 // Handler implements the sessions collection.
 func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) http.Handler {
+	pool := backends.Fixed(localBackend, remoteBackend)
+	return PoolHandler(pool, kernels.NewRoutingTable(pool))
+}
+
+// PoolHandler is like Handler, but implements the sessions collection for the backends currently in the given pool.
+//
+// The given routing table is used to find the backends hosting existing kernels, and records the
+// kernels of the sessions that are created, so it should be shared with the kernels collection.
+// The given hooks are applied, in order, to the listed sessions.
+func PoolHandler(pool backends.Pool, routes kernels.RoutingTable, hooks ...ListHook) http.Handler {
 	// Sessions and kernels within the session map are in their backend form
-	sessions := newCollection(localBackend, remoteBackend)
+	sessions := newCollection(pool, routes)
 	go func() {
 		for {
-			if err := sessions.Update(); err != nil {
+			if err := sessions.Update(context.Background()); err != nil {
 				log.Printf("Failure updating the sessions list: %v", err)
 			}
 			time.Sleep(30 * time.Second)
@@ -337,12 +520,29 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 		w.Write(resp)
 	}
 	listMethod := func(w http.ResponseWriter, r *http.Request) {
-		resp, err := json.Marshal(sessions.List())
+		// Fan the listing out to every backend, at most once per minListRefreshInterval, so that the
+		// list reflects the sessions created or deleted since the last refresh. If that fails, then
+		// the last known sessions are listed.
+		if err := sessions.refresh(r.Context()); err != nil {
+			util.Log(r, fmt.Sprintf("Failure updating the sessions; listing the last known ones: %v", err))
+		}
+		listed := sessions.List()
+		for _, hook := range hooks {
+			var err error
+			if listed, err = hook(r, listed); err != nil {
+				errorMsg := fmt.Sprintf("failure listing the sessions: %v", err)
+				util.Log(r, errorMsg)
+				http.Error(w, errorMsg, util.HTTPStatusCode(err))
+				return
+			}
+		}
+		resp, err := json.Marshal(listed)
 		if err != nil {
 			util.Log(r, fmt.Sprintf("Failure marshalling the list sessions response: %v", err))
 			http.Error(w, "failure marshalling the list of sessions", util.HTTPStatusCode(err))
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.Write(resp)
 	}
 	insertMethod := func(w http.ResponseWriter, r *http.Request) {
@@ -361,11 +561,24 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 			http.Error(w, errorMsg, util.HTTPStatusCode(err))
 			return
 		}
-		util.Log(r, fmt.Sprintf("Creating a new kernel for the session: %q", string(reqBytes)))
-		newSession, err := sessions.Insert("", &sess)
+		for _, warning := range sess.Validate() {
+			util.Log(r, fmt.Sprintf("Creating a session with unexpected values: %v", warning))
+		}
+		if kernelID := r.URL.Query().Get(kernelParam); kernelID != "" {
+			if sess.Kernel == nil {
+				sess.Kernel = &resources.Kernel{}
+			}
+			sess.Kernel.ID = kernelID
+		}
+		if sess.Kernel != nil && sess.Kernel.ID != "" {
+			util.Log(r, fmt.Sprintf("Creating a session for the existing kernel %q: %q", sess.Kernel.ID, string(reqBytes)))
+		} else {
+			util.Log(r, fmt.Sprintf("Creating a new kernel for the session: %q", string(reqBytes)))
+		}
+		newSession, err := sessions.Insert(r.Context(), "", &sess)
 		if err != nil {
 			util.Log(r, err)
-			http.Error(w, err.Error(), util.HTTPStatusCode(err))
+			util.WriteJSONError(w, util.HTTPStatusCode(err), err.Error())
 			return
 		}
 		respBytes, err := json.Marshal(newSession)
@@ -380,8 +593,10 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 	}
 	deleteMethod := func(w http.ResponseWriter, r *http.Request) {
 		sessionID := strings.TrimPrefix(r.URL.Path, APIPath+"/")
-		if ok := sessions.Delete(sessionID); !ok {
-			http.NotFound(w, r)
+		if err := sessions.Delete(r.Context(), sessionID); err != nil {
+			errorMsg := fmt.Sprintf("failure deleting the session: %v", err)
+			util.Log(r, errorMsg)
+			util.WriteJSONError(w, util.HTTPStatusCode(err), errorMsg)
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
@@ -404,11 +619,14 @@ func Handler(localBackend *backends.Backend, remoteBackend *backends.Backend) ht
 			http.Error(w, errorMsg, http.StatusBadRequest)
 			return
 		}
+		for _, warning := range sess.Validate() {
+			util.Log(r, fmt.Sprintf("Patching a session with unexpected values: %v", warning))
+		}
 		updatedSession, err := sessions.Patch(r, sessionID, &sess)
 		if err != nil {
 			errorMsg := fmt.Sprintf("failure patching the session: %v", err)
 			util.Log(r, errorMsg)
-			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			util.WriteJSONError(w, util.HTTPStatusCode(err), errorMsg)
 			return
 		}
 		respBytes, err := json.Marshal(updatedSession)
@@ -29,7 +29,9 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"path"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -37,29 +39,10 @@ import (
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/jupytertestutil"
 	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
 	"google3/webutil/http/go/httpheader"
 )
 
-func TestFillInMissingFields(t *testing.T) {
-	var fullSession, partialSession resources.Session
-	fullSession.ID = "testID"
-	fullSession.Path = "/some/test/notebook/path"
-	fullSession.Name = "test-notebook.ipynb"
-	fullSession.Type = "notebook"
-	fullSession.Kernel = &resources.Kernel{
-		ID:     "test-kernel",
-		SpecID: "test-spec",
-	}
-	fullSession.Notebook = map[string]string{
-		"a": "b",
-		"c": "d",
-	}
-	fillInMissingFields(&fullSession, &partialSession)
-	if diff := cmp.Diff(fullSession, partialSession, cmpopts.IgnoreUnexported(resources.Session{}, resources.Kernel{})); len(diff) > 0 {
-		t.Errorf("Unexpected diff for the result of the session.fillInMissingFields method: %s", diff)
-	}
-}
-
 func NewSessionsRequest(method, urlPath string, body io.Reader) (*http.Request, error) {
 	r, err := http.NewRequest(method, urlPath, body)
 	if err != nil {
@@ -336,3 +319,238 @@ func TestCreateUpdateDelete(t *testing.T) {
 		t.Log(err)
 	}
 }
+
+func TestPatchPreservesUnpatchedFields(t *testing.T) {
+	var mu sync.Mutex
+	backendSession := []byte(`{"id":"session1","path":"example.ipynb","name":"example.ipynb","type":"notebook","kernel":{"id":"kernel1","name":"python3"},"notebook":{"path":"example.ipynb"},"custom":"value"}`)
+	var patched []byte
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == APIPath:
+			w.Write([]byte("[" + string(backendSession) + "]"))
+		case r.URL.Path == APIPath+"/session1" && r.Method == http.MethodPatch:
+			patched, _ = io.ReadAll(r.Body)
+			backendSession = patched
+			// Respond with only some of the fields, as backends may omit the ones that did not change.
+			w.Write([]byte(`{"id":"session1","path":"renamed.ipynb","name":"renamed.ipynb"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer localServer.Close()
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer remoteServer.Close()
+	localURL, err := url.Parse(localServer.URL)
+	if err != nil {
+		t.Fatalf("failure parsing the URL of the local server: %v", err)
+	}
+	remoteURL, err := url.Parse(remoteServer.URL)
+	if err != nil {
+		t.Fatalf("failure parsing the URL of the remote server: %v", err)
+	}
+	localBackend := backends.New("local", "(Local)", localURL.Hostname(), httputil.NewSingleHostReverseProxy(localURL))
+	remoteBackend := backends.New("remote", "(Remote)", remoteURL.Hostname(), httputil.NewSingleHostReverseProxy(remoteURL))
+	sessionsHandler := Handler(localBackend, remoteBackend)
+
+	listed, err := ListSessions(sessionsHandler)
+	if err != nil {
+		t.Fatalf("failure listing the sessions: %v", err)
+	} else if len(listed) != 1 {
+		t.Fatalf("unexpected response when listing sessions: %v", listed)
+	}
+	saved := listed[0]
+	updated, err := UpdateSession(sessionsHandler, saved.ID, &resources.Session{Path: "renamed.ipynb", Name: "renamed.ipynb"})
+	if err != nil {
+		t.Fatalf("failure renaming the session %q: %v", saved.ID, err)
+	}
+	if got, want := updated.Path, "renamed.ipynb"; got != want {
+		t.Errorf("unexpected path for the renamed session: got %q, want %q", got, want)
+	}
+	if got, want := updated.Name, "renamed.ipynb"; got != want {
+		t.Errorf("unexpected name for the renamed session: got %q, want %q", got, want)
+	}
+	if updated.Kernel == nil || updated.Kernel.ID != saved.Kernel.ID {
+		t.Errorf("unexpected kernel for the renamed session: got %+v, want %+v", updated.Kernel, saved.Kernel)
+	}
+	if got, want := updated.Type, saved.Type; got != want {
+		t.Errorf("unexpected type for the renamed session: got %q, want %q", got, want)
+	}
+	respBytes, err := json.Marshal(updated)
+	if err != nil {
+		t.Fatalf("failure marshalling the renamed session: %v", err)
+	}
+	mu.Lock()
+	forwarded := patched
+	mu.Unlock()
+	for desc, bs := range map[string][]byte{"response": respBytes, "request forwarded to the backend": forwarded} {
+		var fields map[string]any
+		if err := json.Unmarshal(bs, &fields); err != nil {
+			t.Errorf("failure parsing the %s %q: %v", desc, string(bs), err)
+		} else if got, want := fields["custom"], "value"; got != want {
+			t.Errorf("unexpected nonstandard field in the %s %q: got %v, want %q", desc, string(bs), got, want)
+		}
+	}
+	if got, err := GetSession(sessionsHandler, saved.ID); err != nil {
+		t.Errorf("failure getting the renamed session %q: %v", saved.ID, err)
+	} else if diff := diffSessions(got, updated); diff != "" {
+		t.Errorf("unexpected diff when reading back the renamed session %q: %s", saved.ID, diff)
+	}
+}
+
+func TestCreateSessionForExistingKernelDoesNotBlock(t *testing.T) {
+	listing := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	local := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	remote := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/kernels":
+			// Hold up looking up the existing kernel.
+			once.Do(func() { close(listing) })
+			<-release
+			w.Write([]byte(`[{"id":"kernel2","name":"pyspark"}]`))
+		case r.Method == http.MethodPost && r.URL.Path == APIPath:
+			var sess resources.Session
+			if err := json.NewDecoder(r.Body).Decode(&sess); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sess.ID = "session1"
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&sess)
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	sessionsHandler := Handler(local, remote)
+
+	created := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rr := httptest.NewRecorder()
+		sessionsHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, APIPath, bytes.NewReader([]byte(`{"path":"a.ipynb","type":"notebook","kernel":{"id":"kernel2"}}`))))
+		created <- rr
+	}()
+	<-listing
+	got := make(chan int, 1)
+	go func() {
+		rr := httptest.NewRecorder()
+		sessionsHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, APIPath+"/unknown", nil))
+		got <- rr.Code
+	}()
+	select {
+	case code := <-got:
+		if code != http.StatusNotFound {
+			t.Errorf("Unexpected status getting an unknown session: got %d, want %d", code, http.StatusNotFound)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Getting a session was blocked while looking up the kernel of a session being created")
+	}
+	close(release)
+	if rr := <-created; rr.Code != http.StatusCreated {
+		t.Errorf("Unexpected status creating a session for an existing kernel: got %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+}
+
+func TestListCollidingSessionIDs(t *testing.T) {
+	sessionsFor := func(path string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && r.URL.Path == APIPath {
+				fmt.Fprintf(w, `[{"id":"session1","path":%q,"type":"notebook"}]`, path)
+				return
+			}
+			w.Write([]byte("[]"))
+		})
+	}
+	local := backends.New("local", " (local)", "local host", sessionsFor("local.ipynb"))
+	remote := backends.New("remote", " (remote)", "remote host", sessionsFor("remote.ipynb"))
+	sessionsHandler := Handler(local, remote)
+
+	for i := 0; i < 2; i++ {
+		got, err := ListSessions(sessionsHandler)
+		if err != nil {
+			t.Fatalf("Failure listing the sessions: %v", err)
+		}
+		want := []*resources.Session{
+			{ID: "session1", Path: "local.ipynb", Type: "notebook"},
+			{ID: "remote-session1", Path: "remote.ipynb", Type: "notebook"},
+		}
+		if diff := cmp.Diff(want, got, cmpopts.SortSlices(func(a, b *resources.Session) bool { return a.ID < b.ID }), cmpopts.IgnoreUnexported(resources.Session{})); diff != "" {
+			t.Errorf("Unexpected diff in the listed sessions: (-want +got)\n%s", diff)
+		}
+	}
+	sess, err := GetSession(sessionsHandler, "remote-session1")
+	if err != nil {
+		t.Fatalf("Failure getting the colliding remote session: %v", err)
+	}
+	if got, want := sess.Path, "remote.ipynb"; got != want {
+		t.Errorf("Unexpected path for the colliding remote session: got %q, want %q", got, want)
+	}
+}
+
+func TestListRefreshInterval(t *testing.T) {
+	var mu sync.Mutex
+	listed := make(map[string]int)
+	countingBackend := func(name string) *backends.Backend {
+		return backends.New(name, " ("+name+")", name+" host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && r.URL.Path == APIPath {
+				mu.Lock()
+				listed[name]++
+				mu.Unlock()
+			}
+			w.Write([]byte("[]"))
+		}))
+	}
+	sessionsHandler := Handler(countingBackend("local"), countingBackend("remote"))
+
+	for i := 0; i < 5; i++ {
+		if _, err := ListSessions(sessionsHandler); err != nil {
+			t.Fatalf("Failure listing the sessions: %v", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"local", "remote"} {
+		// The handler also lists the sessions once in the background when it is created.
+		if got, max := listed[name], 2; got < 1 || got > max {
+			t.Errorf("Unexpected number of times the sessions of %q were listed: got %d, want between 1 and %d", name, got, max)
+		}
+	}
+}
+
+func TestCreateSessionHTMLError(t *testing.T) {
+	local := backends.New("local", " (local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte("[]"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body><h1>Service Unavailable</h1></body></html>"))
+	}))
+	remote := backends.New("remote", " (remote)", "remote host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	h := Handler(local, remote)
+
+	r := httptest.NewRequest(http.MethodPost, APIPath, bytes.NewReader([]byte(`{"path":"notebook.ipynb","type":"notebook"}`)))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if got, want := rr.Code, http.StatusBadGateway; got != want {
+		t.Errorf("Unexpected status for an HTML response: got %d, want %d: %q", got, want, rr.Body.String())
+	}
+	if got, want := rr.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("Unexpected content type for an HTML response: got %q, want %q", got, want)
+	}
+	var got util.JSONError
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Failure parsing the error response %q: %v", rr.Body.String(), err)
+	}
+	if got.Status != http.StatusBadGateway || got.Message == "" {
+		t.Errorf("Unexpected error response for an HTML response: got %+v", got)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package terminals implements the terminals collection, which is only supported by the local backend.
+package terminals
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/resources"
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/util"
+)
+
+// APIPath is the URL path to the terminals collection in the Jupyter REST API.
+const APIPath = "/api/terminals"
+
+// Fetch returns the list of terminals for the given backend.
+func Fetch(ctx context.Context, b *backends.Backend) ([]*resources.Terminal, error) {
+	backendRespBytes, err := b.GetContext(ctx, APIPath)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the terminals from %q: %w", b.Name(), err)
+	}
+	var terminals []*resources.Terminal
+	if err := json.Unmarshal(backendRespBytes, &terminals); err != nil {
+		return nil, fmt.Errorf("failure parsing the terminals response from %q: %w", b.Name(), err)
+	}
+	return terminals, nil
+}
+
+// Handler returns an HTTP handler that implements the terminals collection.
+//
+// Remote backends do not support terminals, so every terminal request, including
+// the terminal websocket connections, is routed to the local backend.
+func Handler(localBackend *backends.Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) || !strings.HasPrefix(r.URL.Path, APIPath) {
+			localBackend.ServeHTTP(w, r)
+			return
+		}
+		relativePath := strings.TrimPrefix(r.URL.Path, APIPath)
+		relativePath = strings.TrimPrefix(relativePath, "/")
+		if relativePath == "" && r.Method == http.MethodGet {
+			// List the terminals
+			terminals, err := Fetch(r.Context(), localBackend)
+			if err != nil {
+				errorMsg := fmt.Sprintf("failure fetching the terminals: %v", err)
+				http.Error(w, errorMsg, util.HTTPStatusCode(err))
+				util.Log(r, fmt.Sprintf("Failed terminals API call: %q", errorMsg))
+				return
+			}
+			valid := []*resources.Terminal{}
+			for _, t := range terminals {
+				if t == nil {
+					continue
+				}
+				if err := t.Validate(); err != nil {
+					util.Log(r, fmt.Sprintf("Dropping an invalid terminal from %q: %v", localBackend.Name(), err))
+					continue
+				}
+				valid = append(valid, t)
+			}
+			respBytes, err := json.Marshal(valid)
+			if err != nil {
+				errorMsg := fmt.Sprintf("failure marshalling the terminals collection: %v", err)
+				http.Error(w, errorMsg, util.HTTPStatusCode(err))
+				util.Log(r, fmt.Sprintf("Failed terminals API call: %q", errorMsg))
+				return
+			}
+			w.Write(respBytes)
+			return
+		}
+		r.Header.Del("Accept-Encoding")
+		rr := httptest.NewRecorder()
+		localBackend.ServeHTTP(rr, r)
+		backendResp := rr.Result()
+		for key, val := range backendResp.Header {
+			if key != "Content-Length" {
+				w.Header()[key] = val
+			}
+		}
+		backendRespBytes, err := ioutil.ReadAll(backendResp.Body)
+		backendResp.Body.Close()
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure reading the backend response from %q: %v", localBackend.Name(), err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		if backendResp.StatusCode < http.StatusOK || backendResp.StatusCode >= http.StatusMultipleChoices || len(backendRespBytes) == 0 {
+			// For anything other than a 2XX response with a body, we don't modify the response
+			w.WriteHeader(backendResp.StatusCode)
+			if backendResp.StatusCode >= http.StatusBadRequest {
+				util.Log(r, fmt.Sprintf("Error response %d from %q for %+v", backendResp.StatusCode, localBackend.Name(), r))
+			}
+			w.Write(backendRespBytes)
+			return
+		}
+		var terminal resources.Terminal
+		if err := json.Unmarshal(backendRespBytes, &terminal); err != nil {
+			errorMsg := fmt.Sprintf("failure parsing the backend response from %q for %+v: %v, %q", localBackend.Name(), r, err, string(backendRespBytes))
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		respBytes, err := json.Marshal(terminal)
+		if err != nil {
+			errorMsg := fmt.Sprintf("failure marshalling the response: %v", err)
+			util.Log(r, errorMsg)
+			http.Error(w, errorMsg, util.HTTPStatusCode(err))
+			return
+		}
+		w.WriteHeader(backendResp.StatusCode)
+		w.Write(respBytes)
+	})
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package terminals
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/notebook-kernels-mixer/backends"
+)
+
+func TestHandler(t *testing.T) {
+	var localRequests []string
+	localBackend := backends.New("local", " (Local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		localRequests = append(localRequests, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`[{"name": "1", "last_activity": "2023-02-14T02:50:02.922555Z"}]`))
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"name": "2", "last_activity": "2023-02-14T02:50:02.922555Z"}`))
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	handler := Handler(localBackend)
+
+	testCases := []struct {
+		desc       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			desc:       "List terminals",
+			method:     http.MethodGet,
+			path:       APIPath,
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"last_activity":"2023-02-14T02:50:02.922555Z","name":"1"}]`,
+		},
+		{
+			desc:       "Create a terminal",
+			method:     http.MethodPost,
+			path:       APIPath,
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"last_activity":"2023-02-14T02:50:02.922555Z","name":"2"}`,
+		},
+		{
+			desc:       "Delete a terminal",
+			method:     http.MethodDelete,
+			path:       APIPath + "/2",
+			wantStatus: http.StatusNoContent,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			localRequests = nil
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(""))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+			if got, want := rr.Code, tc.wantStatus; got != want {
+				t.Errorf("Unexpected response status: got %d, want %d", got, want)
+			}
+			if got, want := rr.Body.String(), tc.wantBody; got != want {
+				t.Errorf("Unexpected response body: got %q, want %q", got, want)
+			}
+			if got, want := len(localRequests), 1; got != want {
+				t.Errorf("Unexpected number of local backend requests: got %v, want %d", localRequests, want)
+			}
+		})
+	}
+}
+
+func TestFetch(t *testing.T) {
+	localBackend := backends.New("local", " (Local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"name": "1"}, {"name": "2"}]`))
+	}))
+	got, err := Fetch(context.Background(), localBackend)
+	if err != nil {
+		t.Fatalf("Fetch() got error %v want nil", err)
+	}
+	gotBytes, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v) got error %v want nil", got, err)
+	}
+	if got, want := string(gotBytes), `[{"name":"1"},{"name":"2"}]`; got != want {
+		t.Errorf("Unexpected terminals: got %q, want %q", got, want)
+	}
+}
+
+func TestHandlerDropsInvalidTerminals(t *testing.T) {
+	localBackend := backends.New("local", " (Local)", "local host", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"name": "1", "last_activity": "2023-02-14T02:50:02.922555Z"}, {"last_activity": "2023-02-14T02:50:02.922555Z"}, {"name": ""}, {"name": "a/b"}, {"name": "2"}]`))
+	}))
+	rr := httptest.NewRecorder()
+	Handler(localBackend).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, APIPath, nil))
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Errorf("Unexpected response status: got %d, want %d", got, want)
+	}
+	if got, want := rr.Body.String(), `[{"last_activity":"2023-02-14T02:50:02.922555Z","name":"1"},{"name":"2"}]`; got != want {
+		t.Errorf("Unexpected response body: got %q, want %q", got, want)
+	}
+}
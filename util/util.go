@@ -20,13 +20,19 @@ package util
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -119,6 +125,46 @@ func IsUserError(err error) bool {
 	return statusCode >= http.StatusBadRequest && statusCode < http.StatusInternalServerError
 }
 
+// IsJSONResponse reports whether or not a response with the given headers and body holds JSON.
+//
+// A JSON `Content-Type` header is trusted. Otherwise the body is sniffed, as some backends
+// omit or mislabel the content type of their JSON responses, while error pages from proxies
+// in front of a backend are typically HTML.
+func IsJSONResponse(h http.Header, body []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil {
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+	body = bytes.TrimSpace(body)
+	return len(body) > 0 && json.Valid(body)
+}
+
+// JSONError is the body of an error response, in the form used by the Jupyter server.
+type JSONError struct {
+	// Status is the HTTP status code of the response.
+	Status int `json:"status"`
+	// Message describes the error.
+	Message string `json:"message"`
+	// Reason is the standard text for the status code.
+	Reason string `json:"reason"`
+}
+
+// WriteJSONError writes an error response with the given status code and message as a JSON body.
+func WriteJSONError(w http.ResponseWriter, statusCode int, msg string) {
+	respBytes, err := json.Marshal(JSONError{Status: statusCode, Message: msg, Reason: http.StatusText(statusCode)})
+	if err != nil {
+		http.Error(w, msg, statusCode)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	w.Write(respBytes)
+}
+
 // CheckXSRF checks whether or not the given request includes XSRF headers if required.
 func CheckXSRF(r *http.Request) error {
 	if r.Method == http.MethodGet || r.Method == http.MethodHead {
@@ -213,3 +259,79 @@ func (lw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	}
 	return hj.Hijack()
 }
+
+// DefaultGzipMinSize is the default size, in bytes, below which response bodies are not compressed.
+const DefaultGzipMinSize = 1024
+
+// acceptsGzip reports whether or not the client that sent the given request accepts gzip-encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+			name = strings.TrimSpace(name)
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if qVal, err := strconv.ParseFloat(q, 64); err == nil && qVal == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// GzipHandler wraps the given handler so that its responses are gzip-compressed for clients that accept that.
+//
+// The response from the wrapped handler is buffered in full before it is compressed, so this
+// must only be used for handlers that write complete (e.g. aggregated) responses, and it is
+// applied after any rewriting of the response body those handlers perform.
+//
+// Response bodies smaller than minSize, responses that already have a content encoding,
+// and websocket upgrade requests are passed through unmodified.
+func GzipHandler(h http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !acceptsGzip(r) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			h.ServeHTTP(w, r)
+			return
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		resp := rr.Result()
+		for key, val := range resp.Header {
+			if key != "Content-Length" {
+				w.Header()[key] = val
+			}
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		body := rr.Body.Bytes()
+		if len(body) < minSize || resp.Header.Get("Content-Encoding") != "" {
+			w.WriteHeader(resp.StatusCode)
+			w.Write(body)
+			return
+		}
+		var compressed bytes.Buffer
+		gw := gzip.NewWriter(&compressed)
+		if _, err := gw.Write(body); err != nil {
+			Log(r, fmt.Sprintf("Failure compressing the response: %v", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err := gw.Close(); err != nil {
+			Log(r, fmt.Sprintf("Failure compressing the response: %v", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(compressed.Bytes())
+	})
+}
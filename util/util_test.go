@@ -17,6 +17,7 @@ package util
 
 import (
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
@@ -127,6 +128,52 @@ func TestHTTPStatusCode(t *testing.T) {
 	}
 }
 
+func TestIsJSONResponse(t *testing.T) {
+	testCases := []struct {
+		Description string
+		ContentType string
+		Body        string
+		Want        bool
+	}{
+		{
+			Description: "JSON content type",
+			ContentType: "application/json; charset=UTF-8",
+			Body:        `{"id":"kernel1"}`,
+			Want:        true,
+		},
+		{
+			Description: "Mislabelled JSON",
+			ContentType: "text/plain",
+			Body:        `[{"id":"kernel1"}]`,
+			Want:        true,
+		},
+		{
+			Description: "HTML error page",
+			ContentType: "text/html",
+			Body:        "<html><body><h1>502 Bad Gateway</h1></body></html>",
+			Want:        false,
+		},
+		{
+			Description: "Unlabelled HTML error page",
+			Body:        "<html><body><h1>502 Bad Gateway</h1></body></html>",
+			Want:        false,
+		},
+		{
+			Description: "Empty body",
+			Want:        false,
+		},
+	}
+	for _, testCase := range testCases {
+		h := make(http.Header)
+		if testCase.ContentType != "" {
+			h.Set("Content-Type", testCase.ContentType)
+		}
+		if got, want := IsJSONResponse(h, []byte(testCase.Body)), testCase.Want; got != want {
+			t.Errorf("Unexpected result of IsJSONResponse for %q: got %v, want %v", testCase.Description, got, want)
+		}
+	}
+}
+
 func TestIsUserError(t *testing.T) {
 	testCases := []struct {
 		Description string
@@ -289,3 +336,79 @@ func TestLoggingResponseWriter(t *testing.T) {
 		t.Errorf("Unexpected logged response body: got %q, want %q", loggedBody, testResponseBody)
 	}
 }
+
+func TestGzipHandler(t *testing.T) {
+	largeBody := strings.Repeat(`{"name": "python3"},`, 100)
+	smallBody := `{"name": "python3"}`
+	testCases := []struct {
+		desc           string
+		body           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{
+			desc:           "Large body for a gzip client",
+			body:           largeBody,
+			acceptEncoding: "deflate, gzip;q=0.8",
+			wantGzip:       true,
+		},
+		{
+			desc:           "Small body for a gzip client",
+			body:           smallBody,
+			acceptEncoding: "gzip",
+		},
+		{
+			desc: "Large body for a client without gzip",
+			body: largeBody,
+		},
+		{
+			desc:           "Large body for a client refusing gzip",
+			body:           largeBody,
+			acceptEncoding: "gzip;q=0",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tc.body))
+			}), DefaultGzipMinSize)
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/api/kernelspecs", nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			resp := rr.Result()
+			if got, want := resp.Header.Get("Vary"), "Accept-Encoding"; got != want {
+				t.Errorf("Unexpected Vary header: got %q, want %q", got, want)
+			}
+			if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+				t.Errorf("Unexpected Content-Type header: got %q, want %q", got, want)
+			}
+			body := io.Reader(resp.Body)
+			if tc.wantGzip {
+				if got, want := resp.Header.Get("Content-Encoding"), "gzip"; got != want {
+					t.Fatalf("Unexpected Content-Encoding header: got %q, want %q", got, want)
+				}
+				if got, want := resp.Header.Get("Content-Length"), fmt.Sprintf("%d", rr.Body.Len()); got != want {
+					t.Errorf("Unexpected Content-Length header: got %q, want %q", got, want)
+				}
+				gr, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("Failure reading the gzip response: %v", err)
+				}
+				body = gr
+			} else if got := resp.Header.Get("Content-Encoding"); got != "" {
+				t.Errorf("Unexpected Content-Encoding header: %q", got)
+			}
+			gotBody, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("Failure reading the response body: %v", err)
+			}
+			if got, want := string(gotBody), tc.body; got != want {
+				t.Errorf("Unexpected response body: got %q, want %q", got, want)
+			}
+		})
+	}
+}